@@ -102,7 +102,7 @@ func (q *AMQPJobQueue) Jobs(ctx gocontext.Context) (outChan <-chan Job, err erro
 				continue
 			}
 
-			buildJob.startAttributes = startAttrs.Config
+			buildJob.startAttributes = startAttrs.StartAttributes()
 			buildJob.conn = q.conn
 			buildJob.delivery = delivery
 
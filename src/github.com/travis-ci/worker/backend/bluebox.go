@@ -3,8 +3,11 @@ package backend
 import (
 	"fmt"
 	"io"
+	"net"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/henrikhodne/goblueboxapi"
@@ -17,8 +20,15 @@ import (
 	gocontext "golang.org/x/net/context"
 )
 
+const (
+	defaultBlueBoxTemplatePrefix   = "travis-"
+	defaultBlueBoxTemplateCacheTTL = time.Minute
+	blueBoxBootPollSleep           = 5 * time.Second
+	blueBoxAddressPollSleep        = time.Second
+	blueBoxAddressPollMaxSleep     = 15 * time.Second
+)
+
 var (
-	templateRegexp = regexp.MustCompile(`travis-([\w-]+)-\d{4}-\d{2}-\d{2}-\d{2}-\d{2}`)
 	errNoBlueBoxIP = fmt.Errorf("no IP address assigned")
 	blueBoxHelp    = map[string]string{
 		"CUSTOMER_ID":             "[REQUIRED] account customer id",
@@ -26,7 +36,12 @@ var (
 		"LOCATION_ID":             "[REQUIRED] location where job blocks will be provisioned",
 		"PRODUCT_ID":              "[REQUIRED]",
 		"IPV6_ONLY":               "boot all blocks with only an IPv6 address (default false)",
+		"PREFER_IPV6":             "connect to blocks with both IPv4 and IPv6 addresses over IPv6 (default false)",
 		"LANGUAGE_MAP_{LANGUAGE}": "Map the key specified in the key to the image associated with a different language",
+		"TEMPLATE_ID_{KEY}":       "exact template ID for the language-group, language or default key, uppercased with non-alphanumerics replaced by _, preferred over the newest matching template",
+		"TEMPLATE_PREFIX":         fmt.Sprintf("description prefix of the private templates picked from, named {prefix}{language[-group]}-YYYY-MM-DD-HH-MM (default %q)", defaultBlueBoxTemplatePrefix),
+		"TEMPLATE_MAX_AGE":        "ignore templates created longer ago than this, so that a stale bake fails jobs rather than serving old images (default none)",
+		"TEMPLATE_CACHE_TTL":      fmt.Sprintf("how long the template listing is cached (default %v)", defaultBlueBoxTemplateCacheTTL),
 	}
 )
 
@@ -37,20 +52,80 @@ func init() {
 type blueBoxProvider struct {
 	client *goblueboxapi.Client
 	cfg    *config.ProviderConfig
+
+	templateRegexp   *regexp.Regexp
+	templateMaxAge   time.Duration
+	templateCacheTTL time.Duration
+
+	preferIPv6 bool
+
+	// addressPollSleep is how long to wait before looking up the addresses
+	// of a running block that has none yet, doubling with each lookup.
+	addressPollSleep time.Duration
+
+	// templates are the IDs of the newest templates by language, as listed
+	// at templatesListed.
+	templatesMutex  sync.Mutex
+	templates       map[string]string
+	templatesListed time.Time
 }
 
 func newBlueBoxProvider(cfg *config.ProviderConfig) (Provider, error) {
+	prefix := defaultBlueBoxTemplatePrefix
+	if cfg.IsSet("TEMPLATE_PREFIX") {
+		prefix = cfg.Get("TEMPLATE_PREFIX")
+	}
+
+	maxAge := time.Duration(0)
+	if cfg.IsSet("TEMPLATE_MAX_AGE") {
+		var err error
+		maxAge, err = time.ParseDuration(cfg.Get("TEMPLATE_MAX_AGE"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid TEMPLATE_MAX_AGE %q: %v", cfg.Get("TEMPLATE_MAX_AGE"), err)
+		}
+	}
+
+	cacheTTL := defaultBlueBoxTemplateCacheTTL
+	if cfg.IsSet("TEMPLATE_CACHE_TTL") {
+		var err error
+		cacheTTL, err = time.ParseDuration(cfg.Get("TEMPLATE_CACHE_TTL"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid TEMPLATE_CACHE_TTL %q: %v", cfg.Get("TEMPLATE_CACHE_TTL"), err)
+		}
+	}
+
+	preferIPv6 := false
+	if cfg.IsSet("PREFER_IPV6") {
+		var err error
+		preferIPv6, err = strconv.ParseBool(cfg.Get("PREFER_IPV6"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid PREFER_IPV6 %q: %v", cfg.Get("PREFER_IPV6"), err)
+		}
+	}
+
 	return &blueBoxProvider{
 		client: goblueboxapi.NewClient(cfg.Get("CUSTOMER_ID"), cfg.Get("API_KEY")),
 		cfg:    cfg,
+
+		templateRegexp:   regexp.MustCompile(fmt.Sprintf(`^%s([\w-]+)-\d{4}-\d{2}-\d{2}-\d{2}-\d{2}`, regexp.QuoteMeta(prefix))),
+		templateMaxAge:   maxAge,
+		templateCacheTTL: cacheTTL,
+
+		preferIPv6:       preferIPv6,
+		addressPollSleep: blueBoxAddressPollSleep,
 	}, nil
 }
 
 func (b *blueBoxProvider) Start(ctx gocontext.Context, startAttributes *StartAttributes) (Instance, error) {
+	templateID, err := b.templateIDForLanguageGroup(ctx, startAttributes.Language, startAttributes.Group)
+	if err != nil {
+		return nil, err
+	}
+
 	password := generatePassword()
 	params := goblueboxapi.BlockParams{
 		Product:  b.cfg.Get("PRODUCT_ID"),
-		Template: b.templateIDForLanguageGroup(startAttributes.Language, startAttributes.Group),
+		Template: templateID,
 		Location: b.cfg.Get("LOCATION_ID"),
 		Hostname: fmt.Sprintf("testing-bb-%s", uuid.NewRandom()),
 		Username: "travis",
@@ -65,27 +140,48 @@ func (b *blueBoxProvider) Start(ctx gocontext.Context, startAttributes *StartAtt
 		return nil, err
 	}
 
-	blockReady := make(chan *goblueboxapi.Block)
+	// the block is ready once it's running and has an address to connect
+	// to, which it may still be acquiring when it starts running
+	blockReady := make(chan *blueBoxInstance, 1)
 	go func(id string) {
+		addressSleep := b.addressPollSleep
+
 		for {
-			b, err := b.client.Blocks.Get(id)
-			if err == nil && b.Status == "running" {
-				blockReady <- b
-				return
+			sleep := blueBoxBootPollSleep
+
+			current, err := b.client.Blocks.Get(id)
+			if err == nil && current.Status == "running" {
+				address, err := blueBoxAddress(current.IPs, b.preferIPv6)
+				if err == nil {
+					blockReady <- &blueBoxInstance{
+						client:   b.client,
+						block:    current,
+						address:  net.JoinHostPort(address.String(), "22"),
+						password: password,
+					}
+					return
+				}
+
+				metrics.Mark("worker.vm.provider.bluebox.boot.address.wait")
+				sleep = addressSleep
+				addressSleep *= 2
+				if addressSleep > blueBoxAddressPollMaxSleep {
+					addressSleep = blueBoxAddressPollMaxSleep
+				}
 			}
 
-			time.Sleep(5 * time.Second)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(sleep):
+			}
 		}
 	}(block.ID)
 
 	select {
-	case block := <-blockReady:
+	case instance := <-blockReady:
 		metrics.TimeSince("worker.vm.provider.bluebox.boot", startBooting)
-		return &blueBoxInstance{
-			client:   b.client,
-			block:    block,
-			password: password,
-		}, nil
+		return instance, nil
 	case <-ctx.Done():
 		if block != nil {
 			err := b.client.Blocks.Destroy(block.ID)
@@ -103,45 +199,79 @@ func (b *blueBoxProvider) Start(ctx gocontext.Context, startAttributes *StartAtt
 
 func (p *blueBoxProvider) Setup() error { return nil }
 
-func (b *blueBoxProvider) templateIDForLanguageGroup(language, group string) string {
+// templateIDForLanguageGroup returns the template for the language-group,
+// the language or the default, checked in that order, where a TEMPLATE_ID_
+// key takes precedence over the newest template for each.
+func (b *blueBoxProvider) templateIDForLanguageGroup(ctx gocontext.Context, language, group string) (string, error) {
 	languageMapSetting := fmt.Sprintf("LANGUAGE_MAP_%s", strings.ToUpper(language))
 	if b.cfg.IsSet(languageMapSetting) {
 		language = b.cfg.Get(languageMapSetting)
 	}
 
-	templates := b.latestTemplates()
-
-	if templateID, ok := templates[fmt.Sprintf("%s-%s", language, group)]; group != "" && ok {
-		return templateID
+	keys := []string{language, "default"}
+	if group != "" {
+		keys = append([]string{fmt.Sprintf("%s-%s", language, group)}, keys...)
 	}
 
-	if templateID, ok := templates[language]; ok {
-		return templateID
-	}
+	var templates map[string]string
+	for _, key := range keys {
+		templateIDSetting := fmt.Sprintf("TEMPLATE_ID_%s", strings.ToUpper(nonAlphaNumRegexp.ReplaceAllString(key, "_")))
+		if b.cfg.IsSet(templateIDSetting) {
+			return b.cfg.Get(templateIDSetting), nil
+		}
+
+		if templates == nil {
+			var err error
+			templates, err = b.latestTemplates(ctx)
+			if err != nil {
+				return "", err
+			}
+		}
 
-	if t, ok := templates["default"]; ok {
-		return t
+		if templateID, ok := templates[key]; ok {
+			return templateID, nil
+		}
 	}
 
-	return ""
+	return "", fmt.Errorf("no template found for language %q", language)
 }
 
-func (b *blueBoxProvider) latestTemplates() map[string]string {
-	latest := map[string]goblueboxapi.Template{}
-	latestIDs := map[string]string{}
+// latestTemplates returns the IDs of the newest private templates with
+// TEMPLATE_PREFIX by language, leaving out ones older than TEMPLATE_MAX_AGE.
+// The listing is cached for TEMPLATE_CACHE_TTL.
+func (b *blueBoxProvider) latestTemplates(ctx gocontext.Context) (map[string]string, error) {
+	b.templatesMutex.Lock()
+	defer b.templatesMutex.Unlock()
+
+	if b.templates != nil && time.Since(b.templatesListed) < b.templateCacheTTL {
+		return b.templates, nil
+	}
 
 	templates, err := b.client.Templates.List()
 	if err != nil {
-		fmt.Printf("error trying to get templates: %s\n", err)
-		return nil
+		return nil, fmt.Errorf("couldn't list templates: %v", err)
 	}
 
+	latest := map[string]goblueboxapi.Template{}
+	latestIDs := map[string]string{}
+
 	for _, t := range templates {
-		if t.Public || !strings.HasPrefix(t.Description, "travis-") {
+		if t.Public {
 			continue
 		}
 
-		language := templateRegexp.FindStringSubmatch(t.Description)[1]
+		match := b.templateRegexp.FindStringSubmatch(t.Description)
+		if match == nil {
+			continue
+		}
+
+		if b.templateMaxAge > 0 && time.Since(t.Created) > b.templateMaxAge {
+			metrics.Mark("worker.vm.provider.bluebox.template.stale")
+			context.LoggerFromContext(ctx).WithField("template", t.Description).Warn("ignoring template older than max age")
+			continue
+		}
+
+		language := match[1]
 		if _, ok := latest[language]; !ok || t.Created.After(latest[language].Created) {
 			latest[language] = t
 			latestIDs[language] = t.ID
@@ -156,21 +286,60 @@ func (b *blueBoxProvider) latestTemplates() map[string]string {
 		}
 	}
 
-	return latestIDs
+	b.templates = latestIDs
+	b.templatesListed = time.Now()
+
+	return latestIDs, nil
+}
+
+// blueBoxAddress returns the address to connect to out of the block's
+// addresses, preferring IPv4 unless preferIPv6 is set. Link-local IPv6
+// addresses are left out, as they can't be dialed without a zone.
+func blueBoxAddress(ips []goblueboxapi.BlockIP, preferIPv6 bool) (net.IP, error) {
+	var ipv4, ipv6 net.IP
+
+	for _, blockIP := range ips {
+		ip := net.ParseIP(blockIP.Address)
+		switch {
+		case ip == nil:
+			continue
+		case ip.To4() != nil:
+			if ipv4 == nil {
+				ipv4 = ip
+			}
+		case !ip.IsLinkLocalUnicast():
+			if ipv6 == nil {
+				ipv6 = ip
+			}
+		}
+	}
+
+	switch {
+	case ipv6 != nil && (preferIPv6 || ipv4 == nil):
+		return ipv6, nil
+	case ipv4 != nil:
+		return ipv4, nil
+	default:
+		return nil, errNoBlueBoxIP
+	}
 }
 
 type blueBoxInstance struct {
 	client   *goblueboxapi.Client
 	block    *goblueboxapi.Block
 	password string
+
+	// address is the host and port to connect to, with IPv6 addresses in
+	// brackets.
+	address string
 }
 
 func (i *blueBoxInstance) sshClient(ctx gocontext.Context) (*ssh.Client, error) {
-	if len(i.block.IPs) == 0 {
+	if i.address == "" {
 		return nil, errNoBlueBoxIP
 	}
 
-	client, err := ssh.Dial("tcp6", fmt.Sprintf("[%s]:22", i.block.IPs[0].Address), &ssh.ClientConfig{
+	client, err := ssh.Dial("tcp", i.address, &ssh.ClientConfig{
 		User: "travis",
 		Auth: []ssh.AuthMethod{
 			ssh.Password(i.password),
@@ -208,12 +377,7 @@ func (i *blueBoxInstance) UploadScript(ctx gocontext.Context, script []byte) err
 		return err
 	}
 
-	_, err = f.Write(script)
-	if err != nil {
-		return err
-	}
-
-	return err
+	return sftpWriteFile(f, script, 0755)
 }
 
 func (i *blueBoxInstance) RunScript(ctx gocontext.Context, output io.Writer) (*RunResult, error) {
@@ -5,11 +5,13 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"sync"
 	"testing"
 	"time"
 
 	"golang.org/x/net/context"
 
+	"github.com/henrikhodne/goblueboxapi"
 	"github.com/travis-ci/worker/config"
 )
 
@@ -240,3 +242,157 @@ func TestBlueBoxStartWithTimeout(t *testing.T) {
 		t.Errorf("expected instance to be nil, but was %+v", instance)
 	}
 }
+
+func TestBlueBoxTemplateIDForLanguageGroup(t *testing.T) {
+	blueboxTestSetup(t, config.ProviderConfigFromMap(map[string]string{
+		"CUSTOMER_ID":         "customer_id",
+		"API_KEY":             "api_key",
+		"TEMPLATE_PREFIX":     "macos-",
+		"TEMPLATE_MAX_AGE":    "720h",
+		"TEMPLATE_ID_GO":      "go-template-id",
+		"TEMPLATE_ID_JVM_DEV": "jvm-dev-template-id",
+	}))
+	defer blueboxTestTeardown()
+
+	now := time.Now()
+	jsonNow, _ := now.MarshalText()
+	jsonOld, _ := now.Add(-1000 * time.Hour).MarshalText()
+	output := `[
+		{"id": "ruby-template-id", "description": "macos-ruby-2015-07-07-00-00-a0b1c2d", "public": false, "created": "%s"},
+		{"id": "old-jvm-template-id", "description": "macos-jvm-2015-06-07-00-00-a0b1c2d", "public": false, "created": "%s"},
+		{"id": "jvm-template-id", "description": "travis-jvm-2015-07-07-00-00-a0b1c2d", "public": false, "created": "%s"},
+		{"id": "public-jvm-template-id", "description": "macos-jvm-2015-07-07-00-00-a0b1c2d", "public": true, "created": "%s"}
+	]`
+	lists := 0
+	blueboxMux.HandleFunc("/api/block_templates.json", func(w http.ResponseWriter, r *http.Request) {
+		lists++
+		fmt.Fprint(w, fmt.Sprintf(output, jsonNow, jsonOld, jsonNow, jsonNow))
+	})
+
+	for _, tc := range []struct {
+		language, group, expected string
+	}{
+		{"go", "", "go-template-id"},
+		{"jvm", "dev", "jvm-dev-template-id"},
+		{"jvm", "", "ruby-template-id"},
+		{"ruby", "dev", "ruby-template-id"},
+	} {
+		templateID, err := blueboxProvider.templateIDForLanguageGroup(context.TODO(), tc.language, tc.group)
+		if err != nil {
+			t.Errorf("templateIDForLanguageGroup(%q, %q) returned error: %v", tc.language, tc.group, err)
+		}
+		if templateID != tc.expected {
+			t.Errorf("expected %q for %q and %q, got %q", tc.expected, tc.language, tc.group, templateID)
+		}
+	}
+
+	if lists != 1 {
+		t.Errorf("expected templates to be listed once, got %d", lists)
+	}
+
+	blueboxProvider.templatesListed = now.Add(-time.Hour)
+	_, _ = blueboxProvider.templateIDForLanguageGroup(context.TODO(), "ruby", "")
+	if lists != 2 {
+		t.Errorf("expected expired template listing to be refreshed, got %d listings", lists)
+	}
+}
+
+func TestNewBlueBoxProviderWithInvalidTemplateMaxAge(t *testing.T) {
+	_, err := newBlueBoxProvider(config.ProviderConfigFromMap(map[string]string{
+		"TEMPLATE_MAX_AGE": "forever",
+	}))
+	if err == nil {
+		t.Error("newBlueBoxProvider() did not return error, but was expected to")
+	}
+}
+
+func TestBlueBoxAddress(t *testing.T) {
+	ipv4 := goblueboxapi.BlockIP{Address: "192.0.2.1"}
+	ipv6 := goblueboxapi.BlockIP{Address: "2001:db8::1"}
+	linkLocal := goblueboxapi.BlockIP{Address: "fe80::1"}
+
+	for _, tc := range []struct {
+		name       string
+		ips        []goblueboxapi.BlockIP
+		preferIPv6 bool
+		expected   string
+	}{
+		{"v4-only", []goblueboxapi.BlockIP{ipv4}, false, "192.0.2.1"},
+		{"v4-only preferring v6", []goblueboxapi.BlockIP{ipv4}, true, "192.0.2.1"},
+		{"v6-only", []goblueboxapi.BlockIP{ipv6}, false, "2001:db8::1"},
+		{"dual-stack", []goblueboxapi.BlockIP{ipv6, ipv4}, false, "192.0.2.1"},
+		{"dual-stack preferring v6", []goblueboxapi.BlockIP{ipv4, ipv6}, true, "2001:db8::1"},
+		{"link-local v6", []goblueboxapi.BlockIP{linkLocal, ipv6}, false, "2001:db8::1"},
+	} {
+		ip, err := blueBoxAddress(tc.ips, tc.preferIPv6)
+		if err != nil {
+			t.Errorf("%s: blueBoxAddress() returned error: %v", tc.name, err)
+			continue
+		}
+
+		if ip.String() != tc.expected {
+			t.Errorf("%s: expected %s, got %s", tc.name, tc.expected, ip)
+		}
+	}
+
+	for _, ips := range [][]goblueboxapi.BlockIP{nil, {linkLocal}, {{Address: "not-an-ip"}}} {
+		_, err := blueBoxAddress(ips, false)
+		if err != errNoBlueBoxIP {
+			t.Errorf("expected errNoBlueBoxIP for %v, got %v", ips, err)
+		}
+	}
+}
+
+func TestBlueBoxStartWaitsForAddress(t *testing.T) {
+	blueboxTestSetup(t, config.ProviderConfigFromMap(map[string]string{
+		"CUSTOMER_ID":      "customer_id",
+		"API_KEY":          "api_key",
+		"LOCATION_ID":      "location_id",
+		"PRODUCT_ID":       "product_id",
+		"PREFER_IPV6":      "true",
+		"TEMPLATE_ID_RUBY": "ruby-template-id",
+	}))
+	defer blueboxTestTeardown()
+	blueboxProvider.addressPollSleep = time.Millisecond
+
+	blueboxMux.HandleFunc("/api/blocks.json", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"id": "block-id", "hostname": "block-id.example.com", "ips":[], "status": "queued"}`)
+	})
+
+	var mutex sync.Mutex
+	gets := 0
+	blueboxMux.HandleFunc("/api/blocks/block-id.json", func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		gets++
+		if gets < 3 {
+			fmt.Fprintf(w, `{"id": "block-id", "hostname": "block-id.example.com", "ips":[], "status": "running"}`)
+			return
+		}
+		fmt.Fprintf(w, `{"id": "block-id", "hostname": "block-id.example.com", "ips":[{"address":"192.0.2.1"},{"address":"2001:db8::1"}], "status": "running"}`)
+	})
+
+	instance, err := blueboxProvider.Start(context.TODO(), &StartAttributes{Language: "ruby"})
+	if err != nil {
+		t.Fatalf("provider.Start() returned error: %v", err)
+	}
+
+	address := instance.(*blueBoxInstance).address
+	if address != "[2001:db8::1]:22" {
+		t.Errorf("expected '[2001:db8::1]:22', got '%s'", address)
+	}
+
+	if gets != 3 {
+		t.Errorf("expected 3 block lookups, got %d", gets)
+	}
+}
+
+func TestNewBlueBoxProviderWithInvalidPreferIPv6(t *testing.T) {
+	_, err := newBlueBoxProvider(config.ProviderConfigFromMap(map[string]string{
+		"PREFER_IPV6": "sometimes",
+	}))
+	if err == nil {
+		t.Error("newBlueBoxProvider() did not return error, but was expected to")
+	}
+}
@@ -1,8 +1,14 @@
 package backend
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
@@ -16,19 +22,70 @@ import (
 	"github.com/pkg/sftp"
 	"github.com/travis-ci/worker/config"
 	"github.com/travis-ci/worker/context"
+	"github.com/travis-ci/worker/image"
 	"github.com/travis-ci/worker/metrics"
 	"golang.org/x/crypto/ssh"
 	gocontext "golang.org/x/net/context"
 )
 
+const (
+	defaultDockerImageSelectorType = "legacy"
+	defaultDockerImage             = "travis:default"
+)
+
+var (
+	// dockerDangerousMounts are host paths that VOLUMES may only mount, or
+	// mount anything below, with ALLOW_DANGEROUS_MOUNTS. Mounting any of
+	// the directories the docker sockets are in is dangerous as well.
+	dockerDangerousMounts = []string{"/proc", "/sys", "/dev", "/etc", "/boot", "/var/lib/docker"}
+	dockerSockets         = []string{"/var/run/docker.sock", "/run/docker.sock"}
+
+	dockerEndpointSchemes = map[string]bool{
+		"tcp":   true,
+		"http":  true,
+		"https": true,
+		"unix":  true,
+	}
+)
+
 var (
 	dockerHelp = map[string]string{
-		"ENDPOINT / HOST": "[REQUIRED] tcp or unix address for connecting to Docker",
-		"CERT_PATH":       "directory where ca.pem, cert.pem, and key.pem are located (default \"\")",
-		"CMD":             "command (CMD) to run when creating containers (default \"/sbin/init\")",
-		"MEMORY":          "memory to allocate to each container (default \"4G\")",
-		"CPUS":            "cpu count to allocate to each container (default 2)",
-		"PRIVILEGED":      "run containers in privileged mode (default false)",
+		"ENDPOINT / HOST":        "[REQUIRED unless ENDPOINTS is set] tcp://, http(s):// or unix:// address for connecting to Docker",
+		"ENDPOINTS":              "comma-delimited addresses of a pool of Docker daemons, instead of ENDPOINT, each job running on the one with the fewest running containers; CPU_SET_SIZE, CERT_PATH and TLS_VERIFY apply to each (default none)",
+		"HEALTH_CHECK_INTERVAL":  fmt.Sprintf("how often to check that the ENDPOINTS can be reached and count their running containers, quarantining unreachable ones until they can be reached again (default %v)", defaultDockerHealthCheckInterval),
+		"CERT_PATH":              "directory where ca.pem, cert.pem, and key.pem are located, to connect to Docker over TLS authenticated with cert.pem and key.pem (default \"\")",
+		"TLS_VERIFY":             "verify Docker's certificate against ca.pem in CERT_PATH, requires CERT_PATH (default true if CERT_PATH is set)",
+		"CMD":                    "command (CMD) to run when creating containers (default \"/sbin/init\")",
+		"MEMORY":                 "memory to allocate to each container, which can't swap beyond it (default \"4G\")",
+		"CPUS":                   "cpu count to allocate to each container, 0 to not pin containers to cpus (default 2)",
+		"CPU_SET_SIZE":           "number of cpus that containers are pinned to, each to a disjoint set (default number of host cpus, at least 2)",
+		"PRIVILEGED":             "run containers in privileged mode (default false)",
+		"PRIVILEGED_ALLOWED":     "run the containers of jobs that set privileged: true in privileged mode, others are run unprivileged with a warning in the job log (default false)",
+		"PRIVILEGED_REPOS":       "comma-delimited owner/name slugs of the repositories whose jobs may run privileged with PRIVILEGED_ALLOWED (required with PRIVILEGED_ALLOWED)",
+		"HARD_TIMEOUT":           fmt.Sprintf("how long jobs may run, after which their containers are considered leaked and removed by sweeps (default %v)", defaultDockerHardTimeout),
+		"SWEEP_INTERVAL":         "how often to remove leaked containers, which are also removed on startup, 0 to only remove them on startup (default 0)",
+		"SWEEP_DRY_RUN":          "only log the leaked containers that would be removed (default false)",
+		"VOLUMES":                "comma-delimited host:container[:ro] bind mounts added to every container, e.g. for shared caches, unless the job's vm_config sets skip_volumes; every job can read them and, unless :ro, write them, so only mount what all jobs may share (default none)",
+		"ALLOW_DANGEROUS_MOUNTS": "allow VOLUMES to mount the docker socket and system directories, which gives jobs control of the host (default false)",
+		"NETWORK_MODE":           "network mode of containers, e.g. bridge, host, none or the name of a network; modes other than bridge require NATIVE, as the vendored docker client only knows the address of containers on the bridge network to ssh to (default Docker's default)",
+		"DNS":                    "comma-delimited DNS server IPs for containers (default Docker's default)",
+		"EXTRA_HOSTS":            "comma-delimited host:ip entries added to the /etc/hosts of containers (default none)",
+		"SECCOMP_PROFILE_PATH":   "path to a JSON seccomp profile applied to containers instead of Docker's default, read on startup (default Docker's default)",
+		"APPARMOR_PROFILE":       "name of an AppArmor profile loaded on the host that's applied to containers (default Docker's default)",
+		"SECURITY_OPT":           "comma-delimited further security options of containers, like docker run's --security-opt, e.g. no-new-privileges (default none)",
+		"TMPFS":                  "not supported, as the vendored docker client can't create tmpfs mounts",
+		"NATIVE":                 "upload and run build scripts with docker exec as the travis user instead of over ssh, so that images don't need an ssh server (default false)",
+		"NATIVE_TTY":             "run build scripts with NATIVE in a TTY, or false for byte-exact output, with stdout and stderr interleaved in the order they arrive (default true)",
+		"IMAGE_SELECTOR_TYPE":    fmt.Sprintf("image selector type (\"legacy\", \"env\" or \"api\", default %q), where legacy picks travis:{language} or travis:default", defaultDockerImageSelectorType),
+		"IMAGE_SELECTOR_URL":     "URL for image selector API, used only when image selector is \"api\"",
+		"IMAGE_ALIASES":          "comma-delimited strings used as stable names for images, used only when image selector type is \"env\"",
+		"IMAGE_[ALIAS_]{ALIAS}":  "repository:tag for a given alias given via IMAGE_ALIASES, where the alias form in the key is uppercased and normalized by replacing non-alphanumerics with _",
+		"IMAGE_DEFAULT":          fmt.Sprintf("repository:tag of the image used when the image selector picks none or fails (default %q)", defaultDockerImage),
+		"PULL_POLICY":            fmt.Sprintf("when to pull images from the registry, never, missing or always (default %q)", defaultDockerPullPolicy),
+		"PULL_TIMEOUT":           fmt.Sprintf("how long to wait for an image to be pulled (default %v)", defaultDockerPullTimeout),
+		"REGISTRY_USERNAME":      "username for pulling images from the registry",
+		"REGISTRY_PASSWORD":      "password for pulling images from the registry",
+		"DOCKERCFG_PATH":         "path to a dockercfg file with credentials for pulling images, instead of REGISTRY_USERNAME and REGISTRY_PASSWORD",
 	}
 )
 
@@ -37,41 +94,195 @@ func init() {
 }
 
 type dockerProvider struct {
-	client *docker.Client
+	// endpoints are the daemons containers are run on, and pooled whether
+	// they're given by ENDPOINTS rather than a single ENDPOINT.
+	endpointsMutex      sync.Mutex
+	endpoints           []*dockerEndpoint
+	pooled              bool
+	healthCheckInterval time.Duration
+
+	imageSelectorType string
+	imageSelector     image.Selector
+	defaultImage      string
 
 	runPrivileged bool
 	runCmd        []string
 	runMemory     uint64
 	runCPUs       int
+	runNative     bool
+	runNativeTTY  bool
+	runBinds      []string
+
+	networkMode string
+	dns         []string
+	extraHosts  []string
+
+	// securityOpt are the security options of containers, and
+	// loggedSecurityOpt the same with the seccomp profile's path in place of
+	// its contents.
+	securityOpt       []string
+	loggedSecurityOpt []string
+
+	// privilegedAllowed is whether jobs may ask for privileged containers,
+	// and privilegedRepos the repositories that may.
+	privilegedAllowed bool
+	privilegedRepos   map[string]bool
 
 	cpuSetsMutex sync.Mutex
-	cpuSets      []bool
+
+	hardTimeout   time.Duration
+	sweepInterval time.Duration
+	sweepDryRun   bool
+
+	// containers are the IDs of the containers of running jobs, which
+	// sweeps leave alone.
+	containersMutex sync.Mutex
+	containers      map[string]bool
 }
 
 type dockerInstance struct {
 	client    *docker.Client
 	provider  *dockerProvider
+	endpoint  *dockerEndpoint
 	container *docker.Container
 
 	imageName string
+	cpuSets   string
+	warnings  []string
 }
 
 func newDockerProvider(cfg *config.ProviderConfig) (Provider, error) {
-	client, err := buildDockerClient(cfg)
-	if err != nil {
-		return nil, err
-	}
+	var err error
 
 	cpuSetSize := runtime.NumCPU()
 	if cpuSetSize < 2 {
 		cpuSetSize = 2
 	}
+	if cfg.IsSet("CPU_SET_SIZE") {
+		cpuSetSize, err = strconv.Atoi(cfg.Get("CPU_SET_SIZE"))
+		if err != nil || cpuSetSize < 1 {
+			return nil, fmt.Errorf("invalid CPU_SET_SIZE %q", cfg.Get("CPU_SET_SIZE"))
+		}
+	}
 
 	privileged := false
 	if cfg.IsSet("PRIVILEGED") {
 		privileged = (cfg.Get("PRIVILEGED") == "true")
 	}
 
+	privilegedAllowed := false
+	if cfg.IsSet("PRIVILEGED_ALLOWED") {
+		privilegedAllowed, err = strconv.ParseBool(cfg.Get("PRIVILEGED_ALLOWED"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid PRIVILEGED_ALLOWED %q: %v", cfg.Get("PRIVILEGED_ALLOWED"), err)
+		}
+	}
+
+	var privilegedRepos map[string]bool
+	if cfg.IsSet("PRIVILEGED_REPOS") {
+		privilegedRepos = map[string]bool{}
+		for _, slug := range strings.Split(cfg.Get("PRIVILEGED_REPOS"), ",") {
+			slug = strings.TrimSpace(slug)
+			if slug == "" {
+				continue
+			}
+			if strings.Count(slug, "/") != 1 {
+				return nil, fmt.Errorf("invalid PRIVILEGED_REPOS slug %q, must be owner/name", slug)
+			}
+			privilegedRepos[slug] = true
+		}
+	}
+
+	if privilegedAllowed && len(privilegedRepos) == 0 {
+		return nil, fmt.Errorf("PRIVILEGED_ALLOWED requires PRIVILEGED_REPOS, so that not every repository can run privileged containers")
+	}
+
+	native := false
+	if cfg.IsSet("NATIVE") {
+		native, err = strconv.ParseBool(cfg.Get("NATIVE"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid NATIVE %q: %v", cfg.Get("NATIVE"), err)
+		}
+	}
+
+	nativeTTY := true
+	if cfg.IsSet("NATIVE_TTY") {
+		nativeTTY, err = strconv.ParseBool(cfg.Get("NATIVE_TTY"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid NATIVE_TTY %q: %v", cfg.Get("NATIVE_TTY"), err)
+		}
+	}
+
+	if cfg.IsSet("TMPFS") {
+		return nil, fmt.Errorf("TMPFS is not supported by the vendored docker client")
+	}
+
+	allowDangerousMounts := false
+	if cfg.IsSet("ALLOW_DANGEROUS_MOUNTS") {
+		allowDangerousMounts, err = strconv.ParseBool(cfg.Get("ALLOW_DANGEROUS_MOUNTS"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid ALLOW_DANGEROUS_MOUNTS %q: %v", cfg.Get("ALLOW_DANGEROUS_MOUNTS"), err)
+		}
+	}
+
+	var binds []string
+	if cfg.IsSet("VOLUMES") {
+		binds, err = parseDockerVolumes(cfg.Get("VOLUMES"), allowDangerousMounts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	networkMode := cfg.Get("NETWORK_MODE")
+	if networkMode != "" && networkMode != "default" && networkMode != "bridge" && !native {
+		return nil, fmt.Errorf("NETWORK_MODE %s requires NATIVE, as scripts are uploaded and run over ssh otherwise, and only containers on the bridge network have an address to ssh to", networkMode)
+	}
+
+	var dns []string
+	if cfg.IsSet("DNS") {
+		dns, err = parseDockerDNS(cfg.Get("DNS"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var extraHosts []string
+	if cfg.IsSet("EXTRA_HOSTS") {
+		extraHosts, err = parseDockerExtraHosts(cfg.Get("EXTRA_HOSTS"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	securityOpt, loggedSecurityOpt, err := parseDockerSecurityOpt(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	hardTimeout := defaultDockerHardTimeout
+	if cfg.IsSet("HARD_TIMEOUT") {
+		hardTimeout, err = time.ParseDuration(cfg.Get("HARD_TIMEOUT"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid HARD_TIMEOUT %q: %v", cfg.Get("HARD_TIMEOUT"), err)
+		}
+	}
+
+	sweepInterval := time.Duration(0)
+	if cfg.IsSet("SWEEP_INTERVAL") {
+		sweepInterval, err = time.ParseDuration(cfg.Get("SWEEP_INTERVAL"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid SWEEP_INTERVAL %q: %v", cfg.Get("SWEEP_INTERVAL"), err)
+		}
+	}
+
+	sweepDryRun := false
+	if cfg.IsSet("SWEEP_DRY_RUN") {
+		sweepDryRun, err = strconv.ParseBool(cfg.Get("SWEEP_DRY_RUN"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid SWEEP_DRY_RUN %q: %v", cfg.Get("SWEEP_DRY_RUN"), err)
+		}
+	}
+
 	cmd := []string{"/sbin/init"}
 	if cfg.IsSet("CMD") {
 		cmd = strings.Split(cfg.Get("CMD"), " ")
@@ -79,118 +290,298 @@ func newDockerProvider(cfg *config.ProviderConfig) (Provider, error) {
 
 	memory := uint64(1024 * 1024 * 1024 * 4)
 	if cfg.IsSet("MEMORY") {
-		if parsedMemory, err := humanize.ParseBytes(cfg.Get("MEMORY")); err == nil {
-			memory = parsedMemory
+		memory, err = humanize.ParseBytes(cfg.Get("MEMORY"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid MEMORY %q: %v", cfg.Get("MEMORY"), err)
 		}
 	}
 
 	cpus := uint64(2)
 	if cfg.IsSet("CPUS") {
-		if parsedCPUs, err := strconv.ParseUint(cfg.Get("CPUS"), 10, 64); err == nil {
-			cpus = parsedCPUs
+		cpus, err = strconv.ParseUint(cfg.Get("CPUS"), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CPUS %q: %v", cfg.Get("CPUS"), err)
+		}
+	}
+
+	if int(cpus) > cpuSetSize {
+		return nil, fmt.Errorf("CPUS %d is larger than CPU_SET_SIZE %d", cpus, cpuSetSize)
+	}
+
+	endpoints, err := buildDockerEndpoints(cfg, cpuSetSize)
+	if err != nil {
+		return nil, err
+	}
+
+	healthCheckInterval := defaultDockerHealthCheckInterval
+	if cfg.IsSet("HEALTH_CHECK_INTERVAL") {
+		healthCheckInterval, err = time.ParseDuration(cfg.Get("HEALTH_CHECK_INTERVAL"))
+		if err != nil || healthCheckInterval <= 0 {
+			return nil, fmt.Errorf("invalid HEALTH_CHECK_INTERVAL %q", cfg.Get("HEALTH_CHECK_INTERVAL"))
+		}
+	}
+
+	imageSelectorType := defaultDockerImageSelectorType
+	if cfg.IsSet("IMAGE_SELECTOR_TYPE") {
+		imageSelectorType = cfg.Get("IMAGE_SELECTOR_TYPE")
+	}
+
+	var imageSelector image.Selector
+	if imageSelectorType != "legacy" {
+		imageSelector, err = buildImageSelector(imageSelectorType, cfg)
+		if err != nil {
+			return nil, err
 		}
 	}
 
+	defaultImage := defaultDockerImage
+	if cfg.IsSet("IMAGE_DEFAULT") {
+		defaultImage = cfg.Get("IMAGE_DEFAULT")
+	}
+
 	return &dockerProvider{
-		client: client,
+		endpoints:           endpoints,
+		pooled:              cfg.IsSet("ENDPOINTS"),
+		healthCheckInterval: healthCheckInterval,
+
+		imageSelectorType: imageSelectorType,
+		imageSelector:     imageSelector,
+		defaultImage:      defaultImage,
 
 		runPrivileged: privileged,
 		runCmd:        cmd,
 		runMemory:     memory,
 		runCPUs:       int(cpus),
+		runNative:     native,
+		runNativeTTY:  nativeTTY,
+		runBinds:      binds,
+
+		networkMode: networkMode,
+		dns:         dns,
+		extraHosts:  extraHosts,
 
-		cpuSets: make([]bool, cpuSetSize),
+		securityOpt:       securityOpt,
+		loggedSecurityOpt: loggedSecurityOpt,
+
+		privilegedAllowed: privilegedAllowed,
+		privilegedRepos:   privilegedRepos,
+
+		hardTimeout:   hardTimeout,
+		sweepInterval: sweepInterval,
+		sweepDryRun:   sweepDryRun,
+
+		containers: map[string]bool{},
 	}, nil
 }
 
-func buildDockerClient(cfg *config.ProviderConfig) (*docker.Client, error) {
-	// check for both DOCKER_ENDPOINT and DOCKER_HOST, the latter for
-	// compatibility with docker's own env vars.
-	if !cfg.IsSet("ENDPOINT") && !cfg.IsSet("HOST") {
-		return nil, ErrMissingEndpointConfig
+// buildDockerClient returns a client for the daemon at the given address,
+// and the endpoint's name.
+func buildDockerClient(cfg *config.ProviderConfig, endpoint string) (*docker.Client, string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid ENDPOINT %q: %v", endpoint, err)
+	}
+	if !dockerEndpointSchemes[u.Scheme] {
+		return nil, "", fmt.Errorf("invalid ENDPOINT %q: scheme must be tcp, http, https or unix", endpoint)
+	}
+	if u.Scheme == "unix" && u.Path == "" {
+		return nil, "", fmt.Errorf("invalid ENDPOINT %q: missing socket path", endpoint)
+	}
+	if u.Scheme != "unix" && u.Host == "" {
+		return nil, "", fmt.Errorf("invalid ENDPOINT %q: missing host", endpoint)
+	}
+
+	name := u.Host
+	if u.Scheme == "unix" {
+		name = u.Path
+	}
+
+	// like docker itself, verify the daemon's certificate by default only
+	// when certificates are given
+	tlsVerify := cfg.IsSet("CERT_PATH")
+	if cfg.IsSet("TLS_VERIFY") {
+		tlsVerify, err = strconv.ParseBool(cfg.Get("TLS_VERIFY"))
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid TLS_VERIFY %q: %v", cfg.Get("TLS_VERIFY"), err)
+		}
+	}
+
+	if !cfg.IsSet("CERT_PATH") {
+		if tlsVerify {
+			return nil, "", fmt.Errorf("TLS_VERIFY requires CERT_PATH")
+		}
+		client, err := docker.NewClient(endpoint)
+		return client, name, err
+	}
+
+	if u.Scheme == "unix" {
+		return nil, "", fmt.Errorf("CERT_PATH can't be combined with a unix ENDPOINT")
 	}
 
-	endpoint := cfg.Get("ENDPOINT")
-	if endpoint == "" {
-		endpoint = cfg.Get("HOST")
+	path := cfg.Get("CERT_PATH")
+	cert, err := ioutil.ReadFile(filepath.Join(path, "cert.pem"))
+	if err != nil {
+		return nil, "", err
+	}
+	key, err := ioutil.ReadFile(filepath.Join(path, "key.pem"))
+	if err != nil {
+		return nil, "", err
 	}
 
-	if cfg.IsSet("CERT_PATH") {
-		path := cfg.Get("CERT_PATH")
-		ca := fmt.Sprintf("%s/ca.pem", path)
-		cert := fmt.Sprintf("%s/cert.pem", path)
-		key := fmt.Sprintf("%s/key.pem", path)
-		return docker.NewTLSClient(endpoint, cert, key, ca)
+	// without a CA, the client skips verifying the daemon's certificate
+	var ca []byte
+	if tlsVerify {
+		ca, err = ioutil.ReadFile(filepath.Join(path, "ca.pem"))
+		if err != nil {
+			return nil, "", err
+		}
 	}
 
-	return docker.NewClient(endpoint)
+	client, err := docker.NewTLSClientFromBytes(endpoint, cert, key, ca)
+	return client, name, err
 }
 
-func (p *dockerProvider) Start(ctx gocontext.Context, startAttributes *StartAttributes) (Instance, error) {
+// dockerConnectionError says whether connecting to the daemon failed because
+// its certificate couldn't be verified or because the TLS handshake failed.
+// The errors are told apart by message, as their types depend on the Go
+// version.
+func dockerConnectionError(err error) error {
+	switch {
+	case strings.Contains(err.Error(), "x509: "):
+		return fmt.Errorf("TLS verification of Docker's certificate failed: %v", err)
+	case strings.Contains(err.Error(), "tls: "), strings.Contains(err.Error(), "HTTP response to HTTPS client"):
+		return fmt.Errorf("TLS negotiation with Docker failed: %v", err)
+	default:
+		return err
+	}
+}
+
+func (p *dockerProvider) Start(ctx gocontext.Context, startAttributes *StartAttributes) (_ Instance, err error) {
 	logger := context.LoggerFromContext(ctx)
 
-	cpuSets, err := p.checkoutCPUSets()
-	if err != nil && cpuSets != "" {
+	endpoint, cpuSets, err := p.checkoutEndpoint()
+	if err != nil {
 		return nil, err
 	}
+	if p.pooled {
+		logger = logger.WithField("endpoint", endpoint.name)
+	}
+
+	var container *docker.Container
+	started := false
+
+	// A container that didn't start is removed before its cpus are returned
+	// to the pool, so that they're never shared by two containers. If the
+	// endpoint couldn't be reached, further jobs are placed elsewhere.
+	defer func() {
+		if started {
+			return
+		}
+
+		if dockerUnreachable(err) {
+			p.quarantineEndpoint(ctx, endpoint, err)
+		}
 
-	imageID, imageName, err := p.imageForLanguage(startAttributes.Language)
+		if container != nil {
+			removeErr := endpoint.client.RemoveContainer(docker.RemoveContainerOptions{
+				ID:            container.ID,
+				RemoveVolumes: true,
+				Force:         true,
+			})
+			if removeErr != nil {
+				logger.WithField("err", removeErr).Error("couldn't remove container after start failure")
+			}
+			p.setActiveContainer(container.ID, false)
+		}
+
+		p.checkinEndpoint(endpoint, cpuSets)
+	}()
+
+	imageID, imageName, err := p.resolveImage(ctx, endpoint, startAttributes)
 	if err != nil {
 		return nil, err
 	}
 
+	labels := map[string]string{dockerWorkerLabel: "true"}
+	containerName := fmt.Sprintf("%s%s", dockerContainerNamePrefix, uuid.NewRandom())
+	if startAttributes.JobID != 0 {
+		labels[dockerJobIDLabel] = strconv.FormatUint(startAttributes.JobID, 10)
+		containerName = fmt.Sprintf("%s%d-%s", dockerContainerNamePrefix, startAttributes.JobID, uuid.NewRandom())
+	}
+
 	dockerConfig := &docker.Config{
 		Cmd:      p.runCmd,
 		Image:    imageID,
-		Memory:   int64(p.runMemory),
 		Hostname: fmt.Sprintf("testing-docker-%s", uuid.NewRandom()),
+		Labels:   labels,
 	}
 
-	dockerHostConfig := &docker.HostConfig{
-		Privileged: p.runPrivileged,
+	dockerHostConfig := p.hostConfig(cpuSets)
+	if !startAttributes.VMConfig.SkipVolumes {
+		dockerHostConfig.Binds = p.runBinds
 	}
 
-	if cpuSets != "" {
-		dockerConfig.CPUSet = cpuSets
+	var warnings []string
+	if startAttributes.Privileged && !dockerHostConfig.Privileged {
+		if p.privilegedAllowedFor(startAttributes.Repository) {
+			metrics.Mark("worker.vm.provider.docker.privileged.granted")
+			dockerHostConfig.Privileged = true
+		} else {
+			metrics.Mark("worker.vm.provider.docker.privileged.denied")
+			logger.WithField("repository", startAttributes.Repository).Info("privileged mode requested but not allowed")
+			warnings = append(warnings, "privileged mode was requested, but isn't allowed for this repository on this worker, so the job runs unprivileged")
+		}
 	}
 
 	logger.WithFields(logrus.Fields{
-		"config":      fmt.Sprintf("%#v", dockerConfig),
-		"host_config": fmt.Sprintf("%#v", dockerHostConfig),
+		"config":       fmt.Sprintf("%#v", dockerConfig),
+		"host_config":  fmt.Sprintf("%#v", dockerHostConfig),
+		"network_mode": dockerHostConfig.NetworkMode,
+		"dns":          dockerHostConfig.DNS,
+		"extra_hosts":  dockerHostConfig.ExtraHosts,
 	}).Debug("starting container")
 
-	container, err := p.client.CreateContainer(docker.CreateContainerOptions{
+	container, err = endpoint.client.CreateContainer(docker.CreateContainerOptions{
+		Name:       containerName,
 		Config:     dockerConfig,
 		HostConfig: dockerHostConfig,
 	})
 
-	if err != nil {
-		if container != nil {
-			err := p.client.RemoveContainer(docker.RemoveContainerOptions{
-				ID:            container.ID,
-				RemoveVolumes: true,
-				Force:         true,
-			})
-			if err != nil {
-				logger.WithField("err", err).Error("couldn't remove container after create failure")
-			}
+	// the image may have been removed since it was resolved
+	if err == docker.ErrNoSuchImage && endpoint.puller.policy != "never" {
+		err = endpoint.puller.pull(ctx, imageName)
+		if err != nil {
+			return nil, err
 		}
 
-		return nil, err
+		dockerConfig.Image = imageName
+		container, err = endpoint.client.CreateContainer(docker.CreateContainerOptions{
+			Name:       containerName,
+			Config:     dockerConfig,
+			HostConfig: dockerHostConfig,
+		})
+	}
+
+	if err != nil {
+		return nil, dockerConnectionError(err)
 	}
 
+	// the container is this worker's from now on, so that a sweep doesn't
+	// mistake it for a leaked one before it's running
+	p.setActiveContainer(container.ID, true)
+
 	startBooting := time.Now()
 
-	err = p.client.StartContainer(container.ID, &docker.HostConfig{})
+	err = endpoint.client.StartContainer(container.ID, dockerHostConfig)
 	if err != nil {
 		return nil, err
 	}
 
-	containerReady := make(chan *docker.Container)
-	errChan := make(chan error)
+	containerReady := make(chan *docker.Container, 1)
+	errChan := make(chan error, 1)
 	go func(id string) {
-		for {
-			container, err := p.client.InspectContainer(id)
+		for ctx.Err() == nil {
+			container, err := endpoint.client.InspectContainer(id)
 			if err != nil {
 				errChan <- err
 				return
@@ -206,11 +597,15 @@ func (p *dockerProvider) Start(ctx gocontext.Context, startAttributes *StartAttr
 	select {
 	case container := <-containerReady:
 		metrics.TimeSince("worker.vm.provider.docker.boot", startBooting)
+		started = true
 		return &dockerInstance{
-			client:    p.client,
+			client:    endpoint.client,
 			provider:  p,
+			endpoint:  endpoint,
 			container: container,
 			imageName: imageName,
+			cpuSets:   cpuSets,
+			warnings:  warnings,
 		}, nil
 	case err := <-errChan:
 		return nil, err
@@ -222,10 +617,333 @@ func (p *dockerProvider) Start(ctx gocontext.Context, startAttributes *StartAttr
 	}
 }
 
-func (p *dockerProvider) Setup() error { return nil }
+// hostConfig returns the host config for a container pinned to the given
+// cpus, which limits its memory to MEMORY, swap included, and uses the
+// configured network settings.
+func (p *dockerProvider) hostConfig(cpuSets string) *docker.HostConfig {
+	return &docker.HostConfig{
+		Privileged:  p.runPrivileged,
+		Memory:      int64(p.runMemory),
+		MemorySwap:  int64(p.runMemory),
+		CPUSet:      cpuSets,
+		NetworkMode: p.networkMode,
+		DNS:         p.dns,
+		ExtraHosts:  p.extraHosts,
+		SecurityOpt: p.securityOpt,
+	}
+}
+
+// parseDockerSecurityOpt returns the security options given by
+// SECCOMP_PROFILE_PATH, APPARMOR_PROFILE and SECURITY_OPT, and the same
+// options to log. The seccomp profile is read and checked to be a JSON object
+// now, as docker only parses it when a container is created.
+func parseDockerSecurityOpt(cfg *config.ProviderConfig) ([]string, []string, error) {
+	securityOpt := []string{}
+	loggedSecurityOpt := []string{}
 
-func (p *dockerProvider) imageForLanguage(language string) (string, string, error) {
-	images, err := p.client.ListImages(docker.ListImagesOptions{All: true})
+	if cfg.IsSet("SECCOMP_PROFILE_PATH") {
+		profile, err := ioutil.ReadFile(cfg.Get("SECCOMP_PROFILE_PATH"))
+		if err != nil {
+			return nil, nil, fmt.Errorf("couldn't read SECCOMP_PROFILE_PATH: %v", err)
+		}
+
+		var parsed map[string]interface{}
+		err = json.Unmarshal(profile, &parsed)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid seccomp profile %s: %v", cfg.Get("SECCOMP_PROFILE_PATH"), err)
+		}
+
+		compacted := &bytes.Buffer{}
+		err = json.Compact(compacted, profile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid seccomp profile %s: %v", cfg.Get("SECCOMP_PROFILE_PATH"), err)
+		}
+
+		securityOpt = append(securityOpt, fmt.Sprintf("seccomp=%s", compacted.String()))
+		loggedSecurityOpt = append(loggedSecurityOpt, fmt.Sprintf("seccomp=%s", cfg.Get("SECCOMP_PROFILE_PATH")))
+	}
+
+	if cfg.IsSet("APPARMOR_PROFILE") {
+		opt := fmt.Sprintf("apparmor=%s", cfg.Get("APPARMOR_PROFILE"))
+		securityOpt = append(securityOpt, opt)
+		loggedSecurityOpt = append(loggedSecurityOpt, opt)
+	}
+
+	for _, opt := range strings.Split(cfg.Get("SECURITY_OPT"), ",") {
+		opt = strings.TrimSpace(opt)
+		if opt == "" {
+			continue
+		}
+
+		// docker accepts both key=value and the older key:value
+		key := strings.SplitN(strings.SplitN(opt, "=", 2)[0], ":", 2)[0]
+		if key == "seccomp" && cfg.IsSet("SECCOMP_PROFILE_PATH") {
+			return nil, nil, fmt.Errorf("SECURITY_OPT %q conflicts with SECCOMP_PROFILE_PATH", opt)
+		}
+		if key == "apparmor" && cfg.IsSet("APPARMOR_PROFILE") {
+			return nil, nil, fmt.Errorf("SECURITY_OPT %q conflicts with APPARMOR_PROFILE", opt)
+		}
+
+		securityOpt = append(securityOpt, opt)
+		loggedSecurityOpt = append(loggedSecurityOpt, opt)
+	}
+
+	if len(securityOpt) == 0 {
+		return nil, nil, nil
+	}
+
+	return securityOpt, loggedSecurityOpt, nil
+}
+
+// parseDockerDNS parses comma-delimited DNS server IPs.
+func parseDockerDNS(servers string) ([]string, error) {
+	dns := []string{}
+
+	for _, server := range strings.Split(servers, ",") {
+		server = strings.TrimSpace(server)
+		if server == "" {
+			continue
+		}
+
+		if net.ParseIP(server) == nil {
+			return nil, fmt.Errorf("invalid DNS server %q, must be an IP", server)
+		}
+
+		dns = append(dns, server)
+	}
+
+	return dns, nil
+}
+
+// parseDockerExtraHosts parses comma-delimited host:ip entries. Like docker,
+// the host ends at the first colon so that the ip may be an IPv6 address.
+func parseDockerExtraHosts(entries string) ([]string, error) {
+	extraHosts := []string{}
+
+	for _, entry := range strings.Split(entries, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || net.ParseIP(parts[1]) == nil {
+			return nil, fmt.Errorf("invalid extra host %q, must be host:ip", entry)
+		}
+
+		extraHosts = append(extraHosts, entry)
+	}
+
+	return extraHosts, nil
+}
+
+// privilegedAllowedFor returns whether jobs of the repository with the given
+// slug may run privileged containers.
+func (p *dockerProvider) privilegedAllowedFor(repository string) bool {
+	return p.privilegedAllowed && p.privilegedRepos[repository]
+}
+
+// parseDockerVolumes parses comma-delimited host:container[:ro] volume specs
+// into binds, refusing dangerous host paths unless allowed.
+func parseDockerVolumes(specs string, allowDangerous bool) ([]string, error) {
+	binds := []string{}
+
+	for _, spec := range strings.Split(specs, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+
+		parts := strings.Split(spec, ":")
+		if len(parts) < 2 || len(parts) > 3 {
+			return nil, fmt.Errorf("invalid volume %q, must be host:container[:ro]", spec)
+		}
+
+		if !filepath.IsAbs(parts[0]) || !filepath.IsAbs(parts[1]) {
+			return nil, fmt.Errorf("invalid volume %q, paths must be absolute", spec)
+		}
+
+		if len(parts) == 3 && parts[2] != "ro" && parts[2] != "rw" {
+			return nil, fmt.Errorf("invalid volume %q, mode must be ro or rw", spec)
+		}
+
+		if !allowDangerous && dockerDangerousMount(parts[0]) {
+			return nil, fmt.Errorf("volume %q mounts a dangerous host path, which requires ALLOW_DANGEROUS_MOUNTS", spec)
+		}
+
+		binds = append(binds, spec)
+	}
+
+	return binds, nil
+}
+
+// dockerDangerousMount returns true if mounting the host path gives access to
+// the docker socket or to system directories.
+func dockerDangerousMount(hostPath string) bool {
+	hostPath = filepath.Clean(hostPath)
+
+	for _, socket := range dockerSockets {
+		if socket == hostPath || strings.HasPrefix(socket, strings.TrimSuffix(hostPath, "/")+"/") {
+			return true
+		}
+	}
+
+	for _, dangerous := range dockerDangerousMounts {
+		if hostPath == dangerous || strings.HasPrefix(hostPath, dangerous+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Setup checks that Docker can be reached and removes containers leaked by
+// workers that crashed, sweeping periodically afterwards if configured. Of a
+// pool of endpoints, only one needs to be reachable, the others are
+// quarantined until the periodic health checks reach them.
+func (p *dockerProvider) Setup() error {
+	if p.pooled {
+		if p.checkEndpoints(gocontext.TODO()) == 0 {
+			return fmt.Errorf("couldn't connect to any of the Docker ENDPOINTS")
+		}
+	} else {
+		err := p.endpoints[0].client.Ping()
+		if err != nil {
+			return fmt.Errorf("couldn't connect to Docker: %v", dockerConnectionError(err))
+		}
+	}
+
+	if len(p.securityOpt) > 0 {
+		logger := context.LoggerFromContext(gocontext.TODO()).WithField("security_opt", p.loggedSecurityOpt)
+		if p.runPrivileged || p.privilegedAllowed {
+			logger.Warn("applying security options to containers, which docker ignores for privileged ones")
+		} else {
+			logger.Info("applying security options to containers")
+		}
+	}
+
+	_, err := p.Sweep(gocontext.TODO(), p.hardTimeout)
+	if err != nil {
+		context.LoggerFromContext(gocontext.TODO()).WithField("err", err).Error("couldn't sweep leaked containers")
+	}
+
+	if p.sweepInterval > 0 {
+		go p.sweepPeriodically()
+	}
+
+	if p.pooled {
+		go p.checkEndpointsPeriodically()
+	}
+
+	return nil
+}
+
+// resolveImage finds the image for the job on the endpoint, chosen by the
+// image selector or, for the legacy selector, by language. Depending on
+// PULL_POLICY it's pulled first: always pulls before looking for a local
+// image, and missing only pulls if there is none.
+func (p *dockerProvider) resolveImage(ctx gocontext.Context, e *dockerEndpoint, startAttributes *StartAttributes) (string, string, error) {
+	find := func() (string, string, error) { return imageForLanguage(e, startAttributes.Language) }
+	pull := func() error { return pullImageForLanguage(ctx, e, startAttributes.Language) }
+
+	if p.imageSelectorType != "legacy" {
+		imageName := p.selectImage(ctx, startAttributes)
+		find = func() (string, string, error) { return imageByName(e, imageName) }
+		pull = func() error { return e.puller.pull(ctx, imageName) }
+	}
+
+	if e.puller.policy == "always" {
+		err := pull()
+		if err != nil {
+			context.LoggerFromContext(ctx).WithField("err", err).Warn("couldn't pull image, using local image")
+		}
+	}
+
+	imageID, imageName, err := find()
+	if err == nil || e.puller.policy != "missing" {
+		return imageID, imageName, err
+	}
+
+	err = pull()
+	if err != nil {
+		return "", "", err
+	}
+
+	return find()
+}
+
+// selectImage returns the repository:tag chosen by the image selector,
+// falling back to IMAGE_DEFAULT if selection fails.
+func (p *dockerProvider) selectImage(ctx gocontext.Context, startAttributes *StartAttributes) string {
+	imageName, err := p.imageSelector.Select(&image.Params{
+		Infra:    "docker",
+		Language: startAttributes.Language,
+		OsxImage: startAttributes.OsxImage,
+		Dist:     startAttributes.Dist,
+		Group:    startAttributes.Group,
+		OS:       startAttributes.OS,
+	})
+	if err != nil || imageName == "" {
+		metrics.Mark("worker.vm.provider.docker.image.select.error")
+		context.LoggerFromContext(ctx).WithFields(logrus.Fields{
+			"err":           err,
+			"selector_type": p.imageSelectorType,
+			"default_image": p.defaultImage,
+		}).Warn("couldn't select image, using default image")
+		imageName = "default"
+	}
+
+	if imageName == "default" {
+		imageName = p.defaultImage
+	}
+
+	return dockerImageReference(imageName)
+}
+
+// dockerImageReference adds the latest tag to an image name without a tag.
+func dockerImageReference(imageName string) string {
+	if strings.LastIndex(imageName, ":") > strings.LastIndex(imageName, "/") {
+		return imageName
+	}
+
+	return imageName + ":latest"
+}
+
+// imageByName returns the ID of the endpoint's image tagged with the given
+// repository:tag.
+func imageByName(e *dockerEndpoint, imageName string) (string, string, error) {
+	images, err := e.client.ListImages(docker.ListImagesOptions{All: true})
+	if err != nil {
+		return "", "", err
+	}
+
+	for _, image := range images {
+		for _, tag := range image.RepoTags {
+			if tag == imageName {
+				return image.ID, tag, nil
+			}
+		}
+	}
+
+	return "", "", fmt.Errorf("no image found with name %s", imageName)
+}
+
+// pullImageForLanguage pulls the language's image, falling back to the
+// default image if that fails.
+func pullImageForLanguage(ctx gocontext.Context, e *dockerEndpoint, language string) error {
+	var err error
+	for _, imageName := range []string{"travis:" + language, "travis:default"} {
+		err = e.puller.pull(ctx, imageName)
+		if err == nil {
+			return nil
+		}
+	}
+
+	return err
+}
+
+func imageForLanguage(e *dockerEndpoint, language string) (string, string, error) {
+	images, err := e.client.ListImages(docker.ListImagesOptions{All: true})
 	if err != nil {
 		return "", "", err
 	}
@@ -248,13 +966,19 @@ func (p *dockerProvider) imageForLanguage(language string) (string, string, erro
 	return "", "", fmt.Errorf("no image found with language %s", language)
 }
 
-func (p *dockerProvider) checkoutCPUSets() (string, error) {
+// checkoutCPUSets marks CPUS free cpus of the endpoint as allocated and
+// returns them as a cpuset string, or "" if containers aren't pinned to cpus.
+func (p *dockerProvider) checkoutCPUSets(e *dockerEndpoint) (string, error) {
+	if p.runCPUs == 0 {
+		return "", nil
+	}
+
 	p.cpuSetsMutex.Lock()
 	defer p.cpuSetsMutex.Unlock()
 
 	cpuSets := []int{}
 
-	for i, checkedOut := range p.cpuSets {
+	for i, checkedOut := range e.cpuSets {
 		if !checkedOut {
 			cpuSets = append(cpuSets, i)
 		}
@@ -271,24 +995,51 @@ func (p *dockerProvider) checkoutCPUSets() (string, error) {
 	cpuSetsString := []string{}
 
 	for _, cpuSet := range cpuSets {
-		p.cpuSets[cpuSet] = true
+		e.cpuSets[cpuSet] = true
 		cpuSetsString = append(cpuSetsString, fmt.Sprintf("%d", cpuSet))
 	}
 
+	p.reportCPUSets()
+
 	return strings.Join(cpuSetsString, ","), nil
 }
 
-func (p *dockerProvider) checkinCPUSets(sets string) {
+// checkinCPUSets returns the cpus in the given cpuset string to the
+// endpoint's pool.
+func (p *dockerProvider) checkinCPUSets(e *dockerEndpoint, sets string) {
+	if sets == "" {
+		return
+	}
+
 	p.cpuSetsMutex.Lock()
 	defer p.cpuSetsMutex.Unlock()
 
 	for _, cpuString := range strings.Split(sets, ",") {
 		cpu, err := strconv.ParseUint(cpuString, 10, 64)
-		if err != nil {
+		if err != nil || int(cpu) >= len(e.cpuSets) {
 			continue
 		}
-		p.cpuSets[int(cpu)] = false
+		e.cpuSets[int(cpu)] = false
 	}
+
+	p.reportCPUSets()
+}
+
+// reportCPUSets updates the gauges of allocated and free cpus of all
+// endpoints. The caller must hold cpuSetsMutex.
+func (p *dockerProvider) reportCPUSets() {
+	allocated, total := 0, 0
+	for _, e := range p.endpoints {
+		for _, checkedOut := range e.cpuSets {
+			if checkedOut {
+				allocated++
+			}
+		}
+		total += len(e.cpuSets)
+	}
+
+	metrics.Gauge("worker.vm.provider.docker.cpusets.allocated", int64(allocated))
+	metrics.Gauge("worker.vm.provider.docker.cpusets.free", int64(total-allocated))
 }
 
 func (i *dockerInstance) sshClient() (*ssh.Client, error) {
@@ -309,6 +1060,10 @@ func (i *dockerInstance) sshClient() (*ssh.Client, error) {
 }
 
 func (i *dockerInstance) UploadScript(ctx gocontext.Context, script []byte) error {
+	if i.provider.runNative {
+		return i.uploadScriptNative(ctx, script)
+	}
+
 	client, err := i.sshClient()
 	if err != nil {
 		return err
@@ -331,14 +1086,14 @@ func (i *dockerInstance) UploadScript(ctx gocontext.Context, script []byte) erro
 		return err
 	}
 
-	if _, err := f.Write(script); err != nil {
-		return err
-	}
-
-	return nil
+	return sftpWriteFile(f, script, 0755)
 }
 
 func (i *dockerInstance) RunScript(ctx gocontext.Context, output io.Writer) (*RunResult, error) {
+	if i.provider.runNative {
+		return i.runScriptNative(ctx, output)
+	}
+
 	client, err := i.sshClient()
 	if err != nil {
 		return &RunResult{Completed: false}, err
@@ -372,11 +1127,15 @@ func (i *dockerInstance) RunScript(ctx gocontext.Context, output io.Writer) (*Ru
 	}
 }
 
+// Stop stops and removes the container. Its cpus are returned to the pool
+// even if that fails. A container that was already killed, e.g. because its
+// native script run was cancelled, is only removed.
 func (i *dockerInstance) Stop(ctx gocontext.Context) error {
-	defer i.provider.checkinCPUSets(i.container.Config.CPUSet)
+	defer i.provider.checkinEndpoint(i.endpoint, i.cpuSets)
+	defer i.provider.setActiveContainer(i.container.ID, false)
 
 	err := i.client.StopContainer(i.container.ID, 30)
-	if err != nil {
+	if _, ok := err.(*docker.ContainerNotRunning); err != nil && !ok {
 		return err
 	}
 
@@ -392,5 +1151,15 @@ func (i *dockerInstance) ID() string {
 		return "{unidentified}"
 	}
 
+	if i.provider.pooled {
+		return fmt.Sprintf("%s/%s:%s", i.endpoint.name, i.container.ID[0:7], i.imageName)
+	}
+
 	return fmt.Sprintf("%s:%s", i.container.ID[0:7], i.imageName)
 }
+
+// Warnings returns the ways the container differs from what the job asked
+// for, such as running unprivileged.
+func (i *dockerInstance) Warnings() []string {
+	return i.warnings
+}
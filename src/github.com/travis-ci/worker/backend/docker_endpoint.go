@@ -0,0 +1,284 @@
+package backend
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/travis-ci/worker/config"
+	"github.com/travis-ci/worker/context"
+	"github.com/travis-ci/worker/metrics"
+	gocontext "golang.org/x/net/context"
+)
+
+const (
+	defaultDockerHealthCheckInterval = 30 * time.Second
+)
+
+// dockerEndpoint is one of the daemons containers are run on.
+type dockerEndpoint struct {
+	// name identifies the endpoint in logs and instance IDs, and is the
+	// host of its address, or the socket path of a unix address.
+	name   string
+	client *docker.Client
+	puller *dockerPuller
+
+	// cpuSets are the cpus of the daemon's host allocated to containers,
+	// guarded by the provider's cpuSetsMutex.
+	cpuSets []bool
+
+	// active is the number of this worker's containers on the endpoint,
+	// external the number of other running worker containers found by the
+	// last health check, and quarantined whether the endpoint couldn't be
+	// reached since. They're guarded by the provider's endpointsMutex.
+	active      int
+	external    int
+	quarantined bool
+}
+
+func (e *dockerEndpoint) load() int {
+	return e.active + e.external
+}
+
+type dockerEndpointsByLoad []*dockerEndpoint
+
+func (l dockerEndpointsByLoad) Len() int           { return len(l) }
+func (l dockerEndpointsByLoad) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l dockerEndpointsByLoad) Less(i, j int) bool { return l[i].load() < l[j].load() }
+
+// buildDockerEndpoints returns the endpoint given by ENDPOINT or HOST, or the
+// pool of endpoints given by ENDPOINTS, each with cpuSetSize cpus.
+func buildDockerEndpoints(cfg *config.ProviderConfig, cpuSetSize int) ([]*dockerEndpoint, error) {
+	addresses := []string{}
+
+	if cfg.IsSet("ENDPOINTS") {
+		if cfg.IsSet("ENDPOINT") || cfg.IsSet("HOST") {
+			return nil, fmt.Errorf("ENDPOINTS can't be combined with ENDPOINT or HOST")
+		}
+
+		for _, address := range strings.Split(cfg.Get("ENDPOINTS"), ",") {
+			address = strings.TrimSpace(address)
+			if address != "" {
+				addresses = append(addresses, address)
+			}
+		}
+
+		if len(addresses) == 0 {
+			return nil, fmt.Errorf("ENDPOINTS lists no endpoints")
+		}
+	} else {
+		// check for both DOCKER_ENDPOINT and DOCKER_HOST, the latter for
+		// compatibility with docker's own env vars.
+		if !cfg.IsSet("ENDPOINT") && !cfg.IsSet("HOST") {
+			return nil, ErrMissingEndpointConfig
+		}
+
+		address := cfg.Get("ENDPOINT")
+		if address == "" {
+			address = cfg.Get("HOST")
+		}
+		addresses = append(addresses, address)
+	}
+
+	endpoints := []*dockerEndpoint{}
+	names := map[string]bool{}
+
+	for _, address := range addresses {
+		client, name, err := buildDockerClient(cfg, address)
+		if err != nil {
+			return nil, err
+		}
+
+		// instances are told apart by endpoint name
+		if names[name] {
+			return nil, fmt.Errorf("ENDPOINTS lists %q more than once", name)
+		}
+		names[name] = true
+
+		puller, err := newDockerPuller(client, cfg)
+		if err != nil {
+			return nil, err
+		}
+
+		endpoints = append(endpoints, &dockerEndpoint{
+			name:    name,
+			client:  client,
+			puller:  puller,
+			cpuSets: make([]bool, cpuSetSize),
+		})
+	}
+
+	return endpoints, nil
+}
+
+// dockerUnreachable returns true if the error is from failing to reach the
+// daemon, rather than from the daemon failing a request.
+func dockerUnreachable(err error) bool {
+	if err == docker.ErrConnectionRefused {
+		return true
+	}
+
+	switch err.(type) {
+	case *url.Error, *net.OpError:
+		return true
+	default:
+		return false
+	}
+}
+
+// checkoutEndpoint picks the least loaded endpoint that isn't quarantined and
+// has enough free cpus, with ties going to the one listed first. It returns
+// the endpoint, with the container about to be started counted against it,
+// and the cpus checked out for the container.
+func (p *dockerProvider) checkoutEndpoint() (*dockerEndpoint, string, error) {
+	p.endpointsMutex.Lock()
+	defer p.endpointsMutex.Unlock()
+
+	candidates := []*dockerEndpoint{}
+	for _, e := range p.endpoints {
+		if !e.quarantined {
+			candidates = append(candidates, e)
+		}
+	}
+
+	if len(candidates) == 0 {
+		metrics.Mark("worker.vm.provider.docker.endpoints.unavailable")
+		return nil, "", fmt.Errorf("no reachable Docker endpoints")
+	}
+
+	sort.Stable(dockerEndpointsByLoad(candidates))
+
+	for _, e := range candidates {
+		cpuSets, err := p.checkoutCPUSets(e)
+		if err != nil {
+			continue
+		}
+
+		e.active++
+		return e, cpuSets, nil
+	}
+
+	metrics.Mark("worker.vm.provider.docker.cpusets.exhausted")
+	return nil, "", fmt.Errorf("not enough free CPUsets")
+}
+
+// checkinEndpoint returns the cpus of a container that was removed from the
+// endpoint to its pool, and no longer counts the container against it.
+func (p *dockerProvider) checkinEndpoint(e *dockerEndpoint, cpuSets string) {
+	p.checkinCPUSets(e, cpuSets)
+
+	p.endpointsMutex.Lock()
+	defer p.endpointsMutex.Unlock()
+
+	e.active--
+}
+
+// quarantineEndpoint stops placing containers on the endpoint until a health
+// check reaches it again. A single endpoint is never quarantined, as there's
+// nowhere else to place containers.
+func (p *dockerProvider) quarantineEndpoint(ctx gocontext.Context, e *dockerEndpoint, err error) {
+	if !p.pooled {
+		return
+	}
+
+	p.endpointsMutex.Lock()
+	defer p.endpointsMutex.Unlock()
+
+	if e.quarantined {
+		return
+	}
+	e.quarantined = true
+
+	metrics.Mark("worker.vm.provider.docker.endpoint.quarantined")
+	context.LoggerFromContext(ctx).WithFields(logrus.Fields{
+		"endpoint": e.name,
+		"err":      err,
+	}).Warn("quarantining unreachable Docker endpoint")
+}
+
+// readmitEndpoint records a successful health check of the endpoint, which
+// found external running containers of other workers.
+func (p *dockerProvider) readmitEndpoint(ctx gocontext.Context, e *dockerEndpoint, external int) {
+	p.endpointsMutex.Lock()
+	defer p.endpointsMutex.Unlock()
+
+	e.external = external
+
+	if !e.quarantined {
+		return
+	}
+	e.quarantined = false
+
+	metrics.Mark("worker.vm.provider.docker.endpoint.readmitted")
+	context.LoggerFromContext(ctx).WithField("endpoint", e.name).Info("readmitting Docker endpoint")
+}
+
+// endpointQuarantined returns whether the endpoint is quarantined.
+func (p *dockerProvider) endpointQuarantined(e *dockerEndpoint) bool {
+	p.endpointsMutex.Lock()
+	defer p.endpointsMutex.Unlock()
+
+	return e.quarantined
+}
+
+// checkEndpoints pings every endpoint, quarantining those that can't be
+// reached and readmitting those that can again, and counts the running
+// containers of other workers on each, returning the number reached.
+func (p *dockerProvider) checkEndpoints(ctx gocontext.Context) int {
+	reached := 0
+
+	for _, e := range p.endpoints {
+		err := e.client.Ping()
+		if err != nil {
+			p.quarantineEndpoint(ctx, e, dockerConnectionError(err))
+			continue
+		}
+
+		external, err := p.countExternalContainers(e)
+		if err != nil {
+			p.quarantineEndpoint(ctx, e, err)
+			continue
+		}
+
+		p.readmitEndpoint(ctx, e, external)
+		reached++
+	}
+
+	return reached
+}
+
+// countExternalContainers returns the number of running worker containers on
+// the endpoint that aren't this worker's, e.g. those of another worker
+// sharing the daemon.
+func (p *dockerProvider) countExternalContainers(e *dockerEndpoint) (int, error) {
+	containers, err := e.client.ListContainers(docker.ListContainersOptions{
+		Filters: map[string][]string{"label": {dockerWorkerLabel + "=true"}},
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	external := 0
+	for _, container := range containers {
+		if !p.isActiveContainer(container.ID) {
+			external++
+		}
+	}
+
+	return external, nil
+}
+
+// checkEndpointsPeriodically checks the endpoints every
+// HEALTH_CHECK_INTERVAL.
+func (p *dockerProvider) checkEndpointsPeriodically() {
+	ctx := gocontext.TODO()
+
+	for range time.Tick(p.healthCheckInterval) {
+		p.checkEndpoints(ctx)
+	}
+}
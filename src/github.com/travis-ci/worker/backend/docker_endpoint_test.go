@@ -0,0 +1,160 @@
+package backend
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/travis-ci/worker/config"
+	gocontext "golang.org/x/net/context"
+)
+
+// dockerTestDaemon is a fake Docker daemon whose containers start running
+// right away, with an external container of another worker, and which drops
+// connections while down.
+type dockerTestDaemon struct {
+	mutex sync.Mutex
+
+	containerID string
+	external    bool
+	down        bool
+}
+
+func (d *dockerTestDaemon) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.down {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+		return
+	}
+
+	switch {
+	case req.URL.Path == "/_ping":
+		fmt.Fprint(w, "OK")
+	case req.Method == "GET" && req.URL.Path == "/containers/json":
+		if d.external {
+			fmt.Fprint(w, `[{"Id":"external","Names":["/travis-job-other"],"Status":"Up 2 minutes"}]`)
+			return
+		}
+		fmt.Fprint(w, `[]`)
+	case req.Method == "GET" && req.URL.Path == "/images/json":
+		fmt.Fprint(w, `[{"Id":"image-id","RepoTags":["travis:default"]}]`)
+	case req.Method == "POST" && req.URL.Path == "/containers/create":
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"Id":%q}`, d.containerID)
+	case req.Method == "GET" && strings.HasSuffix(req.URL.Path, "/json"):
+		fmt.Fprintf(w, `{"Id":%q,"State":{"Running":true}}`, d.containerID)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (d *dockerTestDaemon) setDown(down bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.down = down
+}
+
+func TestDockerProvider_Endpoints(t *testing.T) {
+	daemonA := &dockerTestDaemon{containerID: "aaaaaaaaaaaa", external: true}
+	serverA := httptest.NewServer(daemonA)
+	defer serverA.Close()
+
+	daemonB := &dockerTestDaemon{containerID: "bbbbbbbbbbbb"}
+	serverB := httptest.NewServer(daemonB)
+	defer serverB.Close()
+
+	provider, err := newDockerProvider(config.ProviderConfigFromMap(map[string]string{
+		"ENDPOINTS":    fmt.Sprintf("%s, %s", serverA.URL, serverB.URL),
+		"CPUS":         "1",
+		"CPU_SET_SIZE": "2",
+	}))
+	require.Nil(t, err)
+	p := provider.(*dockerProvider)
+	require.Len(t, p.endpoints, 2)
+
+	nameA := strings.TrimPrefix(serverA.URL, "http://")
+	nameB := strings.TrimPrefix(serverB.URL, "http://")
+	assert.Equal(t, nameA, p.endpoints[0].name)
+
+	assert.Equal(t, 2, p.checkEndpoints(gocontext.TODO()))
+	assert.Equal(t, 1, p.endpoints[0].external)
+
+	// B runs nothing, then ties with A's external container
+	first, err := p.Start(gocontext.TODO(), &StartAttributes{Language: "ruby"})
+	require.Nil(t, err)
+	assert.Equal(t, nameB+"/bbbbbbb:travis:default", first.ID())
+
+	second, err := p.Start(gocontext.TODO(), &StartAttributes{Language: "ruby"})
+	require.Nil(t, err)
+	assert.Equal(t, nameA+"/aaaaaaa:travis:default", second.ID())
+
+	// A's external container counts against it
+	third, err := p.Start(gocontext.TODO(), &StartAttributes{Language: "ruby"})
+	require.Nil(t, err)
+	assert.Equal(t, nameB+"/bbbbbbb:travis:default", third.ID())
+
+	for _, instance := range []Instance{first, second, third} {
+		assert.Nil(t, instance.Stop(gocontext.TODO()))
+	}
+	assert.Equal(t, 0, p.endpoints[0].active)
+	assert.Equal(t, []bool{false, false}, p.endpoints[1].cpuSets)
+
+	// a start on unreachable B quarantines it
+	daemonB.setDown(true)
+
+	_, err = p.Start(gocontext.TODO(), &StartAttributes{Language: "ruby"})
+	assert.NotNil(t, err)
+	assert.True(t, p.endpoints[1].quarantined)
+	assert.Equal(t, 0, p.endpoints[1].active)
+
+	instance, err := p.Start(gocontext.TODO(), &StartAttributes{Language: "ruby"})
+	require.Nil(t, err)
+	assert.Equal(t, nameA+"/aaaaaaa:travis:default", instance.ID())
+	assert.Nil(t, instance.Stop(gocontext.TODO()))
+
+	assert.Equal(t, 1, p.checkEndpoints(gocontext.TODO()))
+	assert.True(t, p.endpoints[1].quarantined)
+
+	daemonB.setDown(false)
+
+	assert.Equal(t, 2, p.checkEndpoints(gocontext.TODO()))
+	assert.False(t, p.endpoints[1].quarantined)
+
+	instance, err = p.Start(gocontext.TODO(), &StartAttributes{Language: "ruby"})
+	require.Nil(t, err)
+	assert.Equal(t, nameB+"/bbbbbbb:travis:default", instance.ID())
+
+	// with all endpoints quarantined, nothing starts
+	daemonA.setDown(true)
+	daemonB.setDown(true)
+	assert.Equal(t, 0, p.checkEndpoints(gocontext.TODO()))
+
+	_, err = p.Start(gocontext.TODO(), &StartAttributes{Language: "ruby"})
+	assert.EqualError(t, err, "no reachable Docker endpoints")
+}
+
+func TestNewDockerProvider_InvalidEndpoints(t *testing.T) {
+	for message, cfg := range map[string]map[string]string{
+		"ENDPOINTS can't be combined with ENDPOINT or HOST": {"ENDPOINTS": "tcp://a:2375", "ENDPOINT": "tcp://b:2375"},
+		"ENDPOINTS lists no endpoints":                      {"ENDPOINTS": " , "},
+		`ENDPOINTS lists "a:2375" more than once`:           {"ENDPOINTS": "tcp://a:2375,http://a:2375"},
+		`invalid ENDPOINT "ftp://a"`:                        {"ENDPOINTS": "tcp://a:2375,ftp://a"},
+		`invalid HEALTH_CHECK_INTERVAL "0s"`:                {"ENDPOINTS": "tcp://a:2375", "HEALTH_CHECK_INTERVAL": "0s"},
+	} {
+		_, err := newDockerProvider(config.ProviderConfigFromMap(cfg))
+		if assert.NotNil(t, err) {
+			assert.Contains(t, err.Error(), message)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package backend
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/travis-ci/worker/context"
+	"github.com/travis-ci/worker/metrics"
+	gocontext "golang.org/x/net/context"
+)
+
+const (
+	// dockerNativeStaleExitCode is what the upload command exits with when
+	// the container already has a build script.
+	dockerNativeStaleExitCode = 64
+
+	dockerNativeUser          = "travis"
+	dockerNativeKillWait      = 10 * time.Second
+	dockerNativeInspectSleep  = 100 * time.Millisecond
+	dockerNativeInspectChecks = 50
+)
+
+var (
+	dockerNativeUploadCmd = []string{
+		"/bin/sh", "-c",
+		fmt.Sprintf("if [ -e ~/build.sh ]; then exit %d; fi; cat > ~/build.sh", dockerNativeStaleExitCode),
+	}
+
+	dockerNativeRunCmd = []string{"/bin/bash", "-c", "cd ~ && bash ~/build.sh"}
+
+	// dockerSignalNames are the names of the signals commonly killing build
+	// scripts, as reported by the ssh path in RunResult.Signal.
+	dockerSignalNames = map[int]string{
+		1:  "HUP",
+		2:  "INT",
+		3:  "QUIT",
+		4:  "ILL",
+		6:  "ABRT",
+		8:  "FPE",
+		9:  "KILL",
+		11: "SEGV",
+		13: "PIPE",
+		14: "ALRM",
+		15: "TERM",
+	}
+)
+
+// uploadScriptNative writes the build script into the container by streaming
+// it to the stdin of an exec, as the vendored docker client has no support
+// for the archive API.
+func (i *dockerInstance) uploadScriptNative(ctx gocontext.Context, script []byte) error {
+	output := &bytes.Buffer{}
+
+	exitCode, err := i.exec(ctx, dockerNativeUploadCmd, false, bytes.NewReader(script), output)
+	if err != nil {
+		return err
+	}
+
+	switch exitCode {
+	case 0:
+		return nil
+	case dockerNativeStaleExitCode:
+		return ErrStaleVM
+	default:
+		return fmt.Errorf("couldn't upload script, exit code %d: %s", exitCode, strings.TrimSpace(output.String()))
+	}
+}
+
+// runScriptNative runs the build script through docker exec, in a TTY unless
+// NATIVE_TTY is false. Docker can't stop an exec, so the container is killed
+// when the context is done.
+func (i *dockerInstance) runScriptNative(ctx gocontext.Context, output io.Writer) (*RunResult, error) {
+	startRun := time.Now()
+
+	exitCode, err := i.exec(ctx, dockerNativeRunCmd, i.provider.runNativeTTY, nil, output)
+	if err != nil {
+		if err == ctx.Err() {
+			metrics.Mark("worker.vm.provider.docker.run.cancelled")
+			return &RunResult{Cancelled: true, Duration: time.Since(startRun)}, err
+		}
+		return &RunResult{Completed: false}, err
+	}
+
+	result := &RunResult{
+		Completed: true,
+		ExitCode:  uint8(exitCode),
+		Duration:  time.Since(startRun),
+	}
+
+	if exitCode > 128 {
+		metrics.Mark("worker.vm.provider.docker.run.signal")
+		result.Reason = RunReasonSignal
+		result.Signal = dockerSignalName(exitCode - 128)
+	}
+
+	return result, nil
+}
+
+// exec runs the command in the container as the travis user and returns its
+// exit code. If the context is done first, the container is killed and the
+// context's error returned once the exec's output stopped.
+//
+// With a TTY, the output is copied as is. Without one, docker multiplexes
+// stdout and stderr into frames with 8 byte headers, which the client
+// demultiplexes unless RawTerminal is set, writing the frames' contents to
+// output unchanged and in the order they arrive.
+func (i *dockerInstance) exec(ctx gocontext.Context, cmd []string, tty bool, input io.Reader, output io.Writer) (int, error) {
+	exec, err := i.client.CreateExec(docker.CreateExecOptions{
+		Container:    i.container.ID,
+		User:         dockerNativeUser,
+		Cmd:          cmd,
+		Tty:          tty,
+		AttachStdin:  input != nil,
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- i.client.StartExec(exec.ID, docker.StartExecOptions{
+			Tty:          tty,
+			RawTerminal:  tty,
+			InputStream:  input,
+			OutputStream: output,
+			ErrorStream:  output,
+		})
+	}()
+
+	select {
+	case err = <-errChan:
+	case <-ctx.Done():
+		i.kill(ctx)
+
+		select {
+		case <-errChan:
+		case <-time.After(dockerNativeKillWait):
+		}
+
+		return 0, ctx.Err()
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	// the exec may still be reported as running right after its output ends
+	for checks := 0; ; checks++ {
+		inspect, err := i.client.InspectExec(exec.ID)
+		if err != nil {
+			return 0, err
+		}
+
+		if !inspect.Running {
+			return inspect.ExitCode, nil
+		}
+
+		if checks >= dockerNativeInspectChecks {
+			return 0, fmt.Errorf("exec %s still running after its output ended", exec.ID)
+		}
+
+		time.Sleep(dockerNativeInspectSleep)
+	}
+}
+
+func (i *dockerInstance) kill(ctx gocontext.Context) {
+	err := i.client.KillContainer(docker.KillContainerOptions{
+		ID:     i.container.ID,
+		Signal: docker.SIGKILL,
+	})
+	if err != nil {
+		context.LoggerFromContext(ctx).WithField("err", err).Error("couldn't kill container")
+	}
+}
+
+// dockerSignalName returns the name of the signal with the given number, or
+// the number if it isn't known.
+func dockerSignalName(signal int) string {
+	if name, ok := dockerSignalNames[signal]; ok {
+		return name
+	}
+	return strconv.Itoa(signal)
+}
@@ -0,0 +1,260 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+	gocontext "golang.org/x/net/context"
+)
+
+var (
+	dockerTestExecPathRegexp = regexp.MustCompile(`^/exec/([^/]+)/(start|json)$`)
+
+	// dockerTestMultiplexedOutput is the output of an exec without a TTY,
+	// frames of stdout (1) and stderr (2) with their big-endian lengths.
+	dockerTestMultiplexedOutput = "" +
+		"\x01\x00\x00\x00\x00\x00\x00\x11Downloading  50%\r" +
+		"\x01\x00\x00\x00\x00\x00\x00\x12Downloading 100%\r\n" +
+		"\x02\x00\x00\x00\x00\x00\x00\x15warning: slow mirror\n" +
+		"\x01\x00\x00\x00\x00\x00\x00\x0f\x1b[32mdone\x1b[0m\r\n" +
+		"\x02\x00\x00\x00\x00\x00\x00\x04\x00\xff\x01\n"
+)
+
+// dockerTestExecServer runs execs of the native upload and run commands
+// against an in-memory build script. Runs write output and exit with
+// exitCode, or block until the container is killed if block is set.
+type dockerTestExecServer struct {
+	mutex     sync.Mutex
+	execs     map[string]docker.CreateExecOptions
+	exitCodes map[string]int
+	script    []byte
+	output    string
+	exitCode  int
+	block     bool
+	kills     int
+	killed    chan struct{}
+}
+
+func newDockerTestExecServer() *dockerTestExecServer {
+	return &dockerTestExecServer{
+		execs:     map[string]docker.CreateExecOptions{},
+		exitCodes: map[string]int{},
+		killed:    make(chan struct{}),
+	}
+}
+
+func (s *dockerTestExecServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if req.URL.Path == "/version" {
+		fmt.Fprint(w, `{"ApiVersion":"1.19"}`)
+		return
+	}
+
+	if req.URL.Path == "/containers/abcdef123456/exec" {
+		opts := docker.CreateExecOptions{}
+		_ = json.Unmarshal(body, &opts)
+
+		id := fmt.Sprintf("exec-%d", len(s.execs))
+		s.execs[id] = opts
+
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"Id":"%s"}`, id)
+		return
+	}
+
+	if req.URL.Path == "/containers/abcdef123456/kill" {
+		s.kills++
+		if s.kills == 1 {
+			close(s.killed)
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	match := dockerTestExecPathRegexp.FindStringSubmatch(req.URL.Path)
+	if match == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	id := match[1]
+	if match[2] == "json" {
+		fmt.Fprintf(w, `{"ID":"%s","Running":false,"ExitCode":%d}`, id, s.exitCodes[id])
+		return
+	}
+
+	conn, rw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	fmt.Fprint(rw, "HTTP/1.1 200 OK\r\nContent-Type: application/vnd.docker.raw-stream\r\n\r\n")
+	_ = rw.Flush()
+
+	if s.execs[id].AttachStdin {
+		script, _ := ioutil.ReadAll(rw)
+		if s.script != nil {
+			s.exitCodes[id] = dockerNativeStaleExitCode
+			return
+		}
+		s.script = script
+		return
+	}
+
+	fmt.Fprint(rw, s.output)
+	_ = rw.Flush()
+	s.exitCodes[id] = s.exitCode
+
+	if s.block {
+		s.mutex.Unlock()
+		<-s.killed
+		s.mutex.Lock()
+	}
+}
+
+func dockerTestNativeInstance(t *testing.T, s *dockerTestExecServer) (*dockerInstance, func()) {
+	server := httptest.NewServer(s)
+
+	p, err := dockerTestProvider(t, map[string]string{
+		"ENDPOINT": server.URL,
+		"NATIVE":   "true",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &dockerInstance{
+		client:    p.endpoints[0].client,
+		provider:  p,
+		endpoint:  p.endpoints[0],
+		container: &docker.Container{ID: "abcdef123456"},
+	}, server.Close
+}
+
+func TestNewDockerProvider_Native(t *testing.T) {
+	p, err := dockerTestProvider(t, nil)
+	if assert.Nil(t, err) {
+		assert.False(t, p.runNative)
+		assert.True(t, p.runNativeTTY)
+	}
+
+	p, err = dockerTestProvider(t, map[string]string{"NATIVE": "true", "NATIVE_TTY": "false"})
+	if assert.Nil(t, err) {
+		assert.True(t, p.runNative)
+		assert.False(t, p.runNativeTTY)
+	}
+
+	_, err = dockerTestProvider(t, map[string]string{"NATIVE": "sometimes"})
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), `invalid NATIVE "sometimes"`)
+	}
+
+	_, err = dockerTestProvider(t, map[string]string{"NATIVE_TTY": "sometimes"})
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), `invalid NATIVE_TTY "sometimes"`)
+	}
+}
+
+func TestDockerInstance_nativeUploadAndRun(t *testing.T) {
+	s := newDockerTestExecServer()
+	s.output = "Done. Your build exited with 0.\r\n"
+	inst, done := dockerTestNativeInstance(t, s)
+	defer done()
+
+	err := inst.UploadScript(gocontext.TODO(), []byte("#!/bin/bash\necho hai\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, "#!/bin/bash\necho hai\n", string(s.script))
+
+	err = inst.UploadScript(gocontext.TODO(), []byte("#!/bin/bash\necho hai\n"))
+	assert.Equal(t, ErrStaleVM, err)
+
+	output := &bytes.Buffer{}
+	result, err := inst.RunScript(gocontext.TODO(), output)
+	if assert.Nil(t, err) {
+		assert.True(t, result.Completed)
+		assert.Equal(t, uint8(0), result.ExitCode)
+		assert.Equal(t, "", result.Reason)
+	}
+	assert.Equal(t, s.output, output.String())
+
+	run := s.execs["exec-2"]
+	assert.Equal(t, dockerNativeRunCmd, run.Cmd)
+	assert.Equal(t, "travis", run.User)
+	assert.True(t, run.Tty)
+	assert.Equal(t, 0, s.kills)
+}
+
+func TestDockerInstance_nativeRunWithoutTTY(t *testing.T) {
+	s := newDockerTestExecServer()
+	s.output = dockerTestMultiplexedOutput
+	inst, done := dockerTestNativeInstance(t, s)
+	defer done()
+	inst.provider.runNativeTTY = false
+
+	output := &bytes.Buffer{}
+	result, err := inst.RunScript(gocontext.TODO(), output)
+	if assert.Nil(t, err) {
+		assert.True(t, result.Completed)
+	}
+	assert.Equal(t, "Downloading  50%\rDownloading 100%\r\nwarning: slow mirror\n\x1b[32mdone\x1b[0m\r\n\x00\xff\x01\n", output.String())
+
+	run := s.execs["exec-0"]
+	assert.False(t, run.Tty)
+	assert.True(t, run.AttachStdout)
+	assert.True(t, run.AttachStderr)
+}
+
+func TestDockerInstance_nativeRunSignal(t *testing.T) {
+	s := newDockerTestExecServer()
+	s.exitCode = 137
+	inst, done := dockerTestNativeInstance(t, s)
+	defer done()
+
+	result, err := inst.RunScript(gocontext.TODO(), &bytes.Buffer{})
+	if assert.Nil(t, err) {
+		assert.Equal(t, &RunResult{
+			Completed: true,
+			ExitCode:  137,
+			Duration:  result.Duration,
+			Reason:    RunReasonSignal,
+			Signal:    "KILL",
+		}, result)
+	}
+
+	assert.Equal(t, "TERM", dockerSignalName(15))
+	assert.Equal(t, "42", dockerSignalName(42))
+}
+
+func TestDockerInstance_nativeRunCancelled(t *testing.T) {
+	s := newDockerTestExecServer()
+	s.output = "still going\r\n"
+	s.block = true
+	inst, done := dockerTestNativeInstance(t, s)
+	defer done()
+
+	ctx, cancel := gocontext.WithCancel(gocontext.TODO())
+	time.AfterFunc(20*time.Millisecond, cancel)
+
+	output := &bytes.Buffer{}
+	result, err := inst.RunScript(ctx, output)
+	assert.Equal(t, gocontext.Canceled, err)
+	assert.True(t, result.Cancelled)
+	assert.False(t, result.Completed)
+	assert.Equal(t, s.output, output.String())
+	assert.Equal(t, 1, s.kills)
+}
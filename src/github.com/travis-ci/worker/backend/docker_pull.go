@@ -0,0 +1,213 @@
+package backend
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/travis-ci/worker/config"
+	"github.com/travis-ci/worker/context"
+	"github.com/travis-ci/worker/metrics"
+	gocontext "golang.org/x/net/context"
+)
+
+const (
+	defaultDockerPullPolicy  = "never"
+	defaultDockerPullTimeout = 10 * time.Minute
+	dockerHubRegistry        = "https://index.docker.io/v1/"
+)
+
+var (
+	dockerPullPolicies = map[string]bool{
+		"never":   true,
+		"missing": true,
+		"always":  true,
+	}
+)
+
+// dockerPuller pulls images for the docker provider. Concurrent pulls of the
+// same image share a single pull, so that many jobs starting at once for a
+// missing image don't each pull it.
+type dockerPuller struct {
+	client *docker.Client
+
+	policy  string
+	timeout time.Duration
+
+	// auth is used for every registry if set, otherwise auths is looked up
+	// by the image's registry.
+	auth  *docker.AuthConfiguration
+	auths *docker.AuthConfigurations
+
+	pullsMutex sync.Mutex
+	pulls      map[string]*dockerPull
+}
+
+type dockerPull struct {
+	done chan struct{}
+	err  error
+}
+
+func newDockerPuller(client *docker.Client, cfg *config.ProviderConfig) (*dockerPuller, error) {
+	policy := defaultDockerPullPolicy
+	if cfg.IsSet("PULL_POLICY") {
+		policy = cfg.Get("PULL_POLICY")
+		if !dockerPullPolicies[policy] {
+			return nil, fmt.Errorf("invalid PULL_POLICY %q", policy)
+		}
+	}
+
+	timeout := defaultDockerPullTimeout
+	if cfg.IsSet("PULL_TIMEOUT") {
+		pt, err := time.ParseDuration(cfg.Get("PULL_TIMEOUT"))
+		if err != nil {
+			return nil, err
+		}
+		timeout = pt
+	}
+
+	puller := &dockerPuller{
+		client:  client,
+		policy:  policy,
+		timeout: timeout,
+		pulls:   map[string]*dockerPull{},
+	}
+
+	if cfg.IsSet("REGISTRY_USERNAME") || cfg.IsSet("REGISTRY_PASSWORD") {
+		if cfg.IsSet("DOCKERCFG_PATH") {
+			return nil, fmt.Errorf("REGISTRY_USERNAME and REGISTRY_PASSWORD can't be combined with DOCKERCFG_PATH")
+		}
+
+		puller.auth = &docker.AuthConfiguration{
+			Username: cfg.Get("REGISTRY_USERNAME"),
+			Password: cfg.Get("REGISTRY_PASSWORD"),
+		}
+	}
+
+	if cfg.IsSet("DOCKERCFG_PATH") {
+		f, err := os.Open(cfg.Get("DOCKERCFG_PATH"))
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		puller.auths, err = docker.NewAuthConfigurations(f)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse DOCKERCFG_PATH: %v", err)
+		}
+	}
+
+	return puller, nil
+}
+
+// authFor returns the credentials for the registry the image is pulled from.
+func (dp *dockerPuller) authFor(repository string) docker.AuthConfiguration {
+	if dp.auth != nil {
+		return *dp.auth
+	}
+
+	if dp.auths == nil {
+		return docker.AuthConfiguration{}
+	}
+
+	registry := dockerHubRegistry
+	if parts := strings.SplitN(repository, "/", 2); len(parts) == 2 && strings.ContainsAny(parts[0], ".:") {
+		registry = parts[0]
+	}
+
+	for key, auth := range dp.auths.Configs {
+		if key == registry || strings.TrimPrefix(strings.TrimPrefix(key, "https://"), "http://") == registry {
+			return auth
+		}
+	}
+
+	return docker.AuthConfiguration{}
+}
+
+// pull pulls the given image, waiting for a pull of the same image that's
+// already in progress instead of starting another one. Docker can't cancel
+// pulls, so one that takes longer than the timeout or the context allow is
+// left to finish in the background.
+func (dp *dockerPuller) pull(ctx gocontext.Context, imageName string) error {
+	dp.pullsMutex.Lock()
+	pull, ok := dp.pulls[imageName]
+	if !ok {
+		pull = &dockerPull{done: make(chan struct{})}
+		dp.pulls[imageName] = pull
+		go dp.doPull(ctx, imageName, pull)
+	}
+	dp.pullsMutex.Unlock()
+
+	select {
+	case <-pull.done:
+		return pull.err
+	case <-time.After(dp.timeout):
+		metrics.Mark("worker.vm.provider.docker.image.pull.timeout")
+		return fmt.Errorf("timed out after %v pulling image %s", dp.timeout, imageName)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (dp *dockerPuller) doPull(ctx gocontext.Context, imageName string, pull *dockerPull) {
+	logger := context.LoggerFromContext(ctx).WithField("image", imageName)
+
+	defer func() {
+		dp.pullsMutex.Lock()
+		delete(dp.pulls, imageName)
+		dp.pullsMutex.Unlock()
+		close(pull.done)
+	}()
+
+	repository, tag := imageName, ""
+	if idx := strings.LastIndex(imageName, ":"); idx > strings.LastIndex(imageName, "/") {
+		repository, tag = imageName[:idx], imageName[idx+1:]
+	}
+
+	logger.Info("pulling image")
+	startPull := time.Now()
+
+	pull.err = dp.client.PullImage(docker.PullImageOptions{
+		Repository:    repository,
+		Tag:           tag,
+		OutputStream:  &dockerPullLogWriter{logger: logger},
+		RawJSONStream: true,
+	}, dp.authFor(repository))
+	if pull.err != nil {
+		metrics.Mark("worker.vm.provider.docker.image.pull.error")
+		logger.WithField("err", pull.err).Error("couldn't pull image")
+		return
+	}
+
+	metrics.TimeSince("worker.vm.provider.docker.image.pull", startPull)
+	logger.WithField("duration", time.Since(startPull)).Info("pulled image")
+}
+
+// dockerPullLogWriter logs each line of pull progress at debug level.
+type dockerPullLogWriter struct {
+	logger *logrus.Entry
+	buf    bytes.Buffer
+}
+
+func (w *dockerPullLogWriter) Write(p []byte) (int, error) {
+	w.buf.Write(p)
+
+	for {
+		line, err := w.buf.ReadString('\n')
+		if err != nil {
+			w.buf.WriteString(line)
+			break
+		}
+
+		if line = strings.TrimSpace(line); line != "" {
+			w.logger.WithField("progress", line).Debug("pulling image")
+		}
+	}
+
+	return len(p), nil
+}
@@ -0,0 +1,212 @@
+package backend
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	gocontext "golang.org/x/net/context"
+)
+
+// dockerTestPullServer serves image listing and pulling. Pulls block until
+// release is closed, and pulled images are listed afterwards.
+type dockerTestPullServer struct {
+	mutex   sync.Mutex
+	pulls   []string
+	images  []string
+	release chan struct{}
+}
+
+func (s *dockerTestPullServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.URL.Path {
+	case "/version":
+		fmt.Fprint(w, `{"ApiVersion":"1.19"}`)
+	case "/images/json":
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+
+		fmt.Fprint(w, "[")
+		for idx, image := range s.images {
+			if idx > 0 {
+				fmt.Fprint(w, ",")
+			}
+			fmt.Fprintf(w, `{"Id":"%s-id","RepoTags":["%s"]}`, image, image)
+		}
+		fmt.Fprint(w, "]")
+	case "/images/create":
+		image := req.URL.Query().Get("fromImage") + ":" + req.URL.Query().Get("tag")
+
+		s.mutex.Lock()
+		s.pulls = append(s.pulls, image)
+		s.mutex.Unlock()
+
+		<-s.release
+
+		if image == "travis:missing" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		s.mutex.Lock()
+		s.images = append(s.images, image)
+		s.mutex.Unlock()
+
+		fmt.Fprint(w, `{"status":"Downloading"}`+"\n"+`{"status":"Download complete"}`+"\n")
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestNewDockerPuller(t *testing.T) {
+	p, err := dockerTestProvider(t, nil)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "never", p.endpoints[0].puller.policy)
+		assert.Equal(t, defaultDockerPullTimeout, p.endpoints[0].puller.timeout)
+	}
+
+	_, err = dockerTestProvider(t, map[string]string{"PULL_POLICY": "sometimes"})
+	if assert.NotNil(t, err) {
+		assert.Equal(t, `invalid PULL_POLICY "sometimes"`, err.Error())
+	}
+
+	_, err = dockerTestProvider(t, map[string]string{
+		"REGISTRY_USERNAME": "travis",
+		"DOCKERCFG_PATH":    "/etc/dockercfg",
+	})
+	assert.NotNil(t, err)
+
+	p, err = dockerTestProvider(t, map[string]string{
+		"REGISTRY_USERNAME": "travis",
+		"REGISTRY_PASSWORD": "secret",
+	})
+	if assert.Nil(t, err) {
+		auth := p.endpoints[0].puller.authFor("quay.io/travisci/travis")
+		assert.Equal(t, "travis", auth.Username)
+		assert.Equal(t, "secret", auth.Password)
+	}
+}
+
+func TestDockerPuller_authForDockercfg(t *testing.T) {
+	f, err := ioutil.TempFile("", "travis-worker-dockercfg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	fmt.Fprintf(f, `{"auths":{"https://index.docker.io/v1/":{"auth":"%s"},"quay.io":{"auth":"%s"}}}`,
+		base64.StdEncoding.EncodeToString([]byte("hub:hub-secret")),
+		base64.StdEncoding.EncodeToString([]byte("quay:quay-secret")))
+	f.Close()
+
+	p, err := dockerTestProvider(t, map[string]string{"DOCKERCFG_PATH": f.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "hub", p.endpoints[0].puller.authFor("travis").Username)
+	assert.Equal(t, "quay", p.endpoints[0].puller.authFor("quay.io/travisci/travis").Username)
+	assert.Equal(t, "", p.endpoints[0].puller.authFor("localhost:5000/travis").Username)
+}
+
+func TestDockerPuller_pullSharesConcurrentPulls(t *testing.T) {
+	s := &dockerTestPullServer{release: make(chan struct{})}
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	p, err := dockerTestProvider(t, map[string]string{"ENDPOINT": server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- p.endpoints[0].puller.pull(gocontext.TODO(), "travis:ruby")
+		}()
+	}
+
+	for {
+		s.mutex.Lock()
+		pulls := len(s.pulls)
+		s.mutex.Unlock()
+		if pulls > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(s.release)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, []string{"travis:ruby"}, s.pulls)
+	assert.Len(t, p.endpoints[0].puller.pulls, 0)
+}
+
+func TestDockerPuller_pullTimeout(t *testing.T) {
+	s := &dockerTestPullServer{release: make(chan struct{})}
+	server := httptest.NewServer(s)
+	defer server.Close()
+	defer close(s.release)
+
+	p, err := dockerTestProvider(t, map[string]string{
+		"ENDPOINT":     server.URL,
+		"PULL_TIMEOUT": "10ms",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = p.endpoints[0].puller.pull(gocontext.TODO(), "travis:ruby")
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "timed out after 10ms")
+	}
+}
+
+func TestDockerProvider_resolveImagePullPolicy(t *testing.T) {
+	s := &dockerTestPullServer{release: make(chan struct{}), images: []string{"travis:default"}}
+	close(s.release)
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	p, err := dockerTestProvider(t, map[string]string{"ENDPOINT": server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, imageName, err := p.resolveImage(gocontext.TODO(), p.endpoints[0], &StartAttributes{Language: "ruby"})
+	assert.Nil(t, err)
+	assert.Equal(t, "travis:default", imageName)
+	assert.Len(t, s.pulls, 0)
+
+	p.endpoints[0].puller.policy = "missing"
+	_, imageName, err = p.resolveImage(gocontext.TODO(), p.endpoints[0], &StartAttributes{Language: "ruby"})
+	assert.Nil(t, err)
+	assert.Equal(t, "travis:default", imageName)
+	assert.Len(t, s.pulls, 0)
+
+	s.images = nil
+	_, imageName, err = p.resolveImage(gocontext.TODO(), p.endpoints[0], &StartAttributes{Language: "ruby"})
+	assert.Nil(t, err)
+	assert.Equal(t, "travis:ruby", imageName)
+	assert.Equal(t, []string{"travis:ruby"}, s.pulls)
+
+	p.endpoints[0].puller.policy = "always"
+	_, imageName, err = p.resolveImage(gocontext.TODO(), p.endpoints[0], &StartAttributes{Language: "missing"})
+	assert.Nil(t, err)
+	assert.Equal(t, "travis:default", imageName)
+	assert.Equal(t, []string{"travis:ruby", "travis:missing", "travis:default"}, s.pulls)
+}
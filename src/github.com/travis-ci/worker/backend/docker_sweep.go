@@ -0,0 +1,160 @@
+package backend
+
+import (
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/travis-ci/worker/context"
+	"github.com/travis-ci/worker/metrics"
+	gocontext "golang.org/x/net/context"
+)
+
+const (
+	dockerContainerNamePrefix = "travis-job-"
+	dockerWorkerLabel         = "travis.worker"
+	dockerJobIDLabel          = "travis.job_id"
+
+	defaultDockerHardTimeout = time.Hour
+)
+
+// Sweep removes containers created by a worker that have exited, or that are
+// older than the given duration, returning the number of containers removed.
+// Containers that were created but not started yet only count as leaked once
+// they're that old, since a start may be in progress.
+// Only containers with both the worker label and the container name prefix
+// are considered, and those of this worker's running jobs are left alone.
+// With SWEEP_DRY_RUN, containers that would be removed are only logged.
+// Quarantined endpoints are skipped, and the first error of sweeping any
+// other endpoint is returned.
+func (p *dockerProvider) Sweep(ctx gocontext.Context, olderThan time.Duration) (int, error) {
+	var sweepErr error
+	removed := 0
+
+	for _, e := range p.endpoints {
+		if p.endpointQuarantined(e) {
+			continue
+		}
+
+		endpointRemoved, err := p.sweepEndpoint(ctx, e, olderThan)
+		removed += endpointRemoved
+		if err != nil && sweepErr == nil {
+			sweepErr = err
+		}
+	}
+
+	return removed, sweepErr
+}
+
+func (p *dockerProvider) sweepEndpoint(ctx gocontext.Context, e *dockerEndpoint, olderThan time.Duration) (int, error) {
+	logger := context.LoggerFromContext(ctx)
+	if p.pooled {
+		logger = logger.WithField("endpoint", e.name)
+	}
+
+	containers, err := e.client.ListContainers(docker.ListContainersOptions{
+		All:     true,
+		Filters: map[string][]string{"label": {dockerWorkerLabel + "=true"}},
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, container := range containers {
+		name, ok := dockerContainerName(container)
+		if !ok || p.isActiveContainer(container.ID) {
+			continue
+		}
+
+		created := time.Unix(container.Created, 0)
+		exited := dockerContainerExited(container.Status)
+		if !exited && time.Since(created) < olderThan {
+			continue
+		}
+
+		containerLogger := logger.WithFields(logrus.Fields{
+			"container": name,
+			"status":    container.Status,
+			"created":   created,
+		})
+
+		if p.sweepDryRun {
+			containerLogger.Info("dry run, not removing leaked container")
+			continue
+		}
+
+		err := e.client.RemoveContainer(docker.RemoveContainerOptions{
+			ID:            container.ID,
+			RemoveVolumes: true,
+			Force:         true,
+		})
+		if err != nil {
+			containerLogger.WithField("err", err).Error("couldn't remove leaked container")
+			continue
+		}
+
+		containerLogger.Info("removed leaked container")
+		metrics.Mark("worker.vm.provider.docker.sweep.removed")
+		removed++
+	}
+
+	return removed, nil
+}
+
+// sweepPeriodically sweeps leaked containers every SWEEP_INTERVAL.
+func (p *dockerProvider) sweepPeriodically() {
+	ctx := gocontext.TODO()
+	logger := context.LoggerFromContext(ctx)
+
+	for range time.Tick(p.sweepInterval) {
+		_, err := p.Sweep(ctx, p.hardTimeout)
+		if err != nil {
+			logger.WithField("err", err).Error("couldn't sweep leaked containers")
+		}
+	}
+}
+
+func (p *dockerProvider) isActiveContainer(id string) bool {
+	p.containersMutex.Lock()
+	defer p.containersMutex.Unlock()
+
+	return p.containers[id]
+}
+
+func (p *dockerProvider) setActiveContainer(id string, active bool) {
+	p.containersMutex.Lock()
+	defer p.containersMutex.Unlock()
+
+	if active {
+		p.containers[id] = true
+	} else {
+		delete(p.containers, id)
+	}
+}
+
+// dockerContainerName returns the name of a container created by a worker,
+// or false if the container has no name with the container name prefix.
+func dockerContainerName(container docker.APIContainers) (string, bool) {
+	for _, name := range container.Names {
+		name = strings.TrimPrefix(name, "/")
+		if strings.HasPrefix(name, dockerContainerNamePrefix) {
+			return name, true
+		}
+	}
+
+	return "", false
+}
+
+// dockerContainerExited tells by the status a container is listed with, e.g.
+// "Up 2 hours" or "Exited (0) 5 minutes ago", whether it's done running.
+func dockerContainerExited(status string) bool {
+	for _, prefix := range []string{"Exited", "Dead"} {
+		if strings.HasPrefix(status, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
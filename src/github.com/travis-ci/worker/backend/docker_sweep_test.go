@@ -0,0 +1,192 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+	gocontext "golang.org/x/net/context"
+)
+
+// dockerTestSweepServer lists containers, records removals and creates
+// containers that are running as soon as they're started.
+type dockerTestSweepServer struct {
+	mutex      sync.Mutex
+	containers []docker.APIContainers
+	filters    string
+	removed    []string
+	created    string
+	failStart  bool
+	config     docker.Config
+	hostConfig docker.HostConfig
+}
+
+func (s *dockerTestSweepServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	switch {
+	case req.URL.Path == "/version":
+		fmt.Fprint(w, `{"ApiVersion":"1.19"}`)
+	case req.URL.Path == "/_ping":
+		fmt.Fprint(w, "OK")
+	case req.URL.Path == "/containers/json":
+		s.filters = req.URL.Query().Get("filters")
+		_ = json.NewEncoder(w).Encode(s.containers)
+	case req.URL.Path == "/images/json":
+		fmt.Fprint(w, `[{"Id":"image-id","RepoTags":["travis:default"]}]`)
+	case req.URL.Path == "/containers/create":
+		s.created = req.URL.Query().Get("name")
+		body, _ := ioutil.ReadAll(req.Body)
+		s.config = docker.Config{}
+		s.hostConfig = docker.HostConfig{}
+		_ = json.Unmarshal(body, &s.config)
+		_ = json.Unmarshal(body, &struct {
+			HostConfig *docker.HostConfig
+		}{&s.hostConfig})
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"Id":"container-new"}`)
+	case req.URL.Path == "/containers/container-new/start" && s.failStart:
+		w.WriteHeader(http.StatusInternalServerError)
+	case req.URL.Path == "/containers/container-new/json":
+		fmt.Fprint(w, `{"Id":"container-new","State":{"Running":true}}`)
+	case req.Method == "POST":
+		w.WriteHeader(http.StatusNoContent)
+	case req.Method == "DELETE":
+		s.removed = append(s.removed, strings.TrimPrefix(req.URL.Path, "/containers/"))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func dockerTestSweepContainers() []docker.APIContainers {
+	now := time.Now()
+
+	return []docker.APIContainers{
+		{ID: "exited", Names: []string{"/travis-job-1-a"}, Status: "Exited (0) 5 minutes ago", Created: now.Add(-10 * time.Minute).Unix()},
+		{ID: "created", Names: []string{"/travis-job-2-b"}, Status: "Created", Created: now.Add(-time.Minute).Unix()},
+		{ID: "created-old", Names: []string{"/travis-job-2-e"}, Status: "Created", Created: now.Add(-2 * time.Hour).Unix()},
+		{ID: "active", Names: []string{"/travis-job-5-f"}, Status: "Exited (0) 1 minute ago", Created: now.Add(-2 * time.Hour).Unix()},
+		{ID: "running", Names: []string{"/travis-job-3-c"}, Status: "Up 10 minutes", Created: now.Add(-10 * time.Minute).Unix()},
+		{ID: "old", Names: []string{"/travis-job-4-d"}, Status: "Up 2 hours", Created: now.Add(-2 * time.Hour).Unix()},
+		{ID: "unnamed", Names: []string{"/redis"}, Status: "Exited (1) 2 hours ago", Created: now.Add(-3 * time.Hour).Unix()},
+	}
+}
+
+func TestDockerProvider_Sweep(t *testing.T) {
+	s := &dockerTestSweepServer{containers: dockerTestSweepContainers()}
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	p, err := dockerTestProvider(t, map[string]string{"ENDPOINT": server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.setActiveContainer("active", true)
+
+	removed, err := p.Sweep(gocontext.TODO(), time.Hour)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, removed)
+
+	sort.Strings(s.removed)
+	assert.Equal(t, []string{"created-old", "exited", "old"}, s.removed)
+	assert.Equal(t, `{"label":["travis.worker=true"]}`, s.filters)
+}
+
+func TestDockerProvider_SweepDryRun(t *testing.T) {
+	s := &dockerTestSweepServer{containers: dockerTestSweepContainers()}
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	p, err := dockerTestProvider(t, map[string]string{
+		"ENDPOINT":      server.URL,
+		"SWEEP_DRY_RUN": "true",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Nil(t, p.Setup())
+	assert.Len(t, s.removed, 0)
+}
+
+func TestDockerProvider_StartContainerConfig(t *testing.T) {
+	s := &dockerTestSweepServer{}
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	p, err := dockerTestProvider(t, map[string]string{
+		"ENDPOINT": server.URL,
+		"VOLUMES":  "/srv/cache:/home/travis/.cache",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inst, err := p.Start(gocontext.TODO(), &StartAttributes{Language: "ruby", JobID: 42})
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	assert.True(t, strings.HasPrefix(s.created, "travis-job-42-"), s.created)
+	assert.Equal(t, map[string]string{"travis.worker": "true", "travis.job_id": "42"}, s.config.Labels)
+	assert.Equal(t, []string{"/srv/cache:/home/travis/.cache"}, s.hostConfig.Binds)
+	assert.True(t, p.isActiveContainer("container-new"))
+
+	assert.Nil(t, inst.Stop(gocontext.TODO()))
+	assert.False(t, p.isActiveContainer("container-new"))
+	assert.Equal(t, []string{"container-new"}, s.removed)
+
+	inst, err = p.Start(gocontext.TODO(), &StartAttributes{Language: "ruby", VMConfig: VMConfig{SkipVolumes: true}})
+	if assert.Nil(t, err) {
+		assert.Len(t, s.hostConfig.Binds, 0)
+		assert.Nil(t, inst.Stop(gocontext.TODO()))
+	}
+}
+
+func TestDockerProvider_StartFailureUnmarksContainer(t *testing.T) {
+	s := &dockerTestSweepServer{failStart: true}
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	p, err := dockerTestProvider(t, map[string]string{"ENDPOINT": server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = p.Start(gocontext.TODO(), &StartAttributes{Language: "ruby"})
+	assert.NotNil(t, err)
+	assert.False(t, p.isActiveContainer("container-new"))
+	assert.Equal(t, []string{"container-new"}, s.removed)
+}
+
+func TestNewDockerProvider_Sweep(t *testing.T) {
+	p, err := dockerTestProvider(t, nil)
+	if assert.Nil(t, err) {
+		assert.Equal(t, defaultDockerHardTimeout, p.hardTimeout)
+		assert.Equal(t, time.Duration(0), p.sweepInterval)
+		assert.False(t, p.sweepDryRun)
+	}
+
+	for key, value := range map[string]string{
+		"HARD_TIMEOUT":   "forever",
+		"SWEEP_INTERVAL": "often",
+		"SWEEP_DRY_RUN":  "maybe",
+	} {
+		_, err := dockerTestProvider(t, map[string]string{key: value})
+		if assert.NotNil(t, err) {
+			assert.Contains(t, err.Error(), fmt.Sprintf("invalid %s %q", key, value))
+		}
+	}
+}
@@ -0,0 +1,559 @@
+package backend
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/travis-ci/worker/config"
+	"github.com/travis-ci/worker/image"
+	gocontext "golang.org/x/net/context"
+)
+
+func dockerTestProvider(t *testing.T, cfg map[string]string) (*dockerProvider, error) {
+	providerCfg := config.ProviderConfigFromMap(map[string]string{
+		"ENDPOINT": "tcp://127.0.0.1:4243",
+	})
+	for key, value := range cfg {
+		providerCfg.Set(key, value)
+	}
+
+	p, err := newDockerProvider(providerCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.(*dockerProvider), nil
+}
+
+func TestNewDockerProvider_Limits(t *testing.T) {
+	p, err := dockerTestProvider(t, map[string]string{
+		"CPUS":         "3",
+		"MEMORY":       "2G",
+		"CPU_SET_SIZE": "8",
+	})
+	if assert.Nil(t, err) {
+		assert.Equal(t, 3, p.runCPUs)
+		assert.Len(t, p.endpoints[0].cpuSets, 8)
+
+		hostConfig := p.hostConfig("0,1,2")
+		assert.Equal(t, "0,1,2", hostConfig.CPUSet)
+		assert.Equal(t, int64(2000000000), hostConfig.Memory)
+		assert.Equal(t, hostConfig.Memory, hostConfig.MemorySwap)
+	}
+
+	for message, cfg := range map[string]map[string]string{
+		`invalid CPUS "two"`:                   {"CPUS": "two"},
+		`invalid MEMORY "lots"`:                {"MEMORY": "lots"},
+		`invalid CPU_SET_SIZE "0"`:             {"CPU_SET_SIZE": "0"},
+		"CPUS 4 is larger than CPU_SET_SIZE 2": {"CPUS": "4", "CPU_SET_SIZE": "2"},
+	} {
+		_, err := dockerTestProvider(t, cfg)
+		if assert.NotNil(t, err) {
+			assert.Contains(t, err.Error(), message)
+		}
+	}
+}
+
+func TestDockerProvider_CPUSets(t *testing.T) {
+	p, err := dockerTestProvider(t, map[string]string{"CPUS": "2", "CPU_SET_SIZE": "5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := p.endpoints[0]
+
+	first, err := p.checkoutCPUSets(e)
+	assert.Nil(t, err)
+	assert.Equal(t, "0,1", first)
+
+	second, err := p.checkoutCPUSets(e)
+	assert.Nil(t, err)
+	assert.Equal(t, "2,3", second)
+
+	_, err = p.checkoutCPUSets(e)
+	assert.NotNil(t, err)
+
+	p.checkinCPUSets(e, first)
+
+	third, err := p.checkoutCPUSets(e)
+	assert.Nil(t, err)
+	assert.Equal(t, "0,1", third)
+
+	p, err = dockerTestProvider(t, map[string]string{"CPUS": "0"})
+	if assert.Nil(t, err) {
+		cpuSets, err := p.checkoutCPUSets(p.endpoints[0])
+		assert.Nil(t, err)
+		assert.Equal(t, "", cpuSets)
+	}
+}
+
+func TestDockerProvider_StartFailureReturnsCPUSets(t *testing.T) {
+	removed := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch {
+		case req.Method == "GET" && req.URL.Path == "/images/json":
+			fmt.Fprint(w, `[{"Id":"image-id","RepoTags":["travis:default"]}]`)
+		case req.Method == "POST" && req.URL.Path == "/containers/create":
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprint(w, `{"Id":"container-id"}`)
+		case req.Method == "DELETE":
+			removed = append(removed, req.URL.Path)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	p, err := dockerTestProvider(t, map[string]string{
+		"ENDPOINT":     server.URL,
+		"CPUS":         "2",
+		"CPU_SET_SIZE": "2",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = p.Start(gocontext.TODO(), &StartAttributes{Language: "ruby"})
+	assert.NotNil(t, err)
+	assert.Equal(t, []string{"/containers/container-id"}, removed)
+	assert.Equal(t, []bool{false, false}, p.endpoints[0].cpuSets)
+	assert.Equal(t, 0, p.endpoints[0].active)
+}
+
+type dockerTestFailingImageSelector struct{}
+
+func (s *dockerTestFailingImageSelector) Select(*image.Params) (string, error) {
+	return "", fmt.Errorf("image selector unavailable")
+}
+
+func TestDockerProvider_resolveImageSelector(t *testing.T) {
+	s := &dockerTestPullServer{
+		release: make(chan struct{}),
+		images:  []string{"travis:default", "travisci/ci-garnet:packer-1", "travisci/ci-amethyst:latest"},
+	}
+	close(s.release)
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	p, err := dockerTestProvider(t, map[string]string{
+		"ENDPOINT":            server.URL,
+		"IMAGE_SELECTOR_TYPE": "env",
+		"IMAGE_DIST_TRUSTY":   "travisci/ci-garnet:packer-1",
+		"IMAGE_DIST_XENIAL":   "travisci/ci-amethyst",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for dist, expected := range map[string]string{
+		"trusty":  "travisci/ci-garnet:packer-1",
+		"xenial":  "travisci/ci-amethyst:latest",
+		"precise": "travis:default",
+	} {
+		_, imageName, err := p.resolveImage(gocontext.TODO(), p.endpoints[0], &StartAttributes{Language: "ruby", Dist: dist})
+		assert.Nil(t, err, dist)
+		assert.Equal(t, expected, imageName, dist)
+	}
+
+	p, err = dockerTestProvider(t, map[string]string{
+		"ENDPOINT":            server.URL,
+		"IMAGE_SELECTOR_TYPE": "api",
+		"IMAGE_SELECTOR_URL":  "http://images.example.com",
+		"IMAGE_DEFAULT":       "travisci/ci-amethyst",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.imageSelector = &dockerTestFailingImageSelector{}
+
+	_, imageName, err := p.resolveImage(gocontext.TODO(), p.endpoints[0], &StartAttributes{Language: "ruby"})
+	assert.Nil(t, err)
+	assert.Equal(t, "travisci/ci-amethyst:latest", imageName)
+
+	_, err = dockerTestProvider(t, map[string]string{"IMAGE_SELECTOR_TYPE": "magic"})
+	if assert.NotNil(t, err) {
+		assert.Equal(t, `invalid image selector type "magic"`, err.Error())
+	}
+}
+
+func TestDockerImageReference(t *testing.T) {
+	assert.Equal(t, "travis:ruby", dockerImageReference("travis:ruby"))
+	assert.Equal(t, "travisci/ci-garnet:latest", dockerImageReference("travisci/ci-garnet"))
+	assert.Equal(t, "localhost:5000/travis:latest", dockerImageReference("localhost:5000/travis"))
+}
+
+func TestNewDockerProvider_Endpoint(t *testing.T) {
+	for _, endpoint := range []string{
+		"tcp://127.0.0.1:2375",
+		"http://docker.example.com:2375",
+		"unix:///var/run/docker.sock",
+	} {
+		_, err := dockerTestProvider(t, map[string]string{"ENDPOINT": endpoint})
+		assert.Nil(t, err, endpoint)
+	}
+
+	for endpoint, message := range map[string]string{
+		"ftp://127.0.0.1:2375": "scheme must be tcp, http, https or unix",
+		"docker.example.com":   "scheme must be tcp, http, https or unix",
+		"tcp://":               "missing host",
+		"unix://":              "missing socket path",
+	} {
+		_, err := dockerTestProvider(t, map[string]string{"ENDPOINT": endpoint})
+		if assert.NotNil(t, err, endpoint) {
+			assert.Equal(t, fmt.Sprintf("invalid ENDPOINT %q: %s", endpoint, message), err.Error())
+		}
+	}
+
+	_, err := dockerTestProvider(t, map[string]string{"TLS_VERIFY": "true"})
+	if assert.NotNil(t, err) {
+		assert.Equal(t, "TLS_VERIFY requires CERT_PATH", err.Error())
+	}
+}
+
+// dockerTestCertPath writes a client certificate and key and the given CA to
+// a temporary directory for use as CERT_PATH.
+func dockerTestCertPath(t *testing.T, ca []byte) string {
+	dir, err := ioutil.TempDir("", "travis-worker-docker-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "travis-worker"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, data := range map[string][]byte{
+		"cert.pem": pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}),
+		"key.pem":  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+		"ca.pem":   ca,
+	} {
+		err = ioutil.WriteFile(filepath.Join(dir, name), data, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return dir
+}
+
+func dockerTestPingHandler(w http.ResponseWriter, req *http.Request) {
+	switch req.URL.Path {
+	case "/version":
+		fmt.Fprint(w, `{"ApiVersion":"1.19"}`)
+	case "/_ping":
+		fmt.Fprint(w, "OK")
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestDockerProvider_SetupTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(dockerTestPingHandler))
+	defer server.Close()
+
+	serverCA := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.TLS.Certificates[0].Certificate[0]})
+	certPath := dockerTestCertPath(t, serverCA)
+	defer os.RemoveAll(certPath)
+
+	p, err := dockerTestProvider(t, map[string]string{
+		"ENDPOINT":  server.URL,
+		"CERT_PATH": certPath,
+	})
+	if assert.Nil(t, err) {
+		assert.Nil(t, p.Setup())
+	}
+
+	otherCertPath := dockerTestCertPath(t, nil)
+	defer os.RemoveAll(otherCertPath)
+	otherCA, err := ioutil.ReadFile(filepath.Join(otherCertPath, "cert.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(otherCertPath, "ca.pem"), otherCA, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err = dockerTestProvider(t, map[string]string{
+		"ENDPOINT":  server.URL,
+		"CERT_PATH": otherCertPath,
+	})
+	if assert.Nil(t, err) {
+		err = p.Setup()
+		if assert.NotNil(t, err) {
+			assert.Contains(t, err.Error(), "TLS verification of Docker's certificate failed")
+		}
+	}
+
+	p, err = dockerTestProvider(t, map[string]string{
+		"ENDPOINT":   server.URL,
+		"CERT_PATH":  otherCertPath,
+		"TLS_VERIFY": "false",
+	})
+	if assert.Nil(t, err) {
+		assert.Nil(t, p.Setup())
+	}
+
+	plainServer := httptest.NewServer(http.HandlerFunc(dockerTestPingHandler))
+	defer plainServer.Close()
+
+	p, err = dockerTestProvider(t, map[string]string{
+		"ENDPOINT":  plainServer.URL,
+		"CERT_PATH": certPath,
+	})
+	if assert.Nil(t, err) {
+		err = p.Setup()
+		if assert.NotNil(t, err) {
+			assert.Contains(t, err.Error(), "TLS negotiation with Docker failed")
+		}
+	}
+}
+
+func TestParseDockerVolumes(t *testing.T) {
+	binds, err := parseDockerVolumes("/var/cache/ccache:/home/travis/.ccache, /srv/bundler:/home/travis/.bundle:ro,", false)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"/var/cache/ccache:/home/travis/.ccache", "/srv/bundler:/home/travis/.bundle:ro"}, binds)
+
+	for spec, message := range map[string]string{
+		"/srv/cache":                "must be host:container[:ro]",
+		"/a:/b:ro:z":                "must be host:container[:ro]",
+		"cache:/home/travis/.cache": "paths must be absolute",
+		"/srv/cache:/cache:rx":      "mode must be ro or rw",
+		"/var/run/docker.sock:/var/run/docker.sock": "requires ALLOW_DANGEROUS_MOUNTS",
+		"/var/run:/host/run":                        "requires ALLOW_DANGEROUS_MOUNTS",
+		"/:/host":                                   "requires ALLOW_DANGEROUS_MOUNTS",
+		"/etc/ssl:/etc/ssl:ro":                      "requires ALLOW_DANGEROUS_MOUNTS",
+	} {
+		_, err := parseDockerVolumes(spec, false)
+		if assert.NotNil(t, err, spec) {
+			assert.Contains(t, err.Error(), message, spec)
+		}
+	}
+
+	binds, err = parseDockerVolumes("/var/run/docker.sock:/var/run/docker.sock", true)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"/var/run/docker.sock:/var/run/docker.sock"}, binds)
+}
+
+func TestNewDockerProvider_Volumes(t *testing.T) {
+	p, err := dockerTestProvider(t, map[string]string{"VOLUMES": "/srv/cache:/home/travis/.cache"})
+	if assert.Nil(t, err) {
+		assert.Equal(t, []string{"/srv/cache:/home/travis/.cache"}, p.runBinds)
+	}
+
+	_, err = dockerTestProvider(t, map[string]string{"VOLUMES": "/var/run/docker.sock:/var/run/docker.sock"})
+	assert.NotNil(t, err)
+
+	_, err = dockerTestProvider(t, map[string]string{
+		"VOLUMES":                "/var/run/docker.sock:/var/run/docker.sock",
+		"ALLOW_DANGEROUS_MOUNTS": "true",
+	})
+	assert.Nil(t, err)
+
+	_, err = dockerTestProvider(t, map[string]string{"TMPFS": "/tmp=rw,size=1g"})
+	if assert.NotNil(t, err) {
+		assert.Equal(t, "TMPFS is not supported by the vendored docker client", err.Error())
+	}
+}
+
+func TestNewDockerProvider_Privileged(t *testing.T) {
+	p, err := dockerTestProvider(t, nil)
+	if assert.Nil(t, err) {
+		assert.False(t, p.privilegedAllowedFor("travis-ci/worker"))
+	}
+
+	_, err = dockerTestProvider(t, map[string]string{"PRIVILEGED_ALLOWED": "true"})
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "PRIVILEGED_ALLOWED requires PRIVILEGED_REPOS")
+	}
+
+	_, err = dockerTestProvider(t, map[string]string{"PRIVILEGED_ALLOWED": "true", "PRIVILEGED_REPOS": " , "})
+	assert.NotNil(t, err)
+
+	p, err = dockerTestProvider(t, map[string]string{"PRIVILEGED_REPOS": "travis-ci/worker"})
+	if assert.Nil(t, err) {
+		assert.False(t, p.privilegedAllowedFor("travis-ci/worker"))
+	}
+
+	p, err = dockerTestProvider(t, map[string]string{
+		"PRIVILEGED_ALLOWED": "true",
+		"PRIVILEGED_REPOS":   "travis-ci/worker, travis-ci/travis-build",
+	})
+	if assert.Nil(t, err) {
+		assert.True(t, p.privilegedAllowedFor("travis-ci/travis-build"))
+		assert.False(t, p.privilegedAllowedFor("travis-ci/travis-web"))
+		assert.False(t, p.privilegedAllowedFor(""))
+	}
+
+	_, err = dockerTestProvider(t, map[string]string{"PRIVILEGED_ALLOWED": "sometimes"})
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), `invalid PRIVILEGED_ALLOWED "sometimes"`)
+	}
+
+	_, err = dockerTestProvider(t, map[string]string{"PRIVILEGED_REPOS": "worker"})
+	if assert.NotNil(t, err) {
+		assert.Equal(t, `invalid PRIVILEGED_REPOS slug "worker", must be owner/name`, err.Error())
+	}
+}
+
+func TestDockerProvider_StartPrivileged(t *testing.T) {
+	s := &dockerTestSweepServer{}
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	p, err := dockerTestProvider(t, map[string]string{
+		"ENDPOINT":           server.URL,
+		"PRIVILEGED_ALLOWED": "true",
+		"PRIVILEGED_REPOS":   "travis-ci/worker",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		privileged bool
+		repository string
+		granted    bool
+		warnings   int
+	}{
+		{false, "travis-ci/worker", false, 0},
+		{true, "travis-ci/worker", true, 0},
+		{true, "travis-ci/travis-web", false, 1},
+	} {
+		inst, err := p.Start(gocontext.TODO(), &StartAttributes{
+			Language:   "ruby",
+			Privileged: tc.privileged,
+			Repository: tc.repository,
+		})
+		if !assert.Nil(t, err) {
+			continue
+		}
+
+		assert.Equal(t, tc.granted, s.hostConfig.Privileged)
+		assert.Len(t, inst.(WarningInstance).Warnings(), tc.warnings)
+		assert.Nil(t, inst.Stop(gocontext.TODO()))
+	}
+}
+
+func TestNewDockerProvider_SecurityOpt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "travis-docker-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	profilePath := filepath.Join(dir, "seccomp.json")
+	err = ioutil.WriteFile(profilePath, []byte("{\n  \"defaultAction\": \"SCMP_ACT_ERRNO\"\n}\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	invalidPath := filepath.Join(dir, "invalid.json")
+	err = ioutil.WriteFile(invalidPath, []byte(`["SCMP_ACT_ERRNO"]`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := dockerTestProvider(t, map[string]string{})
+	if assert.Nil(t, err) {
+		assert.Nil(t, p.hostConfig("0,1").SecurityOpt)
+	}
+
+	p, err = dockerTestProvider(t, map[string]string{
+		"SECCOMP_PROFILE_PATH": profilePath,
+		"APPARMOR_PROFILE":     "travis-build",
+		"SECURITY_OPT":         "no-new-privileges, label=disable",
+	})
+	if assert.Nil(t, err) {
+		assert.Equal(t, []string{
+			`seccomp={"defaultAction":"SCMP_ACT_ERRNO"}`,
+			"apparmor=travis-build",
+			"no-new-privileges",
+			"label=disable",
+		}, p.hostConfig("0,1").SecurityOpt)
+		assert.Equal(t, fmt.Sprintf("seccomp=%s", profilePath), p.loggedSecurityOpt[0])
+	}
+
+	for message, cfg := range map[string]map[string]string{
+		"couldn't read SECCOMP_PROFILE_PATH":                                    {"SECCOMP_PROFILE_PATH": filepath.Join(dir, "missing.json")},
+		fmt.Sprintf("invalid seccomp profile %s", invalidPath):                  {"SECCOMP_PROFILE_PATH": invalidPath},
+		`SECURITY_OPT "seccomp:unconfined" conflicts with SECCOMP_PROFILE_PATH`: {"SECCOMP_PROFILE_PATH": profilePath, "SECURITY_OPT": "seccomp:unconfined"},
+		`SECURITY_OPT "apparmor=unconfined" conflicts with APPARMOR_PROFILE`:    {"APPARMOR_PROFILE": "travis-build", "SECURITY_OPT": "apparmor=unconfined"},
+	} {
+		_, err := dockerTestProvider(t, cfg)
+		if assert.NotNil(t, err, message) {
+			assert.Contains(t, err.Error(), message)
+		}
+	}
+}
+
+func TestNewDockerProvider_Network(t *testing.T) {
+	p, err := dockerTestProvider(t, map[string]string{
+		"NETWORK_MODE": "travis-builds",
+		"NATIVE":       "true",
+		"DNS":          "10.0.0.53, 10.0.1.53",
+		"EXTRA_HOSTS":  "cache.internal:10.0.2.1,v6.internal:fd00::1",
+	})
+	if assert.Nil(t, err) {
+		hostConfig := p.hostConfig("0,1")
+		assert.Equal(t, "travis-builds", hostConfig.NetworkMode)
+		assert.Equal(t, []string{"10.0.0.53", "10.0.1.53"}, hostConfig.DNS)
+		assert.Equal(t, []string{"cache.internal:10.0.2.1", "v6.internal:fd00::1"}, hostConfig.ExtraHosts)
+	}
+
+	p, err = dockerTestProvider(t, map[string]string{"NETWORK_MODE": "none", "NATIVE": "true"})
+	if assert.Nil(t, err) {
+		assert.Equal(t, "none", p.hostConfig("0,1").NetworkMode)
+	}
+
+	p, err = dockerTestProvider(t, map[string]string{"NETWORK_MODE": "bridge"})
+	if assert.Nil(t, err) {
+		assert.Equal(t, "bridge", p.hostConfig("0,1").NetworkMode)
+	}
+
+	for message, cfg := range map[string]map[string]string{
+		"NETWORK_MODE none requires NATIVE":                          {"NETWORK_MODE": "none"},
+		"NETWORK_MODE host requires NATIVE":                          {"NETWORK_MODE": "host"},
+		"NETWORK_MODE travis-builds requires NATIVE":                 {"NETWORK_MODE": "travis-builds"},
+		`invalid DNS server "resolver", must be an IP`:               {"DNS": "10.0.0.53,resolver"},
+		`invalid extra host "cache.internal", must be host:ip`:       {"EXTRA_HOSTS": "cache.internal"},
+		`invalid extra host "cache.internal:cache", must be host:ip`: {"EXTRA_HOSTS": "cache.internal:cache"},
+	} {
+		_, err := dockerTestProvider(t, cfg)
+		if assert.NotNil(t, err) {
+			assert.Contains(t, err.Error(), message)
+		}
+	}
+}
@@ -1,15 +1,19 @@
 package backend
 
 import (
-	"bytes"
+	"crypto/rand"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
 	"encoding/pem"
 	"fmt"
-	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
@@ -18,8 +22,6 @@ import (
 	"time"
 
 	"github.com/Sirupsen/logrus"
-	"github.com/pborman/uuid"
-	"github.com/pkg/sftp"
 	"github.com/travis-ci/worker/config"
 	"github.com/travis-ci/worker/context"
 	"github.com/travis-ci/worker/image"
@@ -27,61 +29,232 @@ import (
 	"golang.org/x/crypto/ssh"
 	gocontext "golang.org/x/net/context"
 	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
 	"golang.org/x/oauth2/jwt"
 	"google.golang.org/api/compute/v1"
 )
 
 const (
-	defaultGCEZone               = "us-central1-a"
-	defaultGCEMachineType        = "n1-standard-2"
-	defaultGCENetwork            = "default"
-	defaultGCEDiskSize           = int64(20)
-	defaultGCELanguage           = "minimal"
-	defaultGCEBootPollSleep      = 3 * time.Second
-	defaultGCEUploadRetries      = uint64(10)
-	defaultGCEUploadRetrySleep   = 5 * time.Second
-	defaultGCEHardTimeoutMinutes = int64(130)
-	defaultGCEImageSelectorType  = "legacy"
-	defaultGCEImage              = "travis-ci-mega.+"
-	gceImageTravisCIPrefixFilter = "name eq ^travis-ci-%s.+"
+	defaultGCEZone                = "us-central1-a"
+	defaultGCEMachineType         = "n1-standard-2"
+	defaultGCENetwork             = "default"
+	defaultGCEDiskSize            = int64(20)
+	defaultGCELanguage            = "minimal"
+	defaultGCEBootPollSleep       = 3 * time.Second
+	defaultGCEUploadRetries       = uint64(10)
+	defaultGCEUploadRetrySleep    = 5 * time.Second
+	gceUploadMaxRetrySleep        = 15 * time.Second
+	gceUploadAuthRetries          = 3
+	defaultGCEHardTimeoutMinutes  = int64(130)
+	defaultGCEGracefulStopTimeout = time.Minute
+	defaultGCEExpiryGrace         = 30 * time.Minute
+	gceCreatedMetadataKey         = "travis-worker-created"
+	gceExpiresMetadataKey         = "travis-worker-expires"
+	gceHostnameMetadataKey        = "travis-worker-hostname"
+	gcePIDMetadataKey             = "travis-worker-pid"
+	gceJobIDMetadataKey           = "travis-job-id"
+	gceLabelMetadataKeyPrefix     = "travis-label-"
+	gceLabelMaxLength             = 63
+	gceInstanceNameMaxLength      = 63
+	defaultGCEImageSelectorType   = "legacy"
+	defaultGCEImage               = "travis-ci-mega.+"
+	gceImageTravisCIPrefixFilter  = "name eq ^travis-ci-%s.+"
+	defaultGCEInstanceNamePrefix  = "testing-gce-"
+	defaultGCENetworkTag          = "testing"
+	gceSSHPollMaxSleep            = 10 * time.Second
+	defaultGCEConnectVia          = "public-ip"
+	defaultGCEStaleVMAction       = "error"
+	defaultGCEScriptPath          = "build.sh"
+	gceUploadTempSuffix           = ".uploading"
+	gceSFTPNoSuchFile             = 2
+	gceRunScriptCancelGrace       = 5 * time.Second
+	defaultGCEWindowsScriptPath   = "build.ps1"
+	defaultGCEScriptInterpreter   = "bash"
+	gceAccountJSONFilename        = "account.json"
+	gceAccountJSONMetadata        = "metadata"
+	gceScopePrefix                = "https://www.googleapis.com/auth/"
+	defaultGCESSHDialTimeout      = 10 * time.Second
+	defaultGCESSHUser             = "travis"
+	defaultGCESSHKeepalive        = 30 * time.Second
+	gceSSHDialRetries             = 2
+	gceBootTimeoutSerialOutputMax = 8192
+	gceExitMissingMessage         = "exited without exit status or exit signal"
+	gceExecTimeout                = time.Minute
+	gceExecMaxOutput              = 64 * 1024
+	defaultGCEPTYTerm             = "xterm"
+	defaultGCEPTYCols             = 80
+	defaultGCEPTYRows             = 40
+	defaultGCESSHHostKeyMode      = "insecure"
+	gceSSHHostKeyModeKnownHosts   = "known-hosts:"
 )
 
 var (
+	errGCEShuttingDown = fmt.Errorf("gce provider is shutting down")
+	errGCEDryRun       = fmt.Errorf("dry run, no build script was run")
+
 	gceHelp = map[string]string{
-		"PROJECT_ID":              "[REQUIRED] GCE project id",
-		"ACCOUNT_JSON":            "[REQUIRED] account JSON config",
-		"SSH_KEY_PATH":            "[REQUIRED] path to ssh key used to access job vms",
-		"SSH_PUB_KEY_PATH":        "[REQUIRED] path to ssh public key used to access job vms",
-		"SSH_KEY_PASSPHRASE":      "[REQUIRED] passphrase for ssh key given as ssh_key_path",
-		"IMAGE_SELECTOR_TYPE":     fmt.Sprintf("image selector type (\"legacy\", \"env\" or \"api\", default %q)", defaultGCEImageSelectorType),
-		"IMAGE_SELECTOR_URL":      "URL for image selector API, used only when image selector is \"api\"",
-		"ZONE":                    fmt.Sprintf("zone name (default %q)", defaultGCEZone),
-		"MACHINE_TYPE":            fmt.Sprintf("machine name (default %q)", defaultGCEMachineType),
-		"NETWORK":                 fmt.Sprintf("machine name (default %q)", defaultGCENetwork),
-		"DISK_SIZE":               fmt.Sprintf("disk size in GB (default %v)", defaultGCEDiskSize),
-		"LANGUAGE_MAP_{LANGUAGE}": "Map the key specified in the key to the image associated with a different language, used only when image selector type is \"legacy\"",
-		"IMAGE_ALIASES":           "comma-delimited strings used as stable names for images, used only when image selector type is \"env\"",
-		"IMAGE_[ALIAS_]{ALIAS}":   "full name for a given alias given via IMAGE_ALIASES, where the alias form in the key is uppercased and normalized by replacing non-alphanumerics with _",
-		"IMAGE_DEFAULT":           fmt.Sprintf("default image name to use when none found (default %q)", defaultGCEImage),
-		"DEFAULT_LANGUAGE":        fmt.Sprintf("default language to use when looking up image (default %q)", defaultGCELanguage),
-		"INSTANCE_GROUP":          "instance group name to which all inserted instances will be added (no default)",
-		"BOOT_POLL_SLEEP":         fmt.Sprintf("sleep interval between polling server for instance status (default %v)", defaultGCEBootPollSleep),
-		"UPLOAD_RETRIES":          fmt.Sprintf("number of times to attempt to upload script before erroring (default %d)", defaultGCEUploadRetries),
-		"UPLOAD_RETRY_SLEEP":      fmt.Sprintf("sleep interval between script upload attempts (default %v)", defaultGCEUploadRetrySleep),
-		"AUTO_IMPLODE":            "schedule a poweroff at HARD_TIMEOUT_MINUTES in the future (default true)",
-		"HARD_TIMEOUT_MINUTES":    fmt.Sprintf("time in minutes in the future when poweroff is scheduled if AUTO_IMPLODE is true (default %v)", defaultGCEHardTimeoutMinutes),
+		"PROJECT_ID":                       "[REQUIRED] GCE project id",
+		"ACCOUNT_JSON":                     fmt.Sprintf("[REQUIRED] account JSON config, or path to a file or a directory containing %q, falling back to $GOOGLE_APPLICATION_CREDENTIALS, or %q to use the metadata server's credentials", gceAccountJSONFilename, gceAccountJSONMetadata),
+		"COMPUTE_SCOPES":                   "comma-delimited OAuth scopes requested for ACCOUNT_JSON credentials, either full URLs or names such as \"compute\", which covers every call the provider makes, none of which touch Cloud Storage (default \"compute\")",
+		"USE_METADATA_CREDENTIALS":         "use the credentials of the instance the worker runs on from the metadata server instead of ACCOUNT_JSON (default false)",
+		"SSH_KEY_PATH":                     "[REQUIRED unless SSH_KEY is set] path to ssh key used to access job vms",
+		"SSH_PUB_KEY_PATH":                 "[REQUIRED unless SSH_PUB_KEY is set] path to ssh public key used to access job vms",
+		"SSH_KEY":                          "ssh key used to access job vms given inline, e.g. from a secret in the environment, instead of as SSH_KEY_PATH, or a path if it isn't a PEM block",
+		"SSH_PUB_KEY":                      "ssh public key used to access job vms given inline in authorized_keys format instead of as SSH_PUB_KEY_PATH, or a path if it isn't a public key",
+		"SSH_KEY_PASSPHRASE":               "[REQUIRED] passphrase for ssh key given as SSH_KEY or SSH_KEY_PATH",
+		"IMAGE_SELECTOR_TYPE":              fmt.Sprintf("image selector type (\"legacy\", \"env\" or \"api\", default %q)", defaultGCEImageSelectorType),
+		"IMAGE_SELECTOR_URL":               "URL for image selector API, used only when image selector is \"api\"",
+		"ZONE":                             fmt.Sprintf("zone name (default %q)", defaultGCEZone),
+		"RESOURCE_POLICIES":                "comma-delimited names of resource policies, e.g. compact placement policies, to attach to instances, which must exist in the region of ZONE and of each of ZONES (default none)",
+		"ZONES":                            "comma-delimited zones to start instances in besides ZONE, each start picking one at random weighted by the success rate of its recent boots so that zones failing e.g. from exhausted resources get fewer instances, while pooled instances stay in ZONE (default none)",
+		"MACHINE_TYPE":                     fmt.Sprintf("machine name (default %q)", defaultGCEMachineType),
+		"ALLOWED_MACHINE_TYPES":            "comma-delimited machine types a job may request via its vm_config size, falling back to MACHINE_TYPE otherwise (default none)",
+		"NETWORK":                          fmt.Sprintf("machine name (default %q)", defaultGCENetwork),
+		"SUBNETWORK":                       "name of the subnetwork of NETWORK in the region of each zone to boot instances in, required with EXTRA_NETWORK_INTERFACES (default none)",
+		"EXTRA_NETWORK_INTERFACES":         "semicolon-delimited network interfaces to add after the one in NETWORK, each comma-delimited network=NAME,subnetwork=NAME[,nat=BOOL] where each network differs and the subnetwork in the region of each zone is required, while ssh keeps using the first interface (default none)",
+		"DISK_SIZE":                        fmt.Sprintf("disk size in GB (default %v)", defaultGCEDiskSize),
+		"DISK_KMS_KEY":                     "resource name of the Cloud KMS key to encrypt boot disks with, e.g. \"projects/p/locations/l/keyRings/r/cryptoKeys/k\", which the project's compute engine service agent must be allowed to use, can't be combined with DISK_ENCRYPTION_KEY (default none)",
+		"DISK_ENCRYPTION_KEY":              "base64-encoded 256-bit customer-supplied key to encrypt boot disks with, can't be combined with DISK_KMS_KEY (default none)",
+		"AUTO_EXPAND_DISK":                 "use the image's minimum disk size if DISK_SIZE is smaller instead of erroring (default true)",
+		"LANGUAGE_MAP_{LANGUAGE}":          "Map the key specified in the key to the image associated with a different language, used only when image selector type is \"legacy\"",
+		"IMAGE_ALIASES":                    "comma-delimited strings used as stable names for images, used only when image selector type is \"env\"",
+		"IMAGE_[ALIAS_]{ALIAS}":            "full name for a given alias given via IMAGE_ALIASES, where the alias form in the key is uppercased and normalized by replacing non-alphanumerics with _",
+		"IMAGE_DEFAULT":                    fmt.Sprintf("default image name to use when none found (default %q)", defaultGCEImage),
+		"SNAPSHOT_NAME":                    "boot from the lexically last disk snapshot whose name starts with this instead of an image, can't be combined with IMAGE_SELECTOR_TYPE or IMAGE_DEFAULT (no default)",
+		"IMAGE_ROLLOUT":                    "comma-delimited percentages of jobs booting the newest, previous and so on of the images whose names start with the selected image name, e.g. 10,90 to canary the newest image on 10% of jobs, which add up to 100 and keep each job on the same image across retries (default 100)",
+		"STRICT_IMAGE_MATCH":               "error jobs whose selected image doesn't mention the job's dist, or windows for windows jobs only, in its name or description, instead of only logging the mismatch (default false)",
+		"ALLOWED_IMAGE_PROJECTS":           "comma-delimited projects from which jobs may boot an image given by its self link, bypassing all other image selection (default none)",
+		"FORCE_IMAGE_{VALUE}":              "full image name to use for jobs whose osx_image or dist (checked in that order) is the value in the key, uppercased and normalized by replacing non-alphanumerics with _, bypassing the image selector",
+		"DEFAULT_LANGUAGE":                 fmt.Sprintf("default language to use when looking up image (default %q)", defaultGCELanguage),
+		"INSTANCE_NAME_PREFIX":             fmt.Sprintf("prefix for the names of created instances (default %q)", defaultGCEInstanceNamePrefix),
+		"SSH_USER":                         fmt.Sprintf("user the startup script authorizes the ssh key for and that logs into instances, which must exist in the image (default %q)", defaultGCESSHUser),
+		"SSH_DIAL_TIMEOUT":                 fmt.Sprintf("timeout for connecting to instances over ssh, including the handshake (default %v)", defaultGCESSHDialTimeout),
+		"SSH_KEEPALIVE_INTERVAL":           fmt.Sprintf("interval between ssh keepalive requests, 0 to disable (default %v)", defaultGCESSHKeepalive),
+		"SSH_BASTION_HOST":                 "host[:port] of a bastion to connect to instances through, typically combined with CONNECT_VIA=private-ip (no default)",
+		"SSH_BASTION_USER":                 "user to log into SSH_BASTION_HOST as (default \"travis\")",
+		"SSH_BASTION_KEY_PATH":             "path to an unencrypted ssh key used to log into SSH_BASTION_HOST, falling back to SSH_KEY_PATH",
+		"SSH_BASTION_KEY":                  "unencrypted ssh key used to log into SSH_BASTION_HOST given inline instead of as SSH_BASTION_KEY_PATH",
+		"SSH_HOST_KEY_MODE":                fmt.Sprintf("how to verify the host keys of instances, \"insecure\" to accept any key, \"known-hosts:<path>\" to require a key listed in the given known_hosts file or \"instance-metadata\" to require a key whose fingerprint the startup script wrote to the serial console (default %q)", defaultGCESSHHostKeyMode),
+		"CONNECT_VIA":                      fmt.Sprintf("how to reach instances over ssh, \"public-ip\", \"private-ip\" or \"internal-dns\" (default %q)", defaultGCEConnectVia),
+		"INSTANCE_GROUP":                   "instance group name to which all inserted instances will be added (no default)",
+		"INSTANCE_GROUP_{ZONE}":            "instance group name to use instead of INSTANCE_GROUP for instances in the zone in the key, uppercased and normalized by replacing non-alphanumerics with _",
+		"NETWORK_TAGS":                     fmt.Sprintf("comma-delimited network tags given to instances in addition to %q, e.g. to apply firewall rules to them (no default)", defaultGCENetworkTag),
+		"NETWORK_TAGS_{GROUP}":             "network tags to use instead of NETWORK_TAGS for jobs in the group in the key, e.g. stable or dev, uppercased and normalized by replacing non-alphanumerics with _",
+		"VERIFY_GROUP_MEMBERSHIP":          "wait for instances to be listed as members of INSTANCE_GROUP before using them (default false)",
+		"COMPUTE_ENDPOINT":                 "base URL of the compute API, e.g. of a private service endpoint or an emulator, ending in /compute/v1/ (default the public API)",
+		"BOOT_POLL_SLEEP":                  fmt.Sprintf("sleep interval between polling server for instance status (default %v)", defaultGCEBootPollSleep),
+		"UPLOAD_RETRIES":                   fmt.Sprintf("number of times to attempt to upload script before erroring (default %d)", defaultGCEUploadRetries),
+		"SCRIPT_PATH":                      fmt.Sprintf("path the build script is uploaded to and run from, relative to the ssh user's home directory unless absolute, whose directory must exist (default %q, or %q for windows jobs)", defaultGCEScriptPath, defaultGCEWindowsScriptPath),
+		"BUILD_SCRIPT_PATH":                "alias of SCRIPT_PATH",
+		"BUILD_SCRIPT_INTERPRETER":         fmt.Sprintf("command the build script is passed to, or empty to execute the script itself, ignored for windows jobs, which run it with powershell (default %q)", defaultGCEScriptInterpreter),
+		"POOL_SIZE":                        "number of instances booted ahead of time from the default image or snapshot and machine type, handed out to jobs that would boot the same, requires AUTO_IMPLODE (default 0)",
+		"POOL_MAX_AGE":                     fmt.Sprintf("how long after booting pooled instances may still be handed out before they're deleted, which shortens the time a job has before AUTO_IMPLODE powers the instance off (default %v)", defaultGCEPoolMaxAge),
+		"PTY":                              "request a pseudo-terminal to run build scripts in, merging stderr into stdout; without one, stdout and stderr are written to the log in the order they arrive, but images whose sudo is configured with requiretty can't run sudo (default true)",
+		"PTY_TERM":                         fmt.Sprintf("TERM of the pseudo-terminal (default %q)", defaultGCEPTYTerm),
+		"PTY_COLS":                         fmt.Sprintf("width of the pseudo-terminal in columns (default %d)", defaultGCEPTYCols),
+		"PTY_ROWS":                         fmt.Sprintf("height of the pseudo-terminal in rows (default %d)", defaultGCEPTYRows),
+		"ADOPT_EXISTING_INSTANCES":         "before inserting an instance for a job, look for a running instance created for the same job id in any of the zones, e.g. by a worker that crashed while starting it, and use it instead if it has no build script yet, deleting it otherwise (default false)",
+		"DRY_RUN":                          "resolve everything needed to start instances and log the instances that would be inserted without inserting them, running no build scripts and requeueing the jobs instead, can't be combined with POOL_SIZE (default false)",
+		"STALE_VM_ACTION":                  fmt.Sprintf("what to do when an instance already has a build script, \"error\" to requeue the job, \"overwrite\" to replace the script or \"recycle\" to delete the instance before requeueing (default %q)", defaultGCEStaleVMAction),
+		"UPLOAD_RETRY_SLEEP":               fmt.Sprintf("sleep interval before the first retry of a script upload, doubled for each further retry up to %v, while host key failures aren't retried and authentication failures only while the startup script may still be installing the ssh key (default %v)", gceUploadMaxRetrySleep, defaultGCEUploadRetrySleep),
+		"AUTO_IMPLODE":                     "schedule a poweroff at HARD_TIMEOUT_MINUTES in the future (default true)",
+		"HARD_TIMEOUT_MINUTES":             fmt.Sprintf("time in minutes in the future when poweroff is scheduled if AUTO_IMPLODE is true (default %v)", defaultGCEHardTimeoutMinutes),
+		"DETAILED_BOOT_METRICS":            "additionally emit boot metrics per image name, zone and machine type (default false)",
+		"EXPIRY_GRACE":                     fmt.Sprintf("time added to the hard timeout when recording an instance's expiry in its metadata (default %v)", defaultGCEExpiryGrace),
+		"PREEMPTIBLE":                      "boot preemptible instances (default true)",
+		"PROVISIONING_MODEL":               "provisioning model of instances, \"STANDARD\" or \"SPOT\", taking precedence over PREEMPTIBLE (default SPOT if PREEMPTIBLE, else STANDARD)",
+		"NODE_AFFINITY_KEY":                "node affinity label key, e.g. \"compute.googleapis.com/node-group-name\", to boot instances on sole-tenant nodes, which can't run preemptible instances and so imply PROVISIONING_MODEL=STANDARD (no default)",
+		"NODE_AFFINITY_OPERATOR":           "node affinity operator, \"IN\" or \"NOT_IN\" (default \"IN\")",
+		"NODE_AFFINITY_VALUES":             "comma-delimited node affinity label values, e.g. sole-tenant node group names, required with NODE_AFFINITY_KEY (no default)",
+		"SPOT_INSTANCE_TERMINATION_ACTION": "what compute engine does with spot instances it reclaims, \"STOP\" or \"DELETE\", where deleted instances are taken as stopped (default the compute API's, STOP)",
+		"ON_HOST_MAINTENANCE":              "what instances do when their host is maintained, \"MIGRATE\" or \"TERMINATE\", where preemptible instances must terminate (default the compute API's, MIGRATE for instances that aren't preemptible)",
+		"AUTOMATIC_RESTART":                "restart instances terminated by compute engine, which preemptible instances can't be (default true unless preemptible)",
+		"GRACEFUL_STOP":                    "stop instances and wait for them to shut down before deleting them (default false)",
+		"GRACEFUL_STOP_TIMEOUT":            fmt.Sprintf("how long to wait for a graceful stop before deleting anyway (default %v)", defaultGCEGracefulStopTimeout),
+		"WAIT_FOR_STARTUP_COMPLETE":        "wait for the startup script to write its completion line to the serial console before using instances, instead of retrying ssh until the key is authorized, for images whose startup takes long (default false)",
+		"BOOT_HARD_TIMEOUT":                "how long an inserted instance may take to become ready before it's deleted, however long the job's start timeout, so that instances stuck provisioning aren't leaked (default none)",
+		"SHIELDED_SECURE_BOOT":             "boot instances with secure boot, which needs images with UEFI support (default false)",
+		"SHIELDED_VTPM":                    "boot instances with a virtual trusted platform module, which needs images with UEFI support (default false)",
+		"SHIELDED_INTEGRITY_MONITORING":    "monitor the boot integrity of instances, which needs images with UEFI support (default false)",
+		"CONFIDENTIAL_COMPUTE":             "boot confidential instances, which need N2D or C2D machine types for MACHINE_TYPE and ALLOWED_MACHINE_TYPES and terminate on host maintenance (default false)",
+		"STARTUP_COMPLETE_TIMEOUT":         fmt.Sprintf("how long to wait for the startup script to complete before deleting the instance with a boot timeout (default %v)", defaultGCEStartupCompleteTimeout),
 	}
 
 	errGCEMissingIPAddressError = fmt.Errorf("no IP address found")
 
+	gceLabelInvalidCharsRegexp        = regexp.MustCompile(`[^a-z0-9_-]`)
+	gceInstanceNameInvalidCharsRegexp = regexp.MustCompile(`[^a-z0-9-]`)
+	gceInstanceNameLeadingRegexp      = regexp.MustCompile(`^[^a-z]+`)
+	gceImageSelfLinkRegexp            = regexp.MustCompile(`(?:^|/)projects/([^/]+)/global/images/([^/]+)$`)
+	gceNetworkTagRegexp               = regexp.MustCompile(`^[a-z]([-a-z0-9]{0,61}[a-z0-9])?$`)
+	gceSSHUserRegexp                  = regexp.MustCompile(`^[a-z_][a-z0-9_-]{0,31}$`)
+	gceKMSKeyRegexp                   = regexp.MustCompile(`^projects/[^/]+/locations/[^/]+/keyRings/[^/]+/cryptoKeys/[^/]+$`)
+
+	// gceConfidentialMachineFamilies are the machine families confidential
+	// instances can be booted with.
+	gceConfidentialMachineFamilies = map[string]bool{
+		"n2d": true,
+		"c2d": true,
+	}
+
+	// gceOpErrorCodeCauses maps operation error codes to the cause of the
+	// StartError they're classified as.
+	gceOpErrorCodeCauses = map[string]error{
+		"QUOTA_EXCEEDED":                            ErrQuotaExceeded,
+		"RESOURCE_EXHAUSTED":                        ErrResourceExhausted,
+		"ZONE_RESOURCE_POOL_EXHAUSTED":              ErrResourceExhausted,
+		"ZONE_RESOURCE_POOL_EXHAUSTED_WITH_DETAILS": ErrResourceExhausted,
+	}
+
+	// gceAPIErrorReasonCauses maps API error reasons to the cause of the
+	// StartError they're classified as.
+	gceAPIErrorReasonCauses = map[string]error{
+		"quotaExceeded":         ErrQuotaExceeded,
+		"rateLimitExceeded":     ErrQuotaExceeded,
+		"userRateLimitExceeded": ErrQuotaExceeded,
+		"resourceExhausted":     ErrResourceExhausted,
+	}
+
+	// gceStartErrorMetricNames are the metric name suffixes marked when
+	// Start fails with a StartError with the given cause.
+	gceStartErrorMetricNames = map[error]string{
+		ErrQuotaExceeded:     "quota_exceeded",
+		ErrResourceExhausted: "resource_exhausted",
+		ErrImageNotFound:     "image_not_found",
+		ErrImageNotAllowed:   "image_not_allowed",
+		ErrImageMismatch:     "image_mismatch",
+		ErrBootTimeout:       "boot_timeout",
+		ErrBootHardTimeout:   "boot_hard_timeout",
+		ErrDiskEncryptionKey: "disk_encryption_key",
+	}
+
+	// gceUnsupportedConfigKeys are config keys for features the provider
+	// can't offer. They are rejected outright so that an operator relying on
+	// them doesn't end up with instances silently booted without them.
+	// Regional instance groups are always managed, so instances can't be
+	// added to them; INSTANCE_GROUP_{ZONE} names a group per zone instead.
+	gceUnsupportedConfigKeys = []string{
+		"INSTANCE_GROUP_REGION",
+	}
+
 	gceStartupScript = template.Must(template.New("gce-startup").Parse(`#!/usr/bin/env bash
 {{ if .AutoImplode }}echo poweroff | at now + {{ .HardTimeoutMinutes }} minutes{{ end }}
-cat > ~travis/.ssh/authorized_keys <<EOF
+cat > ~{{ .SSHUser }}/.ssh/authorized_keys <<EOF
 {{ .SSHPubKey }}
 EOF
-`))
-
-	// FIXME: get rid of the need for this global goop
+{{ if .PublishHostKeys }}{
+  echo "-----BEGIN SSH HOST KEY FINGERPRINTS-----"
+  for key in /etc/ssh/ssh_host_*_key.pub; do
+    ssh-keygen -l -f "${key}"
+  done
+  echo "-----END SSH HOST KEY FINGERPRINTS-----"
+} > /dev/ttyS0
+{{ end }}{{ if .WaitForStartup }}echo "{{ .StartupCompleteLine }}" > /dev/ttyS0
+{{ end }}`))
+
+	// Deprecated: use config.ProviderConfig.SetHTTPTransport instead. This is
+	// only consulted when the provider config doesn't carry a transport, and
+	// will be removed in the next release.
 	gceCustomHTTPTransport     http.RoundTripper = nil
 	gceCustomHTTPTransportLock sync.Mutex
 )
@@ -92,6 +265,9 @@ func init() {
 
 type gceOpError struct {
 	Err *compute.OperationError
+
+	// Hint is a likely reason for the error, if known.
+	Hint string
 }
 
 func (oe *gceOpError) Error() string {
@@ -101,28 +277,125 @@ func (oe *gceOpError) Error() string {
 			err.Code, err.Location, err.Message))
 	}
 
+	if oe.Hint != "" {
+		return fmt.Sprintf("%s (%s)", strings.Join(errStrs, ", "), oe.Hint)
+	}
+
 	return strings.Join(errStrs, ", ")
 }
 
+// Codes returns the codes of the errors in the operation error, e.g.
+// "ZONE_RESOURCE_POOL_EXHAUSTED".
+func (oe *gceOpError) Codes() []string {
+	codes := []string{}
+	for _, err := range oe.Err.Errors {
+		codes = append(codes, err.Code)
+	}
+
+	return codes
+}
+
 type gceAccountJSON struct {
 	ClientEmail string `json:"client_email"`
 	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+// gceTokenSource fetches new tokens from its source, marking metrics and
+// logging each refresh so that failures are visible before they turn into
+// 401s from the API. It's meant to be wrapped in oauth2.ReuseTokenSource so
+// that its Token is only called when the cached token needs refreshing.
+type gceTokenSource struct {
+	src  oauth2.TokenSource
+	kind string
+}
+
+func (ts *gceTokenSource) Token() (*oauth2.Token, error) {
+	logger := context.LoggerFromContext(gocontext.TODO()).WithField("credentials", ts.kind)
+
+	tok, err := ts.src.Token()
+	if err != nil {
+		metrics.Mark("worker.vm.provider.gce.token.refresh.error")
+		logger.WithField("err", err).Error("failed to refresh gce token")
+		return nil, err
+	}
+
+	metrics.Mark("worker.vm.provider.gce.token.refresh")
+	logger.WithField("expiry", tok.Expiry).Debug("refreshed gce token")
+	return tok, nil
 }
 
 type gceProvider struct {
-	client    *compute.Service
+	api       gceComputeAPI
 	projectID string
 	ic        *gceInstanceConfig
 	cfg       *config.ProviderConfig
 
-	imageSelectorType string
-	imageSelector     image.Selector
-	instanceGroup     string
-	bootPollSleep     time.Duration
-	defaultLanguage   string
-	defaultImage      string
-	uploadRetries     uint64
-	uploadRetrySleep  time.Duration
+	imageSelectorType  string
+	imageSelector      image.Selector
+	instanceGroup      string
+	instanceNamePrefix string
+	snapshotName       string
+	hostname           string
+	bootPollSleep      time.Duration
+	defaultLanguage    string
+	defaultImage       string
+	uploadRetries      uint64
+	uploadRetrySleep   time.Duration
+	staleVMAction      string
+	scriptPath         string
+	scriptInterpreter  string
+	pty                bool
+	ptyTerm            string
+	ptyCols            int
+	ptyRows            int
+	dryRun             bool
+	adoptExisting      bool
+	strictImageMatch   bool
+	imageRollout       []int
+
+	detailedBootMetrics   bool
+	verifyGroupMembership bool
+	gracefulStop          bool
+	gracefulStopTimeout   time.Duration
+
+	startupCompleteTimeout time.Duration
+	bootHardTimeout        time.Duration
+
+	connectVia     string
+	sshDialer      *sshDialer
+	sshPort        int
+	sshHostKeyMode string
+	execTimeout    time.Duration
+	sshKnownHosts  *sshKnownHosts
+
+	pool *gcePool
+
+	zoneNames  []string
+	zoneHealth *gceZoneHealth
+
+	shutdownChan  chan struct{}
+	shutdownMutex sync.Mutex
+	shuttingDown  bool
+	shutdownDone  chan struct{}
+	startWG       sync.WaitGroup
+
+	allowedImageProjects map[string]bool
+
+	allowedMachineTypes map[string]bool
+	machineTypes        map[string]*compute.MachineType
+	machineTypesMutex   sync.Mutex
+
+	// resourcePolicies are the names of the resource policies attached to
+	// instances, and resourcePolicyLinks their self-links by region, as
+	// looked up by Setup.
+	resourcePolicies    []string
+	resourcePolicyLinks map[string][]string
+
+	// instances are the names of the instances this worker started and
+	// hasn't deleted yet, which sweeps leave alone.
+	instancesMutex sync.Mutex
+	instances      map[string]bool
 }
 
 type gceInstanceConfig struct {
@@ -131,22 +404,52 @@ type gceInstanceConfig struct {
 	Network            *compute.Network
 	DiskType           string
 	DiskSize           int64
+	DiskEncryptionKey  *compute.CustomerEncryptionKey
+	Subnetwork         string
+	ExtraNetworks      []*gceNetworkInterfaceConfig
 	SSHKeySigner       ssh.Signer
 	SSHPubKey          string
+	SSHUser            string
 	AutoImplode        bool
+	AutoExpandDisk     bool
 	HardTimeoutMinutes int64
+	ExpiryGrace        time.Duration
+	PublishHostKeys    bool
+	WaitForStartup     bool
+	Preemptible        bool
+	ProvisioningModel  string
+	TerminationAction  string
+	NodeAffinities     []*compute.SchedulingNodeAffinity
+	Shielded           *compute.ShieldedInstanceConfig
+	Confidential       *compute.ConfidentialInstanceConfig
+	OnHostMaintenance  string
+	AutomaticRestart   bool
+}
+
+// gceNetworkInterfaceConfig describes a network interface of
+// EXTRA_NETWORK_INTERFACES.
+type gceNetworkInterfaceConfig struct {
+	Network    string
+	Subnetwork string
+	NAT        bool
 }
 
 type gceInstance struct {
-	client   *compute.Service
 	provider *gceProvider
 	instance *compute.Instance
 	ic       *gceInstanceConfig
 
 	authUser string
 
-	projectID string
-	imageName string
+	projectID  string
+	imageName  string
+	os         string
+	scriptPath string
+
+	logSilenceTimeout time.Duration
+	maxLogLength      int64
+
+	bootedAt time.Time
 }
 
 func newGCEProvider(cfg *config.ProviderConfig) (Provider, error) {
@@ -155,7 +458,12 @@ func newGCEProvider(cfg *config.ProviderConfig) (Provider, error) {
 		err           error
 	)
 
-	client, err := buildGoogleComputeService(cfg)
+	httpClient, err := buildGoogleHTTPClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := newGoogleComputeService(httpClient, cfg)
 	if err != nil {
 		return nil, err
 	}
@@ -166,22 +474,23 @@ func newGCEProvider(cfg *config.ProviderConfig) (Provider, error) {
 
 	projectID := cfg.Get("PROJECT_ID")
 
-	if !cfg.IsSet("SSH_KEY_PATH") {
-		return nil, fmt.Errorf("missing SSH_KEY_PATH config key")
+	for _, key := range gceUnsupportedConfigKeys {
+		if cfg.IsSet(key) {
+			return nil, fmt.Errorf("%s is not supported", key)
+		}
 	}
 
-	sshKeyBytes, err := ioutil.ReadFile(cfg.Get("SSH_KEY_PATH"))
-
+	sshKeyBytes, err := loadGCESSHKey(cfg, "SSH_KEY", func(value string) bool {
+		return strings.HasPrefix(value, "-----BEGIN ")
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	if !cfg.IsSet("SSH_PUB_KEY_PATH") {
-		return nil, fmt.Errorf("missing SSH_PUB_KEY_PATH config key")
-	}
-
-	sshPubKeyBytes, err := ioutil.ReadFile(cfg.Get("SSH_PUB_KEY_PATH"))
-
+	sshPubKeyBytes, err := loadGCESSHKey(cfg, "SSH_PUB_KEY", func(value string) bool {
+		_, _, _, _, err := ssh.ParseAuthorizedKey([]byte(value))
+		return err == nil
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -217,6 +526,16 @@ func newGCEProvider(cfg *config.ProviderConfig) (Provider, error) {
 
 	cfg.Set("ZONE", zoneName)
 
+	zoneNames := []string{zoneName}
+	seenZones := map[string]bool{zoneName: true}
+	for _, name := range strings.Split(cfg.Get("ZONES"), ",") {
+		name = strings.TrimSpace(name)
+		if name != "" && !seenZones[name] {
+			seenZones[name] = true
+			zoneNames = append(zoneNames, name)
+		}
+	}
+
 	mtName := defaultGCEMachineType
 	if cfg.IsSet("MACHINE_TYPE") {
 		mtName = cfg.Get("MACHINE_TYPE")
@@ -224,6 +543,24 @@ func newGCEProvider(cfg *config.ProviderConfig) (Provider, error) {
 
 	cfg.Set("MACHINE_TYPE", mtName)
 
+	resourcePolicies := []string{}
+	for _, name := range strings.Split(cfg.Get("RESOURCE_POLICIES"), ",") {
+		name = strings.TrimSpace(name)
+		if name != "" {
+			resourcePolicies = append(resourcePolicies, name)
+		}
+	}
+
+	allowedMachineTypes := map[string]bool{}
+	if cfg.IsSet("ALLOWED_MACHINE_TYPES") {
+		for _, mt := range strings.Split(cfg.Get("ALLOWED_MACHINE_TYPES"), ",") {
+			mt = strings.TrimSpace(mt)
+			if mt != "" {
+				allowedMachineTypes[mt] = true
+			}
+		}
+	}
+
 	nwName := defaultGCENetwork
 	if cfg.IsSet("NETWORK") {
 		nwName = cfg.Get("NETWORK")
@@ -231,6 +568,18 @@ func newGCEProvider(cfg *config.ProviderConfig) (Provider, error) {
 
 	cfg.Set("NETWORK", nwName)
 
+	var extraNetworks []*gceNetworkInterfaceConfig
+	if cfg.IsSet("EXTRA_NETWORK_INTERFACES") {
+		extraNetworks, err = parseGCEExtraNetworkInterfaces(cfg.Get("EXTRA_NETWORK_INTERFACES"), nwName)
+		if err != nil {
+			return nil, err
+		}
+		// compute engine only accepts multiple interfaces with subnetworks
+		if len(extraNetworks) > 0 && cfg.Get("SUBNETWORK") == "" {
+			return nil, fmt.Errorf("SUBNETWORK is required with EXTRA_NETWORK_INTERFACES")
+		}
+	}
+
 	diskSize := defaultGCEDiskSize
 	if cfg.IsSet("DISK_SIZE") {
 		ds, err := strconv.ParseInt(cfg.Get("DISK_SIZE"), 10, 64)
@@ -239,6 +588,25 @@ func newGCEProvider(cfg *config.ProviderConfig) (Provider, error) {
 		}
 	}
 
+	var diskEncryptionKey *compute.CustomerEncryptionKey
+	if cfg.IsSet("DISK_KMS_KEY") && cfg.IsSet("DISK_ENCRYPTION_KEY") {
+		return nil, fmt.Errorf("DISK_KMS_KEY and DISK_ENCRYPTION_KEY can't both be set")
+	}
+	if cfg.IsSet("DISK_KMS_KEY") {
+		if !gceKMSKeyRegexp.MatchString(cfg.Get("DISK_KMS_KEY")) {
+			return nil, fmt.Errorf("invalid DISK_KMS_KEY %q, expected projects/{project}/locations/{location}/keyRings/{key ring}/cryptoKeys/{key}", cfg.Get("DISK_KMS_KEY"))
+		}
+		diskEncryptionKey = &compute.CustomerEncryptionKey{KmsKeyName: cfg.Get("DISK_KMS_KEY")}
+	}
+	if cfg.IsSet("DISK_ENCRYPTION_KEY") {
+		// the key itself is left out of the error so it doesn't end up in logs
+		rawKey, err := base64.StdEncoding.DecodeString(cfg.Get("DISK_ENCRYPTION_KEY"))
+		if err != nil || len(rawKey) != 32 {
+			return nil, fmt.Errorf("invalid DISK_ENCRYPTION_KEY, expected a base64-encoded 256-bit key")
+		}
+		diskEncryptionKey = &compute.CustomerEncryptionKey{RawKey: cfg.Get("DISK_ENCRYPTION_KEY")}
+	}
+
 	bootPollSleep := defaultGCEBootPollSleep
 	if cfg.IsSet("BOOT_POLL_SLEEP") {
 		si, err := time.ParseDuration(cfg.Get("BOOT_POLL_SLEEP"))
@@ -285,6 +653,15 @@ func newGCEProvider(cfg *config.ProviderConfig) (Provider, error) {
 		autoImplode = ai
 	}
 
+	autoExpandDisk := true
+	if cfg.IsSet("AUTO_EXPAND_DISK") {
+		aed, err := strconv.ParseBool(cfg.Get("AUTO_EXPAND_DISK"))
+		if err != nil {
+			return nil, err
+		}
+		autoExpandDisk = aed
+	}
+
 	hardTimeoutMinutes := defaultGCEHardTimeoutMinutes
 	if cfg.IsSet("HARD_TIMEOUT_MINUTES") {
 		ht, err := strconv.ParseInt(cfg.Get("HARD_TIMEOUT_MINUTES"), 10, 64)
@@ -294,679 +671,1069 @@ func newGCEProvider(cfg *config.ProviderConfig) (Provider, error) {
 		hardTimeoutMinutes = ht
 	}
 
-	imageSelectorType := defaultGCEImageSelectorType
-	if cfg.IsSet("IMAGE_SELECTOR_TYPE") {
-		imageSelectorType = cfg.Get("IMAGE_SELECTOR_TYPE")
+	detailedBootMetrics := false
+	if cfg.IsSet("DETAILED_BOOT_METRICS") {
+		dbm, err := strconv.ParseBool(cfg.Get("DETAILED_BOOT_METRICS"))
+		if err != nil {
+			return nil, err
+		}
+		detailedBootMetrics = dbm
 	}
 
-	if imageSelectorType != "legacy" && imageSelectorType != "env" && imageSelectorType != "api" {
-		return nil, fmt.Errorf("invalid image selector type %q", imageSelectorType)
+	verifyGroupMembership := false
+	if cfg.IsSet("VERIFY_GROUP_MEMBERSHIP") {
+		vgm, err := strconv.ParseBool(cfg.Get("VERIFY_GROUP_MEMBERSHIP"))
+		if err != nil {
+			return nil, err
+		}
+		verifyGroupMembership = vgm
 	}
 
-	if imageSelectorType == "env" || imageSelectorType == "api" {
-		imageSelector, err = buildGCEImageSelector(imageSelectorType, cfg)
+	gracefulStop := false
+	if cfg.IsSet("GRACEFUL_STOP") {
+		gs, err := strconv.ParseBool(cfg.Get("GRACEFUL_STOP"))
 		if err != nil {
 			return nil, err
 		}
+		gracefulStop = gs
 	}
 
-	return &gceProvider{
-		client:    client,
-		projectID: projectID,
-		cfg:       cfg,
+	gracefulStopTimeout := defaultGCEGracefulStopTimeout
+	if cfg.IsSet("GRACEFUL_STOP_TIMEOUT") {
+		gst, err := time.ParseDuration(cfg.Get("GRACEFUL_STOP_TIMEOUT"))
+		if err != nil {
+			return nil, err
+		}
+		gracefulStopTimeout = gst
+	}
 
-		ic: &gceInstanceConfig{
-			DiskSize:           diskSize,
-			SSHKeySigner:       sshKeySigner,
-			SSHPubKey:          string(sshPubKeyBytes),
-			AutoImplode:        autoImplode,
-			HardTimeoutMinutes: hardTimeoutMinutes,
-		},
+	waitForStartupComplete := false
+	if cfg.IsSet("WAIT_FOR_STARTUP_COMPLETE") {
+		wfsc, err := strconv.ParseBool(cfg.Get("WAIT_FOR_STARTUP_COMPLETE"))
+		if err != nil {
+			return nil, err
+		}
+		waitForStartupComplete = wfsc
+	}
 
-		imageSelector:     imageSelector,
-		imageSelectorType: imageSelectorType,
-		instanceGroup:     cfg.Get("INSTANCE_GROUP"),
-		bootPollSleep:     bootPollSleep,
-		defaultLanguage:   defaultLanguage,
-		defaultImage:      defaultImage,
-		uploadRetries:     uploadRetries,
-		uploadRetrySleep:  uploadRetrySleep,
-	}, nil
-}
+	startupCompleteTimeout := defaultGCEStartupCompleteTimeout
+	if cfg.IsSet("STARTUP_COMPLETE_TIMEOUT") {
+		sct, err := time.ParseDuration(cfg.Get("STARTUP_COMPLETE_TIMEOUT"))
+		if err != nil {
+			return nil, err
+		}
+		if sct <= 0 {
+			return nil, fmt.Errorf("invalid STARTUP_COMPLETE_TIMEOUT %q, must be positive", cfg.Get("STARTUP_COMPLETE_TIMEOUT"))
+		}
+		startupCompleteTimeout = sct
+	}
 
-func (p *gceProvider) Setup() error {
-	var err error
+	bootHardTimeout := time.Duration(0)
+	if cfg.IsSet("BOOT_HARD_TIMEOUT") {
+		bht, err := time.ParseDuration(cfg.Get("BOOT_HARD_TIMEOUT"))
+		if err != nil {
+			return nil, err
+		}
+		if bht <= 0 {
+			return nil, fmt.Errorf("invalid BOOT_HARD_TIMEOUT %q, must be positive", cfg.Get("BOOT_HARD_TIMEOUT"))
+		}
+		bootHardTimeout = bht
+	}
 
-	p.ic.Zone, err = p.client.Zones.Get(p.projectID, p.cfg.Get("ZONE")).Do()
-	if err != nil {
-		return err
+	expiryGrace := defaultGCEExpiryGrace
+	if cfg.IsSet("EXPIRY_GRACE") {
+		eg, err := time.ParseDuration(cfg.Get("EXPIRY_GRACE"))
+		if err != nil {
+			return nil, err
+		}
+		expiryGrace = eg
 	}
 
-	p.ic.DiskType = fmt.Sprintf("zones/%s/diskTypes/pd-ssd", p.ic.Zone.Name)
+	instanceNamePrefix := defaultGCEInstanceNamePrefix
+	if cfg.IsSet("INSTANCE_NAME_PREFIX") {
+		instanceNamePrefix = gceInstanceNamePrefix(cfg.Get("INSTANCE_NAME_PREFIX"))
+	}
 
-	p.ic.MachineType, err = p.client.MachineTypes.Get(p.projectID, p.ic.Zone.Name, p.cfg.Get("MACHINE_TYPE")).Do()
-	if err != nil {
-		return err
+	connectVia := defaultGCEConnectVia
+	if cfg.IsSet("CONNECT_VIA") {
+		connectVia = cfg.Get("CONNECT_VIA")
 	}
 
-	p.ic.Network, err = p.client.Networks.Get(p.projectID, p.cfg.Get("NETWORK")).Do()
-	if err != nil {
-		return err
+	if connectVia != "public-ip" && connectVia != "private-ip" && connectVia != "internal-dns" {
+		return nil, fmt.Errorf("invalid connect via %q", connectVia)
 	}
 
-	return nil
-}
+	var pool *gcePool
+	if cfg.IsSet("POOL_SIZE") {
+		ps, err := strconv.ParseUint(cfg.Get("POOL_SIZE"), 10, 64)
+		if err != nil {
+			return nil, err
+		}
 
-func buildGoogleComputeService(cfg *config.ProviderConfig) (*compute.Service, error) {
-	if !cfg.IsSet("ACCOUNT_JSON") {
-		return nil, fmt.Errorf("missing ACCOUNT_JSON")
+		if ps > 0 {
+			pool = &gcePool{size: int(ps), maxAge: defaultGCEPoolMaxAge}
+		}
 	}
 
-	a, err := loadGoogleAccountJSON(cfg.Get("ACCOUNT_JSON"))
-	if err != nil {
-		return nil, err
+	if pool != nil {
+		if !autoImplode {
+			return nil, fmt.Errorf("POOL_SIZE requires AUTO_IMPLODE, so that pooled instances don't outlive the worker")
+		}
+
+		if cfg.IsSet("POOL_MAX_AGE") {
+			pma, err := time.ParseDuration(cfg.Get("POOL_MAX_AGE"))
+			if err != nil {
+				return nil, err
+			}
+			pool.maxAge = pma
+		}
 	}
 
-	config := jwt.Config{
-		Email:      a.ClientEmail,
-		PrivateKey: []byte(a.PrivateKey),
-		Scopes: []string{
-			compute.DevstorageFullControlScope,
-			compute.ComputeScope,
-		},
-		TokenURL: "https://accounts.google.com/o/oauth2/token",
+	scriptPath := cfg.Get("SCRIPT_PATH")
+	if cfg.IsSet("BUILD_SCRIPT_PATH") {
+		if cfg.IsSet("SCRIPT_PATH") && scriptPath != cfg.Get("BUILD_SCRIPT_PATH") {
+			return nil, fmt.Errorf("SCRIPT_PATH and BUILD_SCRIPT_PATH can't be set to different paths")
+		}
+		scriptPath = cfg.Get("BUILD_SCRIPT_PATH")
 	}
 
-	client := config.Client(oauth2.NoContext)
+	scriptInterpreter := defaultGCEScriptInterpreter
+	if cfg.IsSet("BUILD_SCRIPT_INTERPRETER") {
+		scriptInterpreter = strings.TrimSpace(cfg.Get("BUILD_SCRIPT_INTERPRETER"))
+	}
 
-	if gceCustomHTTPTransport != nil {
-		client.Transport = gceCustomHTTPTransport
+	pty := true
+	if cfg.IsSet("PTY") {
+		v, err := strconv.ParseBool(cfg.Get("PTY"))
+		if err != nil {
+			return nil, err
+		}
+		pty = v
 	}
 
-	return compute.New(client)
-}
+	ptyTerm := defaultGCEPTYTerm
+	if cfg.IsSet("PTY_TERM") {
+		ptyTerm = cfg.Get("PTY_TERM")
+	}
 
-func loadGoogleAccountJSON(filenameOrJSON string) (*gceAccountJSON, error) {
-	var (
-		bytes []byte
-		err   error
-	)
+	ptyCols := defaultGCEPTYCols
+	if cfg.IsSet("PTY_COLS") {
+		v, err := strconv.ParseUint(cfg.Get("PTY_COLS"), 10, 16)
+		if err != nil {
+			return nil, err
+		}
+		if v == 0 {
+			return nil, fmt.Errorf("PTY_COLS must be greater than 0")
+		}
+		ptyCols = int(v)
+	}
 
-	if strings.HasPrefix(strings.TrimSpace(filenameOrJSON), "{") {
-		bytes = []byte(filenameOrJSON)
-	} else {
-		bytes, err = ioutil.ReadFile(filenameOrJSON)
+	ptyRows := defaultGCEPTYRows
+	if cfg.IsSet("PTY_ROWS") {
+		v, err := strconv.ParseUint(cfg.Get("PTY_ROWS"), 10, 16)
 		if err != nil {
 			return nil, err
 		}
+		if v == 0 {
+			return nil, fmt.Errorf("PTY_ROWS must be greater than 0")
+		}
+		ptyRows = int(v)
 	}
 
-	a := &gceAccountJSON{}
-	err = json.Unmarshal(bytes, a)
-	return a, err
-}
+	adoptExisting := false
+	if cfg.IsSet("ADOPT_EXISTING_INSTANCES") {
+		aei, err := strconv.ParseBool(cfg.Get("ADOPT_EXISTING_INSTANCES"))
+		if err != nil {
+			return nil, err
+		}
+		adoptExisting = aei
+	}
 
-func (p *gceProvider) Start(ctx gocontext.Context, startAttributes *StartAttributes) (Instance, error) {
-	logger := context.LoggerFromContext(ctx)
+	dryRun := false
+	if cfg.IsSet("DRY_RUN") {
+		dr, err := strconv.ParseBool(cfg.Get("DRY_RUN"))
+		if err != nil {
+			return nil, err
+		}
+		dryRun = dr
+	}
 
-	image, err := p.getImage(ctx, startAttributes)
-	if err != nil {
-		return nil, err
+	if dryRun && pool != nil {
+		return nil, fmt.Errorf("DRY_RUN can't be combined with POOL_SIZE")
 	}
 
-	scriptBuf := bytes.Buffer{}
-	err = gceStartupScript.Execute(&scriptBuf, p.ic)
-	if err != nil {
-		return nil, err
+	staleVMAction := defaultGCEStaleVMAction
+	if cfg.IsSet("STALE_VM_ACTION") {
+		staleVMAction = cfg.Get("STALE_VM_ACTION")
 	}
 
-	inst := p.buildInstance(startAttributes, image.SelfLink, scriptBuf.String())
+	if staleVMAction != "error" && staleVMAction != "overwrite" && staleVMAction != "recycle" {
+		return nil, fmt.Errorf("invalid stale vm action %q", staleVMAction)
+	}
 
-	logger.WithFields(logrus.Fields{
-		"instance": inst,
-	}).Debug("inserting instance")
-	op, err := p.client.Instances.Insert(p.projectID, p.ic.Zone.Name, inst).Do()
-	if err != nil {
-		return nil, err
+	sshDialTimeout := defaultGCESSHDialTimeout
+	if cfg.IsSet("SSH_DIAL_TIMEOUT") {
+		sdt, err := time.ParseDuration(cfg.Get("SSH_DIAL_TIMEOUT"))
+		if err != nil {
+			return nil, err
+		}
+		sshDialTimeout = sdt
 	}
 
-	abandonedStart := false
+	// the user is interpolated into the startup script, so it's checked to
+	// be a valid user name rather than quoted
+	sshUser := defaultGCESSHUser
+	if cfg.IsSet("SSH_USER") {
+		sshUser = cfg.Get("SSH_USER")
+		if !gceSSHUserRegexp.MatchString(sshUser) {
+			return nil, fmt.Errorf("invalid SSH_USER %q", sshUser)
+		}
+	}
 
-	defer func() {
-		if abandonedStart {
-			_, _ = p.client.Instances.Delete(p.projectID, p.ic.Zone.Name, inst.Name).Do()
+	sshKeepalive := defaultGCESSHKeepalive
+	if cfg.IsSet("SSH_KEEPALIVE_INTERVAL") {
+		ski, err := time.ParseDuration(cfg.Get("SSH_KEEPALIVE_INTERVAL"))
+		if err != nil {
+			return nil, err
 		}
-	}()
+		sshKeepalive = ski
+	}
 
-	startBooting := time.Now()
+	sshHostKeyMode := defaultGCESSHHostKeyMode
+	if cfg.IsSet("SSH_HOST_KEY_MODE") {
+		sshHostKeyMode = cfg.Get("SSH_HOST_KEY_MODE")
+	}
 
-	var instChan chan *compute.Instance
+	var sshKnownHosts *sshKnownHosts
+	if strings.HasPrefix(sshHostKeyMode, gceSSHHostKeyModeKnownHosts) {
+		knownHostsBytes, err := ioutil.ReadFile(strings.TrimPrefix(sshHostKeyMode, gceSSHHostKeyModeKnownHosts))
+		if err != nil {
+			return nil, err
+		}
 
-	instanceReady := make(chan *compute.Instance)
-	instChan = instanceReady
+		sshKnownHosts, err = parseSSHKnownHosts(knownHostsBytes)
+		if err != nil {
+			return nil, err
+		}
 
-	errChan := make(chan error)
-	go func() {
-		for {
-			newOp, err := p.client.ZoneOperations.Get(p.projectID, p.ic.Zone.Name, op.Name).Do()
-			if err != nil {
-				errChan <- err
-				return
-			}
+		sshHostKeyMode = gceSSHHostKeyModeKnownHosts
+	} else if sshHostKeyMode != "insecure" && sshHostKeyMode != "instance-metadata" {
+		return nil, fmt.Errorf("invalid ssh host key mode %q", sshHostKeyMode)
+	}
 
-			if newOp.Status == "DONE" {
-				if newOp.Error != nil {
-					errChan <- &gceOpError{Err: newOp.Error}
-					return
-				}
+	var sshBastion *sshBastion
+	if cfg.IsSet("SSH_BASTION_HOST") {
+		sshBastion, err = buildGCESSHBastion(cfg, sshKeySigner, sshKnownHosts)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-				logger.WithFields(logrus.Fields{
-					"status": newOp.Status,
-					"name":   op.Name,
-				}).Debug("instance is ready")
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
 
-				instanceReady <- inst
-				return
+	allowedImageProjects := map[string]bool{}
+	if cfg.IsSet("ALLOWED_IMAGE_PROJECTS") {
+		for _, project := range strings.Split(cfg.Get("ALLOWED_IMAGE_PROJECTS"), ",") {
+			project = strings.TrimSpace(project)
+			if project != "" {
+				allowedImageProjects[project] = true
 			}
+		}
+	}
 
-			if newOp.Error != nil {
-				logger.WithFields(logrus.Fields{
-					"err":  newOp.Error,
-					"name": op.Name,
-				}).Error("encountered an error while waiting for instance insert operation")
+	preemptible := true
+	if cfg.IsSet("PREEMPTIBLE") {
+		preemptible, err = strconv.ParseBool(cfg.Get("PREEMPTIBLE"))
+		if err != nil {
+			return nil, err
+		}
+	}
 
-				errChan <- &gceOpError{Err: newOp.Error}
-				return
-			}
+	// preemptible instances are booted as spot instances, which compute
+	// engine also reports as preemptible
+	if cfg.IsSet("PROVISIONING_MODEL") {
+		switch cfg.Get("PROVISIONING_MODEL") {
+		case "STANDARD":
+			preemptible = false
+		case "SPOT":
+			preemptible = true
+		default:
+			return nil, fmt.Errorf("invalid PROVISIONING_MODEL %q, expected STANDARD or SPOT", cfg.Get("PROVISIONING_MODEL"))
+		}
+	}
 
-			logger.WithFields(logrus.Fields{
-				"status": newOp.Status,
-				"name":   op.Name,
-			}).Debug("sleeping before checking instance insert operation")
+	var nodeAffinities []*compute.SchedulingNodeAffinity
+	if cfg.IsSet("NODE_AFFINITY_KEY") || cfg.IsSet("NODE_AFFINITY_OPERATOR") || cfg.IsSet("NODE_AFFINITY_VALUES") {
+		nodeAffinities, err = parseGCENodeAffinities(cfg)
+		if err != nil {
+			return nil, err
+		}
+		// sole-tenant nodes don't run preemptible instances
+		if preemptible && (cfg.IsSet("PREEMPTIBLE") || cfg.IsSet("PROVISIONING_MODEL")) {
+			return nil, fmt.Errorf("NODE_AFFINITY_KEY can't be set for preemptible instances")
+		}
+		preemptible = false
+	}
+
+	provisioningModel := "STANDARD"
+	if preemptible {
+		provisioningModel = "SPOT"
+	}
 
-			time.Sleep(p.bootPollSleep)
+	terminationAction := ""
+	if cfg.IsSet("SPOT_INSTANCE_TERMINATION_ACTION") {
+		terminationAction = cfg.Get("SPOT_INSTANCE_TERMINATION_ACTION")
+		if terminationAction != "STOP" && terminationAction != "DELETE" {
+			return nil, fmt.Errorf("invalid SPOT_INSTANCE_TERMINATION_ACTION %q, expected STOP or DELETE", terminationAction)
 		}
-	}()
+		if !preemptible {
+			return nil, fmt.Errorf("SPOT_INSTANCE_TERMINATION_ACTION can only be set for spot instances")
+		}
+	}
 
-	if p.instanceGroup != "" {
-		logger.WithFields(logrus.Fields{
-			"instance":       inst,
-			"instance_group": p.instanceGroup,
-		}).Debug("instance group is non-empty, adding instance to group")
-
-		origInstanceReady := instanceReady
-		instChan = make(chan *compute.Instance)
-
-		err = func() error {
-			for {
-				select {
-				case readyInst := <-origInstanceReady:
-					inst = readyInst
-					logger.WithFields(logrus.Fields{
-						"instance":       inst,
-						"instance_group": p.instanceGroup,
-					}).Debug("inserting instance into group")
-					return nil
-				case <-ctx.Done():
-					if ctx.Err() == gocontext.DeadlineExceeded {
-						metrics.Mark("worker.vm.provider.gce.boot.timeout")
-					}
-					abandonedStart = true
-
-					return ctx.Err()
-				default:
-					logger.Debug("sleeping while waiting for instance to be ready")
-					time.Sleep(p.bootPollSleep)
-				}
-			}
-		}()
+	var shielded *compute.ShieldedInstanceConfig
+	for _, key := range []string{"SHIELDED_SECURE_BOOT", "SHIELDED_VTPM", "SHIELDED_INTEGRITY_MONITORING"} {
+		if !cfg.IsSet(key) {
+			continue
+		}
+
+		enabled, err := strconv.ParseBool(cfg.Get(key))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q", key, cfg.Get(key))
+		}
+		if shielded == nil {
+			shielded = &compute.ShieldedInstanceConfig{}
+		}
 
+		switch key {
+		case "SHIELDED_SECURE_BOOT":
+			shielded.EnableSecureBoot = enabled
+		case "SHIELDED_VTPM":
+			shielded.EnableVtpm = enabled
+		case "SHIELDED_INTEGRITY_MONITORING":
+			shielded.EnableIntegrityMonitoring = enabled
+		}
+	}
+	if shielded != nil && !shielded.EnableSecureBoot && !shielded.EnableVtpm && !shielded.EnableIntegrityMonitoring {
+		shielded = nil
+	}
+
+	confidential := false
+	if cfg.IsSet("CONFIDENTIAL_COMPUTE") {
+		confidential, err = strconv.ParseBool(cfg.Get("CONFIDENTIAL_COMPUTE"))
 		if err != nil {
 			return nil, err
 		}
+	}
+
+	var confidentialConfig *compute.ConfidentialInstanceConfig
+	if confidential {
+		confidentialConfig = &compute.ConfidentialInstanceConfig{EnableConfidentialCompute: true}
+	}
 
-		inst, err = p.client.Instances.Get(p.projectID, p.ic.Zone.Name, inst.Name).Do()
+	onHostMaintenance := ""
+	if confidential {
+		// confidential instances can't be live migrated
+		onHostMaintenance = "TERMINATE"
+	}
+	if cfg.IsSet("ON_HOST_MAINTENANCE") {
+		onHostMaintenance = cfg.Get("ON_HOST_MAINTENANCE")
+		if onHostMaintenance != "MIGRATE" && onHostMaintenance != "TERMINATE" {
+			return nil, fmt.Errorf("invalid on host maintenance %q", onHostMaintenance)
+		}
+		if preemptible && onHostMaintenance == "MIGRATE" {
+			return nil, fmt.Errorf("ON_HOST_MAINTENANCE can't be MIGRATE for preemptible instances")
+		}
+		if confidential && onHostMaintenance == "MIGRATE" {
+			return nil, fmt.Errorf("ON_HOST_MAINTENANCE can't be MIGRATE for confidential instances")
+		}
+	}
+
+	automaticRestart := !preemptible
+	if cfg.IsSet("AUTOMATIC_RESTART") {
+		automaticRestart, err = strconv.ParseBool(cfg.Get("AUTOMATIC_RESTART"))
 		if err != nil {
 			return nil, err
 		}
+		if preemptible && automaticRestart {
+			return nil, fmt.Errorf("AUTOMATIC_RESTART can't be true for preemptible instances")
+		}
+	}
 
-		ref := &compute.InstanceReference{
-			Instance: inst.SelfLink,
+	strictImageMatch := false
+	if cfg.IsSet("STRICT_IMAGE_MATCH") {
+		sim, err := strconv.ParseBool(cfg.Get("STRICT_IMAGE_MATCH"))
+		if err != nil {
+			return nil, err
+		}
+		strictImageMatch = sim
+	}
+
+	var imageRollout []int
+	if cfg.IsSet("IMAGE_ROLLOUT") {
+		imageRollout, err = parseGCEImageRollout(cfg.Get("IMAGE_ROLLOUT"))
+		if err != nil {
+			return nil, err
 		}
+	}
 
-		logger.WithFields(logrus.Fields{
-			"ref":                ref,
-			"instance_self_link": inst.SelfLink,
-		}).Debug("inserting instance into group with ref")
+	err = validateGCENetworkTags(cfg)
+	if err != nil {
+		return nil, err
+	}
 
-		op, err := p.client.InstanceGroups.AddInstances(p.projectID, p.ic.Zone.Name, p.instanceGroup, &compute.InstanceGroupsAddInstancesRequest{
-			Instances: []*compute.InstanceReference{ref},
-		}).Do()
+	snapshotName := ""
+	if cfg.IsSet("SNAPSHOT_NAME") {
+		if cfg.IsSet("IMAGE_SELECTOR_TYPE") || cfg.IsSet("IMAGE_DEFAULT") {
+			return nil, fmt.Errorf("SNAPSHOT_NAME can't be combined with IMAGE_SELECTOR_TYPE or IMAGE_DEFAULT")
+		}
+		snapshotName = cfg.Get("SNAPSHOT_NAME")
+	}
 
+	imageSelectorType := defaultGCEImageSelectorType
+	if cfg.IsSet("IMAGE_SELECTOR_TYPE") {
+		imageSelectorType = cfg.Get("IMAGE_SELECTOR_TYPE")
+	}
+
+	if imageSelectorType != "legacy" && imageSelectorType != "env" && imageSelectorType != "api" {
+		return nil, fmt.Errorf("invalid image selector type %q", imageSelectorType)
+	}
+
+	if imageSelectorType == "env" || imageSelectorType == "api" {
+		imageSelector, err = buildImageSelector(imageSelectorType, cfg)
 		if err != nil {
-			abandonedStart = true
 			return nil, err
 		}
+	}
 
-		logger.WithFields(logrus.Fields{
-			"instance":       inst,
-			"instance_group": p.instanceGroup,
-		}).Debug("starting goroutine to poll for instance group addition")
+	return &gceProvider{
+		api:       &gceComputeService{client: client},
+		projectID: projectID,
+		cfg:       cfg,
 
-		go func() {
-			for {
-				newOp, err := p.client.ZoneOperations.Get(p.projectID, p.ic.Zone.Name, op.Name).Do()
-				if err != nil {
-					errChan <- err
-					return
-				}
+		ic: &gceInstanceConfig{
+			DiskSize:           diskSize,
+			DiskEncryptionKey:  diskEncryptionKey,
+			Subnetwork:         cfg.Get("SUBNETWORK"),
+			ExtraNetworks:      extraNetworks,
+			SSHKeySigner:       sshKeySigner,
+			SSHPubKey:          string(sshPubKeyBytes),
+			SSHUser:            sshUser,
+			AutoImplode:        autoImplode,
+			AutoExpandDisk:     autoExpandDisk,
+			HardTimeoutMinutes: hardTimeoutMinutes,
+			ExpiryGrace:        expiryGrace,
+			PublishHostKeys:    sshHostKeyMode == "instance-metadata",
+			WaitForStartup:     waitForStartupComplete,
+			Preemptible:        preemptible,
+			ProvisioningModel:  provisioningModel,
+			TerminationAction:  terminationAction,
+			NodeAffinities:     nodeAffinities,
+			Shielded:           shielded,
+			Confidential:       confidentialConfig,
+			OnHostMaintenance:  onHostMaintenance,
+			AutomaticRestart:   automaticRestart,
+		},
 
-				if newOp.Status == "DONE" {
-					if newOp.Error != nil {
-						errChan <- &gceOpError{Err: newOp.Error}
-						return
-					}
+		imageSelector:      imageSelector,
+		imageSelectorType:  imageSelectorType,
+		instanceGroup:      cfg.Get("INSTANCE_GROUP"),
+		instanceNamePrefix: instanceNamePrefix,
+		snapshotName:       snapshotName,
+		hostname:           hostname,
+		bootPollSleep:      bootPollSleep,
+		defaultLanguage:    defaultLanguage,
+		defaultImage:       defaultImage,
+		uploadRetries:      uploadRetries,
+		uploadRetrySleep:   uploadRetrySleep,
+		staleVMAction:      staleVMAction,
+		scriptPath:         scriptPath,
+		scriptInterpreter:  scriptInterpreter,
+		pty:                pty,
+		ptyTerm:            ptyTerm,
+		ptyCols:            ptyCols,
+		ptyRows:            ptyRows,
+		dryRun:             dryRun,
+		adoptExisting:      adoptExisting,
+		strictImageMatch:   strictImageMatch,
+		imageRollout:       imageRollout,
+
+		detailedBootMetrics:   detailedBootMetrics,
+		verifyGroupMembership: verifyGroupMembership,
+		gracefulStop:          gracefulStop,
+		gracefulStopTimeout:   gracefulStopTimeout,
+
+		startupCompleteTimeout: startupCompleteTimeout,
+		bootHardTimeout:        bootHardTimeout,
+
+		zoneNames:  zoneNames,
+		zoneHealth: newGCEZoneHealth(),
+
+		connectVia:  connectVia,
+		sshPort:     22,
+		execTimeout: gceExecTimeout,
+		sshDialer: &sshDialer{
+			DialTimeout:       sshDialTimeout,
+			KeepaliveInterval: sshKeepalive,
+			Retries:           gceSSHDialRetries,
+			RetrySleep:        time.Second,
+			Bastion:           sshBastion,
+		},
+		sshHostKeyMode: sshHostKeyMode,
+		sshKnownHosts:  sshKnownHosts,
 
-					instChan <- inst
-					return
-				}
+		allowedImageProjects: allowedImageProjects,
 
-				if newOp.Error != nil {
-					logger.WithFields(logrus.Fields{
-						"err":  newOp.Error,
-						"name": op.Name,
-					}).Error("encountered an error while waiting for instance group addition operation")
+		pool: pool,
 
-					errChan <- &gceOpError{Err: newOp.Error}
-					return
-				}
+		shutdownChan: make(chan struct{}),
 
-				logger.WithFields(logrus.Fields{
-					"status": newOp.Status,
-					"name":   op.Name,
-				}).Debug("sleeping before checking instance group addition operation")
+		allowedMachineTypes: allowedMachineTypes,
+		machineTypes:        map[string]*compute.MachineType{},
+		instances:           map[string]bool{},
 
-				time.Sleep(p.bootPollSleep)
-			}
-		}()
-	}
+		resourcePolicies:    resourcePolicies,
+		resourcePolicyLinks: map[string][]string{},
+	}, nil
+}
 
-	logger.Debug("selecting over instance, error, and done channels")
-	select {
-	case inst := <-instChan:
-		metrics.TimeSince("worker.vm.provider.gce.boot", startBooting)
-		return &gceInstance{
-			client:   p.client,
-			provider: p,
-			instance: inst,
-			ic:       p.ic,
-
-			authUser: "travis",
-
-			projectID: p.projectID,
-			imageName: image.Name,
-		}, nil
-	case err := <-errChan:
-		abandonedStart = true
-		return nil, err
-	case <-ctx.Done():
-		if ctx.Err() == gocontext.DeadlineExceeded {
-			metrics.Mark("worker.vm.provider.gce.boot.timeout")
-		}
-		abandonedStart = true
-		return nil, ctx.Err()
+// Setup looks up and verifies everything needed to start instances. Rather
+// than stopping at the first problem, it attempts every lookup and returns a
+// single error listing everything that's wrong.
+func (p *gceProvider) Setup() error {
+	var err error
+	setupErr := &gceSetupError{}
+
+	zoneName := p.cfg.Get("ZONE")
+	p.ic.Zone, err = p.api.GetZone(p.projectID, zoneName)
+	if err != nil {
+		setupErr.add("zone %q", zoneName, err)
+		p.ic.Zone = &compute.Zone{Name: zoneName}
 	}
-}
 
-func (p *gceProvider) getImage(ctx gocontext.Context, startAttributes *StartAttributes) (*compute.Image, error) {
-	logger := context.LoggerFromContext(ctx)
+	p.ic.DiskType = fmt.Sprintf("zones/%s/diskTypes/pd-ssd", p.ic.Zone.Name)
 
-	switch p.imageSelectorType {
-	case "env", "api":
-		return p.imageSelect(ctx, startAttributes)
-	default:
-		logger.WithFields(logrus.Fields{
-			"selector_type": p.imageSelectorType,
-		}).Warn("unknown image selector, falling back to legacy image selection")
-		return p.legacyImageSelect(ctx, startAttributes)
+	_, err = p.api.GetDiskType(p.projectID, p.ic.Zone.Name, "pd-ssd")
+	if err != nil {
+		setupErr.add("disk type %q", p.ic.DiskType, err)
 	}
-}
 
-func (p *gceProvider) legacyImageSelect(ctx gocontext.Context, startAttributes *StartAttributes) (*compute.Image, error) {
-	logger := context.LoggerFromContext(ctx)
+	p.ic.MachineType, err = p.api.GetMachineType(p.projectID, p.ic.Zone.Name, p.cfg.Get("MACHINE_TYPE"))
+	if err != nil {
+		setupErr.add("machine type %q", p.cfg.Get("MACHINE_TYPE"), err)
+	} else {
+		p.machineTypesMutex.Lock()
+		p.machineTypes[p.ic.MachineType.Name] = p.ic.MachineType
+		p.machineTypesMutex.Unlock()
+	}
 
-	var (
-		image *compute.Image
-		err   error
-	)
+	if p.ic.Confidential != nil {
+		machineTypeNames := []string{p.cfg.Get("MACHINE_TYPE")}
+		for name := range p.allowedMachineTypes {
+			machineTypeNames = append(machineTypeNames, name)
+		}
+		sort.Strings(machineTypeNames[1:])
 
-	candidateLangs := []string{}
+		for _, name := range machineTypeNames {
+			if !gceConfidentialMachineFamilies[gceMachineFamily(name)] {
+				setupErr.add("machine type %q", name, fmt.Errorf("confidential instances need an N2D or C2D machine type"))
+			}
+		}
+	}
 
-	mappedLang := fmt.Sprintf("LANGUAGE_MAP_%s", strings.ToUpper(startAttributes.Language))
-	if p.cfg.IsSet(mappedLang) {
-		logger.WithFields(logrus.Fields{
-			"original": startAttributes.Language,
-			"mapped":   p.cfg.Get(mappedLang),
-		}).Debug("using mapped language to candidates")
-		candidateLangs = append(candidateLangs, p.cfg.Get(mappedLang))
-	} else {
-		logger.WithFields(logrus.Fields{
-			"original": startAttributes.Language,
-		}).Debug("adding original language to candidates")
-		candidateLangs = append(candidateLangs, startAttributes.Language)
+	p.ic.Network, err = p.api.GetNetwork(p.projectID, p.cfg.Get("NETWORK"))
+	if err != nil {
+		setupErr.add("network %q", p.cfg.Get("NETWORK"), err)
 	}
-	candidateLangs = append(candidateLangs, p.defaultLanguage)
 
-	for _, language := range candidateLangs {
-		logger.WithFields(logrus.Fields{
-			"original":  startAttributes.Language,
-			"candidate": language,
-		}).Debug("searching for image matching language")
+	for _, extra := range p.ic.ExtraNetworks {
+		_, err = p.api.GetNetwork(p.projectID, extra.Network)
+		if err != nil {
+			setupErr.add("network %q", extra.Network, err)
+		}
+	}
 
-		image, err = p.imageForLanguage(language)
-		if err == nil {
-			logger.WithFields(logrus.Fields{
-				"candidate": language,
-				"image":     image,
-			}).Debug("found matching image for language")
-			break
+	instanceGroup := p.instanceGroupForZone(p.ic.Zone.Name)
+	if instanceGroup != "" {
+		_, err = p.api.GetInstanceGroup(p.projectID, p.ic.Zone.Name, instanceGroup)
+		if err != nil {
+			setupErr.add("instance group %q", instanceGroup, err)
 		}
 	}
 
-	return image, err
-}
+	for _, zoneName := range p.zoneNames[1:] {
+		p.setupZone(zoneName, setupErr)
+	}
+
+	regionNames := map[string]bool{}
+	for _, zoneName := range p.zoneNames {
+		regionName := gceRegionName(zoneName)
+		if !regionNames[regionName] {
+			regionNames[regionName] = true
+			p.setupResourcePolicies(regionName, setupErr)
+		}
+	}
 
-func (p *gceProvider) imageByFilter(filter string) (*compute.Image, error) {
-	// TODO: add some TTL cache in here maybe?
-	images, err := p.client.Images.List(p.projectID).Filter(filter).Do()
+	_, err = p.api.ListImages(p.projectID, "")
 	if err != nil {
-		return nil, err
+		setupErr.add("images in project %q", p.projectID, err)
+	}
+
+	bootSource, err := p.defaultBootSource()
+	if err != nil {
+		setupErr.add("default boot source %q", bootSource, err)
 	}
 
-	if len(images.Items) == 0 {
-		return nil, fmt.Errorf("no image found with filter %s", filter)
+	err = gceVerifySSHKeyPair(p.ic.SSHKeySigner, p.ic.SSHPubKey)
+	if err != nil {
+		// an inline key is named by its config key, rather than logged
+		sshPubKeySource := p.cfg.Get("SSH_PUB_KEY_PATH")
+		if p.cfg.IsSet("SSH_PUB_KEY") {
+			sshPubKeySource = "SSH_PUB_KEY"
+		}
+		setupErr.add("ssh key pair %q", sshPubKeySource, err)
 	}
 
-	imagesByName := map[string]*compute.Image{}
-	imageNames := []string{}
-	for _, image := range images.Items {
-		imagesByName[image.Name] = image
-		imageNames = append(imageNames, image.Name)
+	if len(setupErr.errs) > 0 {
+		return setupErr
 	}
 
-	sort.Strings(imageNames)
+	context.LoggerFromContext(gocontext.TODO()).WithFields(logrus.Fields{
+		"project":        p.projectID,
+		"zones":          strings.Join(p.zoneNames, ","),
+		"machine_type":   p.ic.MachineType.Name,
+		"network":        p.ic.Network.Name,
+		"disk_type":      p.ic.DiskType,
+		"instance_group": instanceGroup,
+		"boot_source":    bootSource,
+	}).Info("gce provider set up")
+
+	if p.pool != nil {
+		go p.refillPool()
+	}
 
-	return imagesByName[imageNames[len(imageNames)-1]], nil
+	return nil
 }
 
-func (p *gceProvider) imageForLanguage(language string) (*compute.Image, error) {
-	return p.imageByFilter(fmt.Sprintf(gceImageTravisCIPrefixFilter, language))
+// gceMachineFamily returns the family of the named machine type, e.g. "n2d"
+// for "n2d-standard-2".
+func gceMachineFamily(name string) string {
+	return strings.SplitN(name, "-", 2)[0]
 }
 
-func (p *gceProvider) imageSelect(ctx gocontext.Context, startAttributes *StartAttributes) (*compute.Image, error) {
-	imageName, err := p.imageSelector.Select(&image.Params{
-		Infra:    "gce",
-		Language: startAttributes.Language,
-		OsxImage: startAttributes.OsxImage,
-		Dist:     startAttributes.Dist,
-		Group:    startAttributes.Group,
-		OS:       startAttributes.OS,
-	})
+// setupZone checks that everything instances are started with in ZONE
+// exists in one of the additional ZONES as well.
+func (p *gceProvider) setupZone(zoneName string, setupErr *gceSetupError) {
+	_, err := p.api.GetZone(p.projectID, zoneName)
+	if err != nil {
+		setupErr.add("zone %q", zoneName, err)
+		return
+	}
 
+	_, err = p.api.GetDiskType(p.projectID, zoneName, "pd-ssd")
 	if err != nil {
-		return nil, err
+		setupErr.add("disk type %q", fmt.Sprintf("zones/%s/diskTypes/pd-ssd", zoneName), err)
 	}
 
-	if imageName == "default" {
-		imageName = p.defaultImage
+	_, err = p.api.GetMachineType(p.projectID, zoneName, p.cfg.Get("MACHINE_TYPE"))
+	if err != nil {
+		setupErr.add("machine type %q", fmt.Sprintf("zones/%s/machineTypes/%s", zoneName, p.cfg.Get("MACHINE_TYPE")), err)
 	}
 
-	return p.imageByFilter(fmt.Sprintf("name eq ^%s", imageName))
+	instanceGroup := p.instanceGroupForZone(zoneName)
+	if instanceGroup != "" {
+		_, err = p.api.GetInstanceGroup(p.projectID, zoneName, instanceGroup)
+		if err != nil {
+			setupErr.add("instance group %q", instanceGroup, err)
+		}
+	}
 }
 
-func buildGCEImageSelector(selectorType string, cfg *config.ProviderConfig) (image.Selector, error) {
-	switch selectorType {
-	case "env":
-		return image.NewEnvSelector(cfg)
-	case "api":
-		baseURL, err := url.Parse(cfg.Get("IMAGE_SELECTOR_URL"))
+// setupResourcePolicies looks up the self-links of RESOURCE_POLICIES in the
+// given region.
+func (p *gceProvider) setupResourcePolicies(regionName string, setupErr *gceSetupError) {
+	if len(p.resourcePolicies) == 0 {
+		return
+	}
+
+	links := []string{}
+	for _, name := range p.resourcePolicies {
+		policy, err := p.api.GetResourcePolicy(p.projectID, regionName, name)
 		if err != nil {
-			return nil, err
+			setupErr.add("resource policy %q", fmt.Sprintf("regions/%s/resourcePolicies/%s", regionName, name), err)
+			return
 		}
-		return image.NewAPISelector(baseURL), nil
-	default:
-		return nil, fmt.Errorf("invalid image selector type %q", selectorType)
+		links = append(links, policy.SelfLink)
 	}
+
+	p.resourcePolicyLinks[regionName] = links
 }
 
-func (p *gceProvider) buildInstance(startAttributes *StartAttributes, imageLink, startupScript string) *compute.Instance {
-	return &compute.Instance{
-		Description: fmt.Sprintf("Travis CI %s test VM", startAttributes.Language),
-		Disks: []*compute.AttachedDisk{
-			&compute.AttachedDisk{
-				Type:       "PERSISTENT",
-				Mode:       "READ_WRITE",
-				Boot:       true,
-				AutoDelete: true,
-				InitializeParams: &compute.AttachedDiskInitializeParams{
-					SourceImage: imageLink,
-					DiskType:    p.ic.DiskType,
-					DiskSizeGb:  p.ic.DiskSize,
-				},
-			},
-		},
-		Scheduling: &compute.Scheduling{
-			Preemptible: true,
-		},
-		MachineType: p.ic.MachineType.SelfLink,
-		Name:        fmt.Sprintf("testing-gce-%s", uuid.NewRandom()),
-		Metadata: &compute.Metadata{
-			Items: []*compute.MetadataItems{
-				&compute.MetadataItems{
-					Key:   "startup-script",
-					Value: startupScript,
-				},
-			},
-		},
-		NetworkInterfaces: []*compute.NetworkInterface{
-			&compute.NetworkInterface{
-				AccessConfigs: []*compute.AccessConfig{
-					&compute.AccessConfig{
-						Name: "AccessConfig brought to you by travis-worker",
-						Type: "ONE_TO_ONE_NAT",
-					},
-				},
-				Network: p.ic.Network.SelfLink,
-			},
-		},
-		ServiceAccounts: []*compute.ServiceAccount{
-			&compute.ServiceAccount{
-				Email: "default",
-				Scopes: []string{
-					"https://www.googleapis.com/auth/userinfo.email",
-					compute.DevstorageFullControlScope,
-					compute.ComputeScope,
-				},
-			},
-		},
-		Tags: &compute.Tags{
-			Items: []string{
-				"testing",
-			},
-		},
+// gceRegionName returns the name of the region of the named zone, e.g.
+// "us-central1" for "us-central1-a".
+func gceRegionName(zoneName string) string {
+	if i := strings.LastIndex(zoneName, "-"); i > 0 {
+		return zoneName[:i]
 	}
+	return zoneName
 }
 
-func (i *gceInstance) sshClient() (*ssh.Client, error) {
-	err := i.refreshInstance()
-	if err != nil {
-		return nil, err
-	}
+// parseGCEExtraNetworkInterfaces parses the value of
+// EXTRA_NETWORK_INTERFACES, checking that every interface has a subnetwork
+// and that no two interfaces, including the primary one in the given
+// network, share a network.
+func parseGCEExtraNetworkInterfaces(value, primaryNetwork string) ([]*gceNetworkInterfaceConfig, error) {
+	extras := []*gceNetworkInterfaceConfig{}
+	seenNetworks := map[string]bool{primaryNetwork: true}
+
+	for _, entry := range strings.Split(value, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		extra := &gceNetworkInterfaceConfig{}
+		for _, pair := range strings.Split(entry, ",") {
+			parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("invalid EXTRA_NETWORK_INTERFACES entry %q, expected network=NAME,subnetwork=NAME[,nat=BOOL]", entry)
+			}
 
-	ipAddr := i.getIP()
-	if ipAddr == "" {
-		return nil, errGCEMissingIPAddressError
+			switch parts[0] {
+			case "network":
+				extra.Network = parts[1]
+			case "subnetwork":
+				extra.Subnetwork = parts[1]
+			case "nat":
+				nat, err := strconv.ParseBool(parts[1])
+				if err != nil {
+					return nil, fmt.Errorf("invalid nat %q in EXTRA_NETWORK_INTERFACES entry %q", parts[1], entry)
+				}
+				extra.NAT = nat
+			default:
+				return nil, fmt.Errorf("unknown key %q in EXTRA_NETWORK_INTERFACES entry %q", parts[0], entry)
+			}
+		}
+
+		if extra.Network == "" || extra.Subnetwork == "" {
+			return nil, fmt.Errorf("EXTRA_NETWORK_INTERFACES entry %q needs both a network and a subnetwork", entry)
+		}
+		if seenNetworks[extra.Network] {
+			return nil, fmt.Errorf("network %q of EXTRA_NETWORK_INTERFACES entry %q already has an interface", extra.Network, entry)
+		}
+		seenNetworks[extra.Network] = true
+
+		extras = append(extras, extra)
 	}
 
-	return ssh.Dial("tcp", fmt.Sprintf("%s:22", ipAddr), &ssh.ClientConfig{
-		User: i.authUser,
-		Auth: []ssh.AuthMethod{
-			ssh.PublicKeys(i.ic.SSHKeySigner),
-		},
-	})
+	return extras, nil
 }
 
-func (i *gceInstance) getIP() string {
-	for _, ni := range i.instance.NetworkInterfaces {
-		if ni.AccessConfigs == nil {
-			continue
+// parseGCENodeAffinities returns the node affinity described by the
+// NODE_AFFINITY_* keys.
+func parseGCENodeAffinities(cfg *config.ProviderConfig) ([]*compute.SchedulingNodeAffinity, error) {
+	key := cfg.Get("NODE_AFFINITY_KEY")
+	if key == "" {
+		return nil, fmt.Errorf("missing NODE_AFFINITY_KEY")
+	}
+
+	operator := "IN"
+	if cfg.IsSet("NODE_AFFINITY_OPERATOR") {
+		operator = cfg.Get("NODE_AFFINITY_OPERATOR")
+		if operator != "IN" && operator != "NOT_IN" {
+			return nil, fmt.Errorf("invalid NODE_AFFINITY_OPERATOR %q, expected IN or NOT_IN", operator)
 		}
+	}
 
-		for _, ac := range ni.AccessConfigs {
-			if ac.NatIP != "" {
-				return ac.NatIP
-			}
+	values := []string{}
+	for _, value := range strings.Split(cfg.Get("NODE_AFFINITY_VALUES"), ",") {
+		value = strings.TrimSpace(value)
+		if value != "" {
+			values = append(values, value)
 		}
 	}
+	if len(values) == 0 {
+		return nil, fmt.Errorf("missing NODE_AFFINITY_VALUES")
+	}
 
-	return ""
+	return []*compute.SchedulingNodeAffinity{
+		{Key: key, Operator: operator, Values: values},
+	}, nil
 }
 
-func (i *gceInstance) refreshInstance() error {
-	inst, err := i.client.Instances.Get(i.projectID, i.ic.Zone.Name, i.instance.Name).Do()
+// gceVerifySSHKeyPair checks that the public key matches the private key by
+// verifying a signature made with the latter.
+func gceVerifySSHKeyPair(signer ssh.Signer, pubKey string) error {
+	parsedPubKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(pubKey))
+	if err != nil {
+		return err
+	}
+
+	data := make([]byte, 32)
+	_, err = rand.Read(data)
+	if err != nil {
+		return err
+	}
+
+	sig, err := signer.Sign(rand.Reader, data)
 	if err != nil {
 		return err
 	}
 
-	i.instance = inst
+	err = parsedPubKey.Verify(data, sig)
+	if err != nil {
+		return fmt.Errorf("public key doesn't match private key: %v", err)
+	}
+
 	return nil
 }
 
-func (i *gceInstance) UploadScript(ctx gocontext.Context, script []byte) error {
-	uploadedChan := make(chan error)
+// gceSetupError collects everything that went wrong during Setup.
+type gceSetupError struct {
+	errs []string
+}
 
-	go func() {
-		var errCount uint64
-		for {
-			if ctx.Err() != nil {
-				return
-			}
+func (se *gceSetupError) add(format, name string, err error) {
+	se.errs = append(se.errs, fmt.Sprintf("%s: %v", fmt.Sprintf(format, name), err))
+}
 
-			err := i.uploadScriptAttempt(ctx, script)
-			if err == nil {
-				uploadedChan <- nil
-				return
-			}
+func (se *gceSetupError) Error() string {
+	return fmt.Sprintf("gce provider setup failed: %s", strings.Join(se.errs, "; "))
+}
 
-			errCount++
-			if errCount > i.provider.uploadRetries {
-				uploadedChan <- err
-				return
-			}
+// buildGoogleHTTPClient returns the client that compute API requests are
+// authenticated and sent with.
+func buildGoogleHTTPClient(cfg *config.ProviderConfig) (*http.Client, error) {
+	ts, err := buildGoogleTokenSource(cfg)
+	if err != nil {
+		return nil, err
+	}
 
-			time.Sleep(i.provider.uploadRetrySleep)
-		}
-	}()
+	client := oauth2.NewClient(oauth2.NoContext, ts)
 
-	select {
-	case err := <-uploadedChan:
-		return err
-	case <-ctx.Done():
-		return ctx.Err()
+	if rt := cfg.HTTPTransport(); rt != nil {
+		client.Transport = rt
+	} else {
+		gceCustomHTTPTransportLock.Lock()
+		if gceCustomHTTPTransport != nil {
+			client.Transport = gceCustomHTTPTransport
+		}
+		gceCustomHTTPTransportLock.Unlock()
 	}
+
+	return client, nil
 }
 
-func (i *gceInstance) uploadScriptAttempt(ctx gocontext.Context, script []byte) error {
-	client, err := i.sshClient()
+// newGoogleComputeService returns a compute service sending requests with
+// the given client to COMPUTE_ENDPOINT, if set.
+func newGoogleComputeService(client *http.Client, cfg *config.ProviderConfig) (*compute.Service, error) {
+	service, err := compute.New(client)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer client.Close()
 
-	sftp, err := sftp.NewClient(client)
-	if err != nil {
-		return err
+	if cfg.IsSet("COMPUTE_ENDPOINT") {
+		endpoint, err := url.Parse(cfg.Get("COMPUTE_ENDPOINT"))
+		if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+			return nil, fmt.Errorf("invalid COMPUTE_ENDPOINT %q", cfg.Get("COMPUTE_ENDPOINT"))
+		}
+
+		// the client's paths start at projects/, which older configs included
+		service.BasePath = strings.TrimSuffix(strings.TrimSuffix(endpoint.String(), "/"), "/projects") + "/"
 	}
-	defer sftp.Close()
 
-	_, err = sftp.Lstat("build.sh")
-	if err == nil {
-		return ErrStaleVM
+	return service, nil
+}
+
+// buildGoogleTokenSource returns the token source shared by all requests the
+// provider makes, which caches tokens until they expire.
+func buildGoogleTokenSource(cfg *config.ProviderConfig) (oauth2.TokenSource, error) {
+	useMetadata := cfg.Get("ACCOUNT_JSON") == gceAccountJSONMetadata
+	if cfg.IsSet("USE_METADATA_CREDENTIALS") {
+		v, err := strconv.ParseBool(cfg.Get("USE_METADATA_CREDENTIALS"))
+		if err != nil {
+			return nil, err
+		}
+		useMetadata = useMetadata || v
 	}
 
-	f, err := sftp.Create("build.sh")
+	if useMetadata {
+		return oauth2.ReuseTokenSource(nil, &gceTokenSource{
+			src:  google.ComputeTokenSource(""),
+			kind: "metadata",
+		}), nil
+	}
+
+	accountJSON := cfg.Get("ACCOUNT_JSON")
+	if !cfg.IsSet("ACCOUNT_JSON") {
+		accountJSON = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+		if accountJSON == "" {
+			return nil, fmt.Errorf("missing ACCOUNT_JSON")
+		}
+	}
+
+	a, err := loadGoogleAccountJSON(accountJSON)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if _, err := f.Write(script); err != nil {
-		return err
+	// The compute scope is needed to insert, stop and delete instances,
+	// disks and instance group memberships. Setup's lookups of zones,
+	// machine types, networks, images and snapshots only need
+	// compute.readonly, and nothing needs the devstorage scopes.
+	scopes := []string{compute.ComputeScope}
+	if cfg.IsSet("COMPUTE_SCOPES") {
+		scopes = []string{}
+		for _, scope := range strings.Split(cfg.Get("COMPUTE_SCOPES"), ",") {
+			scope = strings.TrimSpace(scope)
+			if scope == "" {
+				continue
+			}
+			if !strings.Contains(scope, "://") {
+				scope = gceScopePrefix + scope
+			}
+			scopes = append(scopes, scope)
+		}
+
+		if len(scopes) == 0 {
+			return nil, fmt.Errorf("COMPUTE_SCOPES must list at least one scope")
+		}
 	}
 
-	return nil
+	config := jwt.Config{
+		Email:      a.ClientEmail,
+		PrivateKey: []byte(a.PrivateKey),
+		Scopes:     scopes,
+		TokenURL:   "https://accounts.google.com/o/oauth2/token",
+	}
+
+	if a.TokenURI != "" {
+		config.TokenURL = a.TokenURI
+	}
+
+	return oauth2.ReuseTokenSource(nil, &gceTokenSource{
+		src:  config.TokenSource(oauth2.NoContext),
+		kind: "jwt",
+	}), nil
 }
 
-func (i *gceInstance) RunScript(ctx gocontext.Context, output io.Writer) (*RunResult, error) {
-	client, err := i.sshClient()
-	if err != nil {
-		return &RunResult{Completed: false}, err
+// buildGCESSHBastion builds the bastion to connect to instances through. Its
+// host key is checked against the known hosts if SSH_HOST_KEY_MODE gives them.
+func buildGCESSHBastion(cfg *config.ProviderConfig, instanceSigner ssh.Signer, knownHosts *sshKnownHosts) (*sshBastion, error) {
+	addr := cfg.Get("SSH_BASTION_HOST")
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "22")
 	}
-	defer client.Close()
 
-	session, err := client.NewSession()
-	if err != nil {
-		return &RunResult{Completed: false}, err
+	user := "travis"
+	if cfg.IsSet("SSH_BASTION_USER") {
+		user = cfg.Get("SSH_BASTION_USER")
 	}
-	defer session.Close()
 
-	err = session.RequestPty("xterm", 80, 40, ssh.TerminalModes{})
-	if err != nil {
-		return &RunResult{Completed: false}, err
+	if cfg.IsSet("SSH_BASTION_KEY") && cfg.IsSet("SSH_BASTION_KEY_PATH") {
+		return nil, fmt.Errorf("SSH_BASTION_KEY can't be combined with SSH_BASTION_KEY_PATH")
 	}
 
-	session.Stdout = output
-	session.Stderr = output
+	signer := instanceSigner
+	if cfg.IsSet("SSH_BASTION_KEY") {
+		var err error
+		signer, err = ssh.ParsePrivateKey([]byte(cfg.Get("SSH_BASTION_KEY")))
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse SSH_BASTION_KEY: %v", err)
+		}
+	}
 
-	err = session.Run("bash ~/build.sh")
-	if err == nil {
-		return &RunResult{Completed: true, ExitCode: 0}, nil
+	if cfg.IsSet("SSH_BASTION_KEY_PATH") {
+		keyBytes, err := ioutil.ReadFile(cfg.Get("SSH_BASTION_KEY_PATH"))
+		if err != nil {
+			return nil, err
+		}
+
+		signer, err = ssh.ParsePrivateKey(keyBytes)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse SSH_BASTION_KEY_PATH: %v", err)
+		}
+	}
+
+	clientConfig := &ssh.ClientConfig{
+		User: user,
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
 	}
 
-	switch err := err.(type) {
-	case *ssh.ExitError:
-		return &RunResult{Completed: true, ExitCode: uint8(err.ExitStatus())}, nil
-	default:
-		return &RunResult{Completed: false}, err
+	if knownHosts != nil {
+		clientConfig.HostKeyCallback = knownHosts.HostKeyCallback
 	}
+
+	return &sshBastion{Addr: addr, Config: clientConfig}, nil
 }
 
-func (i *gceInstance) Stop(ctx gocontext.Context) error {
-	op, err := i.client.Instances.Delete(i.projectID, i.ic.Zone.Name, i.instance.Name).Do()
-	if err != nil {
-		return err
+// loadGCESSHKey returns the key given by the config key, which like
+// ACCOUNT_JSON is either the key itself, if inline returns true for it, or a
+// path to it. Without the config key, the key is read from the path given by
+// the config key with a _PATH suffix.
+func loadGCESSHKey(cfg *config.ProviderConfig, key string, inline func(string) bool) ([]byte, error) {
+	pathKey := key + "_PATH"
+
+	if cfg.IsSet(key) && cfg.IsSet(pathKey) {
+		return nil, fmt.Errorf("%s can't be combined with %s", key, pathKey)
 	}
 
-	errChan := make(chan error)
-	go func() {
-		for {
-			newOp, err := i.client.ZoneOperations.Get(i.projectID, i.ic.Zone.Name, op.Name).Do()
-			if err != nil {
-				errChan <- err
-				return
-			}
+	if cfg.IsSet(key) {
+		value := cfg.Get(key)
+		if inline(strings.TrimSpace(value)) {
+			return []byte(value), nil
+		}
 
-			if newOp.Status == "DONE" {
-				if newOp.Error != nil {
-					errChan <- &gceOpError{Err: newOp.Error}
-					return
-				}
+		return ioutil.ReadFile(value)
+	}
 
-				errChan <- nil
-				return
-			}
+	if !cfg.IsSet(pathKey) {
+		return nil, fmt.Errorf("missing %s or %s config key", pathKey, key)
+	}
+
+	return ioutil.ReadFile(cfg.Get(pathKey))
+}
+
+func loadGoogleAccountJSON(filenameOrJSON string) (*gceAccountJSON, error) {
+	var (
+		bytes []byte
+		err   error
+	)
+
+	if strings.HasPrefix(strings.TrimSpace(filenameOrJSON), "{") {
+		bytes = []byte(filenameOrJSON)
+	} else {
+		filename := filenameOrJSON
+		if fi, err := os.Stat(filename); err == nil && fi.IsDir() {
+			filename = filepath.Join(filename, gceAccountJSONFilename)
+		}
 
-			time.Sleep(i.provider.bootPollSleep)
+		bytes, err = ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
 		}
+	}
+
+	a := &gceAccountJSON{}
+	err = json.Unmarshal(bytes, a)
+	return a, err
+}
+
+// gceCall makes a call with the vendored compute client, whose calls can't
+// be given a context. Once the context is done, its error is returned right
+// away, and the call is left to finish in the background with its result
+// discarded. No call is made if the context is already done.
+func gceCall(ctx gocontext.Context, call func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- call()
 	}()
 
 	select {
@@ -976,7 +1743,3 @@ func (i *gceInstance) Stop(ctx gocontext.Context) error {
 		return ctx.Err()
 	}
 }
-
-func (i *gceInstance) ID() string {
-	return fmt.Sprintf("%s:%s", i.instance.Name, i.imageName)
-}
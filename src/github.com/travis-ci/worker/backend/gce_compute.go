@@ -0,0 +1,153 @@
+package backend
+
+import (
+	"fmt"
+
+	"google.golang.org/api/compute/v1"
+)
+
+// gceComputeAPI is the part of the compute API the provider uses. Every call
+// goes through it, so that the provider can be tested against a fake.
+type gceComputeAPI interface {
+	GetZone(project, zone string) (*compute.Zone, error)
+	GetDiskType(project, zone, name string) (*compute.DiskType, error)
+	GetMachineType(project, zone, name string) (*compute.MachineType, error)
+	GetNetwork(project, name string) (*compute.Network, error)
+	GetResourcePolicy(project, region, name string) (*compute.ResourcePolicy, error)
+
+	InsertInstance(project, zone string, inst *compute.Instance) (*compute.Operation, error)
+	GetInstance(project, zone, name string) (*compute.Instance, error)
+	ListInstances(project, zone, filter, pageToken string) (*compute.InstanceList, error)
+	StopInstance(project, zone, name string) (*compute.Operation, error)
+	StartInstance(project, zone, name string) (*compute.Operation, error)
+	SetMachineType(project, zone, name, machineType string) (*compute.Operation, error)
+	DeleteInstance(project, zone, name string) (*compute.Operation, error)
+	GetSerialPortOutput(project, zone, name string, port int64) (*compute.SerialPortOutput, error)
+
+	ListImages(project, filter string) (*compute.ImageList, error)
+	GetImage(project, name string) (*compute.Image, error)
+	ListSnapshots(project, filter string) (*compute.SnapshotList, error)
+	InsertDisk(project, zone string, disk *compute.Disk) (*compute.Operation, error)
+	DeleteDisk(project, zone, name string) (*compute.Operation, error)
+
+	GetZoneOperation(project, zone, name string) (*compute.Operation, error)
+
+	GetInstanceGroup(project, zone, name string) (*compute.InstanceGroup, error)
+	AddInstanceToGroup(project, zone, group, selfLink string) (*compute.Operation, error)
+	ListGroupInstances(project, zone, group, pageToken string) (*compute.InstanceGroupsListInstances, error)
+}
+
+// gceComputeService implements gceComputeAPI with a compute.Service.
+type gceComputeService struct {
+	client *compute.Service
+}
+
+func (s *gceComputeService) GetZone(project, zone string) (*compute.Zone, error) {
+	return s.client.Zones.Get(project, zone).Do()
+}
+
+func (s *gceComputeService) GetDiskType(project, zone, name string) (*compute.DiskType, error) {
+	return s.client.DiskTypes.Get(project, zone, name).Do()
+}
+
+func (s *gceComputeService) GetMachineType(project, zone, name string) (*compute.MachineType, error) {
+	return s.client.MachineTypes.Get(project, zone, name).Do()
+}
+
+func (s *gceComputeService) GetNetwork(project, name string) (*compute.Network, error) {
+	return s.client.Networks.Get(project, name).Do()
+}
+
+func (s *gceComputeService) GetResourcePolicy(project, region, name string) (*compute.ResourcePolicy, error) {
+	return s.client.ResourcePolicies.Get(project, region, name).Do()
+}
+
+func (s *gceComputeService) InsertInstance(project, zone string, inst *compute.Instance) (*compute.Operation, error) {
+	return s.client.Instances.Insert(project, zone, inst).Do()
+}
+
+func (s *gceComputeService) GetInstance(project, zone, name string) (*compute.Instance, error) {
+	return s.client.Instances.Get(project, zone, name).Do()
+}
+
+func (s *gceComputeService) ListInstances(project, zone, filter, pageToken string) (*compute.InstanceList, error) {
+	call := s.client.Instances.List(project, zone).Filter(filter)
+	if pageToken != "" {
+		call = call.PageToken(pageToken)
+	}
+
+	return call.Do()
+}
+
+func (s *gceComputeService) StopInstance(project, zone, name string) (*compute.Operation, error) {
+	return s.client.Instances.Stop(project, zone, name).Do()
+}
+
+func (s *gceComputeService) StartInstance(project, zone, name string) (*compute.Operation, error) {
+	return s.client.Instances.Start(project, zone, name).Do()
+}
+
+func (s *gceComputeService) SetMachineType(project, zone, name, machineType string) (*compute.Operation, error) {
+	return s.client.Instances.SetMachineType(project, zone, name, &compute.InstancesSetMachineTypeRequest{
+		MachineType: fmt.Sprintf("zones/%s/machineTypes/%s", zone, machineType),
+	}).Do()
+}
+
+func (s *gceComputeService) DeleteInstance(project, zone, name string) (*compute.Operation, error) {
+	return s.client.Instances.Delete(project, zone, name).Do()
+}
+
+func (s *gceComputeService) GetSerialPortOutput(project, zone, name string, port int64) (*compute.SerialPortOutput, error) {
+	return s.client.Instances.GetSerialPortOutput(project, zone, name).Port(port).Do()
+}
+
+func (s *gceComputeService) ListImages(project, filter string) (*compute.ImageList, error) {
+	call := s.client.Images.List(project)
+	if filter != "" {
+		call = call.Filter(filter)
+	}
+
+	return call.Do()
+}
+
+func (s *gceComputeService) GetImage(project, name string) (*compute.Image, error) {
+	return s.client.Images.Get(project, name).Do()
+}
+
+func (s *gceComputeService) ListSnapshots(project, filter string) (*compute.SnapshotList, error) {
+	return s.client.Snapshots.List(project).Filter(filter).Do()
+}
+
+func (s *gceComputeService) InsertDisk(project, zone string, disk *compute.Disk) (*compute.Operation, error) {
+	return s.client.Disks.Insert(project, zone, disk).Do()
+}
+
+func (s *gceComputeService) DeleteDisk(project, zone, name string) (*compute.Operation, error) {
+	return s.client.Disks.Delete(project, zone, name).Do()
+}
+
+func (s *gceComputeService) GetZoneOperation(project, zone, name string) (*compute.Operation, error) {
+	return s.client.ZoneOperations.Get(project, zone, name).Do()
+}
+
+func (s *gceComputeService) GetInstanceGroup(project, zone, name string) (*compute.InstanceGroup, error) {
+	return s.client.InstanceGroups.Get(project, zone, name).Do()
+}
+
+func (s *gceComputeService) AddInstanceToGroup(project, zone, group, selfLink string) (*compute.Operation, error) {
+	return s.client.InstanceGroups.AddInstances(project, zone, group, &compute.InstanceGroupsAddInstancesRequest{
+		Instances: []*compute.InstanceReference{{Instance: selfLink}},
+	}).Do()
+}
+
+// ListGroupInstances lists the instances of the group in any state.
+func (s *gceComputeService) ListGroupInstances(project, zone, group, pageToken string) (*compute.InstanceGroupsListInstances, error) {
+	call := s.client.InstanceGroups.ListInstances(project, zone, group, &compute.InstanceGroupsListInstancesRequest{
+		InstanceState: "ALL",
+	})
+	if pageToken != "" {
+		call = call.PageToken(pageToken)
+	}
+
+	return call.Do()
+}
@@ -0,0 +1,964 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/travis-ci/worker/config"
+	gocontext "golang.org/x/net/context"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// gceTestFakeCompute serves the parts of the compute API used by
+// gceComputeAPI for a single project. Like the real API, inserted instances
+// exist right away, and operations go from PENDING through RUNNING to DONE,
+// taking one step each time they're polled. Zones, disk types, machine types,
+// networks and instance groups all exist, while resource policies exist in
+// every region if they're listed.
+type gceTestFakeCompute struct {
+	mutex  sync.Mutex
+	server *httptest.Server
+
+	// opPolls is the number of polls an operation takes to get DONE, and
+	// never if it's negative.
+	opPolls int
+	// opErrors are the errors that operations of the given kind, e.g.
+	// "insert", "delete" or "addInstances", finish with.
+	opErrors map[string]*compute.OperationError
+	// stopPolls is the number of times a stopped instance is fetched before
+	// it shuts down, whether or not its stop operation is polled, and never
+	// if it's negative.
+	stopPolls int
+
+	images           []*compute.Image
+	snapshots        []*compute.Snapshot
+	resourcePolicies []string
+	disks            map[string]*compute.Disk
+	instances        map[string]*compute.Instance
+	serial           map[string]string
+	groups           map[string][]string
+	operations       map[string]*gceTestFakeOperation
+	stopping         map[string]int
+	deleted          []string
+	nextOpID         int
+
+	// requests are the method and path of every request served, in order
+	requests []string
+}
+
+type gceTestFakeOperation struct {
+	op     *compute.Operation
+	polls  int
+	onDone func()
+}
+
+func newGCETestFakeCompute(t *testing.T) (*gceTestFakeCompute, *compute.Service) {
+	fc := &gceTestFakeCompute{
+		opPolls:    2,
+		opErrors:   map[string]*compute.OperationError{},
+		stopPolls:  2,
+		images:     []*compute.Image{{Name: "travis-ci-minimal-1", SelfLink: "travis-ci-minimal-1-link"}},
+		disks:      map[string]*compute.Disk{},
+		instances:  map[string]*compute.Instance{},
+		serial:     map[string]string{},
+		groups:     map[string][]string{},
+		operations: map[string]*gceTestFakeOperation{},
+		stopping:   map[string]int{},
+	}
+	fc.server = httptest.NewServer(fc)
+
+	client, err := compute.New(fc.server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.BasePath = fc.server.URL + "/compute/v1/"
+
+	return fc, client
+}
+
+var gceTestFakeComputeRoutes = []struct {
+	method  string
+	pattern *regexp.Regexp
+	handler func(*gceTestFakeCompute, *http.Request, []string) (int, interface{})
+}{
+	{"GET", regexp.MustCompile(`^/zones/([^/]+)$`), (*gceTestFakeCompute).getNamed},
+	{"GET", regexp.MustCompile(`^/zones/([^/]+)/(diskTypes|machineTypes|instanceGroups)/([^/]+)$`), (*gceTestFakeCompute).getNamed},
+	{"GET", regexp.MustCompile(`^/global/networks/([^/]+)$`), (*gceTestFakeCompute).getNamed},
+	{"GET", regexp.MustCompile(`^/regions/([^/]+)/resourcePolicies/([^/]+)$`), (*gceTestFakeCompute).getResourcePolicy},
+	{"GET", regexp.MustCompile(`^/global/images$`), (*gceTestFakeCompute).listImages},
+	{"GET", regexp.MustCompile(`^/global/images/([^/]+)$`), (*gceTestFakeCompute).getImage},
+	{"GET", regexp.MustCompile(`^/global/snapshots$`), (*gceTestFakeCompute).listSnapshots},
+	{"POST", regexp.MustCompile(`^/zones/([^/]+)/disks$`), (*gceTestFakeCompute).insertDisk},
+	{"DELETE", regexp.MustCompile(`^/zones/([^/]+)/disks/([^/]+)$`), (*gceTestFakeCompute).deleteDisk},
+	{"GET", regexp.MustCompile(`^/zones/([^/]+)/instances$`), (*gceTestFakeCompute).listInstances},
+	{"POST", regexp.MustCompile(`^/zones/([^/]+)/instances$`), (*gceTestFakeCompute).insertInstance},
+	{"GET", regexp.MustCompile(`^/zones/([^/]+)/instances/([^/]+)$`), (*gceTestFakeCompute).getInstance},
+	{"DELETE", regexp.MustCompile(`^/zones/([^/]+)/instances/([^/]+)$`), (*gceTestFakeCompute).deleteInstance},
+	{"POST", regexp.MustCompile(`^/zones/([^/]+)/instances/([^/]+)/stop$`), (*gceTestFakeCompute).stopInstance},
+	{"POST", regexp.MustCompile(`^/zones/([^/]+)/instances/([^/]+)/start$`), (*gceTestFakeCompute).startInstance},
+	{"POST", regexp.MustCompile(`^/zones/([^/]+)/instances/([^/]+)/setMachineType$`), (*gceTestFakeCompute).setMachineType},
+	{"GET", regexp.MustCompile(`^/zones/([^/]+)/instances/([^/]+)/serialPort$`), (*gceTestFakeCompute).serialPort},
+	{"GET", regexp.MustCompile(`^/zones/([^/]+)/operations/([^/]+)$`), (*gceTestFakeCompute).getOperation},
+	{"POST", regexp.MustCompile(`^/zones/([^/]+)/instanceGroups/([^/]+)/addInstances$`), (*gceTestFakeCompute).addInstances},
+	{"POST", regexp.MustCompile(`^/zones/([^/]+)/instanceGroups/([^/]+)/listInstances$`), (*gceTestFakeCompute).listGroupInstances},
+}
+
+func (fc *gceTestFakeCompute) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+
+	path := strings.TrimPrefix(req.URL.Path, "/compute/v1/projects/project_id")
+	status, body := http.StatusNotFound, interface{}(nil)
+	fc.requests = append(fc.requests, req.Method+" "+path)
+
+	for _, route := range gceTestFakeComputeRoutes {
+		match := route.pattern.FindStringSubmatch(path)
+		if match != nil && req.Method == route.method {
+			status, body = route.handler(fc, req, match[1:])
+			break
+		}
+	}
+
+	if body == nil {
+		body = map[string]interface{}{"error": map[string]interface{}{"code": status, "message": http.StatusText(status)}}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func (fc *gceTestFakeCompute) close() {
+	fc.server.Close()
+}
+
+func (fc *gceTestFakeCompute) operation(kind, zone, targetLink string, onDone func()) *compute.Operation {
+	fc.nextOpID++
+	op := &compute.Operation{
+		Name:          fmt.Sprintf("operation-%d", fc.nextOpID),
+		OperationType: kind,
+		Status:        "PENDING",
+		TargetLink:    targetLink,
+		Zone:          zone,
+	}
+	fc.operations[op.Name] = &gceTestFakeOperation{op: op, onDone: onDone}
+
+	return op
+}
+
+func (fc *gceTestFakeCompute) selfLink(zone, kind, name string) string {
+	return fmt.Sprintf("%s/compute/v1/projects/project_id/zones/%s/%s/%s", fc.server.URL, zone, kind, name)
+}
+
+// instance returns the instance named by the second path argument if it's
+// in the zone named by the first.
+func (fc *gceTestFakeCompute) instance(args []string) (*compute.Instance, bool) {
+	inst, ok := fc.instances[args[1]]
+	if !ok || inst.Zone != args[0] {
+		return nil, false
+	}
+	return inst, true
+}
+
+// nameFilter returns the name regexp of the request's "name eq" filter.
+func (fc *gceTestFakeCompute) nameFilter(req *http.Request) *regexp.Regexp {
+	return regexp.MustCompile(strings.TrimPrefix(req.URL.Query().Get("filter"), "name eq "))
+}
+
+// getNamed returns a resource named by the last path element, for the kinds
+// of resources that always exist.
+func (fc *gceTestFakeCompute) getNamed(_ *http.Request, args []string) (int, interface{}) {
+	return http.StatusOK, map[string]string{"name": args[len(args)-1]}
+}
+
+func (fc *gceTestFakeCompute) getResourcePolicy(_ *http.Request, args []string) (int, interface{}) {
+	for _, name := range fc.resourcePolicies {
+		if name == args[1] {
+			return http.StatusOK, &compute.ResourcePolicy{
+				Name:     name,
+				Region:   args[0],
+				SelfLink: fmt.Sprintf("%s/compute/v1/projects/project_id/regions/%s/resourcePolicies/%s", fc.server.URL, args[0], name),
+			}
+		}
+	}
+
+	return http.StatusNotFound, nil
+}
+
+func (fc *gceTestFakeCompute) listImages(req *http.Request, _ []string) (int, interface{}) {
+	filter := fc.nameFilter(req)
+
+	list := &compute.ImageList{}
+	for _, image := range fc.images {
+		if filter.MatchString(image.Name) {
+			list.Items = append(list.Items, image)
+		}
+	}
+
+	return http.StatusOK, list
+}
+
+func (fc *gceTestFakeCompute) getImage(_ *http.Request, args []string) (int, interface{}) {
+	for _, image := range fc.images {
+		if image.Name == args[0] {
+			return http.StatusOK, image
+		}
+	}
+
+	return http.StatusNotFound, nil
+}
+
+func (fc *gceTestFakeCompute) listSnapshots(req *http.Request, _ []string) (int, interface{}) {
+	filter := fc.nameFilter(req)
+
+	list := &compute.SnapshotList{}
+	for _, snapshot := range fc.snapshots {
+		if filter.MatchString(snapshot.Name) {
+			list.Items = append(list.Items, snapshot)
+		}
+	}
+
+	return http.StatusOK, list
+}
+
+func (fc *gceTestFakeCompute) insertDisk(req *http.Request, args []string) (int, interface{}) {
+	disk := &compute.Disk{}
+	err := json.NewDecoder(req.Body).Decode(disk)
+	if err != nil {
+		return http.StatusBadRequest, nil
+	}
+
+	disk.SelfLink = fc.selfLink(args[0], "disks", disk.Name)
+	fc.disks[disk.Name] = disk
+
+	return http.StatusOK, fc.operation("insertDisk", args[0], disk.SelfLink, func() {})
+}
+
+func (fc *gceTestFakeCompute) deleteDisk(_ *http.Request, args []string) (int, interface{}) {
+	disk, ok := fc.disks[args[1]]
+	if !ok {
+		return http.StatusNotFound, nil
+	}
+
+	delete(fc.disks, disk.Name)
+	return http.StatusOK, fc.operation("deleteDisk", args[0], disk.SelfLink, func() {})
+}
+
+func (fc *gceTestFakeCompute) listInstances(req *http.Request, args []string) (int, interface{}) {
+	filter := fc.nameFilter(req)
+
+	list := &compute.InstanceList{}
+	for _, inst := range fc.instances {
+		if inst.Zone == args[0] && filter.MatchString(inst.Name) {
+			list.Items = append(list.Items, inst)
+		}
+	}
+
+	return http.StatusOK, list
+}
+
+func (fc *gceTestFakeCompute) insertInstance(req *http.Request, args []string) (int, interface{}) {
+	inst := &compute.Instance{}
+	err := json.NewDecoder(req.Body).Decode(inst)
+	if err != nil {
+		return http.StatusBadRequest, nil
+	}
+
+	if _, ok := fc.instances[inst.Name]; ok {
+		return http.StatusConflict, nil
+	}
+
+	inst.Status = "PROVISIONING"
+	inst.Zone = args[0]
+	inst.CreationTimestamp = time.Now().Format(time.RFC3339)
+	inst.SelfLink = fc.selfLink(args[0], "instances", inst.Name)
+	fc.instances[inst.Name] = inst
+
+	return http.StatusOK, fc.operation("insert", args[0], inst.SelfLink, func() {
+		if fc.opErrors["insert"] != nil {
+			delete(fc.instances, inst.Name)
+			return
+		}
+		inst.Status = "RUNNING"
+	})
+}
+
+func (fc *gceTestFakeCompute) getInstance(_ *http.Request, args []string) (int, interface{}) {
+	inst, ok := fc.instance(args)
+	if !ok {
+		return http.StatusNotFound, nil
+	}
+
+	if fetches, ok := fc.stopping[inst.Name]; ok && fc.stopPolls >= 0 {
+		fc.stopping[inst.Name] = fetches + 1
+		if fetches+1 >= fc.stopPolls {
+			delete(fc.stopping, inst.Name)
+			inst.Status = "TERMINATED"
+		}
+	}
+
+	return http.StatusOK, inst
+}
+
+func (fc *gceTestFakeCompute) deleteInstance(_ *http.Request, args []string) (int, interface{}) {
+	inst, ok := fc.instance(args)
+	if !ok {
+		return http.StatusNotFound, nil
+	}
+
+	inst.Status = "STOPPING"
+	delete(fc.stopping, inst.Name)
+	fc.deleted = append(fc.deleted, inst.Name)
+
+	return http.StatusOK, fc.operation("delete", args[0], inst.SelfLink, func() {
+		if fc.opErrors["delete"] == nil {
+			delete(fc.instances, inst.Name)
+		}
+	})
+}
+
+func (fc *gceTestFakeCompute) stopInstance(_ *http.Request, args []string) (int, interface{}) {
+	inst, ok := fc.instance(args)
+	if !ok {
+		return http.StatusNotFound, nil
+	}
+
+	inst.Status = "STOPPING"
+	fc.stopping[inst.Name] = 0
+
+	return http.StatusOK, fc.operation("stop", args[0], inst.SelfLink, func() {
+		delete(fc.stopping, inst.Name)
+		inst.Status = "TERMINATED"
+	})
+}
+
+func (fc *gceTestFakeCompute) startInstance(_ *http.Request, args []string) (int, interface{}) {
+	inst, ok := fc.instance(args)
+	if !ok {
+		return http.StatusNotFound, nil
+	}
+
+	inst.Status = "STAGING"
+
+	return http.StatusOK, fc.operation("start", args[0], inst.SelfLink, func() {
+		inst.Status = "RUNNING"
+	})
+}
+
+func (fc *gceTestFakeCompute) setMachineType(req *http.Request, args []string) (int, interface{}) {
+	inst, ok := fc.instance(args)
+	if !ok {
+		return http.StatusNotFound, nil
+	}
+	if inst.Status != "TERMINATED" {
+		return http.StatusBadRequest, nil
+	}
+
+	body := struct {
+		MachineType string `json:"machineType"`
+	}{}
+	err := json.NewDecoder(req.Body).Decode(&body)
+	if err != nil {
+		return http.StatusBadRequest, nil
+	}
+
+	return http.StatusOK, fc.operation("setMachineType", args[0], inst.SelfLink, func() {
+		if fc.opErrors["setMachineType"] == nil {
+			inst.MachineType = body.MachineType
+		}
+	})
+}
+
+func (fc *gceTestFakeCompute) serialPort(_ *http.Request, args []string) (int, interface{}) {
+	if _, ok := fc.instance(args); !ok {
+		return http.StatusNotFound, nil
+	}
+
+	if contents, ok := fc.serial[args[1]]; ok {
+		return http.StatusOK, &compute.SerialPortOutput{Contents: contents}
+	}
+
+	return http.StatusOK, &compute.SerialPortOutput{Contents: "booting...\n"}
+}
+
+func (fc *gceTestFakeCompute) getOperation(_ *http.Request, args []string) (int, interface{}) {
+	fop, ok := fc.operations[args[1]]
+	if !ok {
+		return http.StatusNotFound, nil
+	}
+
+	if fop.op.Status != "DONE" && fc.opPolls >= 0 {
+		fop.polls++
+		switch {
+		case fop.polls >= fc.opPolls:
+			fop.op.Status = "DONE"
+			fop.op.Error = fc.opErrors[fop.op.OperationType]
+			fop.onDone()
+		default:
+			fop.op.Status = "RUNNING"
+			fop.op.Progress = int64(100 * fop.polls / fc.opPolls)
+		}
+	}
+
+	return http.StatusOK, fop.op
+}
+
+func (fc *gceTestFakeCompute) addInstances(req *http.Request, args []string) (int, interface{}) {
+	addReq := &compute.InstanceGroupsAddInstancesRequest{}
+	err := json.NewDecoder(req.Body).Decode(addReq)
+	if err != nil {
+		return http.StatusBadRequest, nil
+	}
+
+	group := args[1]
+	return http.StatusOK, fc.operation("addInstances", args[0], fc.selfLink(args[0], "instanceGroups", group), func() {
+		if fc.opErrors["addInstances"] != nil {
+			return
+		}
+		for _, ref := range addReq.Instances {
+			fc.groups[group] = append(fc.groups[group], ref.Instance)
+		}
+	})
+}
+
+func (fc *gceTestFakeCompute) listGroupInstances(_ *http.Request, args []string) (int, interface{}) {
+	list := &compute.InstanceGroupsListInstances{}
+	for _, selfLink := range fc.groups[args[1]] {
+		list.Items = append(list.Items, &compute.InstanceWithNamedPorts{Instance: selfLink})
+	}
+
+	return http.StatusOK, list
+}
+
+func gceTestFakeComputeSetup(t *testing.T, cfg map[string]string) (*gceProvider, *gceTestFakeCompute) {
+	providerCfg := config.ProviderConfigFromMap(map[string]string{
+		"ACCOUNT_JSON":    "{}",
+		"PROJECT_ID":      "project_id",
+		"BOOT_POLL_SLEEP": "1ms",
+	})
+	for key, value := range cfg {
+		providerCfg.Set(key, value)
+	}
+
+	p, _, _ := gceTestSetup(t, providerCfg, nil)
+
+	fc, client := newGCETestFakeCompute(t)
+	p.api = &gceComputeService{client: client}
+	p.ic.Zone = &compute.Zone{Name: "us-central1-a"}
+	p.ic.MachineType = &compute.MachineType{Name: "n1-standard-2"}
+	p.ic.Network = &compute.Network{Name: "default"}
+
+	return p, fc
+}
+
+func TestGCEProvider_StartStop(t *testing.T) {
+	p, fc := gceTestFakeComputeSetup(t, nil)
+	defer gceTestTeardown(p)
+	defer fc.close()
+
+	progress := make(chan ProgressEntry, 8)
+	inst, err := p.StartWithProgress(gocontext.TODO(), &StartAttributes{Language: "minimal"}, progress)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	gceInst := inst.(*gceInstance)
+	assert.Equal(t, "travis-ci-minimal-1", gceInst.imageName)
+	assert.Equal(t, "RUNNING", fc.instances[gceInst.instance.Name].Status)
+
+	close(progress)
+	stages := []string{}
+	for entry := range progress {
+		stages = append(stages, entry.String())
+	}
+	assert.Equal(t, []string{ProgressStageInstanceInsert, "operation-running 50%", ProgressStageOperationDone}, stages)
+
+	assert.Nil(t, inst.Stop(gocontext.TODO()))
+	assert.Len(t, fc.instances, 0)
+	assert.Equal(t, []string{gceInst.instance.Name}, fc.deleted)
+}
+
+// gceTestStopRequests returns which of stop and delete the fake compute API
+// was requested to do to the named instance, in order.
+func gceTestStopRequests(fc *gceTestFakeCompute, name string) []string {
+	path := "/zones/us-central1-a/instances/" + name
+	requests := []string{}
+	for _, req := range fc.requests {
+		switch req {
+		case "POST " + path + "/stop":
+			requests = append(requests, "stop")
+		case "DELETE " + path:
+			requests = append(requests, "delete")
+		}
+	}
+	return requests
+}
+
+func TestGCEInstance_StopGracefully(t *testing.T) {
+	p, fc := gceTestFakeComputeSetup(t, map[string]string{"GRACEFUL_STOP": "true"})
+	defer gceTestTeardown(p)
+	defer fc.close()
+
+	inst, err := p.Start(gocontext.TODO(), &StartAttributes{Language: "minimal"})
+	if !assert.Nil(t, err) {
+		return
+	}
+	name := inst.(*gceInstance).instance.Name
+
+	assert.Nil(t, inst.Stop(gocontext.TODO()))
+	assert.Equal(t, []string{"stop", "delete"}, gceTestStopRequests(fc, name))
+	assert.Len(t, fc.instances, 0)
+}
+
+func TestGCEInstance_StopGracefullyTimeout(t *testing.T) {
+	p, fc := gceTestFakeComputeSetup(t, map[string]string{
+		"GRACEFUL_STOP":         "true",
+		"GRACEFUL_STOP_TIMEOUT": "50ms",
+	})
+	defer gceTestTeardown(p)
+	defer fc.close()
+
+	inst, err := p.Start(gocontext.TODO(), &StartAttributes{Language: "minimal"})
+	if !assert.Nil(t, err) {
+		return
+	}
+	name := inst.(*gceInstance).instance.Name
+
+	// the instance ignores the shutdown, so it's deleted after the timeout
+	fc.stopPolls = -1
+
+	startStop := time.Now()
+	assert.Nil(t, inst.Stop(gocontext.TODO()))
+	assert.True(t, time.Since(startStop) >= 50*time.Millisecond)
+	assert.Equal(t, []string{"stop", "delete"}, gceTestStopRequests(fc, name))
+	assert.Len(t, fc.instances, 0)
+}
+
+func TestGCEProvider_Sweep(t *testing.T) {
+	p, fc := gceTestFakeComputeSetup(t, nil)
+	defer gceTestTeardown(p)
+	defer fc.close()
+
+	inst, err := p.Start(gocontext.TODO(), &StartAttributes{Language: "minimal"})
+	if !assert.Nil(t, err) {
+		return
+	}
+	inUse := inst.(*gceInstance).instance.Name
+
+	old := time.Now().Add(-2 * time.Hour).Format(time.RFC3339)
+	expiry := &compute.Metadata{Items: []*compute.MetadataItems{
+		{Key: gceExpiresMetadataKey, Value: googleapi.String(time.Now().Format(time.RFC3339))},
+	}}
+	for _, leaked := range []*compute.Instance{
+		{Name: p.instanceNamePrefix + "leaked", CreationTimestamp: old, Metadata: expiry},
+		{Name: p.instanceNamePrefix + "booting", CreationTimestamp: time.Now().Format(time.RFC3339), Metadata: expiry},
+		{Name: p.instanceNamePrefix + "unmanaged", CreationTimestamp: old},
+		{Name: "someone-elses", CreationTimestamp: old, Metadata: expiry},
+	} {
+		leaked.Zone = "us-central1-a"
+		fc.instances[leaked.Name] = leaked
+	}
+
+	// the instance in use is as old as the leaked one
+	fc.instances[inUse].CreationTimestamp = old
+
+	reaped, err := p.Sweep(gocontext.TODO(), time.Hour)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, reaped)
+	assert.Equal(t, []string{p.instanceNamePrefix + "leaked"}, fc.deleted)
+
+	// once it's stopped, the instance is no longer in use
+	assert.Nil(t, inst.Stop(gocontext.TODO()))
+	assert.False(t, p.isActiveInstance(inUse))
+}
+
+func TestGCEProvider_StartDeletesUncheckableInstanceForJob(t *testing.T) {
+	p, fc := gceTestFakeComputeSetup(t, map[string]string{
+		"ADOPT_EXISTING_INSTANCES": "true",
+	})
+	defer gceTestTeardown(p)
+	defer fc.close()
+
+	// without a network interface there's no address to check the instance
+	// for a build script at, so it can't be adopted
+	existing := &compute.Instance{
+		Name:     p.instanceNamePrefix + "existing",
+		Status:   "RUNNING",
+		Zone:     "us-central1-a",
+		Metadata: &compute.Metadata{Items: []*compute.MetadataItems{{Key: gceJobIDMetadataKey, Value: googleapi.String("4")}}},
+	}
+	fc.instances[existing.Name] = existing
+
+	inst, err := p.Start(gocontext.TODO(), &StartAttributes{Language: "minimal", JobID: 4})
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	assert.NotEqual(t, existing.Name, inst.(*gceInstance).instance.Name)
+	assert.Equal(t, []string{existing.Name}, fc.deleted)
+}
+
+func TestGCEProvider_SetupAndStartFromSnapshot(t *testing.T) {
+	p, fc := gceTestFakeComputeSetup(t, map[string]string{
+		"SNAPSHOT_NAME": "travis-ci-snap",
+	})
+	defer gceTestTeardown(p)
+	defer fc.close()
+
+	fc.snapshots = []*compute.Snapshot{
+		{Name: "travis-ci-snap-1", SelfLink: "snap-1-link", DiskSizeGb: 30},
+		{Name: "travis-ci-snap-2", SelfLink: "snap-2-link", DiskSizeGb: 30},
+	}
+
+	if !assert.Nil(t, p.Setup()) {
+		return
+	}
+	assert.Equal(t, "us-central1-a", p.ic.Zone.Name)
+	assert.Equal(t, "n1-standard-2", p.ic.MachineType.Name)
+
+	inst, err := p.Start(gocontext.TODO(), &StartAttributes{Language: "minimal"})
+	if !assert.Nil(t, err) {
+		return
+	}
+	gceInst := inst.(*gceInstance)
+	assert.Equal(t, "travis-ci-snap-2", gceInst.imageName)
+
+	disk := fc.disks[gceInst.instance.Name]
+	if assert.NotNil(t, disk) {
+		assert.Equal(t, "snap-2-link", disk.SourceSnapshot)
+		assert.Equal(t, int64(30), disk.SizeGb)
+	}
+
+	assert.Nil(t, inst.Stop(gocontext.TODO()))
+}
+
+func TestGCEProvider_SetupResourcePolicies(t *testing.T) {
+	p, fc := gceTestFakeComputeSetup(t, map[string]string{
+		"ZONES":             "us-central1-b,us-east1-b",
+		"RESOURCE_POLICIES": "compact, missing",
+	})
+	defer gceTestTeardown(p)
+	defer fc.close()
+
+	fc.resourcePolicies = []string{"compact"}
+
+	err := p.Setup()
+	if assert.IsType(t, &gceSetupError{}, err) {
+		errs := err.(*gceSetupError).errs
+		if assert.Len(t, errs, 2) {
+			assert.Contains(t, errs[0], `resource policy "regions/us-central1/resourcePolicies/missing": googleapi: Error 404`)
+			assert.Contains(t, errs[1], `resource policy "regions/us-east1/resourcePolicies/missing": googleapi: Error 404`)
+		}
+	}
+
+	fc.resourcePolicies = append(fc.resourcePolicies, "missing")
+	if !assert.Nil(t, p.Setup()) {
+		return
+	}
+
+	inst, err := p.Start(gocontext.TODO(), &StartAttributes{Language: "minimal"})
+	if !assert.Nil(t, err) {
+		return
+	}
+	fakeInst := fc.instances[inst.(*gceInstance).instance.Name]
+	regionName := gceRegionName(fakeInst.Zone)
+	assert.Equal(t, []string{
+		fmt.Sprintf("%s/compute/v1/projects/project_id/regions/%s/resourcePolicies/compact", fc.server.URL, regionName),
+		fmt.Sprintf("%s/compute/v1/projects/project_id/regions/%s/resourcePolicies/missing", fc.server.URL, regionName),
+	}, fakeInst.ResourcePolicies)
+
+	assert.Nil(t, inst.Stop(gocontext.TODO()))
+}
+
+func TestGCEInstance_setMachineType(t *testing.T) {
+	p, fc := gceTestFakeComputeSetup(t, nil)
+	defer gceTestTeardown(p)
+	defer fc.close()
+
+	inst, err := p.Start(gocontext.TODO(), &StartAttributes{Language: "minimal"})
+	if !assert.Nil(t, err) {
+		return
+	}
+	gceInst := inst.(*gceInstance)
+	fakeInst := fc.instances[gceInst.instance.Name]
+	fakeInst.MachineType = "zones/us-central1-a/machineTypes/n1-standard-2"
+
+	assert.Nil(t, gceInst.setMachineType(gocontext.TODO(), "n1-highmem-8"))
+	assert.Equal(t, "RUNNING", fakeInst.Status)
+	assert.Equal(t, "zones/us-central1-a/machineTypes/n1-highmem-8", gceInst.instance.MachineType)
+
+	// a failed resize still starts the instance again
+	fc.opErrors["setMachineType"] = &compute.OperationError{Errors: []*compute.OperationErrorErrors{{Code: "RESOURCE_NOT_FOUND"}}}
+	err = gceInst.setMachineType(gocontext.TODO(), "n1-unknown-8")
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "RESOURCE_NOT_FOUND")
+	}
+	assert.Equal(t, "RUNNING", fakeInst.Status)
+	assert.Equal(t, "zones/us-central1-a/machineTypes/n1-highmem-8", fakeInst.MachineType)
+}
+
+func TestGCEProvider_StartStrictImageMatch(t *testing.T) {
+	p, fc := gceTestFakeComputeSetup(t, nil)
+	defer gceTestTeardown(p)
+	defer fc.close()
+
+	inst, err := p.Start(gocontext.TODO(), &StartAttributes{Language: "minimal", OS: "windows"})
+	if assert.Nil(t, err) {
+		assert.Nil(t, inst.Stop(gocontext.TODO()))
+	}
+
+	p.strictImageMatch = true
+	_, err = p.Start(gocontext.TODO(), &StartAttributes{Language: "minimal", OS: "windows"})
+	if assert.IsType(t, &StartError{}, err) {
+		assert.Equal(t, ErrImageMismatch, err.(*StartError).Cause)
+		assert.False(t, err.(*StartError).Recoverable())
+	}
+	assert.Len(t, fc.deleted, 1)
+}
+
+func TestGCEProvider_StartImageNotFound(t *testing.T) {
+	p, fc := gceTestFakeComputeSetup(t, map[string]string{
+		"DEFAULT_LANGUAGE":   "go",
+		"LANGUAGE_MAP_JRUBY": "ruby",
+	})
+	defer gceTestTeardown(p)
+	defer fc.close()
+
+	_, err := p.Start(gocontext.TODO(), &StartAttributes{Language: "jruby"})
+	if assert.IsType(t, &StartError{}, err) {
+		assert.Equal(t, ErrImageNotFound, err.(*StartError).Cause)
+		assert.Equal(t, &ImageNotFoundError{Filters: []string{
+			fmt.Sprintf(gceImageTravisCIPrefixFilter, "ruby"),
+			fmt.Sprintf(gceImageTravisCIPrefixFilter, "go"),
+		}}, err.(*StartError).Err)
+		assert.Contains(t, err.Error(), "no image found with filters ")
+	}
+	assert.Len(t, fc.instances, 0)
+}
+
+func TestGCEProvider_StartOperationError(t *testing.T) {
+	p, fc := gceTestFakeComputeSetup(t, nil)
+	defer gceTestTeardown(p)
+	defer fc.close()
+
+	fc.opErrors["insert"] = &compute.OperationError{
+		Errors: []*compute.OperationErrorErrors{{Code: "ZONE_RESOURCE_POOL_EXHAUSTED"}},
+	}
+
+	_, err := p.Start(gocontext.TODO(), &StartAttributes{Language: "minimal"})
+	if assert.IsType(t, &StartError{}, err) {
+		assert.Equal(t, ErrResourceExhausted, err.(*StartError).Cause)
+	}
+	assert.Len(t, fc.instances, 0)
+}
+
+func TestGCEProvider_StartShielded(t *testing.T) {
+	p, fc := gceTestFakeComputeSetup(t, map[string]string{
+		"SHIELDED_SECURE_BOOT": "true",
+		"SHIELDED_VTPM":        "true",
+	})
+	defer gceTestTeardown(p)
+	defer fc.close()
+
+	inst, err := p.Start(gocontext.TODO(), &StartAttributes{Language: "minimal"})
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, &compute.ShieldedInstanceConfig{EnableSecureBoot: true, EnableVtpm: true},
+		fc.instances[inst.(*gceInstance).instance.Name].ShieldedInstanceConfig)
+	assert.Nil(t, inst.Stop(gocontext.TODO()))
+
+	// images without UEFI support fail to boot with shielded VM options
+	fc.opErrors["insert"] = &compute.OperationError{
+		Errors: []*compute.OperationErrorErrors{{Code: "INVALID_RESOURCE_USAGE", Message: "secure boot isn't supported"}},
+	}
+
+	_, err = p.Start(gocontext.TODO(), &StartAttributes{Language: "minimal"})
+	if assert.IsType(t, &gceOpError{}, err) {
+		assert.Contains(t, err.Error(), "code=INVALID_RESOURCE_USAGE")
+		assert.Contains(t, err.Error(), "image travis-ci-minimal-1 has the UEFI_COMPATIBLE guest OS feature")
+	}
+	assert.Len(t, fc.instances, 0)
+}
+
+func TestGCEProvider_SetupConfidentialMachineTypes(t *testing.T) {
+	p, fc := gceTestFakeComputeSetup(t, map[string]string{
+		"CONFIDENTIAL_COMPUTE":  "true",
+		"PREEMPTIBLE":           "false",
+		"ALLOWED_MACHINE_TYPES": "n2d-standard-4,e2-standard-4",
+	})
+	defer gceTestTeardown(p)
+	defer fc.close()
+
+	assert.Equal(t, "TERMINATE", p.ic.OnHostMaintenance)
+	assert.Equal(t, &compute.ConfidentialInstanceConfig{EnableConfidentialCompute: true},
+		p.buildInstance("us-central1-a", &StartAttributes{}, p.ic.MachineType, "image-link", "").ConfidentialInstanceConfig)
+
+	err := p.Setup()
+	if assert.IsType(t, &gceSetupError{}, err) {
+		assert.Equal(t, []string{
+			`machine type "n1-standard-2": confidential instances need an N2D or C2D machine type`,
+			`machine type "e2-standard-4": confidential instances need an N2D or C2D machine type`,
+		}, err.(*gceSetupError).errs)
+	}
+
+	p.cfg.Set("MACHINE_TYPE", "n2d-standard-2")
+	delete(p.allowedMachineTypes, "e2-standard-4")
+	assert.Nil(t, p.Setup())
+
+	p.cfg.Set("ON_HOST_MAINTENANCE", "MIGRATE")
+	_, err = newGCEProvider(p.cfg)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, "ON_HOST_MAINTENANCE can't be MIGRATE for confidential instances", err.Error())
+	}
+}
+
+func TestGCEProvider_StartDiskKMSKeyPermissionDenied(t *testing.T) {
+	p, fc := gceTestFakeComputeSetup(t, map[string]string{
+		"DISK_KMS_KEY": "projects/project_id/locations/us-central1/keyRings/builds/cryptoKeys/disks",
+	})
+	defer gceTestTeardown(p)
+	defer fc.close()
+
+	fc.opErrors["insert"] = &compute.OperationError{
+		Errors: []*compute.OperationErrorErrors{{
+			Code:    "INVALID_FIELD_VALUE",
+			Message: "Cloud KMS error when using key projects/project_id/locations/us-central1/keyRings/builds/cryptoKeys/disks: Permission 'cloudkms.cryptoKeyVersions.useToEncrypt' denied on resource",
+		}},
+	}
+
+	_, err := p.Start(gocontext.TODO(), &StartAttributes{Language: "minimal"})
+	if assert.IsType(t, &StartError{}, err) {
+		assert.Equal(t, ErrDiskEncryptionKey, err.(*StartError).Cause)
+		assert.False(t, err.(*StartError).Recoverable())
+		assert.Contains(t, err.Error(), "check that the project's compute engine service agent has the cloudkms.cryptoKeyEncrypterDecrypter role")
+	}
+	assert.Len(t, fc.instances, 0)
+}
+
+func TestGCEProvider_StartCancelledWhileBooting(t *testing.T) {
+	p, fc := gceTestFakeComputeSetup(t, nil)
+	defer gceTestTeardown(p)
+	defer fc.close()
+
+	fc.opPolls = -1
+
+	ctx, cancel := gocontext.WithCancel(gocontext.TODO())
+	time.AfterFunc(20*time.Millisecond, cancel)
+
+	_, err := p.Start(ctx, &StartAttributes{Language: "minimal"})
+	assert.Equal(t, gocontext.Canceled, err)
+	assert.Len(t, fc.deleted, 1)
+
+	ctx, cancel = gocontext.WithTimeout(gocontext.TODO(), 20*time.Millisecond)
+	defer cancel()
+
+	_, err = p.Start(ctx, &StartAttributes{Language: "minimal"})
+	if assert.IsType(t, &StartError{}, err) {
+		assert.Equal(t, ErrBootTimeout, err.(*StartError).Cause)
+		assert.Contains(t, err.Error(), "booting...")
+	}
+	assert.Len(t, fc.deleted, 2)
+}
+
+func TestGCEProvider_StartBootHardTimeout(t *testing.T) {
+	p, fc := gceTestFakeComputeSetup(t, map[string]string{
+		"BOOT_HARD_TIMEOUT": "20ms",
+	})
+	defer gceTestTeardown(p)
+	defer fc.close()
+
+	fc.opPolls = -1
+
+	_, err := p.Start(gocontext.TODO(), &StartAttributes{Language: "minimal"})
+	if assert.IsType(t, &StartError{}, err) {
+		assert.Equal(t, ErrBootHardTimeout, err.(*StartError).Cause)
+		assert.Contains(t, err.Error(), "wasn't ready within 20ms")
+	}
+	assert.Len(t, fc.deleted, 1)
+
+	// a shorter context still times out as usual
+	ctx, cancel := gocontext.WithTimeout(gocontext.TODO(), 5*time.Millisecond)
+	defer cancel()
+
+	_, err = p.Start(ctx, &StartAttributes{Language: "minimal"})
+	if assert.IsType(t, &StartError{}, err) {
+		assert.Equal(t, ErrBootTimeout, err.(*StartError).Cause)
+	}
+	assert.Len(t, fc.deleted, 2)
+}
+
+func TestGCEProvider_StartInstanceGroup(t *testing.T) {
+	p, fc := gceTestFakeComputeSetup(t, map[string]string{
+		"INSTANCE_GROUP":          "testing-group",
+		"VERIFY_GROUP_MEMBERSHIP": "true",
+	})
+	defer gceTestTeardown(p)
+	defer fc.close()
+
+	progress := make(chan ProgressEntry, 8)
+	inst, err := p.StartWithProgress(gocontext.TODO(), &StartAttributes{Language: "minimal"}, progress)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	selfLink := inst.(*gceInstance).instance.SelfLink
+	assert.Equal(t, []string{selfLink}, fc.groups["testing-group"])
+
+	close(progress)
+	stages := []string{}
+	for entry := range progress {
+		stages = append(stages, entry.Stage)
+	}
+	assert.Equal(t, []string{
+		ProgressStageInstanceInsert,
+		ProgressStageOperationRunning,
+		ProgressStageOperationDone,
+		ProgressStageGroupAdd,
+		ProgressStageGroupAdded,
+	}, stages)
+
+	_, err = p.Start(gocontext.TODO(), &StartAttributes{
+		Language: "minimal",
+		VMConfig: VMConfig{SkipInstanceGroup: true},
+	})
+	assert.Nil(t, err)
+	assert.Len(t, fc.groups["testing-group"], 1)
+
+	fc.opErrors["addInstances"] = &compute.OperationError{
+		Errors: []*compute.OperationErrorErrors{{Code: "RESOURCE_NOT_READY"}},
+	}
+
+	_, err = p.Start(gocontext.TODO(), &StartAttributes{Language: "minimal"})
+	assert.IsType(t, &gceOpError{}, err)
+	if assert.Len(t, fc.deleted, 1) {
+		assert.Equal(t, "STOPPING", fc.instances[fc.deleted[0]].Status)
+	}
+}
+
+func TestGCEProvider_StartImageRollout(t *testing.T) {
+	p, fc := gceTestFakeComputeSetup(t, map[string]string{"IMAGE_ROLLOUT": "0,100"})
+	defer gceTestTeardown(p)
+	defer fc.close()
+
+	fc.images = append(fc.images, &compute.Image{Name: "travis-ci-minimal-2", SelfLink: "travis-ci-minimal-2-link"})
+
+	image, err := p.getImage(gocontext.TODO(), &StartAttributes{Language: "minimal", JobID: 42})
+	if assert.Nil(t, err) {
+		assert.Equal(t, "travis-ci-minimal-1", image.Name)
+	}
+
+	image, err = p.getImage(gocontext.TODO(), &StartAttributes{Language: "minimal"})
+	if assert.Nil(t, err) {
+		assert.Equal(t, "travis-ci-minimal-2", image.Name)
+	}
+}
@@ -0,0 +1,136 @@
+package backend
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	gocontext "golang.org/x/net/context"
+)
+
+const (
+	gceHostKeyFingerprintsBegin = "-----BEGIN SSH HOST KEY FINGERPRINTS-----"
+	gceHostKeyFingerprintsEnd   = "-----END SSH HOST KEY FINGERPRINTS-----"
+)
+
+// gceHostKeyFingerprintRegexp matches a line of the fingerprints block that
+// cloud-init writes to the serial console, e.g.
+// "256 SHA256:n0Tx2O0C... root@travis-job (ECDSA)" or, from older versions,
+// "2048 9b:4f:...:c1 /etc/ssh/ssh_host_rsa_key.pub (RSA)".
+var gceHostKeyFingerprintRegexp = regexp.MustCompile(`\d+ ((?:SHA256|MD5):\S+|[0-9a-f]{2}(?::[0-9a-f]{2}){15}) .*\(\w+\)`)
+
+// gceNoHostKeyFingerprintError is returned by HostKeyFingerprint when the
+// instance's serial console output contains no host key fingerprints, either
+// because its image doesn't publish them or because it didn't yet.
+type gceNoHostKeyFingerprintError struct {
+	instance string
+}
+
+func (e *gceNoHostKeyFingerprintError) Error() string {
+	return fmt.Sprintf("instance %s didn't publish ssh host key fingerprints", e.instance)
+}
+
+// Temporary returns true, as the instance may still publish its fingerprints,
+// so that ssh connections failing because of it are retried.
+func (e *gceNoHostKeyFingerprintError) Temporary() bool {
+	return true
+}
+
+// hostKeyCallback returns the ssh.ClientConfig HostKeyCallback for the
+// provider's SSH_HOST_KEY_MODE, which is nil to accept any host key.
+func (i *gceInstance) hostKeyCallback(ctx gocontext.Context) func(string, net.Addr, ssh.PublicKey) error {
+	switch i.provider.sshHostKeyMode {
+	case gceSSHHostKeyModeKnownHosts:
+		return i.provider.sshKnownHosts.HostKeyCallback
+	case "instance-metadata":
+		return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			fingerprints, err := i.hostKeyFingerprints(ctx)
+			if err != nil {
+				return err
+			}
+
+			for _, fingerprint := range fingerprints {
+				if gceHostKeyFingerprintMatches(key, fingerprint) {
+					return nil
+				}
+			}
+
+			return fmt.Errorf("host key of instance %s doesn't match any of its published fingerprints", i.instance.Name)
+		}
+	default:
+		return nil
+	}
+}
+
+// HostKeyFingerprint returns the first of the ssh host key fingerprints the
+// instance's image wrote to the serial console while booting.
+func (i *gceInstance) HostKeyFingerprint(ctx gocontext.Context) (string, error) {
+	fingerprints, err := i.hostKeyFingerprints(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return fingerprints[0], nil
+}
+
+// hostKeyFingerprints returns all ssh host key fingerprints the instance's
+// image wrote to the serial console while booting.
+func (i *gceInstance) hostKeyFingerprints(ctx gocontext.Context) ([]string, error) {
+	output, err := i.SerialOutput(ctx, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	fingerprints := gceParseHostKeyFingerprints(output)
+	if len(fingerprints) == 0 {
+		return nil, &gceNoHostKeyFingerprintError{instance: i.instance.Name}
+	}
+
+	return fingerprints, nil
+}
+
+// gceParseHostKeyFingerprints returns the fingerprints listed in the last
+// fingerprints block of the given serial console output.
+func gceParseHostKeyFingerprints(contents string) []string {
+	begin := strings.LastIndex(contents, gceHostKeyFingerprintsBegin)
+	if begin == -1 {
+		return nil
+	}
+
+	block := contents[begin+len(gceHostKeyFingerprintsBegin):]
+	if end := strings.Index(block, gceHostKeyFingerprintsEnd); end != -1 {
+		block = block[:end]
+	}
+
+	fingerprints := []string{}
+	for _, line := range strings.Split(block, "\n") {
+		match := gceHostKeyFingerprintRegexp.FindStringSubmatch(line)
+		if match != nil {
+			fingerprints = append(fingerprints, match[1])
+		}
+	}
+
+	return fingerprints
+}
+
+// gceHostKeyFingerprintMatches returns whether the fingerprint, in either the
+// SHA256 or the MD5 form printed by ssh-keygen, is that of the given key.
+func gceHostKeyFingerprintMatches(key ssh.PublicKey, fingerprint string) bool {
+	if strings.HasPrefix(fingerprint, "SHA256:") {
+		sum := sha256.Sum256(key.Marshal())
+		return strings.TrimPrefix(fingerprint, "SHA256:") == strings.TrimRight(base64.StdEncoding.EncodeToString(sum[:]), "=")
+	}
+
+	sum := md5.Sum(key.Marshal())
+	hexParts := make([]string, len(sum))
+	for idx, b := range sum {
+		hexParts[idx] = fmt.Sprintf("%02x", b)
+	}
+
+	return strings.TrimPrefix(fingerprint, "MD5:") == strings.Join(hexParts, ":")
+}
@@ -0,0 +1,122 @@
+package backend
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	gocontext "golang.org/x/net/context"
+	"google.golang.org/api/compute/v1"
+)
+
+const gceTestSerialOutput = `[    5.1234] cloud-init[812]: Cloud-init v. 0.7.5 running 'modules:final'
+ec2:
+ec2: #############################################################
+ec2: -----BEGIN SSH HOST KEY FINGERPRINTS-----
+ec2: 1024 SHA256:Qgkcq9aBxZsaUbpA8Pxcd1NK2KMZkCnA3zl2Amb2rEc root@testing-gce-abc (DSA)
+ec2: 256 SHA256:n0Tx2O0CWcf6TpOqcuqu3OkmmeBLz9uxE8JKJ4UtIAY root@testing-gce-abc (ECDSA)
+ec2: 2048 9b:4f:0e:22:84:51:ab:e1:5c:3d:8e:19:0f:aa:72:c1 /etc/ssh/ssh_host_rsa_key.pub (RSA)
+ec2: -----END SSH HOST KEY FINGERPRINTS-----
+ec2: #############################################################
+`
+
+func TestGCEParseHostKeyFingerprints(t *testing.T) {
+	assert.Equal(t, []string{
+		"SHA256:Qgkcq9aBxZsaUbpA8Pxcd1NK2KMZkCnA3zl2Amb2rEc",
+		"SHA256:n0Tx2O0CWcf6TpOqcuqu3OkmmeBLz9uxE8JKJ4UtIAY",
+		"9b:4f:0e:22:84:51:ab:e1:5c:3d:8e:19:0f:aa:72:c1",
+	}, gceParseHostKeyFingerprints(gceTestSerialOutput))
+
+	assert.Len(t, gceParseHostKeyFingerprints("booting...\nlogin: "), 0)
+}
+
+func TestGCEInstance_HostKeyFingerprint(t *testing.T) {
+	serialOutputPath := "/compute/v1/projects/project_id/zones/us-central1-a/instances/testing-gce-abc/serialPort"
+	rt := &gceTestRoundTripper{responses: map[string]string{
+		serialOutputPath: `{"contents":"booting...\n"}`,
+	}}
+	client, err := compute.New(&http.Client{Transport: rt})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i := &gceInstance{
+		provider:  &gceProvider{api: &gceComputeService{client: client}},
+		instance:  &compute.Instance{Name: "testing-gce-abc"},
+		ic:        &gceInstanceConfig{Zone: &compute.Zone{Name: "us-central1-a"}},
+		projectID: "project_id",
+	}
+
+	_, err = i.HostKeyFingerprint(gocontext.TODO())
+	assert.IsType(t, &gceNoHostKeyFingerprintError{}, err)
+
+	contents := strings.Replace(strings.Replace(gceTestSerialOutput, "\n", `\n`, -1), `"`, `\"`, -1)
+	rt.responses[serialOutputPath] = fmt.Sprintf(`{"contents":"%s"}`, contents)
+
+	fingerprint, err := i.HostKeyFingerprint(gocontext.TODO())
+	assert.Nil(t, err)
+	assert.Equal(t, "SHA256:Qgkcq9aBxZsaUbpA8Pxcd1NK2KMZkCnA3zl2Amb2rEc", fingerprint)
+}
+
+func TestGCEHostKeyFingerprintMatches(t *testing.T) {
+	key := sshTestSigner(t).PublicKey()
+	otherKey := sshTestSigner(t).PublicKey()
+
+	sha256Sum := sha256.Sum256(key.Marshal())
+	sha256Fingerprint := "SHA256:" + strings.TrimRight(base64.StdEncoding.EncodeToString(sha256Sum[:]), "=")
+
+	md5Sum := md5.Sum(key.Marshal())
+	md5Parts := []string{}
+	for _, b := range md5Sum {
+		md5Parts = append(md5Parts, fmt.Sprintf("%02x", b))
+	}
+	md5Fingerprint := strings.Join(md5Parts, ":")
+
+	for _, fingerprint := range []string{sha256Fingerprint, md5Fingerprint, "MD5:" + md5Fingerprint} {
+		assert.True(t, gceHostKeyFingerprintMatches(key, fingerprint), fingerprint)
+		assert.False(t, gceHostKeyFingerprintMatches(otherKey, fingerprint), fingerprint)
+	}
+}
+
+func TestGCEInstance_hostKeyCallback(t *testing.T) {
+	key := sshTestSigner(t).PublicKey()
+	sum := sha256.Sum256(key.Marshal())
+	fingerprint := "SHA256:" + strings.TrimRight(base64.StdEncoding.EncodeToString(sum[:]), "=")
+
+	serialOutputPath := "/compute/v1/projects/project_id/zones/us-central1-a/instances/testing-gce-abc/serialPort"
+	rt := &gceTestRoundTripper{responses: map[string]string{
+		serialOutputPath: `{"contents":"booting...\n"}`,
+	}}
+	client, err := compute.New(&http.Client{Transport: rt})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i := &gceInstance{
+		provider:  &gceProvider{api: &gceComputeService{client: client}, sshHostKeyMode: "insecure"},
+		instance:  &compute.Instance{Name: "testing-gce-abc"},
+		ic:        &gceInstanceConfig{Zone: &compute.Zone{Name: "us-central1-a"}},
+		projectID: "project_id",
+	}
+
+	assert.Nil(t, i.hostKeyCallback(gocontext.TODO()))
+
+	i.provider.sshHostKeyMode = "instance-metadata"
+	callback := i.hostKeyCallback(gocontext.TODO())
+
+	err = callback("10.0.0.1:22", nil, key)
+	if assert.IsType(t, &gceNoHostKeyFingerprintError{}, err) {
+		assert.True(t, err.(*gceNoHostKeyFingerprintError).Temporary())
+	}
+
+	rt.responses[serialOutputPath] = fmt.Sprintf(`{"contents":"%s\n256 %s root@testing-gce-abc (ECDSA)\n%s\n"}`,
+		gceHostKeyFingerprintsBegin, fingerprint, gceHostKeyFingerprintsEnd)
+
+	assert.Nil(t, callback("10.0.0.1:22", nil, key))
+	assert.NotNil(t, callback("10.0.0.1:22", nil, sshTestSigner(t).PublicKey()))
+}
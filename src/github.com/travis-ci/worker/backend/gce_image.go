@@ -0,0 +1,449 @@
+package backend
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/travis-ci/worker/context"
+	"github.com/travis-ci/worker/image"
+	"github.com/travis-ci/worker/metrics"
+	gocontext "golang.org/x/net/context"
+	"google.golang.org/api/compute/v1"
+)
+
+// defaultBootSource resolves the image or snapshot booted from when a job
+// doesn't ask for anything specific, returning its name or, if it couldn't be
+// resolved, the name or filter it was looked up by.
+func (p *gceProvider) defaultBootSource() (string, error) {
+	if p.snapshotName != "" {
+		snapshot, err := p.snapshotByPrefix(p.snapshotName)
+		if err != nil {
+			return p.snapshotName, err
+		}
+		return snapshot.Name, nil
+	}
+
+	if p.imageSelectorType == "env" || p.imageSelectorType == "api" {
+		image, err := p.imageByFilter(fmt.Sprintf("name eq ^%s", p.defaultImage), 0)
+		if err != nil {
+			return p.defaultImage, err
+		}
+		return image.Name, nil
+	}
+
+	image, err := p.imageForLanguage(p.defaultLanguage, 0)
+	if err != nil {
+		return p.defaultLanguage, err
+	}
+	return image.Name, nil
+}
+
+// checkImageMatch guards against image maps that have drifted from the
+// images they point at by checking that the selected image mentions the job's
+// dist, and windows for windows jobs only, in its name or description. The
+// vendored compute API has no image labels or families to go by instead.
+// Mismatches are logged, or returned as errors with STRICT_IMAGE_MATCH.
+func (p *gceProvider) checkImageMatch(ctx gocontext.Context, image *compute.Image, startAttributes *StartAttributes) error {
+	mismatch := gceImageMismatch(image, startAttributes)
+	if mismatch == "" {
+		return nil
+	}
+
+	metrics.Mark("worker.vm.provider.gce.image.mismatch")
+
+	logger := context.LoggerFromContext(ctx).WithFields(logrus.Fields{
+		"image":    image.Name,
+		"os":       startAttributes.OS,
+		"dist":     startAttributes.Dist,
+		"mismatch": mismatch,
+	})
+
+	if !p.strictImageMatch {
+		logger.Warn("selected image doesn't match job")
+		return nil
+	}
+
+	logger.Error("selected image doesn't match job")
+	return &StartError{
+		Cause: ErrImageMismatch,
+		Err:   fmt.Errorf("image %s %s", image.Name, mismatch),
+	}
+}
+
+// gceImageMismatch describes how the image doesn't match the job's OS or
+// dist, or returns an empty string if it matches.
+func gceImageMismatch(image *compute.Image, startAttributes *StartAttributes) string {
+	text := strings.ToLower(image.Name + " " + image.Description)
+	windowsImage := strings.Contains(text, "windows")
+
+	if startAttributes.OS == "windows" {
+		if !windowsImage {
+			return "isn't a windows image"
+		}
+		return ""
+	}
+
+	if windowsImage {
+		return fmt.Sprintf("is a windows image, but the job's os is %q", startAttributes.OS)
+	}
+
+	dist := strings.ToLower(startAttributes.Dist)
+	if dist != "" && !strings.Contains(text, dist) {
+		return fmt.Sprintf("doesn't mention dist %q", startAttributes.Dist)
+	}
+
+	return ""
+}
+
+// getImage finds the image to boot for the given start attributes. An image
+// self link given by the job takes precedence over a forced image configured
+// for the job's osx_image or dist, which takes precedence over the image
+// selector, which in turn may fall back to the default image.
+func (p *gceProvider) getImage(ctx gocontext.Context, startAttributes *StartAttributes) (*compute.Image, error) {
+	logger := context.LoggerFromContext(ctx)
+
+	if startAttributes.ImageSelfLink != "" {
+		logger.WithFields(logrus.Fields{
+			"image_self_link": startAttributes.ImageSelfLink,
+		}).Debug("using image self link, bypassing image selection")
+		return p.imageBySelfLink(startAttributes.ImageSelfLink)
+	}
+
+	if imageName, ok := p.forcedImageName(startAttributes); ok {
+		logger.WithFields(logrus.Fields{
+			"image": imageName,
+		}).Debug("using forced image, bypassing image selector")
+		return p.imageByFilter(fmt.Sprintf("name eq ^%s", imageName), startAttributes.JobID)
+	}
+
+	switch p.imageSelectorType {
+	case "env", "api":
+		return p.imageSelect(ctx, startAttributes)
+	default:
+		logger.WithFields(logrus.Fields{
+			"selector_type": p.imageSelectorType,
+		}).Warn("unknown image selector, falling back to legacy image selection")
+		return p.legacyImageSelect(ctx, startAttributes)
+	}
+}
+
+// imageBySelfLink looks up the image with the given self link, which must
+// be in one of the allowed image projects.
+func (p *gceProvider) imageBySelfLink(selfLink string) (*compute.Image, error) {
+	match := gceImageSelfLinkRegexp.FindStringSubmatch(selfLink)
+	if match == nil {
+		return nil, &StartError{
+			Cause: ErrImageNotAllowed,
+			Err:   fmt.Errorf("invalid image self link %q", selfLink),
+		}
+	}
+
+	project, name := match[1], match[2]
+	if !p.allowedImageProjects[project] {
+		return nil, &StartError{
+			Cause: ErrImageNotAllowed,
+			Err:   fmt.Errorf("image project %q is not in ALLOWED_IMAGE_PROJECTS", project),
+		}
+	}
+
+	image, err := p.api.GetImage(project, name)
+	if err != nil {
+		if gceIsNotFound(err) {
+			return nil, &StartError{Cause: ErrImageNotFound, Err: err}
+		}
+		return nil, err
+	}
+
+	return image, nil
+}
+
+// forcedImageName returns the image name configured via FORCE_IMAGE_{VALUE}
+// for the job's osx_image or, failing that, its dist.
+func (p *gceProvider) forcedImageName(startAttributes *StartAttributes) (string, bool) {
+	for _, value := range []string{startAttributes.OsxImage, startAttributes.Dist} {
+		if value == "" {
+			continue
+		}
+
+		key := fmt.Sprintf("FORCE_IMAGE_%s", strings.ToUpper(nonAlphaNumRegexp.ReplaceAllString(value, "_")))
+		if p.cfg.IsSet(key) {
+			return p.cfg.Get(key), true
+		}
+	}
+
+	return "", false
+}
+
+func (p *gceProvider) legacyImageSelect(ctx gocontext.Context, startAttributes *StartAttributes) (*compute.Image, error) {
+	logger := context.LoggerFromContext(ctx)
+
+	var (
+		image *compute.Image
+		err   error
+	)
+
+	candidateLangs := []string{}
+
+	mappedLang := fmt.Sprintf("LANGUAGE_MAP_%s", strings.ToUpper(startAttributes.Language))
+	if p.cfg.IsSet(mappedLang) {
+		logger.WithFields(logrus.Fields{
+			"original": startAttributes.Language,
+			"mapped":   p.cfg.Get(mappedLang),
+		}).Debug("using mapped language to candidates")
+		candidateLangs = append(candidateLangs, p.cfg.Get(mappedLang))
+	} else {
+		logger.WithFields(logrus.Fields{
+			"original": startAttributes.Language,
+		}).Debug("adding original language to candidates")
+		candidateLangs = append(candidateLangs, startAttributes.Language)
+	}
+	candidateLangs = append(candidateLangs, p.defaultLanguage)
+
+	// when no candidate has an image, every filter tried is reported,
+	// unless a lookup failed for another reason
+	notFound := &ImageNotFoundError{}
+	var lookupErr error
+
+	for _, language := range candidateLangs {
+		logger.WithFields(logrus.Fields{
+			"original":  startAttributes.Language,
+			"candidate": language,
+		}).Debug("searching for image matching language")
+
+		image, err = p.imageForLanguage(language, startAttributes.JobID)
+		if err == nil {
+			logger.WithFields(logrus.Fields{
+				"candidate": language,
+				"image":     image,
+			}).Debug("found matching image for language")
+			return image, nil
+		}
+
+		if startErr, ok := err.(*StartError); ok {
+			if imageErr, ok := startErr.Err.(*ImageNotFoundError); ok {
+				notFound.Filters = append(notFound.Filters, imageErr.Filters...)
+				continue
+			}
+		}
+
+		logger.WithFields(logrus.Fields{
+			"candidate": language,
+			"err":       err,
+		}).Warn("couldn't search for image matching language")
+		lookupErr = err
+	}
+
+	if lookupErr != nil {
+		return nil, lookupErr
+	}
+
+	return nil, &StartError{Cause: ErrImageNotFound, Err: notFound}
+}
+
+// imageByFilter returns the lexically last image matching the filter or, with
+// IMAGE_ROLLOUT, the image the job with the given ID is rolled out to.
+func (p *gceProvider) imageByFilter(filter string, jobID uint64) (*compute.Image, error) {
+	// TODO: add some TTL cache in here maybe?
+	images, err := p.api.ListImages(p.projectID, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(images.Items) == 0 {
+		return nil, &StartError{
+			Cause: ErrImageNotFound,
+			Err:   &ImageNotFoundError{Filters: []string{filter}},
+		}
+	}
+
+	imagesByName := map[string]*compute.Image{}
+	imageNames := []string{}
+	for _, image := range images.Items {
+		imagesByName[image.Name] = image
+		imageNames = append(imageNames, image.Name)
+	}
+
+	sort.Sort(sort.Reverse(sort.StringSlice(imageNames)))
+
+	idx := gceImageRolloutIndex(p.imageRollout, len(imageNames), jobID)
+	if idx > 0 {
+		metrics.Mark("worker.vm.provider.gce.image.rollout.previous")
+	}
+
+	return imagesByName[imageNames[idx]], nil
+}
+
+// parseGCEImageRollout parses comma-delimited percentages, which must add up
+// to 100, of jobs booting the newest, previous and so on of matching images.
+func parseGCEImageRollout(value string) ([]int, error) {
+	weights := []int{}
+	total := 0
+
+	for _, part := range strings.Split(value, ",") {
+		weight, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("invalid IMAGE_ROLLOUT %q, must be comma-delimited percentages", value)
+		}
+		weights = append(weights, weight)
+		total += weight
+	}
+
+	if total != 100 {
+		return nil, fmt.Errorf("invalid IMAGE_ROLLOUT %q, percentages add up to %d instead of 100", value, total)
+	}
+
+	return weights, nil
+}
+
+// gceImageRolloutIndex returns the index of the image, counting from the
+// newest of the given number of images, that the job is rolled out to. Jobs
+// are placed by a hash of their ID, so that a job boots the same image each
+// time it's tried. Percentages of images that don't exist are left out, and
+// the newest image is used without a rollout or a job ID.
+func gceImageRolloutIndex(weights []int, images int, jobID uint64) int {
+	if len(weights) > images {
+		weights = weights[:images]
+	}
+
+	total := 0
+	for _, weight := range weights {
+		total += weight
+	}
+
+	if total == 0 || jobID == 0 {
+		return 0
+	}
+
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(strconv.FormatUint(jobID, 10)))
+	point := int(hash.Sum32() % uint32(total))
+
+	for idx, weight := range weights {
+		if point < weight {
+			return idx
+		}
+		point -= weight
+	}
+
+	return 0
+}
+
+// bootDiskSize returns the configured disk size, or the minimum disk size of
+// the image or snapshot booted from if that's larger and AUTO_EXPAND_DISK is
+// enabled.
+func (p *gceProvider) bootDiskSize(ctx gocontext.Context, imageName string, minDiskSize int64) (int64, error) {
+	if p.ic.DiskSize >= minDiskSize {
+		return p.ic.DiskSize, nil
+	}
+
+	if !p.ic.AutoExpandDisk {
+		return 0, fmt.Errorf("disk size %dGB is smaller than the %dGB required by %s", p.ic.DiskSize, minDiskSize, imageName)
+	}
+
+	context.LoggerFromContext(ctx).WithFields(logrus.Fields{
+		"image":         imageName,
+		"disk_size":     p.ic.DiskSize,
+		"min_disk_size": minDiskSize,
+	}).Warn("disk size is smaller than required by image, expanding")
+
+	return minDiskSize, nil
+}
+
+// snapshotByPrefix returns the lexically last snapshot whose name starts with
+// the given prefix.
+func (p *gceProvider) snapshotByPrefix(prefix string) (*compute.Snapshot, error) {
+	filter := fmt.Sprintf("name eq ^%s.*", prefix)
+	snapshots, err := p.api.ListSnapshots(p.projectID, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(snapshots.Items) == 0 {
+		return nil, &StartError{
+			Cause: ErrImageNotFound,
+			Err:   fmt.Errorf("no snapshot found with filter %s", filter),
+		}
+	}
+
+	snapshotsByName := map[string]*compute.Snapshot{}
+	snapshotNames := []string{}
+	for _, snapshot := range snapshots.Items {
+		snapshotsByName[snapshot.Name] = snapshot
+		snapshotNames = append(snapshotNames, snapshot.Name)
+	}
+
+	sort.Strings(snapshotNames)
+
+	return snapshotsByName[snapshotNames[len(snapshotNames)-1]], nil
+}
+
+// attachBootDiskFromSnapshot creates a disk from the given snapshot, named
+// after the instance, and replaces the instance's boot disk with it. The
+// vendored compute API can't initialize attached disks from snapshots, so
+// the disk has to be created up front.
+func (p *gceProvider) attachBootDiskFromSnapshot(ctx gocontext.Context, zoneName string, inst *compute.Instance, snapshot *compute.Snapshot) error {
+	bootDisk := inst.Disks[0]
+	disk := &compute.Disk{
+		Name:              inst.Name,
+		SizeGb:            bootDisk.InitializeParams.DiskSizeGb,
+		SourceSnapshot:    snapshot.SelfLink,
+		Type:              fmt.Sprintf("projects/%s/zones/%s/diskTypes/pd-ssd", p.projectID, zoneName),
+		DiskEncryptionKey: bootDisk.DiskEncryptionKey,
+	}
+
+	context.LoggerFromContext(ctx).WithFields(logrus.Fields{
+		"disk":     disk.Name,
+		"snapshot": snapshot.Name,
+	}).Debug("creating boot disk from snapshot")
+
+	op, err := p.api.InsertDisk(p.projectID, zoneName, disk)
+	if err != nil {
+		return err
+	}
+
+	err = p.waitForZoneOperation(ctx, zoneName, op)
+	if err != nil {
+		_, _ = p.api.DeleteDisk(p.projectID, zoneName, disk.Name)
+		return err
+	}
+
+	// only a disk encrypted with a customer-supplied key needs its key to be
+	// attached
+	if disk.DiskEncryptionKey != nil && disk.DiskEncryptionKey.RawKey == "" {
+		bootDisk.DiskEncryptionKey = nil
+	}
+	bootDisk.InitializeParams = nil
+	bootDisk.DeviceName = disk.Name
+	bootDisk.Source = op.TargetLink
+
+	return nil
+}
+
+func (p *gceProvider) imageForLanguage(language string, jobID uint64) (*compute.Image, error) {
+	return p.imageByFilter(fmt.Sprintf(gceImageTravisCIPrefixFilter, language), jobID)
+}
+
+func (p *gceProvider) imageSelect(ctx gocontext.Context, startAttributes *StartAttributes) (*compute.Image, error) {
+	imageName, err := p.imageSelector.Select(&image.Params{
+		Infra:    "gce",
+		Language: startAttributes.Language,
+		OsxImage: startAttributes.OsxImage,
+		Dist:     startAttributes.Dist,
+		Group:    startAttributes.Group,
+		OS:       startAttributes.OS,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if imageName == "default" {
+		imageName = p.defaultImage
+	}
+
+	return p.imageByFilter(fmt.Sprintf("name eq ^%s", imageName), startAttributes.JobID)
+}
@@ -0,0 +1,1435 @@
+package backend
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pborman/uuid"
+	"github.com/travis-ci/worker/config"
+	"github.com/travis-ci/worker/context"
+	"github.com/travis-ci/worker/metrics"
+	gocontext "golang.org/x/net/context"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// Start starts an instance, returning a *StartError if the reason for a
+// failure could be classified.
+func (p *gceProvider) Start(ctx gocontext.Context, startAttributes *StartAttributes) (Instance, error) {
+	return p.StartWithProgress(ctx, startAttributes, nil)
+}
+
+// StartWithProgress is like Start, but reports the instance-insert,
+// operation-running, operation-done, group-add and group-added stages to the
+// given channel.
+func (p *gceProvider) StartWithProgress(ctx gocontext.Context, startAttributes *StartAttributes, progress chan<- ProgressEntry) (Instance, error) {
+	ctx, done, err := p.trackStart(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	if p.pool != nil {
+		if inst := p.startFromPool(ctx, startAttributes); inst != nil {
+			return inst, nil
+		}
+	}
+
+	zoneName := p.selectZone()
+
+	inst, err := p.start(ctx, zoneName, startAttributes, progress)
+	if err != nil {
+		err = gceClassifyStartError(err)
+		if startErr, ok := err.(*StartError); ok {
+			metrics.Mark(fmt.Sprintf("worker.vm.provider.gce.boot.error.%s", gceStartErrorMetricNames[startErr.Cause]))
+		}
+		p.recordZoneHealth(zoneName, nil, err)
+		return nil, err
+	}
+
+	p.recordZoneHealth(zoneName, inst, nil)
+	return inst, nil
+}
+
+// trackStart returns a context for starting an instance that's cancelled when
+// the provider shuts down, along with a func to call once the start is done,
+// which Shutdown waits for.
+func (p *gceProvider) trackStart(ctx gocontext.Context) (gocontext.Context, func(), error) {
+	p.shutdownMutex.Lock()
+	if p.shuttingDown {
+		p.shutdownMutex.Unlock()
+		return nil, nil, errGCEShuttingDown
+	}
+	p.startWG.Add(1)
+	p.shutdownMutex.Unlock()
+
+	ctx, cancel := gocontext.WithCancel(ctx)
+
+	go func() {
+		select {
+		case <-p.shutdownChan:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, func() {
+		cancel()
+		p.startWG.Done()
+	}, nil
+}
+
+// Shutdown cancels instance starts in progress, which delete the instances
+// they inserted, deletes the instances in the pool, and waits for all of it
+// to finish or the context to be done. The cleanup continues in the
+// background if the context is done first, and later calls wait for the same
+// cleanup. Nothing can be started afterwards.
+func (p *gceProvider) Shutdown(ctx gocontext.Context) error {
+	p.shutdownMutex.Lock()
+	if !p.shuttingDown {
+		p.shuttingDown = true
+		p.shutdownDone = make(chan struct{})
+		close(p.shutdownChan)
+		go p.cleanUp(p.shutdownDone)
+	}
+	doneChan := p.shutdownDone
+	p.shutdownMutex.Unlock()
+
+	select {
+	case <-doneChan:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *gceProvider) cleanUp(doneChan chan struct{}) {
+	defer close(doneChan)
+
+	ctx := gocontext.TODO()
+	logger := context.LoggerFromContext(ctx)
+
+	p.startWG.Wait()
+
+	if p.pool != nil {
+		var wg sync.WaitGroup
+		for _, inst := range p.pool.drain() {
+			wg.Add(1)
+			go func(inst *gceInstance) {
+				defer wg.Done()
+				err := inst.delete(ctx)
+				if err != nil {
+					logger.WithFields(logrus.Fields{
+						"err":      err,
+						"instance": inst.instance.Name,
+					}).Error("couldn't delete pooled instance")
+				}
+			}(inst)
+		}
+		wg.Wait()
+	}
+
+	logger.Info("gce provider shut down")
+}
+
+// gceClassifyStartError wraps errors with a known cause in a *StartError and
+// returns any other error unchanged.
+func gceClassifyStartError(err error) error {
+	switch e := err.(type) {
+	case *StartError:
+		return e
+	case *gceOpError:
+		for _, code := range e.Codes() {
+			if cause := gceOpErrorCodeCause(code); cause != nil {
+				return &StartError{Cause: cause, Err: err}
+			}
+		}
+
+		for _, opErr := range e.Err.Errors {
+			if opErr.Code == "RESOURCE_NOT_FOUND" && strings.Contains(opErr.Message, "/images/") {
+				return &StartError{Cause: ErrImageNotFound, Err: err}
+			}
+		}
+	case *googleapi.Error:
+		for _, item := range e.Errors {
+			if cause := gceAPIErrorReasonCause(item.Reason); cause != nil {
+				return &StartError{Cause: cause, Err: err}
+			}
+		}
+
+		if e.Code == http.StatusTooManyRequests {
+			return &StartError{Cause: ErrQuotaExceeded, Err: err}
+		}
+	}
+
+	if err == gocontext.DeadlineExceeded {
+		return &StartError{Cause: ErrBootTimeout, Err: err}
+	}
+
+	return err
+}
+
+func gceReportProgress(progress chan<- ProgressEntry, stage string) {
+	gceSendProgress(progress, ProgressEntry{Stage: stage, Time: time.Now()})
+}
+
+func gceReportProgressPercent(progress chan<- ProgressEntry, stage string, percent int) {
+	gceSendProgress(progress, ProgressEntry{Stage: stage, Time: time.Now(), Percent: percent})
+}
+
+func gceSendProgress(progress chan<- ProgressEntry, entry ProgressEntry) {
+	if progress == nil {
+		return
+	}
+
+	select {
+	case progress <- entry:
+	default:
+	}
+}
+
+// gceOpErrorCodeCause returns the StartError cause for the given operation
+// error code, or nil if it isn't classified.
+func gceOpErrorCodeCause(code string) error {
+	return gceOpErrorCodeCauses[code]
+}
+
+// gceAPIErrorReasonCause returns the StartError cause for the given API
+// error reason, or nil if it isn't classified.
+func gceAPIErrorReasonCause(reason string) error {
+	return gceAPIErrorReasonCauses[reason]
+}
+
+// start starts an instance in the given zone.
+func (p *gceProvider) start(ctx gocontext.Context, zoneName string, startAttributes *StartAttributes, progress chan<- ProgressEntry) (Instance, error) {
+	logger := context.LoggerFromContext(ctx).WithField("zone", zoneName)
+
+	var (
+		imageName, imageLink string
+		minDiskSize          int64
+		snapshot             *compute.Snapshot
+		err                  error
+	)
+
+	if p.snapshotName != "" && startAttributes.ImageSelfLink == "" {
+		snapshot, err = p.snapshotByPrefix(p.snapshotName)
+		if err != nil {
+			return nil, err
+		}
+
+		imageName = snapshot.Name
+		minDiskSize = snapshot.DiskSizeGb
+
+		logger.WithFields(logrus.Fields{
+			"snapshot": snapshot.Name,
+		}).Debug("selected snapshot")
+	} else {
+		startImageSelect := time.Now()
+
+		image, err := p.getImage(ctx, startAttributes)
+		if err != nil {
+			return nil, err
+		}
+
+		metrics.TimeSince("worker.vm.provider.gce.image.select", startImageSelect)
+		metrics.TimeSince(fmt.Sprintf("worker.vm.provider.gce.image.select.%s", p.imageSelectorType), startImageSelect)
+
+		err = p.checkImageMatch(ctx, image, startAttributes)
+		if err != nil {
+			return nil, err
+		}
+
+		imageName = image.Name
+		imageLink = image.SelfLink
+		minDiskSize = image.DiskSizeGb
+
+		logger.WithFields(logrus.Fields{
+			"image":         image.Name,
+			"selector_type": p.imageSelectorType,
+			"duration":      time.Since(startImageSelect),
+		}).Debug("selected image")
+	}
+
+	diskSize, err := p.bootDiskSize(ctx, imageName, minDiskSize)
+	if err != nil {
+		return nil, err
+	}
+
+	scriptBuf := bytes.Buffer{}
+	err = gceStartupScript.Execute(&scriptBuf, p.ic)
+	if err != nil {
+		return nil, err
+	}
+
+	machineType := p.machineTypeFor(ctx, startAttributes)
+
+	logger.WithFields(logrus.Fields{
+		"machine_type": machineType.Name,
+	}).Debug("selected machine type")
+
+	inst := p.buildInstance(zoneName, startAttributes, machineType, imageLink, scriptBuf.String())
+	inst.Disks[0].InitializeParams.DiskSizeGb = diskSize
+
+	if p.dryRun {
+		metrics.Mark("worker.vm.provider.gce.dry_run")
+		logger.WithFields(logrus.Fields{
+			"instance": inst,
+			"snapshot": snapshot != nil,
+		}).Info("dry run, not inserting instance")
+
+		return &gceDryRunInstance{name: inst.Name, imageName: imageName}, nil
+	}
+
+	if p.adoptExisting && startAttributes.JobID != 0 {
+		if existing := p.adoptInstanceForJob(ctx, imageName, startAttributes); existing != nil {
+			return existing, nil
+		}
+	}
+
+	if snapshot != nil {
+		err = p.attachBootDiskFromSnapshot(ctx, zoneName, inst, snapshot)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	logger.WithFields(logrus.Fields{
+		"instance": inst,
+	}).Debug("inserting instance")
+	tags := gceBootMetricTags{imageName: imageName, zoneName: zoneName, machineTypeName: machineType.Name}
+	startInsert := time.Now()
+	op, err := p.insertInstance(ctx, zoneName, inst)
+	if err != nil {
+		if snapshot != nil {
+			_, _ = p.api.DeleteDisk(p.projectID, zoneName, inst.Disks[0].DeviceName)
+		}
+		return nil, p.diskEncryptionKeyError(err)
+	}
+	// the zone is output only, so it's recorded once the instance exists
+	inst.Zone = zoneName
+	p.setActiveInstance(inst.Name, true)
+	p.timeBootMetric("worker.vm.provider.gce.boot.insert", tags, startInsert)
+	gceReportProgress(progress, ProgressStageInstanceInsert)
+
+	startBooting := time.Now()
+
+	// bootCtx bounds the wait for the instance to become ready by
+	// BOOT_HARD_TIMEOUT, however long ctx allows.
+	bootCtx := ctx
+	if p.bootHardTimeout > 0 {
+		var cancel gocontext.CancelFunc
+		bootCtx, cancel = gocontext.WithTimeout(ctx, p.bootHardTimeout)
+		defer cancel()
+	}
+
+	// abandon deletes the instance when the start fails after inserting it.
+	abandon := func(err error) error {
+		_, deleteErr := p.api.DeleteInstance(p.projectID, zoneName, inst.Name)
+		p.setActiveInstance(inst.Name, false)
+
+		if bootCtx.Err() == gocontext.DeadlineExceeded && ctx.Err() == nil {
+			p.markBootMetric("worker.vm.provider.gce.boot.hard_timeout", tags)
+			if deleteErr != nil {
+				logger.WithFields(logrus.Fields{
+					"err":      deleteErr,
+					"instance": inst.Name,
+				}).Error("couldn't delete instance that hit the boot hard timeout")
+			}
+
+			return &StartError{
+				Cause: ErrBootHardTimeout,
+				Err:   fmt.Errorf("instance %s wasn't ready within %v", inst.Name, p.bootHardTimeout),
+			}
+		}
+
+		if err == gocontext.DeadlineExceeded {
+			p.markBootMetric("worker.vm.provider.gce.boot.timeout", tags)
+			return p.bootTimeoutError(ctx, inst, err)
+		}
+
+		return err
+	}
+
+	logger.WithField("name", op.Name).Debug("waiting for instance insert operation")
+	err = p.waitForZoneOperationWithProgress(bootCtx, zoneName, op, progress)
+	if err != nil {
+		if opErr, ok := err.(*gceOpError); ok && p.ic.Shielded != nil {
+			opErr.Hint = fmt.Sprintf("shielded VM options need an image with UEFI support, check that image %s has the UEFI_COMPATIBLE guest OS feature", imageName)
+		}
+		return nil, abandon(p.diskEncryptionKeyError(err))
+	}
+
+	p.timeBootMetric("worker.vm.provider.gce.boot.operation.wait", tags, startBooting)
+	gceReportProgress(progress, ProgressStageOperationDone)
+
+	instanceGroup := p.instanceGroupForZone(zoneName)
+	if instanceGroup != "" && startAttributes.VMConfig.SkipInstanceGroup {
+		logger.WithFields(logrus.Fields{
+			"instance_group": instanceGroup,
+		}).Debug("job skips instance group, not adding instance to group")
+		instanceGroup = ""
+	}
+
+	if instanceGroup != "" {
+		gceReportProgress(progress, ProgressStageGroupAdd)
+
+		groupInst, err := p.addToInstanceGroup(bootCtx, inst, instanceGroup, tags)
+		if err != nil {
+			return nil, abandon(err)
+		}
+		inst = groupInst
+
+		gceReportProgress(progress, ProgressStageGroupAdded)
+	}
+
+	if p.ic.WaitForStartup {
+		startStartup := time.Now()
+
+		err = p.waitForStartupComplete(bootCtx, inst)
+		if err != nil {
+			return nil, abandon(err)
+		}
+
+		p.timeBootMetric("worker.vm.provider.gce.boot.startup", tags, startStartup)
+	}
+
+	p.timeBootMetric("worker.vm.provider.gce.boot", tags, startBooting)
+	return p.newInstance(inst, imageName, startAttributes), nil
+}
+
+// diskEncryptionKeyError returns a StartError with the ErrDiskEncryptionKey
+// cause if the given error is compute engine failing to use DISK_KMS_KEY,
+// which is most likely missing permission, and the error unchanged otherwise.
+func (p *gceProvider) diskEncryptionKeyError(err error) error {
+	if p.ic.DiskEncryptionKey == nil || p.ic.DiskEncryptionKey.KmsKeyName == "" || !gceIsKMSError(err) {
+		return err
+	}
+
+	return &StartError{
+		Cause: ErrDiskEncryptionKey,
+		Err:   fmt.Errorf("couldn't use DISK_KMS_KEY %s, check that the project's compute engine service agent has the cloudkms.cryptoKeyEncrypterDecrypter role on it: %v", p.ic.DiskEncryptionKey.KmsKeyName, err),
+	}
+}
+
+// gceIsKMSError returns whether the error is the compute API's response for
+// a request or operation that failed to use a Cloud KMS key.
+func gceIsKMSError(err error) bool {
+	messages := []string{}
+	switch e := err.(type) {
+	case *googleapi.Error:
+		messages = append(messages, e.Message)
+		for _, item := range e.Errors {
+			messages = append(messages, item.Message)
+		}
+	case *gceOpError:
+		for _, opErr := range e.Err.Errors {
+			messages = append(messages, opErr.Message)
+		}
+	}
+
+	for _, message := range messages {
+		if strings.Contains(message, "Cloud KMS") || strings.Contains(message, "cloudkms.") {
+			return true
+		}
+	}
+	return false
+}
+
+// addToInstanceGroup adds the inserted instance to the instance group, or to
+// the one configured for the zone the instance ended up in, and returns the
+// instance as fetched after it finished inserting.
+func (p *gceProvider) addToInstanceGroup(ctx gocontext.Context, inst *compute.Instance, instanceGroup string, tags gceBootMetricTags) (*compute.Instance, error) {
+	logger := context.LoggerFromContext(ctx)
+
+	insertZoneName := gceZoneName(inst, p.ic.Zone.Name)
+	inst, err := p.api.GetInstance(p.projectID, insertZoneName, inst.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	zoneName := gceZoneName(inst, insertZoneName)
+	if zoneName != insertZoneName {
+		instanceGroup = p.instanceGroupForZone(zoneName)
+		if instanceGroup == "" {
+			return nil, fmt.Errorf("no instance group configured for zone %q", zoneName)
+		}
+	}
+
+	logger.WithFields(logrus.Fields{
+		"instance_self_link": inst.SelfLink,
+		"instance_group":     instanceGroup,
+	}).Debug("inserting instance into group")
+
+	startGroupAdd := time.Now()
+	op, err := p.api.AddInstanceToGroup(p.projectID, zoneName, instanceGroup, inst.SelfLink)
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.waitForZoneOperation(ctx, zoneName, op)
+	if err != nil {
+		return nil, err
+	}
+
+	p.timeBootMetric("worker.vm.provider.gce.boot.group.add", tags, startGroupAdd)
+
+	if p.verifyGroupMembership {
+		startMembership := time.Now()
+		err = p.waitForGroupMembership(ctx, zoneName, instanceGroup, inst.SelfLink)
+		if err != nil {
+			return nil, err
+		}
+		p.timeBootMetric("worker.vm.provider.gce.boot.group.membership", tags, startMembership)
+	}
+
+	return inst, nil
+}
+
+func (p *gceProvider) newInstance(inst *compute.Instance, imageName string, startAttributes *StartAttributes) *gceInstance {
+	return &gceInstance{
+		provider: p,
+		instance: inst,
+		ic:       p.ic,
+
+		authUser: p.ic.SSHUser,
+
+		projectID:  p.projectID,
+		imageName:  imageName,
+		os:         startAttributes.OS,
+		scriptPath: p.scriptPathFor(startAttributes.OS),
+
+		logSilenceTimeout: startAttributes.LogSilenceTimeout,
+		maxLogLength:      int64(startAttributes.MaxLogLength),
+
+		bootedAt: time.Now(),
+	}
+}
+
+// adoptInstanceForJob returns the running instance created for the job, e.g.
+// by a worker that crashed while starting it, or nil if there's none. Only an
+// instance without a build script is adopted: one with a script already ran
+// the job, which keeps its id when it's restarted, so it's deleted instead,
+// as is one that can't be checked.
+func (p *gceProvider) adoptInstanceForJob(ctx gocontext.Context, imageName string, startAttributes *StartAttributes) *gceInstance {
+	logger := context.LoggerFromContext(ctx)
+
+	existing, err := p.instanceForJob(ctx, startAttributes.JobID)
+	if err != nil {
+		logger.WithField("err", err).Warn("couldn't look for existing instance for job")
+		return nil
+	}
+	if existing == nil {
+		return nil
+	}
+
+	i := p.newInstance(existing, imageName, startAttributes)
+	logger = logger.WithField("instance", existing.Name)
+
+	hasScript, err := i.hasBuildScript(ctx)
+	if err == nil && !hasScript {
+		metrics.Mark("worker.vm.provider.gce.boot.adopted")
+		logger.Info("adopting existing instance for job")
+		p.setActiveInstance(existing.Name, true)
+		return i
+	}
+
+	if err != nil {
+		logger.WithField("err", err).Warn("couldn't check existing instance for job for a build script, deleting it")
+	} else {
+		logger.Info("existing instance for job already has a build script, deleting it")
+	}
+
+	metrics.Mark("worker.vm.provider.gce.boot.adopt.deleted")
+	_, err = p.api.DeleteInstance(p.projectID, i.zoneName(), existing.Name)
+	if err != nil {
+		logger.WithField("err", err).Error("couldn't delete existing instance for job")
+	}
+
+	return nil
+}
+
+// instanceForJob returns a running instance whose metadata says it was
+// created for the given job, or nil if there's none. The vendored compute API
+// doesn't support labels, which could be filtered on, so instances are listed
+// by name prefix and their metadata is checked here.
+func (p *gceProvider) instanceForJob(ctx gocontext.Context, jobID uint64) (*compute.Instance, error) {
+	instances, err := p.listInstances(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	jobIDValue := strconv.FormatUint(jobID, 10)
+	for _, inst := range instances {
+		if inst.Status == "RUNNING" && gceInstanceMetadataValue(inst, gceJobIDMetadataKey) == jobIDValue {
+			return inst, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// listInstances returns the instances named with the instance name prefix in
+// every zone instances are started in.
+func (p *gceProvider) listInstances(ctx gocontext.Context) ([]*compute.Instance, error) {
+	filter := fmt.Sprintf("name eq ^%s.+", p.instanceNamePrefix)
+	instances := []*compute.Instance{}
+
+	for _, zoneName := range p.zoneNames {
+		pageToken := ""
+		for {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+
+			list, err := p.api.ListInstances(p.projectID, zoneName, filter, pageToken)
+			if err != nil {
+				return nil, err
+			}
+			instances = append(instances, list.Items...)
+
+			if list.NextPageToken == "" {
+				break
+			}
+			pageToken = list.NextPageToken
+		}
+	}
+
+	return instances, nil
+}
+
+// gceZoneName returns the name of the zone the instance is in, or the given
+// default zone for instances that weren't inserted yet.
+func gceZoneName(inst *compute.Instance, defaultZone string) string {
+	if inst.Zone == "" {
+		return defaultZone
+	}
+	return path.Base(inst.Zone)
+}
+
+// gceInstanceMetadataValue returns the value of the instance's metadata item
+// with the given key, or "" if it has none.
+func gceInstanceMetadataValue(inst *compute.Instance, key string) string {
+	if inst.Metadata == nil {
+		return ""
+	}
+
+	for _, item := range inst.Metadata.Items {
+		if item.Key == key && item.Value != nil {
+			return *item.Value
+		}
+	}
+
+	return ""
+}
+
+// bootTimeoutError returns a *StartError for an instance that didn't finish
+// booting in time, carrying the end of its serial console output if it could
+// be retrieved, since that's usually the only way to tell why.
+func (p *gceProvider) bootTimeoutError(ctx gocontext.Context, inst *compute.Instance, err error) error {
+	i := &gceInstance{
+		provider:  p,
+		instance:  inst,
+		ic:        p.ic,
+		projectID: p.projectID,
+	}
+
+	output, serialErr := i.SerialOutput(gocontext.TODO(), 1)
+	if serialErr != nil {
+		context.LoggerFromContext(ctx).WithFields(logrus.Fields{
+			"err":      serialErr,
+			"instance": inst.Name,
+		}).Warn("couldn't get serial console output of instance that timed out booting")
+		return &StartError{Cause: ErrBootTimeout, Err: err}
+	}
+
+	if len(output) > gceBootTimeoutSerialOutputMax {
+		output = output[len(output)-gceBootTimeoutSerialOutputMax:]
+	}
+
+	return &StartError{
+		Cause: ErrBootTimeout,
+		Err:   fmt.Errorf("%v, serial console output of instance %s:\n%s", err, inst.Name, output),
+	}
+}
+
+// gceBootMetricTags are what detailed boot metrics are broken down by.
+type gceBootMetricTags struct {
+	imageName       string
+	zoneName        string
+	machineTypeName string
+}
+
+// bootMetricNames returns the given metric name along with, when detailed
+// boot metrics are enabled, variants suffixed with the image name, zone and
+// machine type.
+func (p *gceProvider) bootMetricNames(name string, tags gceBootMetricTags) []string {
+	names := []string{name}
+	if !p.detailedBootMetrics {
+		return names
+	}
+
+	for _, part := range []struct{ kind, value string }{
+		{"image", tags.imageName},
+		{"zone", tags.zoneName},
+		{"machine_type", tags.machineTypeName},
+	} {
+		if part.value == "" {
+			continue
+		}
+
+		names = append(names, fmt.Sprintf("%s.%s.%s", name, part.kind,
+			metricNameCleanRegexp.ReplaceAllString(part.value, "-")))
+	}
+
+	return names
+}
+
+func (p *gceProvider) markBootMetric(name string, tags gceBootMetricTags) {
+	for _, n := range p.bootMetricNames(name, tags) {
+		metrics.Mark(n)
+	}
+}
+
+func (p *gceProvider) timeBootMetric(name string, tags gceBootMetricTags, since time.Time) {
+	for _, n := range p.bootMetricNames(name, tags) {
+		metrics.TimeSince(n, since)
+	}
+}
+
+// instanceGroupForZone returns the instance group configured for the given
+// zone via INSTANCE_GROUP_{ZONE}, falling back to INSTANCE_GROUP.
+func (p *gceProvider) instanceGroupForZone(zoneName string) string {
+	key := fmt.Sprintf("INSTANCE_GROUP_%s", strings.ToUpper(nonAlphaNumRegexp.ReplaceAllString(zoneName, "_")))
+	if p.cfg.IsSet(key) {
+		return p.cfg.Get(key)
+	}
+
+	return p.instanceGroup
+}
+
+// waitForGroupMembership polls the instance group until the instance with
+// the given self link is listed in it or the context is done.
+func (p *gceProvider) waitForGroupMembership(ctx gocontext.Context, zoneName, instanceGroup, selfLink string) error {
+	logger := context.LoggerFromContext(ctx).WithFields(logrus.Fields{
+		"instance_group": instanceGroup,
+		"instance":       selfLink,
+	})
+
+	for {
+		isMember, err := p.isGroupMember(zoneName, instanceGroup, selfLink)
+		if err != nil {
+			return err
+		}
+
+		if isMember {
+			return nil
+		}
+
+		logger.Debug("sleeping before checking instance group membership")
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(p.bootPollSleep):
+		}
+	}
+}
+
+func (p *gceProvider) isGroupMember(zoneName, instanceGroup, selfLink string) (bool, error) {
+	pageToken := ""
+	for {
+		list, err := p.api.ListGroupInstances(p.projectID, zoneName, instanceGroup, pageToken)
+		if err != nil {
+			return false, err
+		}
+
+		for _, item := range list.Items {
+			if item.Instance == selfLink {
+				return true, nil
+			}
+		}
+
+		if list.NextPageToken == "" {
+			return false, nil
+		}
+		pageToken = list.NextPageToken
+	}
+}
+
+// waitForZoneOperation polls the given operation in the given zone until it's
+// done or the context is done.
+func (p *gceProvider) waitForZoneOperation(ctx gocontext.Context, zoneName string, op *compute.Operation) error {
+	return p.waitForZoneOperationWithProgress(ctx, zoneName, op, nil)
+}
+
+// waitForZoneOperationWithProgress is like waitForZoneOperation, but reports
+// the operation-running stage to the given channel whenever the percentage
+// the API reports for the running operation changes.
+func (p *gceProvider) waitForZoneOperationWithProgress(ctx gocontext.Context, zoneName string, op *compute.Operation, progress chan<- ProgressEntry) error {
+	lastPercent := -1
+
+	for {
+		newOp, err := p.api.GetZoneOperation(p.projectID, zoneName, op.Name)
+		if err != nil {
+			return err
+		}
+
+		if newOp.Error != nil {
+			return &gceOpError{Err: newOp.Error}
+		}
+
+		if newOp.Status == "DONE" {
+			return nil
+		}
+
+		if newOp.Status == "RUNNING" && int(newOp.Progress) != lastPercent {
+			lastPercent = int(newOp.Progress)
+			gceReportProgressPercent(progress, ProgressStageOperationRunning, lastPercent)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(p.bootPollSleep):
+		}
+	}
+}
+
+// machineTypeFor returns the machine type requested by the job if it's in
+// the allowed list and exists in the zone, and the default machine type
+// otherwise. Looked up machine types are cached for the provider's lifetime.
+func (p *gceProvider) machineTypeFor(ctx gocontext.Context, startAttributes *StartAttributes) *compute.MachineType {
+	name := startAttributes.VMConfig.Size
+	if name == "" || name == p.ic.MachineType.Name {
+		return p.ic.MachineType
+	}
+
+	logger := context.LoggerFromContext(ctx).WithField("machine_type", name)
+
+	if !p.allowedMachineTypes[name] {
+		logger.Warn("requested machine type is not allowed, using default")
+		return p.ic.MachineType
+	}
+
+	p.machineTypesMutex.Lock()
+	mt, ok := p.machineTypes[name]
+	p.machineTypesMutex.Unlock()
+	if ok {
+		return mt
+	}
+
+	// concurrent starts may both look up the same machine type, which is
+	// cheaper than making every start wait for the API
+	mt, err := p.api.GetMachineType(p.projectID, p.ic.Zone.Name, name)
+	if err != nil {
+		logger.WithField("err", err).Warn("couldn't look up requested machine type, using default")
+		return p.ic.MachineType
+	}
+
+	p.machineTypesMutex.Lock()
+	p.machineTypes[name] = mt
+	p.machineTypesMutex.Unlock()
+	return mt
+}
+
+func (p *gceProvider) buildInstance(zoneName string, startAttributes *StartAttributes, machineType *compute.MachineType, imageLink, startupScript string) *compute.Instance {
+	hardTimeout := startAttributes.HardTimeout
+	if hardTimeout == 0 {
+		hardTimeout = time.Duration(p.ic.HardTimeoutMinutes) * time.Minute
+	}
+
+	now := time.Now().UTC()
+
+	metadataItems := []*compute.MetadataItems{
+		&compute.MetadataItems{
+			Key:   "startup-script",
+			Value: googleapi.String(startupScript),
+		},
+		&compute.MetadataItems{
+			Key:   gceCreatedMetadataKey,
+			Value: googleapi.String(now.Format(time.RFC3339)),
+		},
+		&compute.MetadataItems{
+			Key:   gceExpiresMetadataKey,
+			Value: googleapi.String(now.Add(hardTimeout + p.ic.ExpiryGrace).Format(time.RFC3339)),
+		},
+		&compute.MetadataItems{
+			Key:   gceHostnameMetadataKey,
+			Value: googleapi.String(p.hostname),
+		},
+		&compute.MetadataItems{
+			Key:   gcePIDMetadataKey,
+			Value: googleapi.String(strconv.Itoa(os.Getpid())),
+		},
+	}
+
+	if startAttributes.JobID != 0 {
+		metadataItems = append(metadataItems, &compute.MetadataItems{
+			Key:   gceJobIDMetadataKey,
+			Value: googleapi.String(strconv.FormatUint(startAttributes.JobID, 10)),
+		})
+	}
+
+	metadataItems = append(metadataItems, gceStartAttributesLabels(startAttributes)...)
+
+	return &compute.Instance{
+		Description: fmt.Sprintf("Travis CI %s test VM", startAttributes.Language),
+		Disks: []*compute.AttachedDisk{
+			&compute.AttachedDisk{
+				Type:       "PERSISTENT",
+				Mode:       "READ_WRITE",
+				Boot:       true,
+				AutoDelete: true,
+				InitializeParams: &compute.AttachedDiskInitializeParams{
+					SourceImage: imageLink,
+					DiskType:    fmt.Sprintf("zones/%s/diskTypes/pd-ssd", zoneName),
+					DiskSizeGb:  p.ic.DiskSize,
+				},
+				DiskEncryptionKey: p.ic.DiskEncryptionKey,
+			},
+		},
+		Scheduling: &compute.Scheduling{
+			Preemptible:               p.ic.Preemptible,
+			ProvisioningModel:         p.ic.ProvisioningModel,
+			InstanceTerminationAction: p.ic.TerminationAction,
+			NodeAffinities:            p.ic.NodeAffinities,
+			OnHostMaintenance:         p.ic.OnHostMaintenance,
+			AutomaticRestart:          googleapi.Bool(p.ic.AutomaticRestart),
+		},
+		ResourcePolicies:           p.resourcePolicyLinks[gceRegionName(zoneName)],
+		ShieldedInstanceConfig:     p.ic.Shielded,
+		ConfidentialInstanceConfig: p.ic.Confidential,
+		MachineType:                fmt.Sprintf("zones/%s/machineTypes/%s", zoneName, machineType.Name),
+		Name:                       p.instanceName(),
+		Metadata: &compute.Metadata{
+			Items: metadataItems,
+		},
+		NetworkInterfaces: p.networkInterfacesFor(zoneName),
+		ServiceAccounts: []*compute.ServiceAccount{
+			&compute.ServiceAccount{
+				Email: "default",
+				Scopes: []string{
+					"https://www.googleapis.com/auth/userinfo.email",
+					compute.DevstorageFullControlScope,
+					compute.ComputeScope,
+				},
+			},
+		},
+		Tags: &compute.Tags{
+			Items: p.networkTagsFor(startAttributes),
+		},
+	}
+}
+
+// networkInterfacesFor returns the network interfaces of instances in the
+// given zone, the one in NETWORK with a NAT followed by those of
+// EXTRA_NETWORK_INTERFACES.
+func (p *gceProvider) networkInterfacesFor(zoneName string) []*compute.NetworkInterface {
+	regionName := gceRegionName(zoneName)
+
+	primary := &compute.NetworkInterface{
+		AccessConfigs: []*compute.AccessConfig{
+			&compute.AccessConfig{
+				Name: "AccessConfig brought to you by travis-worker",
+				Type: "ONE_TO_ONE_NAT",
+			},
+		},
+		Network: p.ic.Network.SelfLink,
+	}
+	if p.ic.Subnetwork != "" {
+		primary.Subnetwork = fmt.Sprintf("regions/%s/subnetworks/%s", regionName, p.ic.Subnetwork)
+	}
+
+	interfaces := []*compute.NetworkInterface{primary}
+	for _, extra := range p.ic.ExtraNetworks {
+		ni := &compute.NetworkInterface{
+			Network:    fmt.Sprintf("global/networks/%s", extra.Network),
+			Subnetwork: fmt.Sprintf("regions/%s/subnetworks/%s", regionName, extra.Subnetwork),
+		}
+		if extra.NAT {
+			ni.AccessConfigs = []*compute.AccessConfig{
+				&compute.AccessConfig{
+					Name: "AccessConfig brought to you by travis-worker",
+					Type: "ONE_TO_ONE_NAT",
+				},
+			}
+		}
+		interfaces = append(interfaces, ni)
+	}
+
+	return interfaces
+}
+
+// networkTagsFor returns the network tags of the instance for the given
+// start attributes, the default tag followed by those configured for the
+// job's group via NETWORK_TAGS_{GROUP}, falling back to NETWORK_TAGS.
+func (p *gceProvider) networkTagsFor(startAttributes *StartAttributes) []string {
+	key := "NETWORK_TAGS"
+	if startAttributes.Group != "" {
+		groupKey := fmt.Sprintf("NETWORK_TAGS_%s", strings.ToUpper(nonAlphaNumRegexp.ReplaceAllString(startAttributes.Group, "_")))
+		if p.cfg.IsSet(groupKey) {
+			key = groupKey
+		}
+	}
+
+	tags := []string{defaultGCENetworkTag}
+	seen := map[string]bool{defaultGCENetworkTag: true}
+	for _, tag := range strings.Split(p.cfg.Get(key), ",") {
+		tag = strings.TrimSpace(tag)
+		if tag != "" && !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+
+	return tags
+}
+
+// validateGCENetworkTags checks that the tags of NETWORK_TAGS and its
+// per-group variants are valid network tags: lowercase letters, digits and
+// hyphens, starting with a letter and not ending in a hyphen, at most 63
+// characters long.
+func validateGCENetworkTags(cfg *config.ProviderConfig) error {
+	var err error
+	cfg.Each(func(key, value string) {
+		if err != nil || (key != "NETWORK_TAGS" && !strings.HasPrefix(key, "NETWORK_TAGS_")) {
+			return
+		}
+
+		for _, tag := range strings.Split(value, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag != "" && !gceNetworkTagRegexp.MatchString(tag) {
+				err = fmt.Errorf("invalid network tag %q in %s, expected at most 63 lowercase letters, digits and hyphens, starting with a letter and not ending in a hyphen", tag, key)
+				return
+			}
+		}
+	})
+	return err
+}
+
+// insertInstance inserts the given instance in the zone. If an instance with the same name
+// already exists, the instance is renamed and inserting it is retried once.
+func (p *gceProvider) insertInstance(ctx gocontext.Context, zoneName string, inst *compute.Instance) (*compute.Operation, error) {
+	op, err := p.api.InsertInstance(p.projectID, zoneName, inst)
+	if !gceIsAlreadyExistsError(err) {
+		return op, err
+	}
+
+	newName := p.instanceName()
+	context.LoggerFromContext(ctx).WithFields(logrus.Fields{
+		"name":     inst.Name,
+		"new_name": newName,
+	}).Warn("instance name already exists, retrying with new name")
+	metrics.Mark("worker.vm.provider.gce.boot.name_collision")
+
+	inst.Name = newName
+	return p.api.InsertInstance(p.projectID, zoneName, inst)
+}
+
+func gceIsAlreadyExistsError(err error) bool {
+	apiErr, ok := err.(*googleapi.Error)
+	if !ok {
+		return false
+	}
+
+	if apiErr.Code == http.StatusConflict {
+		return true
+	}
+
+	for _, item := range apiErr.Errors {
+		if item.Reason == "alreadyExists" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// instanceName generates a new instance name from the instance name prefix
+// and a random suffix.
+func (p *gceProvider) instanceName() string {
+	return fmt.Sprintf("%s%s", p.instanceNamePrefix, uuid.NewRandom())
+}
+
+// gceInstanceNamePrefix sanitizes a configured instance name prefix so that
+// names generated from it are valid RFC1035 names of at most 63 characters:
+// it's lowercased, invalid characters are replaced with dashes, leading
+// characters other than letters are stripped and it's truncated to leave room
+// for the random suffix. An empty prefix is replaced by the default one.
+func gceInstanceNamePrefix(prefix string) string {
+	prefix = gceInstanceNameInvalidCharsRegexp.ReplaceAllString(strings.ToLower(prefix), "-")
+	prefix = gceInstanceNameLeadingRegexp.ReplaceAllString(prefix, "")
+	if prefix == "" {
+		return defaultGCEInstanceNamePrefix
+	}
+
+	maxLength := gceInstanceNameMaxLength - len(uuid.NewRandom().String())
+	if len(prefix) > maxLength {
+		prefix = prefix[:maxLength]
+	}
+
+	return prefix
+}
+
+// gceStartAttributesLabels returns metadata items for the start attributes
+// that are useful for slicing usage, e.g. by language or dist. The vendored
+// compute API doesn't support instance labels, so these are stored as
+// metadata items with label-compatible values, which makes it possible to
+// move them to labels later without changing their values.
+func gceStartAttributesLabels(startAttributes *StartAttributes) []*compute.MetadataItems {
+	items := []*compute.MetadataItems{}
+
+	for _, attr := range []struct {
+		key, value string
+	}{
+		{"language", startAttributes.Language},
+		{"dist", startAttributes.Dist},
+		{"group", startAttributes.Group},
+		{"os", startAttributes.OS},
+	} {
+		value := gceLabelValue(attr.value)
+		if value == "" {
+			continue
+		}
+
+		items = append(items, &compute.MetadataItems{
+			Key:   gceLabelMetadataKeyPrefix + attr.key,
+			Value: googleapi.String(value),
+		})
+	}
+
+	return items
+}
+
+// gceLabelValue sanitizes a string to fit the constraints on GCE label
+// values: at most 63 characters, all of which are lowercase letters, digits,
+// underscores or dashes. Invalid characters are replaced with underscores.
+func gceLabelValue(value string) string {
+	value = gceLabelInvalidCharsRegexp.ReplaceAllString(strings.ToLower(value), "_")
+	if len(value) > gceLabelMaxLength {
+		value = value[:gceLabelMaxLength]
+	}
+
+	return value
+}
+
+// Sweep deletes instances created by the worker that are older than the given
+// duration, returning the number of instances deleted. Instances that don't
+// carry the expiry metadata recorded at creation are never deleted, nor are
+// those this worker started and still uses, and deletions are only requested,
+// not waited for.
+func (p *gceProvider) Sweep(ctx gocontext.Context, olderThan time.Duration) (int, error) {
+	logger := context.LoggerFromContext(ctx)
+	reaped := 0
+
+	instances, err := p.listInstances(ctx)
+	if err != nil {
+		return reaped, err
+	}
+
+	for _, inst := range instances {
+		if p.isActiveInstance(inst.Name) {
+			continue
+		}
+
+		if _, ok := gceInstanceExpiry(inst); !ok {
+			logger.WithField("instance", inst.Name).Debug("skipping instance without expiry metadata")
+			continue
+		}
+
+		created, err := time.Parse(time.RFC3339, inst.CreationTimestamp)
+		if err != nil || time.Since(created) < olderThan {
+			continue
+		}
+
+		_, err = p.api.DeleteInstance(p.projectID, gceZoneName(inst, p.ic.Zone.Name), inst.Name)
+		if err != nil {
+			logger.WithFields(logrus.Fields{
+				"err":      err,
+				"instance": inst.Name,
+			}).Error("couldn't delete leaked instance")
+			continue
+		}
+
+		logger.WithFields(logrus.Fields{
+			"instance": inst.Name,
+			"created":  created,
+		}).Info("deleted leaked instance")
+		metrics.Mark("worker.vm.provider.gce.sweep.deleted")
+		reaped++
+	}
+
+	return reaped, nil
+}
+
+func (p *gceProvider) isActiveInstance(name string) bool {
+	p.instancesMutex.Lock()
+	defer p.instancesMutex.Unlock()
+
+	return p.instances[name]
+}
+
+func (p *gceProvider) setActiveInstance(name string, active bool) {
+	p.instancesMutex.Lock()
+	defer p.instancesMutex.Unlock()
+
+	if active {
+		p.instances[name] = true
+	} else {
+		delete(p.instances, name)
+	}
+}
+
+// gceInstanceExpiry returns the expiry recorded in the instance's metadata at
+// creation time. The second return value is false if the instance doesn't
+// carry a (valid) expiry, e.g. because it wasn't created by the worker.
+func gceInstanceExpiry(inst *compute.Instance) (time.Time, bool) {
+	expires, err := time.Parse(time.RFC3339, gceInstanceMetadataValue(inst, gceExpiresMetadataKey))
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return expires, true
+}
+
+// zoneName returns the name of the zone the instance is in.
+func (i *gceInstance) zoneName() string {
+	return gceZoneName(i.instance, i.ic.Zone.Name)
+}
+
+func (i *gceInstance) refreshInstance(ctx gocontext.Context) error {
+	var inst *compute.Instance
+	err := gceCall(ctx, func() (err error) {
+		inst, err = i.provider.api.GetInstance(i.projectID, i.zoneName(), i.instance.Name)
+		return
+	})
+	if err != nil {
+		return err
+	}
+
+	i.instance = inst
+	return nil
+}
+
+// SetMachineType changes the machine type of the instance, which compute
+// engine only allows while it's stopped. The instance is stopped, resized and
+// started again, losing everything but its disk, and SetMachineType returns
+// once it accepts ssh connections again. If resizing fails, the instance is
+// started again with its old machine type.
+func (i *gceInstance) SetMachineType(ctx gocontext.Context, machineType string) error {
+	logger := context.LoggerFromContext(ctx).WithFields(logrus.Fields{
+		"instance":     i.instance.Name,
+		"machine_type": machineType,
+	})
+
+	startResizing := time.Now()
+
+	err := i.setMachineType(ctx, machineType)
+	if err == nil {
+		err = i.waitForSSH(ctx)
+	}
+	if err != nil {
+		metrics.Mark("worker.vm.provider.gce.resize.error")
+		logger.WithField("err", err).Error("couldn't set machine type")
+		return err
+	}
+
+	metrics.TimeSince("worker.vm.provider.gce.resize", startResizing)
+	logger.Info("set machine type")
+	return nil
+}
+
+// setMachineType stops the instance, sets its machine type and starts it
+// again, even if setting the machine type failed.
+func (i *gceInstance) setMachineType(ctx gocontext.Context, machineType string) error {
+	zoneName := i.zoneName()
+
+	op, err := i.provider.api.StopInstance(i.projectID, zoneName, i.instance.Name)
+	if err == nil {
+		err = i.provider.waitForZoneOperation(ctx, zoneName, op)
+	}
+	if err != nil {
+		return fmt.Errorf("couldn't stop instance: %v", err)
+	}
+
+	op, err = i.provider.api.SetMachineType(i.projectID, zoneName, i.instance.Name, machineType)
+	if err == nil {
+		err = i.provider.waitForZoneOperation(ctx, zoneName, op)
+	}
+	setErr := err
+
+	op, err = i.provider.api.StartInstance(i.projectID, zoneName, i.instance.Name)
+	if err == nil {
+		err = i.provider.waitForZoneOperation(ctx, zoneName, op)
+	}
+	if setErr != nil {
+		return setErr
+	}
+	if err != nil {
+		return fmt.Errorf("couldn't start instance: %v", err)
+	}
+
+	return i.refreshInstance(ctx)
+}
+
+// SerialOutput returns what the instance wrote to the given serial port, which
+// is port 1 for the console. GCE only keeps the last megabyte or so.
+func (i *gceInstance) SerialOutput(ctx gocontext.Context, port int64) (string, error) {
+	var output *compute.SerialPortOutput
+	err := gceCall(ctx, func() (err error) {
+		output, err = i.provider.api.GetSerialPortOutput(i.projectID, i.zoneName(), i.instance.Name, port)
+		return
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return output.Contents, nil
+}
+
+// recycle deletes a stale instance, returning ErrStaleVMRecycled so that the
+// caller knows to replace it without stopping it again.
+func (i *gceInstance) recycle(ctx gocontext.Context) error {
+	err := i.delete(ctx)
+	if err != nil {
+		context.LoggerFromContext(ctx).WithFields(logrus.Fields{
+			"err":      err,
+			"instance": i.instance.Name,
+		}).Error("couldn't delete stale instance")
+		return ErrStaleVM
+	}
+
+	metrics.Mark("worker.vm.provider.gce.upload.stale_vm.recycle")
+	return ErrStaleVMRecycled
+}
+
+// Stop deletes the instance. Instances handed out from the pool are deleted
+// as well, since nothing short of a new boot disk cleans up after a job.
+func (i *gceInstance) Stop(ctx gocontext.Context) error {
+	err := i.delete(ctx)
+	if gceIsNotFound(err) {
+		// e.g. deleted by compute engine when it was preempted, or by hand
+		metrics.Mark("worker.vm.provider.gce.delete.not_found")
+		return nil
+	}
+
+	return err
+}
+
+// gceIsNotFound returns whether the error is the compute API's response for
+// a resource that doesn't exist, or an operation that failed because the
+// resource it acted on was gone by the time it ran.
+func gceIsNotFound(err error) bool {
+	switch e := err.(type) {
+	case *googleapi.Error:
+		return e.Code == http.StatusNotFound
+	case *gceOpError:
+		for _, code := range e.Codes() {
+			if code == "RESOURCE_NOT_FOUND" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (i *gceInstance) delete(ctx gocontext.Context) error {
+	defer i.provider.setActiveInstance(i.instance.Name, false)
+
+	if i.provider.gracefulStop {
+		i.stopGracefully(ctx)
+	}
+
+	op, err := i.provider.api.DeleteInstance(i.projectID, i.zoneName(), i.instance.Name)
+	if err != nil {
+		return err
+	}
+
+	return i.provider.waitForZoneOperation(ctx, i.zoneName(), op)
+}
+
+// stopGracefully issues a stop (ACPI shutdown) for the instance and waits up
+// to the configured timeout for it to reach TERMINATED. Any failure along the
+// way is logged and otherwise ignored, since the instance is deleted right
+// afterwards regardless.
+func (i *gceInstance) stopGracefully(ctx gocontext.Context) {
+	logger := context.LoggerFromContext(ctx)
+
+	err := gceCall(ctx, func() (err error) {
+		_, err = i.provider.api.StopInstance(i.projectID, i.zoneName(), i.instance.Name)
+		return
+	})
+	if err != nil {
+		logger.WithField("err", err).Warn("couldn't stop instance, deleting immediately")
+		return
+	}
+
+	stopCtx, cancel := gocontext.WithTimeout(ctx, i.provider.gracefulStopTimeout)
+	defer cancel()
+
+	startStopping := time.Now()
+
+	for {
+		var inst *compute.Instance
+		err := gceCall(stopCtx, func() (err error) {
+			inst, err = i.provider.api.GetInstance(i.projectID, i.zoneName(), i.instance.Name)
+			return
+		})
+		if err == nil && inst.Status == "TERMINATED" {
+			metrics.TimeSince("worker.vm.provider.gce.stop.graceful", startStopping)
+			return
+		}
+
+		select {
+		case <-stopCtx.Done():
+			metrics.Mark("worker.vm.provider.gce.stop.graceful.timeout")
+			logger.WithField("timeout", i.provider.gracefulStopTimeout).Warn("timed out waiting for instance to stop, deleting")
+			return
+		case <-time.After(i.provider.bootPollSleep):
+		}
+	}
+}
+
+func (i *gceInstance) Expires() time.Time {
+	expires, _ := gceInstanceExpiry(i.instance)
+	return expires
+}
+
+func (i *gceInstance) ID() string {
+	return fmt.Sprintf("%s:%s", i.instance.Name, i.imageName)
+}
+
+// gceDryRunInstance is returned by Start in dry run mode in place of an
+// instance that was never inserted.
+type gceDryRunInstance struct {
+	name      string
+	imageName string
+}
+
+func (i *gceDryRunInstance) UploadScript(ctx gocontext.Context, script []byte) error {
+	return nil
+}
+
+// RunScript never completes, so that the job is requeued for a worker that
+// runs it rather than reported as passed.
+func (i *gceDryRunInstance) RunScript(ctx gocontext.Context, output io.Writer) (*RunResult, error) {
+	_, _ = fmt.Fprintf(output, "Dry run: instance %s wasn't inserted, so no build script was run.\n", i.name)
+	return &RunResult{Completed: false}, errGCEDryRun
+}
+
+func (i *gceDryRunInstance) Stop(ctx gocontext.Context) error {
+	return nil
+}
+
+func (i *gceDryRunInstance) ID() string {
+	return fmt.Sprintf("%s:%s:dry-run", i.name, i.imageName)
+}
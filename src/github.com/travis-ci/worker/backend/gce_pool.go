@@ -0,0 +1,207 @@
+package backend
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/travis-ci/worker/context"
+	"github.com/travis-ci/worker/metrics"
+	gocontext "golang.org/x/net/context"
+)
+
+const (
+	defaultGCEPoolMaxAge      = 10 * time.Minute
+	defaultGCEPoolRefillSleep = 10 * time.Second
+	gcePoolBootTimeout        = 4 * time.Minute
+)
+
+// gcePool holds instances booted ahead of time from the default boot source
+// and machine type, so that jobs that would boot the same don't have to wait
+// for an instance to be inserted.
+type gcePool struct {
+	size   int
+	maxAge time.Duration
+
+	mutex     sync.Mutex
+	instances []*gceInstance
+	booting   int
+}
+
+// take removes and returns a pooled instance booted from the given image or
+// snapshot, or nil if there's none.
+func (pool *gcePool) take(bootSource string) *gceInstance {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	for idx, inst := range pool.instances {
+		if inst.imageName == bootSource && time.Since(inst.bootedAt) <= pool.maxAge {
+			pool.instances = append(pool.instances[:idx], pool.instances[idx+1:]...)
+			return inst
+		}
+	}
+
+	return nil
+}
+
+// expire removes and returns the pooled instances that are too old to hand
+// out, to be deleted by the caller.
+func (pool *gcePool) expire() []*gceInstance {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	expired := []*gceInstance{}
+	kept := []*gceInstance{}
+	for _, inst := range pool.instances {
+		if time.Since(inst.bootedAt) > pool.maxAge {
+			expired = append(expired, inst)
+		} else {
+			kept = append(kept, inst)
+		}
+	}
+	pool.instances = kept
+
+	return expired
+}
+
+// drain removes and returns all pooled instances.
+func (pool *gcePool) drain() []*gceInstance {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	instances := pool.instances
+	pool.instances = nil
+	return instances
+}
+
+// reserve returns whether another instance should be booted for the pool,
+// counting it as booting if so. Each reservation must be followed by a call
+// to booted.
+func (pool *gcePool) reserve() bool {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	if len(pool.instances)+pool.booting >= pool.size {
+		return false
+	}
+
+	pool.booting++
+	return true
+}
+
+// booted adds an instance booted for a reservation to the pool, or just
+// releases the reservation if inst is nil.
+func (pool *gcePool) booted(inst *gceInstance) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	pool.booting--
+	if inst != nil {
+		pool.instances = append(pool.instances, inst)
+	}
+}
+
+// refillPool keeps the pool topped up, booting instances one at a time and
+// deleting any that got too old to hand out, until the provider shuts down.
+func (p *gceProvider) refillPool() {
+	ctx, done, err := p.trackStart(gocontext.TODO())
+	if err != nil {
+		return
+	}
+	defer done()
+
+	logger := context.LoggerFromContext(ctx).WithField("self", "backend/gce_pool")
+
+	for {
+		for _, inst := range p.pool.expire() {
+			p.deletePooled(ctx, inst)
+		}
+
+		for p.pool.reserve() {
+			bootCtx, cancel := gocontext.WithTimeout(ctx, gcePoolBootTimeout)
+			inst, err := p.start(bootCtx, p.ic.Zone.Name, &StartAttributes{}, nil)
+			cancel()
+
+			if err != nil {
+				if ctx.Err() != nil {
+					p.pool.booted(nil)
+					return
+				}
+
+				metrics.Mark("worker.vm.provider.gce.pool.boot.error")
+				logger.WithField("err", err).Error("couldn't boot instance for pool")
+				p.pool.booted(nil)
+				break
+			}
+
+			metrics.Mark("worker.vm.provider.gce.pool.boot")
+			p.pool.booted(inst.(*gceInstance))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(defaultGCEPoolRefillSleep):
+		}
+	}
+}
+
+// startFromPool hands out a pooled instance if the job would boot one just
+// like it, returning nil otherwise.
+func (p *gceProvider) startFromPool(ctx gocontext.Context, startAttributes *StartAttributes) *gceInstance {
+	if startAttributes.VMConfig.SkipInstanceGroup && p.instanceGroupForZone(p.ic.Zone.Name) != "" {
+		return nil
+	}
+
+	if p.machineTypeFor(ctx, startAttributes).Name != p.ic.MachineType.Name {
+		return nil
+	}
+
+	var bootSource string
+	if p.snapshotName != "" && startAttributes.ImageSelfLink == "" {
+		snapshot, err := p.snapshotByPrefix(p.snapshotName)
+		if err != nil {
+			return nil
+		}
+		bootSource = snapshot.Name
+	} else {
+		image, err := p.getImage(ctx, startAttributes)
+		if err != nil {
+			return nil
+		}
+		bootSource = image.Name
+	}
+
+	for _, i := range p.pool.expire() {
+		go p.deletePooled(gocontext.TODO(), i)
+	}
+
+	inst := p.pool.take(bootSource)
+	if inst == nil {
+		metrics.Mark("worker.vm.provider.gce.pool.miss")
+		return nil
+	}
+
+	metrics.Mark("worker.vm.provider.gce.pool.hit")
+	context.LoggerFromContext(ctx).WithFields(logrus.Fields{
+		"instance": inst.instance.Name,
+		"age":      time.Since(inst.bootedAt),
+	}).Info("using pooled instance")
+
+	inst.os = startAttributes.OS
+	inst.scriptPath = p.scriptPathFor(startAttributes.OS)
+	inst.logSilenceTimeout = startAttributes.LogSilenceTimeout
+	inst.maxLogLength = int64(startAttributes.MaxLogLength)
+	return inst
+}
+
+func (p *gceProvider) deletePooled(ctx gocontext.Context, inst *gceInstance) {
+	metrics.Mark("worker.vm.provider.gce.pool.expired")
+	err := inst.delete(ctx)
+	if err != nil {
+		context.LoggerFromContext(ctx).WithFields(logrus.Fields{
+			"err":      err,
+			"instance": inst.instance.Name,
+		}).Error("couldn't delete expired pooled instance")
+	}
+}
@@ -0,0 +1,67 @@
+package backend
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/travis-ci/worker/config"
+)
+
+func TestGCEPool(t *testing.T) {
+	pool := &gcePool{size: 2, maxAge: time.Minute}
+
+	assert.True(t, pool.reserve())
+	assert.True(t, pool.reserve())
+	assert.False(t, pool.reserve())
+
+	pool.booted(&gceInstance{imageName: "travis-ci-a", bootedAt: time.Now()})
+	pool.booted(nil)
+
+	assert.Nil(t, pool.take("travis-ci-b"))
+	inst := pool.take("travis-ci-a")
+	if assert.NotNil(t, inst) {
+		assert.Equal(t, "travis-ci-a", inst.imageName)
+	}
+	assert.Nil(t, pool.take("travis-ci-a"))
+
+	pool.instances = append(pool.instances, &gceInstance{imageName: "travis-ci-b", bootedAt: time.Now().Add(-2 * time.Minute)})
+
+	assert.Nil(t, pool.take("travis-ci-b"))
+	expired := pool.expire()
+	if assert.Len(t, expired, 1) {
+		assert.Equal(t, "travis-ci-b", expired[0].imageName)
+	}
+	assert.Len(t, pool.instances, 0)
+}
+
+func TestNewGCEProvider_Pool(t *testing.T) {
+	cfg := config.ProviderConfigFromMap(map[string]string{
+		"ACCOUNT_JSON": "{}",
+		"PROJECT_ID":   "project_id",
+		"POOL_SIZE":    "3",
+		"POOL_MAX_AGE": "5m",
+	})
+	gceTestSetupSSH(t, cfg)
+	defer os.RemoveAll(cfg.Get("TEMP_DIR"))
+
+	p, err := newGCEProvider(cfg)
+	if assert.Nil(t, err) {
+		pool := p.(*gceProvider).pool
+		if assert.NotNil(t, pool) {
+			assert.Equal(t, 3, pool.size)
+			assert.Equal(t, 5*time.Minute, pool.maxAge)
+		}
+	}
+
+	cfg.Set("AUTO_IMPLODE", "false")
+	_, err = newGCEProvider(cfg)
+	assert.NotNil(t, err)
+
+	cfg.Set("POOL_SIZE", "0")
+	p, err = newGCEProvider(cfg)
+	if assert.Nil(t, err) {
+		assert.Nil(t, p.(*gceProvider).pool)
+	}
+}
@@ -0,0 +1,683 @@
+package backend
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/travis-ci/worker/metrics"
+	"golang.org/x/crypto/ssh"
+	gocontext "golang.org/x/net/context"
+)
+
+func (i *gceInstance) sshClient(ctx gocontext.Context) (*ssh.Client, error) {
+	host, err := i.sshHost(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't find address to connect via %s: %v", i.provider.connectVia, err)
+	}
+
+	client, err := i.provider.sshDialer.Dial(ctx, net.JoinHostPort(host, strconv.Itoa(i.provider.sshPort)), &ssh.ClientConfig{
+		User: i.authUser,
+		Auth: []ssh.AuthMethod{
+			ssh.PublicKeys(i.ic.SSHKeySigner),
+		},
+		HostKeyCallback: i.hostKeyCallback(ctx),
+	})
+	if err != nil {
+		if _, ok := err.(*sshHostKeyError); ok {
+			metrics.Mark("worker.vm.provider.gce.ssh.host_key_error")
+		} else {
+			metrics.Mark("worker.vm.provider.gce.ssh.dial_error")
+		}
+		return nil, &gceSSHError{connectVia: i.provider.connectVia, host: host, err: err}
+	}
+
+	return client, nil
+}
+
+// gceSSHError is returned by sshClient when dialing failed, wrapping the
+// dialer's *sshAuthError, *sshHostKeyError or *sshNetworkError.
+type gceSSHError struct {
+	connectVia string
+	host       string
+	err        error
+}
+
+func (e *gceSSHError) Error() string {
+	return fmt.Sprintf("couldn't connect via %s to %s: %v", e.connectVia, e.host, e.err)
+}
+
+// sshHost returns the host to connect to over ssh, depending on the
+// provider's CONNECT_VIA setting.
+func (i *gceInstance) sshHost(ctx gocontext.Context) (string, error) {
+	if i.provider.connectVia == "internal-dns" {
+		return fmt.Sprintf("%s.c.%s.internal", i.instance.Name, i.projectID), nil
+	}
+
+	err := i.refreshInstance(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	ipAddr := i.getIP()
+	if i.provider.connectVia == "private-ip" {
+		ipAddr = i.getPrivateIP()
+	}
+
+	if ipAddr == "" {
+		return "", errGCEMissingIPAddressError
+	}
+
+	return ipAddr, nil
+}
+
+// getIP returns the external IP of the instance's primary network interface,
+// which any EXTRA_NETWORK_INTERFACES come after.
+func (i *gceInstance) getIP() string {
+	if len(i.instance.NetworkInterfaces) == 0 {
+		return ""
+	}
+
+	for _, ac := range i.instance.NetworkInterfaces[0].AccessConfigs {
+		if ac.NatIP != "" {
+			return ac.NatIP
+		}
+	}
+
+	return ""
+}
+
+// getPrivateIP returns the internal IP of the instance's primary network
+// interface.
+func (i *gceInstance) getPrivateIP() string {
+	if len(i.instance.NetworkInterfaces) == 0 {
+		return ""
+	}
+
+	return i.instance.NetworkInterfaces[0].NetworkIP
+}
+
+// waitForSSH polls the instance until it accepts ssh connections, giving up
+// on errors other than network ones.
+func (i *gceInstance) waitForSSH(ctx gocontext.Context) error {
+	return pollUntil(ctx, i.provider.bootPollSleep, gceSSHPollMaxSleep, func() (bool, error) {
+		client, err := i.sshClient(ctx)
+		if sshErr, ok := err.(*gceSSHError); ok {
+			if _, ok := sshErr.err.(*sshNetworkError); ok {
+				return false, nil
+			}
+		}
+		if err != nil {
+			return false, err
+		}
+
+		client.Close()
+		return true, nil
+	})
+}
+
+func (i *gceInstance) UploadScript(ctx gocontext.Context, script []byte) error {
+	return i.upload(ctx, map[string][]byte{i.scriptPath: script})
+}
+
+// UploadFiles uploads auxiliary files for the build script in a single sftp
+// session, creating their parent directories as needed. Like SCRIPT_PATH,
+// the paths are relative to the ssh user's home directory. The build script
+// is the sentinel for the stale VM check, so the upload fails with
+// ErrStaleVM if it's already there just like with UploadScript.
+func (i *gceInstance) UploadFiles(ctx gocontext.Context, files map[string][]byte) error {
+	for filePath := range files {
+		if path.IsAbs(filePath) || filePath != path.Clean(filePath) || strings.HasPrefix(filePath, "../") || filePath == ".." {
+			return &UploadFileError{Path: filePath, Err: fmt.Errorf("path must be relative and clean")}
+		}
+	}
+
+	return i.upload(ctx, files)
+}
+
+// gceUploadErrorClass classifies an error of an upload attempt as "auth" or
+// "host_key" if the instance didn't accept the key or presented the wrong host
+// key, "network" if it couldn't be reached, e.g. because sshd isn't up yet,
+// or "other".
+func gceUploadErrorClass(err error) string {
+	if fileErr, ok := err.(*UploadFileError); ok {
+		if _, ok := fileErr.Err.(*sftpPartialWriteError); ok {
+			return "partial_write"
+		}
+	}
+
+	sshErr, ok := err.(*gceSSHError)
+	if !ok {
+		return "other"
+	}
+
+	switch sshErr.err.(type) {
+	case *sshAuthError:
+		return "auth"
+	case *sshHostKeyError:
+		return "host_key"
+	default:
+		return "network"
+	}
+}
+
+// gceUploadRetryBackoff returns how long to wait before the given retry,
+// doubling the sleep for each retry up to gceUploadMaxRetrySleep, which leaves
+// room for several attempts within the worker's upload timeout.
+func gceUploadRetryBackoff(sleep time.Duration, retry uint64) time.Duration {
+	for n := uint64(1); n < retry && sleep < gceUploadMaxRetrySleep; n++ {
+		sleep *= 2
+	}
+
+	if sleep > gceUploadMaxRetrySleep {
+		return gceUploadMaxRetrySleep
+	}
+
+	return sleep
+}
+
+func (i *gceInstance) upload(ctx gocontext.Context, files map[string][]byte) error {
+	uploadedChan := make(chan error, 1)
+
+	go func() {
+		var attempts int64
+		err := i.uploadRetrying(ctx, files, &attempts)
+
+		metrics.Sample("worker.vm.provider.gce.script.upload.attempts", attempts)
+		if err == nil {
+			metrics.Mark("worker.vm.provider.gce.script.upload.success")
+		} else {
+			metrics.Mark("worker.vm.provider.gce.script.upload.failure")
+		}
+
+		uploadedChan <- err
+	}()
+
+	select {
+	case err := <-uploadedChan:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// uploadRetrying attempts the upload until it succeeds, fails in a way that
+// retrying can't fix or runs out of retries, counting the attempts made.
+func (i *gceInstance) uploadRetrying(ctx gocontext.Context, files map[string][]byte, attempts *int64) error {
+	var errCount, authErrCount uint64
+	for {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		*attempts++
+		err := i.uploadAttempt(ctx, files)
+		if err == nil {
+			return nil
+		}
+
+		// retrying against the same dirty instance can't succeed, so
+		// leave it to the caller to replace the instance
+		if err == ErrStaleVM {
+			metrics.Mark("worker.vm.provider.gce.upload.stale_vm")
+			if i.provider.staleVMAction == "recycle" {
+				err = i.recycle(ctx)
+			}
+			return err
+		}
+
+		class := gceUploadErrorClass(err)
+		metrics.Mark(fmt.Sprintf("worker.vm.provider.gce.upload.error.%s", class))
+
+		// a wrong host key won't change, so retrying would only waste
+		// time
+		if class == "host_key" {
+			return err
+		}
+
+		// the key isn't accepted until the startup script installed it,
+		// which it's known to have done with WAIT_FOR_STARTUP_COMPLETE,
+		// but an image that never accepts it shouldn't use up every retry
+		if class == "auth" {
+			authErrCount++
+			if i.ic.WaitForStartup || authErrCount > gceUploadAuthRetries {
+				return err
+			}
+		}
+
+		errCount++
+		if errCount > i.provider.uploadRetries {
+			return err
+		}
+
+		metrics.Mark("worker.vm.provider.gce.script.upload.retry")
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(gceUploadRetryBackoff(i.provider.uploadRetrySleep, errCount)):
+		}
+	}
+}
+
+// uploadAttempt uploads the files in order of their paths, the build script
+// with mode 0755 and others with mode 0644. Whatever the files are, the build
+// script is checked for being left over from a previous job first. If any
+// file fails, the ones already written are removed again.
+func (i *gceInstance) uploadAttempt(ctx gocontext.Context, files map[string][]byte) error {
+	client, err := i.sshClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	sftp, err := sftp.NewClient(client)
+	if err != nil {
+		return err
+	}
+	defer sftp.Close()
+
+	_, err = sftp.Lstat(i.scriptPath)
+	if err == nil {
+		if i.provider.staleVMAction != "overwrite" {
+			return ErrStaleVM
+		}
+
+		metrics.Mark("worker.vm.provider.gce.upload.stale_vm.overwrite")
+		err = sftp.Remove(i.scriptPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	filePaths := []string{}
+	for filePath := range files {
+		filePaths = append(filePaths, filePath)
+	}
+	sort.Strings(filePaths)
+
+	written := []string{}
+	for _, filePath := range filePaths {
+		mode := os.FileMode(0644)
+		if filePath == i.scriptPath {
+			mode = 0755
+		}
+
+		err = gceUploadFile(sftp, filePath, files[filePath], mode)
+		if err != nil {
+			// remove what was written so that the next attempt isn't
+			// mistaken for a stale VM
+			for _, writtenPath := range append(written, filePath) {
+				_ = sftp.Remove(writtenPath)
+			}
+			return &UploadFileError{Path: filePath, Err: err}
+		}
+
+		written = append(written, filePath)
+	}
+
+	return nil
+}
+
+// hasBuildScript returns whether a build script was uploaded to the
+// instance.
+func (i *gceInstance) hasBuildScript(ctx gocontext.Context) (bool, error) {
+	client, err := i.sshClient(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer client.Close()
+
+	sftpClient, err := sftp.NewClient(client)
+	if err != nil {
+		return false, err
+	}
+	defer sftpClient.Close()
+
+	_, err = sftpClient.Lstat(i.scriptPath)
+	if err == nil {
+		return true, nil
+	}
+
+	if statusErr, ok := err.(*sftp.StatusError); ok && statusErr.Code == gceSFTPNoSuchFile {
+		return false, nil
+	}
+
+	return false, err
+}
+
+// scriptPathFor returns where the build script is uploaded for jobs on the
+// given OS.
+func (p *gceProvider) scriptPathFor(os string) string {
+	if p.scriptPath != "" {
+		return p.scriptPath
+	}
+
+	if os == "windows" {
+		return defaultGCEWindowsScriptPath
+	}
+
+	return defaultGCEScriptPath
+}
+
+// scriptCommand returns the command that runs the uploaded build script. Like
+// sftp paths, relative paths in ssh commands are relative to the home
+// directory, so both resolve to the same file.
+func (i *gceInstance) scriptCommand() string {
+	if i.os == "windows" {
+		return fmt.Sprintf("powershell -NoProfile -NonInteractive -ExecutionPolicy Bypass -File %s", gcePowerShellQuote(i.scriptPath))
+	}
+
+	scriptPath := i.scriptPath
+	if !path.IsAbs(scriptPath) {
+		scriptPath = "./" + scriptPath
+	}
+
+	if i.provider.scriptInterpreter == "" {
+		return gceShellQuote(scriptPath)
+	}
+
+	return fmt.Sprintf("%s %s", i.provider.scriptInterpreter, gceShellQuote(scriptPath))
+}
+
+// gceShellQuote quotes s as a single word for POSIX shells.
+func gceShellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// gcePowerShellQuote quotes s as a single word for PowerShell.
+func gcePowerShellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+// gceUploadFile creates the file's parent directories if they're missing and
+// writes and verifies the file. The file is written under a temporary name
+// and only renamed into place once it's complete, so that a write cut short
+// by a connection reset can't leave a truncated file that a retry would
+// mistake for a stale VM's.
+func gceUploadFile(client *sftp.Client, filePath string, contents []byte, mode os.FileMode) error {
+	err := gceMkdirAll(client, path.Dir(filePath))
+	if err != nil {
+		return err
+	}
+
+	// a previous attempt whose connection was reset couldn't remove it
+	tempPath := filePath + gceUploadTempSuffix
+	_ = client.Remove(tempPath)
+
+	f, err := client.Create(tempPath)
+	if err != nil {
+		return err
+	}
+
+	err = sftpWriteFile(f, contents, mode)
+	if err == nil {
+		err = gceVerifyFile(client, tempPath, contents)
+	}
+	if err != nil {
+		_ = client.Remove(tempPath)
+		return err
+	}
+
+	// renaming onto an existing file fails over sftp
+	if _, err := client.Lstat(filePath); err == nil {
+		err = client.Remove(filePath)
+		if err != nil {
+			_ = client.Remove(tempPath)
+			return err
+		}
+	}
+
+	return client.Rename(tempPath, filePath)
+}
+
+// gceMkdirAll creates the directory and any missing parents.
+func gceMkdirAll(client *sftp.Client, dir string) error {
+	if dir == "." || dir == "/" {
+		return nil
+	}
+
+	if _, err := client.Lstat(dir); err == nil {
+		return nil
+	}
+
+	err := gceMkdirAll(client, path.Dir(dir))
+	if err != nil {
+		return err
+	}
+
+	return client.Mkdir(dir)
+}
+
+// gceVerifyFile checks that the uploaded file has the expected size.
+func gceVerifyFile(client *sftp.Client, filePath string, contents []byte) error {
+	fi, err := client.Lstat(filePath)
+	if err != nil {
+		return err
+	}
+
+	if fi.Size() != int64(len(contents)) {
+		return &sftpPartialWriteError{written: fi.Size(), expected: int64(len(contents))}
+	}
+
+	return nil
+}
+
+func (i *gceInstance) RunScript(ctx gocontext.Context, output io.Writer) (*RunResult, error) {
+	client, err := i.sshClient(ctx)
+	if err != nil {
+		return &RunResult{Completed: false}, err
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return &RunResult{Completed: false}, err
+	}
+	defer session.Close()
+
+	if i.provider.pty {
+		err = session.RequestPty(i.provider.ptyTerm, i.provider.ptyRows, i.provider.ptyCols, ssh.TerminalModes{})
+		if err != nil {
+			return &RunResult{Completed: false}, err
+		}
+	}
+
+	limitedOutput := output
+	var limitExceededChan <-chan struct{}
+	if i.maxLogLength > 0 {
+		lw := newLimitWriter(output, i.maxLogLength)
+		limitedOutput = lw
+		limitExceededChan = lw.Exceeded()
+	}
+
+	silenceOutput := newSilenceWriter(limitedOutput)
+	countingOutput := &countingWriter{w: silenceOutput}
+
+	// without a pty, stdout and stderr are copied by separate goroutines
+	syncedOutput := &syncWriter{w: countingOutput}
+	session.Stdout = syncedOutput
+	session.Stderr = syncedOutput
+
+	defer func() {
+		metrics.Sample("worker.vm.provider.gce.run.output_bytes", countingOutput.Count())
+	}()
+
+	startRun := time.Now()
+	err = session.Start(i.scriptCommand())
+	if err != nil {
+		return &RunResult{Completed: false}, err
+	}
+
+	waitChan := make(chan error, 1)
+	go func() {
+		waitChan <- session.Wait()
+	}()
+
+	var silenceChan <-chan time.Time
+	if i.logSilenceTimeout > 0 {
+		ticker := time.NewTicker(gceLogSilenceCheckInterval(i.logSilenceTimeout))
+		defer ticker.Stop()
+		silenceChan = ticker.C
+	}
+
+	for done := false; !done; {
+		select {
+		case err = <-waitChan:
+			done = true
+		case <-silenceChan:
+			if silenceOutput.SilentFor() < i.logSilenceTimeout {
+				continue
+			}
+
+			metrics.Mark("worker.vm.provider.gce.run.log_silence_timeout")
+			gceTerminateSession(session, waitChan)
+			_, _ = fmt.Fprintf(output, "\n\nNo output has been received in the last %v, this potentially indicates a stalled build or something wrong with the build itself.\n\nThe build has been terminated\n\n", i.logSilenceTimeout)
+
+			return &RunResult{
+				TimedOut:    true,
+				Duration:    time.Since(startRun),
+				OutputBytes: countingOutput.Count(),
+			}, nil
+		case <-limitExceededChan:
+			metrics.Mark("worker.vm.provider.gce.run.log_limit_exceeded")
+			gceTerminateSession(session, waitChan)
+
+			return &RunResult{
+				LogLimitExceeded: true,
+				Duration:         time.Since(startRun),
+				OutputBytes:      countingOutput.Count(),
+			}, nil
+		case <-ctx.Done():
+			metrics.Mark("worker.vm.provider.gce.run.cancelled")
+			gceTerminateSession(session, waitChan)
+
+			return &RunResult{
+				Cancelled:   true,
+				Duration:    time.Since(startRun),
+				OutputBytes: countingOutput.Count(),
+			}, ctx.Err()
+		}
+	}
+
+	result := &RunResult{
+		Duration:    time.Since(startRun),
+		OutputBytes: countingOutput.Count(),
+	}
+
+	return gceClassifyWaitError(result, err)
+}
+
+// Exec runs the command over ssh without a pty, returning at most 64KiB of
+// its combined output. It's stopped after a minute if the context isn't done
+// before.
+func (i *gceInstance) Exec(ctx gocontext.Context, command string) ([]byte, error) {
+	ctx, cancel := gocontext.WithTimeout(ctx, i.provider.execTimeout)
+	defer cancel()
+
+	client, err := i.sshClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	output := &bytes.Buffer{}
+	syncedOutput := &syncWriter{w: newLimitWriter(output, gceExecMaxOutput)}
+	session.Stdout = syncedOutput
+	session.Stderr = syncedOutput
+
+	err = session.Start(command)
+	if err != nil {
+		return nil, err
+	}
+
+	waitChan := make(chan error, 1)
+	go func() {
+		waitChan <- session.Wait()
+	}()
+
+	select {
+	case err = <-waitChan:
+	case <-ctx.Done():
+		gceTerminateSession(session, waitChan)
+		err = ctx.Err()
+	}
+
+	// the session's output may still be copied after it was terminated
+	syncedOutput.mutex.Lock()
+	defer syncedOutput.mutex.Unlock()
+
+	return append([]byte{}, output.Bytes()...), err
+}
+
+// gceClassifyWaitError fills in the result of a script from the error returned
+// by waiting for its session, returning the error if it isn't one the result
+// can express.
+func gceClassifyWaitError(result *RunResult, err error) (*RunResult, error) {
+	if err == nil {
+		result.Completed = true
+		return result, nil
+	}
+
+	switch e := err.(type) {
+	case *ssh.ExitError:
+		result.Completed = true
+		result.ExitCode = uint8(e.ExitStatus())
+		if e.Signal() != "" {
+			metrics.Mark("worker.vm.provider.gce.run.signal")
+			result.Reason = RunReasonSignal
+			result.Signal = e.Signal()
+		}
+		return result, nil
+	default:
+		// the vendored ssh package doesn't have a type for this error
+		if strings.Contains(err.Error(), gceExitMissingMessage) {
+			metrics.Mark("worker.vm.provider.gce.run.exit_missing")
+			result.Reason = RunReasonExitMissing
+			return result, nil
+		}
+		return result, err
+	}
+}
+
+// gceTerminateSession tells the script run by the session that it's being
+// stopped and gives it a moment to write its last output, closing the session
+// if it doesn't exit in time.
+func gceTerminateSession(session *ssh.Session, waitChan <-chan error) {
+	if err := session.Signal(ssh.SIGTERM); err != nil {
+		_ = session.Close()
+	}
+
+	select {
+	case <-waitChan:
+	case <-time.After(gceRunScriptCancelGrace):
+		_ = session.Close()
+	}
+}
+
+// gceLogSilenceCheckInterval returns how often to check whether a script has
+// been silent for longer than the given timeout.
+func gceLogSilenceCheckInterval(timeout time.Duration) time.Duration {
+	interval := timeout / 10
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	return interval
+}
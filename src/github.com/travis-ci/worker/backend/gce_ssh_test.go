@@ -0,0 +1,148 @@
+package backend
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	gocontext "golang.org/x/net/context"
+	"google.golang.org/api/compute/v1"
+)
+
+// gceTestSSHInstance returns an instance of a provider backed by the fake
+// compute API, reachable over ssh on the server started by listen, which is
+// given the key the instance logs in with.
+func gceTestSSHInstance(t *testing.T, listen func(clientKey ssh.PublicKey) net.Listener) (*gceInstance, *gceTestFakeCompute) {
+	p, fc := gceTestFakeComputeSetup(t, map[string]string{"UPLOAD_RETRY_SLEEP": "1ms"})
+
+	listener := listen(p.ic.SSHKeySigner.PublicKey())
+	_, port, err := net.SplitHostPort(listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.sshPort, err = strconv.Atoi(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inst := &compute.Instance{
+		Name:   p.instanceNamePrefix + "ssh",
+		Status: "RUNNING",
+		Zone:   "us-central1-a",
+		NetworkInterfaces: []*compute.NetworkInterface{{
+			AccessConfigs: []*compute.AccessConfig{{NatIP: "127.0.0.1"}},
+		}},
+	}
+	fc.instances[inst.Name] = inst
+
+	return p.newInstance(inst, "travis-ci-minimal-1", &StartAttributes{}), fc
+}
+
+func TestGCEInstance_uploadRetryingAuthErrors(t *testing.T) {
+	// the server only accepts some other key, as if the startup script
+	// didn't install the worker's yet
+	i, fc := gceTestSSHInstance(t, func(ssh.PublicKey) net.Listener {
+		return sshTestExecServer(t, sshTestSigner(t).PublicKey(), func(ssh.Channel) {})
+	})
+	defer gceTestTeardown(i.provider)
+	defer fc.close()
+
+	files := map[string][]byte{"build.sh": []byte("echo hai")}
+
+	var attempts int64
+	err := i.uploadRetrying(gocontext.TODO(), files, &attempts)
+	assert.Equal(t, "auth", gceUploadErrorClass(err))
+	assert.Equal(t, int64(gceUploadAuthRetries+1), attempts)
+
+	i.ic.WaitForStartup = true
+	attempts = 0
+	err = i.uploadRetrying(gocontext.TODO(), files, &attempts)
+	assert.Equal(t, "auth", gceUploadErrorClass(err))
+	assert.Equal(t, int64(1), attempts)
+}
+
+func TestGCEInstance_ExecMaxOutput(t *testing.T) {
+	i, fc := gceTestSSHInstance(t, func(clientKey ssh.PublicKey) net.Listener {
+		return sshTestExecServer(t, clientKey, func(ch ssh.Channel) {
+			_, _ = ch.Write(bytes.Repeat([]byte("a"), gceExecMaxOutput))
+			_, _ = ch.Write([]byte("truncated"))
+			_, _ = ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+		})
+	})
+	defer gceTestTeardown(i.provider)
+	defer fc.close()
+
+	output, err := i.Exec(gocontext.TODO(), "dmesg")
+	assert.Nil(t, err)
+	assert.Len(t, output, gceExecMaxOutput)
+	assert.NotContains(t, string(output), "truncated")
+}
+
+func TestGCEInstance_ExecTimeout(t *testing.T) {
+	signals := make(chan string, 1)
+	hang := make(chan struct{})
+	defer close(hang)
+
+	// the command hangs until it's signalled
+	i, fc := gceTestSSHInstance(t, func(clientKey ssh.PublicKey) net.Listener {
+		return sshTestSignalServer(t, clientKey, func(ch ssh.Channel) {
+			_, _ = ch.Write([]byte("partial output"))
+			<-hang
+		}, signals)
+	})
+	defer gceTestTeardown(i.provider)
+	defer fc.close()
+
+	i.provider.execTimeout = 50 * time.Millisecond
+
+	startExec := time.Now()
+	output, err := i.Exec(gocontext.TODO(), "sleep 3600")
+	assert.Equal(t, gocontext.DeadlineExceeded, err)
+	assert.Equal(t, "partial output", string(output))
+	assert.Equal(t, "TERM", <-signals)
+	assert.True(t, time.Since(startExec) < gceRunScriptCancelGrace)
+}
+
+func TestGCEInstance_RunScriptCancelled(t *testing.T) {
+	signals := make(chan string, 1)
+	started := make(chan struct{})
+	hang := make(chan struct{})
+	defer close(hang)
+
+	i, fc := gceTestSSHInstance(t, func(clientKey ssh.PublicKey) net.Listener {
+		return sshTestSignalServer(t, clientKey, func(ch ssh.Channel) {
+			_, _ = ch.Write([]byte("running"))
+			close(started)
+			<-hang
+		}, signals)
+	})
+	defer gceTestTeardown(i.provider)
+	defer fc.close()
+
+	ctx, cancel := gocontext.WithCancel(gocontext.TODO())
+	defer cancel()
+
+	// the job is cancelled while its script is running
+	go func() {
+		<-started
+		cancel()
+	}()
+
+	output := &bytes.Buffer{}
+	startRun := time.Now()
+	result, err := i.RunScript(ctx, output)
+	assert.Equal(t, gocontext.Canceled, err)
+	if assert.NotNil(t, result) {
+		assert.True(t, result.Cancelled)
+		assert.False(t, result.Completed)
+	}
+	assert.Equal(t, "running", output.String())
+	assert.Equal(t, "TERM", <-signals)
+
+	// the script stopped when signalled, so it wasn't closed after the grace
+	assert.True(t, time.Since(startRun) < gceRunScriptCancelGrace)
+}
@@ -0,0 +1,82 @@
+package backend
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/travis-ci/worker/context"
+	"github.com/travis-ci/worker/metrics"
+	gocontext "golang.org/x/net/context"
+	"google.golang.org/api/compute/v1"
+)
+
+const (
+	defaultGCEStartupCompleteTimeout = 5 * time.Minute
+
+	// gceStartupCompleteLine is written to the serial console by the
+	// startup script as its last step with WAIT_FOR_STARTUP_COMPLETE. The
+	// vendored compute API has no guest attributes the script could set
+	// instead.
+	gceStartupCompleteLine = "-----TRAVIS WORKER STARTUP COMPLETE-----"
+)
+
+// StartupCompleteLine returns the line the startup script writes once it's
+// done, for use in the startup script template.
+func (ic *gceInstanceConfig) StartupCompleteLine() string {
+	return gceStartupCompleteLine
+}
+
+// gceStartupCompleted returns whether the serial console output shows that
+// the startup script completed.
+func gceStartupCompleted(output string) bool {
+	for _, line := range strings.Split(output, "\n") {
+		if strings.TrimSpace(line) == gceStartupCompleteLine {
+			return true
+		}
+	}
+
+	return false
+}
+
+// waitForStartupComplete polls the instance's serial console output until the
+// startup script wrote its completion line. After STARTUP_COMPLETE_TIMEOUT it
+// gives up with a boot timeout carrying the output, which usually tells why.
+func (p *gceProvider) waitForStartupComplete(ctx gocontext.Context, inst *compute.Instance) error {
+	i := &gceInstance{
+		provider:  p,
+		instance:  inst,
+		ic:        p.ic,
+		projectID: p.projectID,
+	}
+
+	timeout := time.After(p.startupCompleteTimeout)
+
+	for {
+		output, err := i.SerialOutput(ctx, 1)
+		if err == nil && gceStartupCompleted(output) {
+			return nil
+		}
+
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			context.LoggerFromContext(ctx).WithFields(logrus.Fields{
+				"err":      err,
+				"instance": inst.Name,
+			}).Warn("couldn't get serial console output while waiting for startup script")
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timeout:
+			metrics.Mark("worker.vm.provider.gce.boot.startup.timeout")
+			return p.bootTimeoutError(ctx, inst, fmt.Errorf("instance %s didn't complete its startup script within %v", inst.Name, p.startupCompleteTimeout))
+		case <-time.After(p.bootPollSleep):
+		}
+	}
+}
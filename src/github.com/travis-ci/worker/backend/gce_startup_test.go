@@ -0,0 +1,55 @@
+package backend
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	gocontext "golang.org/x/net/context"
+	"google.golang.org/api/compute/v1"
+)
+
+func TestGCEStartupCompleted(t *testing.T) {
+	assert.False(t, gceStartupCompleted("booting...\nlogin: "))
+	assert.False(t, gceStartupCompleted("startup-script: echo \""+gceStartupCompleteLine+"\"\n"))
+	assert.True(t, gceStartupCompleted("booting...\r\n"+gceStartupCompleteLine+"\r\nlogin: "))
+}
+
+func TestGCEProvider_waitForStartupComplete(t *testing.T) {
+	serialOutputPath := "/compute/v1/projects/project_id/zones/us-central1-a/instances/testing-gce-abc/serialPort"
+	rt := &gceTestRoundTripper{responses: map[string]string{
+		serialOutputPath: `{"contents":"booting...\n"}`,
+	}}
+	client, err := compute.New(&http.Client{Transport: rt})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &gceProvider{
+		api:                    &gceComputeService{client: client},
+		ic:                     &gceInstanceConfig{Zone: &compute.Zone{Name: "us-central1-a"}},
+		projectID:              "project_id",
+		bootPollSleep:          time.Millisecond,
+		startupCompleteTimeout: 20 * time.Millisecond,
+	}
+	inst := &compute.Instance{Name: "testing-gce-abc"}
+
+	err = p.waitForStartupComplete(gocontext.TODO(), inst)
+	if assert.IsType(t, &StartError{}, err) {
+		assert.Equal(t, ErrBootTimeout, err.(*StartError).Cause)
+		assert.Contains(t, err.Error(), "didn't complete its startup script within 20ms")
+		assert.Contains(t, err.Error(), "booting...")
+	}
+
+	rt.mutex.Lock()
+	rt.responses[serialOutputPath] = fmt.Sprintf(`{"contents":"booting...\n%s\n"}`, gceStartupCompleteLine)
+	rt.mutex.Unlock()
+
+	assert.Nil(t, p.waitForStartupComplete(gocontext.TODO(), inst))
+
+	ctx, cancel := gocontext.WithCancel(gocontext.TODO())
+	cancel()
+	assert.Equal(t, gocontext.Canceled, p.waitForStartupComplete(ctx, inst))
+}
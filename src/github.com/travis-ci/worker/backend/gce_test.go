@@ -1,6 +1,13 @@
 package backend
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -9,10 +16,19 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	gometrics "github.com/rcrowley/go-metrics"
 	"github.com/stretchr/testify/assert"
 	"github.com/travis-ci/worker/config"
+	"github.com/travis-ci/worker/image"
+	"golang.org/x/crypto/ssh"
+	gocontext "golang.org/x/net/context"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
 )
 
 var (
@@ -105,11 +121,11 @@ func gceTestSetupSSH(t *testing.T, cfg *config.ProviderConfig) {
 		t.Fatal(err)
 	}
 
-	if !cfg.IsSet("SSH_KEY_PATH") {
+	if !cfg.IsSet("SSH_KEY_PATH") && !cfg.IsSet("SSH_KEY") {
 		cfg.Set("SSH_KEY_PATH", keyPath)
 	}
 
-	if !cfg.IsSet("SSH_PUB_KEY_PATH") {
+	if !cfg.IsSet("SSH_PUB_KEY_PATH") && !cfg.IsSet("SSH_PUB_KEY") {
 		cfg.Set("SSH_PUB_KEY_PATH", pubKeyPath)
 	}
 
@@ -184,7 +200,6 @@ func gceTestSetup(t *testing.T, cfg *config.ProviderConfig, resp *gceTestRespons
 	server := gceTestSetupGCEServer(resp)
 	reqs := &gceTestRequestLog{}
 
-	gceCustomHTTPTransportLock.Lock()
 	transport := &http.Transport{
 		Proxy: func(req *http.Request) (*url.URL, error) {
 			reqs.Add(req)
@@ -199,13 +214,9 @@ func gceTestSetup(t *testing.T, cfg *config.ProviderConfig, resp *gceTestRespons
 			return u, nil
 		},
 	}
-	gceCustomHTTPTransport = transport
+	cfg.SetHTTPTransport(transport)
 
 	p, err := newGCEProvider(cfg)
-
-	gceCustomHTTPTransport = nil
-	gceCustomHTTPTransportLock.Unlock()
-
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -267,6 +278,38 @@ func TestNewGCEProvider_RequiresSSHPubKeyPath(t *testing.T) {
 	assert.Regexp(t, "missing SSH_PUB_KEY_PATH", err.Error())
 }
 
+func TestNewGCEProvider_InlineSSHKeys(t *testing.T) {
+	cfg := config.ProviderConfigFromMap(map[string]string{
+		"ACCOUNT_JSON": "{}",
+		"PROJECT_ID":   "project_id",
+		"SSH_KEY":      gceTestSSHKey,
+		"SSH_PUB_KEY":  gceTestSSHPubKey + "\n",
+	})
+
+	p, _, _ := gceTestSetup(t, cfg, nil)
+	defer gceTestTeardown(p)
+
+	assert.False(t, cfg.IsSet("SSH_KEY_PATH"))
+	assert.Equal(t, gceTestSSHPubKey+"\n", p.ic.SSHPubKey)
+	assert.Nil(t, gceVerifySSHKeyPair(p.ic.SSHKeySigner, p.ic.SSHPubKey))
+
+	// values that aren't keys are paths
+	cfg = config.ProviderConfigFromMap(map[string]string{
+		"ACCOUNT_JSON": "{}",
+		"PROJECT_ID":   "foo",
+	})
+	gceTestSetupSSH(t, cfg)
+	cfg.Set("SSH_KEY", cfg.Get("SSH_KEY_PATH"))
+	cfg.Unset("SSH_KEY_PATH")
+
+	_, err := newGCEProvider(cfg)
+	assert.Nil(t, err)
+
+	cfg.Set("SSH_KEY_PATH", cfg.Get("SSH_KEY"))
+	_, err = newGCEProvider(cfg)
+	assert.EqualError(t, err, "SSH_KEY can't be combined with SSH_KEY_PATH")
+}
+
 func TestNewGCEProvider_RequiresSSHKeyPassphrase(t *testing.T) {
 	cfg := config.ProviderConfigFromMap(map[string]string{
 		"ACCOUNT_JSON": "{}",
@@ -330,5 +373,1903 @@ func TestGCEProvider_SetupMakesRequests(t *testing.T) {
 	err := p.Setup()
 
 	assert.NotNil(t, err)
-	assert.Len(t, rl.Reqs, 1)
+	assert.Len(t, rl.Reqs, 6)
+}
+
+func TestGCEProvider_SetupAggregatesErrors(t *testing.T) {
+	p, _, _ := gceTestSetup(t, nil, nil)
+	defer gceTestTeardown(p)
+
+	rt := &gceTestRoundTripper{responses: map[string]string{
+		"/compute/v1/projects/project_id/zones/us-central1-a":                            `{"name":"us-central1-a"}`,
+		"/compute/v1/projects/project_id/zones/us-central1-a/diskTypes/pd-ssd":           `{"name":"pd-ssd"}`,
+		"/compute/v1/projects/project_id/zones/us-central1-a/machineTypes/n1-standard-2": `{"name":"n1-standard-2"}`,
+		"/compute/v1/projects/project_id/global/images":                                  `{"items":[{"name":"travis-ci-minimal-1"}]}`,
+	}}
+
+	client, err := compute.New(&http.Client{Transport: rt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.api = &gceComputeService{client: client}
+
+	err = p.Setup()
+	if assert.IsType(t, &gceSetupError{}, err) {
+		assert.Equal(t, []string{`network "default": googleapi: Error 404: not found`}, err.(*gceSetupError).errs)
+	}
+
+	rt.responses["/compute/v1/projects/project_id/global/networks/default"] = `{"name":"default"}`
+
+	err = p.Setup()
+	assert.Nil(t, err)
+	assert.Equal(t, "n1-standard-2", p.ic.MachineType.Name)
+}
+
+func TestGCEVerifySSHKeyPair(t *testing.T) {
+	p, _, _ := gceTestSetup(t, nil, nil)
+	defer gceTestTeardown(p)
+
+	assert.Nil(t, gceVerifySSHKeyPair(p.ic.SSHKeySigner, p.ic.SSHPubKey))
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	otherSigner, err := ssh.NewSignerFromKey(otherKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.NotNil(t, gceVerifySSHKeyPair(otherSigner, p.ic.SSHPubKey))
+}
+
+func TestNewGCEProvider_RejectsUnsupportedConfig(t *testing.T) {
+	for _, key := range gceUnsupportedConfigKeys {
+		cfg := config.ProviderConfigFromMap(map[string]string{
+			"ACCOUNT_JSON": "{}",
+			"PROJECT_ID":   "foo",
+			key:            "true",
+		})
+
+		gceTestSetupSSH(t, cfg)
+		_, err := newGCEProvider(cfg)
+		_ = os.RemoveAll(cfg.Get("TEMP_DIR"))
+
+		if !assert.NotNil(t, err) {
+			t.Fatal()
+		}
+
+		assert.Regexp(t, key+" is not supported", err.Error())
+	}
+}
+
+func TestGCEProvider_bootMetricNames(t *testing.T) {
+	p, _, _ := gceTestSetup(t, nil, nil)
+	defer gceTestTeardown(p)
+
+	tags := gceBootMetricTags{imageName: "travis-ci-ruby-1", zoneName: "us-central1-b", machineTypeName: "n1-standard-2"}
+
+	assert.Equal(t, []string{"worker.vm.provider.gce.boot"},
+		p.bootMetricNames("worker.vm.provider.gce.boot", tags))
+
+	p.detailedBootMetrics = true
+	assert.Equal(t, []string{
+		"worker.vm.provider.gce.boot",
+		"worker.vm.provider.gce.boot.image.travis-ci-ruby-1",
+		"worker.vm.provider.gce.boot.zone.us-central1-b",
+		"worker.vm.provider.gce.boot.machine_type.n1-standard-2",
+	}, p.bootMetricNames("worker.vm.provider.gce.boot", tags))
+}
+
+func TestGCEProvider_buildInstanceRecordsExpiry(t *testing.T) {
+	p, _, _ := gceTestSetup(t, nil, nil)
+	defer gceTestTeardown(p)
+
+	p.ic.MachineType = &compute.MachineType{}
+	p.ic.Network = &compute.Network{}
+
+	before := time.Now().Add(time.Hour + p.ic.ExpiryGrace).Add(-time.Second)
+	inst := p.buildInstance("us-central1-a", &StartAttributes{HardTimeout: time.Hour}, p.ic.MachineType, "image-link", "")
+	after := time.Now().Add(time.Hour + p.ic.ExpiryGrace)
+
+	expires, ok := gceInstanceExpiry(inst)
+	assert.True(t, ok)
+	assert.True(t, expires.After(before), "expires %v should be after %v", expires, before)
+	assert.False(t, expires.After(after), "expires %v should not be after %v", expires, after)
+
+	_, ok = gceInstanceExpiry(&compute.Instance{})
+	assert.False(t, ok)
+}
+
+func TestNewGCEProvider_Scheduling(t *testing.T) {
+	p, _, _ := gceTestSetup(t, nil, nil)
+	gceTestTeardown(p)
+
+	p.ic.MachineType = &compute.MachineType{}
+	p.ic.Network = &compute.Network{}
+	assert.Equal(t, &compute.Scheduling{Preemptible: true, ProvisioningModel: "SPOT", AutomaticRestart: googleapi.Bool(false)},
+		p.buildInstance("us-central1-a", &StartAttributes{}, p.ic.MachineType, "image-link", "").Scheduling)
+
+	cfg := config.ProviderConfigFromMap(map[string]string{
+		"ACCOUNT_JSON":        "{}",
+		"PROJECT_ID":          "project_id",
+		"PREEMPTIBLE":         "false",
+		"ON_HOST_MAINTENANCE": "MIGRATE",
+		"AUTOMATIC_RESTART":   "true",
+	})
+	p, _, _ = gceTestSetup(t, cfg, nil)
+	defer gceTestTeardown(p)
+
+	p.ic.MachineType = &compute.MachineType{}
+	p.ic.Network = &compute.Network{}
+	assert.Equal(t, &compute.Scheduling{ProvisioningModel: "STANDARD", OnHostMaintenance: "MIGRATE", AutomaticRestart: googleapi.Bool(true)},
+		p.buildInstance("us-central1-a", &StartAttributes{}, p.ic.MachineType, "image-link", "").Scheduling)
+
+	for message, settings := range map[string]map[string]string{
+		`invalid on host maintenance "REBOOT"`:                                        {"ON_HOST_MAINTENANCE": "REBOOT"},
+		"ON_HOST_MAINTENANCE can't be MIGRATE for preemptible instances":              {"PREEMPTIBLE": "true", "ON_HOST_MAINTENANCE": "MIGRATE"},
+		"AUTOMATIC_RESTART can't be true for preemptible instances":                   {"PREEMPTIBLE": "true", "ON_HOST_MAINTENANCE": "TERMINATE"},
+		`invalid SPOT_INSTANCE_TERMINATION_ACTION "SUSPEND", expected STOP or DELETE`: {"PREEMPTIBLE": "true", "ON_HOST_MAINTENANCE": "TERMINATE", "AUTOMATIC_RESTART": "false", "SPOT_INSTANCE_TERMINATION_ACTION": "SUSPEND"},
+		"SPOT_INSTANCE_TERMINATION_ACTION can only be set for spot instances":         {"SPOT_INSTANCE_TERMINATION_ACTION": "DELETE"},
+		`invalid PROVISIONING_MODEL "RESERVED", expected STANDARD or SPOT`:            {"PROVISIONING_MODEL": "RESERVED"},
+	} {
+		for key, value := range settings {
+			cfg.Set(key, value)
+		}
+
+		_, err := newGCEProvider(cfg)
+		if assert.NotNil(t, err, message) {
+			assert.Equal(t, message, err.Error())
+		}
+
+		cfg.Set("PREEMPTIBLE", "false")
+		cfg.Set("ON_HOST_MAINTENANCE", "MIGRATE")
+		cfg.Set("AUTOMATIC_RESTART", "true")
+		cfg.Unset("PROVISIONING_MODEL")
+		cfg.Unset("SPOT_INSTANCE_TERMINATION_ACTION")
+	}
+
+	// the provisioning model takes precedence over PREEMPTIBLE
+	cfg.Set("PREEMPTIBLE", "true")
+	cfg.Set("PROVISIONING_MODEL", "STANDARD")
+	cfg.Set("AUTOMATIC_RESTART", "false")
+	p, _, _ = gceTestSetup(t, cfg, nil)
+	defer gceTestTeardown(p)
+
+	p.ic.MachineType = &compute.MachineType{}
+	p.ic.Network = &compute.Network{}
+	assert.Equal(t, &compute.Scheduling{ProvisioningModel: "STANDARD", OnHostMaintenance: "MIGRATE", AutomaticRestart: googleapi.Bool(false)},
+		p.buildInstance("us-central1-a", &StartAttributes{}, p.ic.MachineType, "image-link", "").Scheduling)
+
+	cfg.Set("PREEMPTIBLE", "false")
+	cfg.Set("PROVISIONING_MODEL", "SPOT")
+	cfg.Set("ON_HOST_MAINTENANCE", "TERMINATE")
+	cfg.Set("SPOT_INSTANCE_TERMINATION_ACTION", "DELETE")
+	cfg.Unset("AUTOMATIC_RESTART")
+	p, _, _ = gceTestSetup(t, cfg, nil)
+	defer gceTestTeardown(p)
+
+	p.ic.MachineType = &compute.MachineType{}
+	p.ic.Network = &compute.Network{}
+	assert.Equal(t, &compute.Scheduling{Preemptible: true, ProvisioningModel: "SPOT", InstanceTerminationAction: "DELETE", OnHostMaintenance: "TERMINATE", AutomaticRestart: googleapi.Bool(false)},
+		p.buildInstance("us-central1-a", &StartAttributes{}, p.ic.MachineType, "image-link", "").Scheduling)
+}
+
+func TestNewGCEProvider_NodeAffinity(t *testing.T) {
+	cfg := config.ProviderConfigFromMap(map[string]string{
+		"ACCOUNT_JSON":         "{}",
+		"PROJECT_ID":           "project_id",
+		"NODE_AFFINITY_KEY":    "compute.googleapis.com/node-group-name",
+		"NODE_AFFINITY_VALUES": "builds-a, builds-b",
+	})
+	p, _, _ := gceTestSetup(t, cfg, nil)
+	defer gceTestTeardown(p)
+
+	p.ic.MachineType = &compute.MachineType{}
+	p.ic.Network = &compute.Network{}
+	assert.Equal(t, &compute.Scheduling{
+		ProvisioningModel: "STANDARD",
+		AutomaticRestart:  googleapi.Bool(true),
+		NodeAffinities: []*compute.SchedulingNodeAffinity{
+			{Key: "compute.googleapis.com/node-group-name", Operator: "IN", Values: []string{"builds-a", "builds-b"}},
+		},
+	}, p.buildInstance("us-central1-a", &StartAttributes{}, p.ic.MachineType, "image-link", "").Scheduling)
+
+	for _, c := range []struct {
+		message  string
+		settings map[string]string
+	}{
+		{"missing NODE_AFFINITY_KEY", map[string]string{"NODE_AFFINITY_KEY": ""}},
+		{"missing NODE_AFFINITY_VALUES", map[string]string{"NODE_AFFINITY_VALUES": " , "}},
+		{`invalid NODE_AFFINITY_OPERATOR "EQ", expected IN or NOT_IN`, map[string]string{"NODE_AFFINITY_OPERATOR": "EQ"}},
+		{"NODE_AFFINITY_KEY can't be set for preemptible instances", map[string]string{"PREEMPTIBLE": "true"}},
+		{"NODE_AFFINITY_KEY can't be set for preemptible instances", map[string]string{"PROVISIONING_MODEL": "SPOT"}},
+	} {
+		for key, value := range c.settings {
+			cfg.Set(key, value)
+		}
+
+		_, err := newGCEProvider(cfg)
+		if assert.NotNil(t, err, c.message) {
+			assert.Equal(t, c.message, err.Error())
+		}
+
+		cfg.Set("NODE_AFFINITY_KEY", "compute.googleapis.com/node-group-name")
+		cfg.Set("NODE_AFFINITY_VALUES", "builds-a")
+		cfg.Unset("NODE_AFFINITY_OPERATOR")
+		cfg.Unset("PREEMPTIBLE")
+		cfg.Unset("PROVISIONING_MODEL")
+	}
+}
+
+func TestNewGCEProvider_DiskEncryptionKey(t *testing.T) {
+	kmsKey := "projects/project_id/locations/us-central1/keyRings/builds/cryptoKeys/disks"
+	rawKey := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{'k'}, 32))
+
+	cfg := config.ProviderConfigFromMap(map[string]string{
+		"ACCOUNT_JSON": "{}",
+		"PROJECT_ID":   "project_id",
+		"DISK_KMS_KEY": kmsKey,
+	})
+	p, _, _ := gceTestSetup(t, cfg, nil)
+	defer gceTestTeardown(p)
+
+	p.ic.MachineType = &compute.MachineType{}
+	p.ic.Network = &compute.Network{}
+	assert.Equal(t, &compute.CustomerEncryptionKey{KmsKeyName: kmsKey},
+		p.buildInstance("us-central1-a", &StartAttributes{}, p.ic.MachineType, "image-link", "").Disks[0].DiskEncryptionKey)
+
+	cfg.Unset("DISK_KMS_KEY")
+	cfg.Set("DISK_ENCRYPTION_KEY", rawKey)
+	p, _, _ = gceTestSetup(t, cfg, nil)
+	defer gceTestTeardown(p)
+
+	p.ic.MachineType = &compute.MachineType{}
+	p.ic.Network = &compute.Network{}
+	assert.Equal(t, &compute.CustomerEncryptionKey{RawKey: rawKey},
+		p.buildInstance("us-central1-a", &StartAttributes{}, p.ic.MachineType, "image-link", "").Disks[0].DiskEncryptionKey)
+
+	for message, settings := range map[string]map[string]string{
+		"DISK_KMS_KEY and DISK_ENCRYPTION_KEY can't both be set":                                                              {"DISK_KMS_KEY": kmsKey},
+		`invalid DISK_KMS_KEY "disks", expected projects/{project}/locations/{location}/keyRings/{key ring}/cryptoKeys/{key}`: {"DISK_KMS_KEY": "disks", "DISK_ENCRYPTION_KEY": ""},
+		"invalid DISK_ENCRYPTION_KEY, expected a base64-encoded 256-bit key":                                                  {"DISK_ENCRYPTION_KEY": base64.StdEncoding.EncodeToString([]byte("short"))},
+	} {
+		for key, value := range settings {
+			if value == "" {
+				cfg.Unset(key)
+			} else {
+				cfg.Set(key, value)
+			}
+		}
+
+		_, err := newGCEProvider(cfg)
+		if assert.NotNil(t, err, message) {
+			assert.Equal(t, message, err.Error())
+		}
+
+		cfg.Unset("DISK_KMS_KEY")
+		cfg.Set("DISK_ENCRYPTION_KEY", rawKey)
+	}
+}
+
+func TestNewGCEProvider_ExtraNetworkInterfaces(t *testing.T) {
+	cfg := config.ProviderConfigFromMap(map[string]string{
+		"ACCOUNT_JSON":             "{}",
+		"PROJECT_ID":               "project_id",
+		"SUBNETWORK":               "builds",
+		"EXTRA_NETWORK_INTERFACES": "network=mgmt,subnetwork=mgmt-builds; network=cache,subnetwork=cache-builds,nat=true",
+	})
+	p, _, _ := gceTestSetup(t, cfg, nil)
+	defer gceTestTeardown(p)
+
+	p.ic.MachineType = &compute.MachineType{}
+	p.ic.Network = &compute.Network{SelfLink: "default-link"}
+	interfaces := p.buildInstance("us-east1-b", &StartAttributes{}, p.ic.MachineType, "image-link", "").NetworkInterfaces
+	if assert.Len(t, interfaces, 3) {
+		assert.Equal(t, "default-link", interfaces[0].Network)
+		assert.Equal(t, "regions/us-east1/subnetworks/builds", interfaces[0].Subnetwork)
+		assert.Len(t, interfaces[0].AccessConfigs, 1)
+		assert.Equal(t, "global/networks/mgmt", interfaces[1].Network)
+		assert.Equal(t, "regions/us-east1/subnetworks/mgmt-builds", interfaces[1].Subnetwork)
+		assert.Len(t, interfaces[1].AccessConfigs, 0)
+		assert.Equal(t, "global/networks/cache", interfaces[2].Network)
+		assert.Equal(t, "regions/us-east1/subnetworks/cache-builds", interfaces[2].Subnetwork)
+		assert.Len(t, interfaces[2].AccessConfigs, 1)
+	}
+
+	for message, settings := range map[string]map[string]string{
+		"SUBNETWORK is required with EXTRA_NETWORK_INTERFACES":                                                            {"SUBNETWORK": ""},
+		`EXTRA_NETWORK_INTERFACES entry "network=mgmt" needs both a network and a subnetwork`:                             {"EXTRA_NETWORK_INTERFACES": "network=mgmt"},
+		`invalid EXTRA_NETWORK_INTERFACES entry "mgmt", expected network=NAME,subnetwork=NAME[,nat=BOOL]`:                 {"EXTRA_NETWORK_INTERFACES": "mgmt"},
+		`unknown key "region" in EXTRA_NETWORK_INTERFACES entry "network=mgmt,region=us"`:                                 {"EXTRA_NETWORK_INTERFACES": "network=mgmt,region=us"},
+		`invalid nat "maybe" in EXTRA_NETWORK_INTERFACES entry "network=mgmt,subnetwork=mgmt-builds,nat=maybe"`:           {"EXTRA_NETWORK_INTERFACES": "network=mgmt,subnetwork=mgmt-builds,nat=maybe"},
+		`network "default" of EXTRA_NETWORK_INTERFACES entry "network=default,subnetwork=other" already has an interface`: {"EXTRA_NETWORK_INTERFACES": "network=default,subnetwork=other"},
+	} {
+		for key, value := range settings {
+			cfg.Set(key, value)
+		}
+
+		_, err := newGCEProvider(cfg)
+		if assert.NotNil(t, err, message) {
+			assert.Equal(t, message, err.Error())
+		}
+
+		cfg.Set("SUBNETWORK", "builds")
+		cfg.Set("EXTRA_NETWORK_INTERFACES", "network=mgmt,subnetwork=mgmt-builds")
+	}
+}
+
+func TestGCEProvider_networkTagsFor(t *testing.T) {
+	cfg := config.ProviderConfigFromMap(map[string]string{
+		"ACCOUNT_JSON":        "{}",
+		"PROJECT_ID":          "project_id",
+		"NETWORK_TAGS":        "egress-limited, testing",
+		"NETWORK_TAGS_STABLE": "egress-trusted,egress-limited",
+	})
+	p, _, _ := gceTestSetup(t, cfg, nil)
+	defer gceTestTeardown(p)
+
+	p.ic.MachineType = &compute.MachineType{}
+	p.ic.Network = &compute.Network{}
+	assert.Equal(t, []string{"testing", "egress-limited"},
+		p.buildInstance("us-central1-a", &StartAttributes{}, p.ic.MachineType, "image-link", "").Tags.Items)
+	assert.Equal(t, []string{"testing", "egress-limited"},
+		p.buildInstance("us-central1-a", &StartAttributes{Group: "dev"}, p.ic.MachineType, "image-link", "").Tags.Items)
+	assert.Equal(t, []string{"testing", "egress-trusted", "egress-limited"},
+		p.buildInstance("us-central1-a", &StartAttributes{Group: "stable"}, p.ic.MachineType, "image-link", "").Tags.Items)
+
+	for _, tag := range []string{"Egress", "1egress", "egress-", "egress_trusted", strings.Repeat("a", 64)} {
+		cfg.Set("NETWORK_TAGS_DEV", tag)
+		_, err := newGCEProvider(cfg)
+		if assert.NotNil(t, err, tag) {
+			assert.Contains(t, err.Error(), fmt.Sprintf("invalid network tag %q in NETWORK_TAGS_DEV", tag))
+		}
+	}
+}
+
+func TestGCEProvider_DistinctHTTPTransports(t *testing.T) {
+	var wg sync.WaitGroup
+
+	transports := []*recordingHTTPTransport{{}, {}}
+	for _, rt := range transports {
+		wg.Add(1)
+		go func(rt *recordingHTTPTransport) {
+			defer wg.Done()
+
+			cfg := config.ProviderConfigFromMap(map[string]string{
+				"ACCOUNT_JSON": "{}",
+				"PROJECT_ID":   "project_id",
+			})
+			gceTestSetupSSH(t, cfg)
+			cfg.SetHTTPTransport(rt)
+
+			p, err := newGCEProvider(cfg)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer gceTestTeardown(p.(*gceProvider))
+
+			assert.NotNil(t, p.Setup())
+		}(rt)
+	}
+
+	wg.Wait()
+
+	for _, rt := range transports {
+		assert.NotNil(t, rt.req)
+	}
+}
+
+type gceTestRoundTripper struct {
+	mutex     sync.Mutex
+	responses map[string]string
+	reqs      []*http.Request
+}
+
+func (rt *gceTestRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+
+	rt.reqs = append(rt.reqs, req)
+
+	rec := httptest.NewRecorder()
+	body, ok := rt.responses[req.URL.Path]
+	if !ok {
+		rec.WriteHeader(http.StatusNotFound)
+		body = `{"error":{"code":404,"message":"not found"}}`
+	}
+	io.WriteString(rec, body)
+
+	return rec.Result(), nil
+}
+
+func TestGCEProvider_machineTypeFor(t *testing.T) {
+	cfg := config.ProviderConfigFromMap(map[string]string{
+		"ACCOUNT_JSON":          "{}",
+		"PROJECT_ID":            "project_id",
+		"ALLOWED_MACHINE_TYPES": "n1-standard-4, n1-standard-8",
+	})
+
+	p, _, _ := gceTestSetup(t, cfg, nil)
+	defer gceTestTeardown(p)
+
+	rt := &gceTestRoundTripper{responses: map[string]string{
+		"/compute/v1/projects/project_id/zones/us-central1-a/machineTypes/n1-standard-4": `{"name":"n1-standard-4","selfLink":"n1-standard-4-link"}`,
+	}}
+
+	client, err := compute.New(&http.Client{Transport: rt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.api = &gceComputeService{client: client}
+
+	p.ic.Zone = &compute.Zone{Name: "us-central1-a"}
+	p.ic.MachineType = &compute.MachineType{Name: "n1-standard-2", SelfLink: "n1-standard-2-link"}
+
+	ctx := gocontext.TODO()
+
+	for _, size := range []string{"", "n1-standard-2", "n1-highmem-32", "n1-standard-8"} {
+		mt := p.machineTypeFor(ctx, &StartAttributes{VMConfig: VMConfig{Size: size}})
+		assert.Equal(t, p.ic.MachineType, mt, "size %q", size)
+	}
+
+	mt := p.machineTypeFor(ctx, &StartAttributes{VMConfig: VMConfig{Size: "n1-standard-4"}})
+	assert.Equal(t, "n1-standard-4-link", mt.SelfLink)
+
+	nReqs := len(rt.reqs)
+	mt = p.machineTypeFor(ctx, &StartAttributes{VMConfig: VMConfig{Size: "n1-standard-4"}})
+	assert.Equal(t, "n1-standard-4-link", mt.SelfLink)
+	assert.Len(t, rt.reqs, nReqs)
+}
+
+func TestGCELabelValue(t *testing.T) {
+	for value, expected := range map[string]string{
+		"":                       "",
+		"ruby":                   "ruby",
+		"Objective-C":            "objective-c",
+		"node_js":                "node_js",
+		"stage: deploy/ö":        "stage__deploy__",
+		strings.Repeat("a", 64):  strings.Repeat("a", 63),
+		strings.Repeat("A!", 40): strings.Repeat("a_", 31) + "a",
+	} {
+		assert.Equal(t, expected, gceLabelValue(value), "value %q", value)
+	}
+}
+
+func TestGCEStartAttributesLabels(t *testing.T) {
+	items := gceStartAttributesLabels(&StartAttributes{
+		Language: "Ruby",
+		Dist:     "trusty",
+		OS:       "linux",
+	})
+
+	values := map[string]string{}
+	for _, item := range items {
+		values[item.Key] = *item.Value
+	}
+
+	assert.Equal(t, map[string]string{
+		"travis-label-language": "ruby",
+		"travis-label-dist":     "trusty",
+		"travis-label-os":       "linux",
+	}, values)
+}
+
+func TestGCEImageMismatch(t *testing.T) {
+	trusty := &compute.Image{Name: "travis-ci-garnet-trusty-1503417006"}
+	windows := &compute.Image{Name: "travis-ci-vs2017-1", Description: "Windows Server 1803"}
+
+	for _, tc := range []struct {
+		image    *compute.Image
+		attrs    *StartAttributes
+		mismatch string
+	}{
+		{trusty, &StartAttributes{}, ""},
+		{trusty, &StartAttributes{OS: "linux", Dist: "trusty"}, ""},
+		{trusty, &StartAttributes{OS: "linux", Dist: "Trusty"}, ""},
+		{trusty, &StartAttributes{OS: "linux", Dist: "xenial"}, `doesn't mention dist "xenial"`},
+		{trusty, &StartAttributes{OS: "windows"}, "isn't a windows image"},
+		{windows, &StartAttributes{OS: "windows", Dist: "1803-containers"}, ""},
+		{windows, &StartAttributes{OS: "linux"}, `is a windows image, but the job's os is "linux"`},
+		{&compute.Image{Name: "travis-ci-1", Description: "Ubuntu 16.04 (xenial)"}, &StartAttributes{Dist: "xenial"}, ""},
+	} {
+		assert.Equal(t, tc.mismatch, gceImageMismatch(tc.image, tc.attrs), "image %q, attributes %+v", tc.image.Name, tc.attrs)
+	}
+}
+
+type gceTestImageSelector struct {
+	imageName string
+	calls     int
+}
+
+func (s *gceTestImageSelector) Select(*image.Params) (string, error) {
+	s.calls++
+	return s.imageName, nil
+}
+
+func TestGCEProvider_getImagePrecedence(t *testing.T) {
+	cfg := config.ProviderConfigFromMap(map[string]string{
+		"ACCOUNT_JSON":         "{}",
+		"PROJECT_ID":           "project_id",
+		"IMAGE_DEFAULT":        "travis-ci-default",
+		"FORCE_IMAGE_XCODE7_3": "travis-ci-forced-osx",
+		"FORCE_IMAGE_TRUSTY":   "travis-ci-forced-trusty",
+	})
+
+	p, _, _ := gceTestSetup(t, cfg, nil)
+	defer gceTestTeardown(p)
+
+	rt := &gceTestRoundTripper{responses: map[string]string{
+		"/compute/v1/projects/project_id/global/images": `{"items":[{"name":"whatever"}]}`,
+	}}
+
+	client, err := compute.New(&http.Client{Transport: rt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.api = &gceComputeService{client: client}
+
+	selector := &gceTestImageSelector{}
+	p.imageSelector = selector
+	p.imageSelectorType = "api"
+
+	for _, tc := range []struct {
+		attrs         *StartAttributes
+		selectorImage string
+		filter        string
+		selectorCalls int
+	}{
+		{&StartAttributes{OsxImage: "xcode7.3", Dist: "trusty"}, "travis-ci-selected", "name eq ^travis-ci-forced-osx", 0},
+		{&StartAttributes{Dist: "trusty"}, "travis-ci-selected", "name eq ^travis-ci-forced-trusty", 0},
+		{&StartAttributes{Dist: "precise"}, "travis-ci-selected", "name eq ^travis-ci-selected", 1},
+		{&StartAttributes{Dist: "precise"}, "default", "name eq ^travis-ci-default", 1},
+	} {
+		selector.imageName = tc.selectorImage
+		selector.calls = 0
+		rt.reqs = nil
+
+		_, err := p.getImage(gocontext.TODO(), tc.attrs)
+		assert.Nil(t, err)
+		assert.Equal(t, tc.selectorCalls, selector.calls)
+		if assert.Len(t, rt.reqs, 1) {
+			assert.Equal(t, tc.filter, rt.reqs[0].URL.Query().Get("filter"))
+		}
+	}
+}
+
+func TestGCEClassifyStartError(t *testing.T) {
+	for payload, expected := range map[string]error{
+		`{"errors":[{"code":"ZONE_RESOURCE_POOL_EXHAUSTED","message":"The zone 'projects/project_id/zones/us-central1-b' does not have enough resources available to fulfill the request.  Try a different zone, or try again later."}]}`: ErrResourceExhausted,
+		`{"errors":[{"code":"QUOTA_EXCEEDED","message":"Quota 'CPUS' exceeded.  Limit: 2400.0 in region us-central1."}]}`:                                                                                                                 ErrQuotaExceeded,
+		`{"errors":[{"code":"RESOURCE_NOT_FOUND","message":"The resource 'projects/project_id/global/images/travis-ci-ruby-1' was not found"}]}`:                                                                                          ErrImageNotFound,
+		`{"errors":[{"code":"RESOURCE_NOT_FOUND","message":"The resource 'projects/project_id/global/networks/main' was not found"}]}`:                                                                                                    nil,
+		`{"errors":[{"code":"INTERNAL_ERROR","message":"Internal error. Please try again or contact Google Support."}]}`:                                                                                                                  nil,
+	} {
+		opErr := &compute.OperationError{}
+		err := json.Unmarshal([]byte(payload), opErr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		origErr := &gceOpError{Err: opErr}
+		err = gceClassifyStartError(origErr)
+		if expected == nil {
+			assert.Equal(t, origErr, err, "payload %s", payload)
+			continue
+		}
+
+		if assert.IsType(t, &StartError{}, err, "payload %s", payload) {
+			assert.Equal(t, expected, err.(*StartError).Cause, "payload %s", payload)
+			assert.Equal(t, origErr, err.(*StartError).Err, "payload %s", payload)
+		}
+	}
+
+	err := gceClassifyStartError(&googleapi.Error{
+		Code:   http.StatusForbidden,
+		Errors: []googleapi.ErrorItem{{Reason: "rateLimitExceeded", Message: "Rate Limit Exceeded"}},
+	})
+	if assert.IsType(t, &StartError{}, err) {
+		assert.Equal(t, ErrQuotaExceeded, err.(*StartError).Cause)
+	}
+
+	err = gceClassifyStartError(&googleapi.Error{Code: http.StatusForbidden})
+	assert.IsType(t, &googleapi.Error{}, err)
+
+	err = gceClassifyStartError(gocontext.DeadlineExceeded)
+	if assert.IsType(t, &StartError{}, err) {
+		assert.Equal(t, ErrBootTimeout, err.(*StartError).Cause)
+	}
+
+	assert.Equal(t, []string{"QUOTA_EXCEEDED", "RESOURCE_EXHAUSTED"}, (&gceOpError{Err: &compute.OperationError{
+		Errors: []*compute.OperationErrorErrors{{Code: "QUOTA_EXCEEDED"}, {Code: "RESOURCE_EXHAUSTED"}},
+	}}).Codes())
+}
+
+func TestNewGCEProvider_RejectsInvalidConnectVia(t *testing.T) {
+	cfg := config.ProviderConfigFromMap(map[string]string{
+		"ACCOUNT_JSON": "{}",
+		"PROJECT_ID":   "project_id",
+		"CONNECT_VIA":  "carrier-pigeon",
+	})
+	gceTestSetupSSH(t, cfg)
+	defer os.RemoveAll(cfg.Get("TEMP_DIR"))
+
+	_, err := newGCEProvider(cfg)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, `invalid connect via "carrier-pigeon"`, err.Error())
+	}
+}
+
+func TestNewGCEProvider_RejectsInvalidStaleVMAction(t *testing.T) {
+	cfg := config.ProviderConfigFromMap(map[string]string{
+		"ACCOUNT_JSON":    "{}",
+		"PROJECT_ID":      "project_id",
+		"STALE_VM_ACTION": "ignore",
+	})
+	gceTestSetupSSH(t, cfg)
+	defer os.RemoveAll(cfg.Get("TEMP_DIR"))
+
+	_, err := newGCEProvider(cfg)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, `invalid stale vm action "ignore"`, err.Error())
+	}
+}
+
+func TestNewGCEProvider_RejectsMissingImageAliases(t *testing.T) {
+	cfg := config.ProviderConfigFromMap(map[string]string{
+		"ACCOUNT_JSON":        "{}",
+		"PROJECT_ID":          "project_id",
+		"IMAGE_SELECTOR_TYPE": "env",
+		"IMAGE_ALIASES":       "dist_trusty,language_go",
+	})
+	gceTestSetupSSH(t, cfg)
+	defer os.RemoveAll(cfg.Get("TEMP_DIR"))
+
+	_, err := newGCEProvider(cfg)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, "missing config keys for IMAGE_ALIASES: IMAGE_ALIAS_DIST_TRUSTY, IMAGE_ALIAS_LANGUAGE_GO", err.Error())
+	}
+}
+
+func TestNewGCEProvider_SSHUser(t *testing.T) {
+	cfg := config.ProviderConfigFromMap(map[string]string{
+		"ACCOUNT_JSON": "{}",
+		"PROJECT_ID":   "project_id",
+	})
+	gceTestSetupSSH(t, cfg)
+	defer os.RemoveAll(cfg.Get("TEMP_DIR"))
+
+	// the default goes first, before SSH_USER is set
+	for _, tc := range []struct {
+		user       string
+		scriptLine string
+	}{
+		{"", "cat > ~travis/.ssh/authorized_keys <<EOF"},
+		{"builder", "cat > ~builder/.ssh/authorized_keys <<EOF"},
+	} {
+		if tc.user != "" {
+			cfg.Set("SSH_USER", tc.user)
+		}
+
+		p, err := newGCEProvider(cfg)
+		if !assert.Nil(t, err) {
+			continue
+		}
+		gp := p.(*gceProvider)
+
+		var scriptBuf bytes.Buffer
+		assert.Nil(t, gceStartupScript.Execute(&scriptBuf, gp.ic))
+		assert.Contains(t, scriptBuf.String(), tc.scriptLine)
+
+		i := gp.newInstance(&compute.Instance{Name: "travis-job-1"}, "travis-ci-image", &StartAttributes{})
+		assert.Equal(t, gp.ic.SSHUser, i.authUser)
+		assert.Contains(t, tc.scriptLine, "~"+i.authUser+"/")
+	}
+
+	cfg.Set("SSH_USER", "travis; rm -rf /")
+	_, err := newGCEProvider(cfg)
+	assert.EqualError(t, err, `invalid SSH_USER "travis; rm -rf /"`)
+}
+
+func TestNewGCEProvider_SSHHostKeyMode(t *testing.T) {
+	cfg := config.ProviderConfigFromMap(map[string]string{
+		"ACCOUNT_JSON":      "{}",
+		"PROJECT_ID":        "project_id",
+		"SSH_HOST_KEY_MODE": "strict",
+	})
+	gceTestSetupSSH(t, cfg)
+	defer os.RemoveAll(cfg.Get("TEMP_DIR"))
+
+	_, err := newGCEProvider(cfg)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, `invalid ssh host key mode "strict"`, err.Error())
+	}
+
+	cfg.Set("SSH_HOST_KEY_MODE", "instance-metadata")
+	p, err := newGCEProvider(cfg)
+	if assert.Nil(t, err) {
+		var scriptBuf bytes.Buffer
+		assert.Nil(t, gceStartupScript.Execute(&scriptBuf, p.(*gceProvider).ic))
+		assert.Contains(t, scriptBuf.String(), gceHostKeyFingerprintsBegin)
+	}
+
+	cfg.Set("SSH_HOST_KEY_MODE", "known-hosts:"+filepath.Join(cfg.Get("TEMP_DIR"), "known_hosts"))
+	_, err = newGCEProvider(cfg)
+	assert.NotNil(t, err)
+}
+
+func TestNewGCEProvider_WaitForStartupComplete(t *testing.T) {
+	cfg := config.ProviderConfigFromMap(map[string]string{
+		"ACCOUNT_JSON": "{}",
+		"PROJECT_ID":   "project_id",
+	})
+	gceTestSetupSSH(t, cfg)
+	defer os.RemoveAll(cfg.Get("TEMP_DIR"))
+
+	p, err := newGCEProvider(cfg)
+	if assert.Nil(t, err) {
+		gp := p.(*gceProvider)
+		assert.False(t, gp.ic.WaitForStartup)
+		assert.Equal(t, defaultGCEStartupCompleteTimeout, gp.startupCompleteTimeout)
+
+		var scriptBuf bytes.Buffer
+		assert.Nil(t, gceStartupScript.Execute(&scriptBuf, gp.ic))
+		assert.NotContains(t, scriptBuf.String(), gceStartupCompleteLine)
+	}
+
+	cfg.Set("WAIT_FOR_STARTUP_COMPLETE", "true")
+	cfg.Set("STARTUP_COMPLETE_TIMEOUT", "10m")
+	p, err = newGCEProvider(cfg)
+	if assert.Nil(t, err) {
+		gp := p.(*gceProvider)
+		assert.True(t, gp.ic.WaitForStartup)
+		assert.Equal(t, 10*time.Minute, gp.startupCompleteTimeout)
+
+		var scriptBuf bytes.Buffer
+		assert.Nil(t, gceStartupScript.Execute(&scriptBuf, gp.ic))
+		assert.Contains(t, scriptBuf.String(), fmt.Sprintf("echo \"%s\" > /dev/ttyS0\n", gceStartupCompleteLine))
+	}
+
+	cfg.Set("STARTUP_COMPLETE_TIMEOUT", "0s")
+	_, err = newGCEProvider(cfg)
+	assert.EqualError(t, err, `invalid STARTUP_COMPLETE_TIMEOUT "0s", must be positive`)
+}
+
+func TestNewGCEProvider_BootHardTimeout(t *testing.T) {
+	cfg := config.ProviderConfigFromMap(map[string]string{
+		"ACCOUNT_JSON": "{}",
+		"PROJECT_ID":   "project_id",
+	})
+	gceTestSetupSSH(t, cfg)
+	defer os.RemoveAll(cfg.Get("TEMP_DIR"))
+
+	p, err := newGCEProvider(cfg)
+	if assert.Nil(t, err) {
+		assert.Equal(t, time.Duration(0), p.(*gceProvider).bootHardTimeout)
+	}
+
+	cfg.Set("BOOT_HARD_TIMEOUT", "15m")
+	p, err = newGCEProvider(cfg)
+	if assert.Nil(t, err) {
+		assert.Equal(t, 15*time.Minute, p.(*gceProvider).bootHardTimeout)
+	}
+
+	cfg.Set("BOOT_HARD_TIMEOUT", "-1m")
+	_, err = newGCEProvider(cfg)
+	assert.EqualError(t, err, `invalid BOOT_HARD_TIMEOUT "-1m", must be positive`)
+}
+
+func TestGCEInstance_uploadMetrics(t *testing.T) {
+	rt := &gceTestRoundTripper{responses: map[string]string{}}
+	client, err := compute.New(&http.Client{Transport: rt})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i := &gceInstance{
+		provider: &gceProvider{
+			api:              &gceComputeService{client: client},
+			connectVia:       "public-ip",
+			uploadRetries:    2,
+			uploadRetrySleep: time.Millisecond,
+		},
+		instance:   &compute.Instance{Name: "testing-gce-abc"},
+		ic:         &gceInstanceConfig{Zone: &compute.Zone{Name: "us-central1-a"}},
+		projectID:  "project_id",
+		scriptPath: "build.sh",
+	}
+
+	count := func(name string) int64 {
+		return gometrics.GetOrRegisterMeter(name, gometrics.DefaultRegistry).Count()
+	}
+	attempts := gometrics.GetOrRegisterHistogram("worker.vm.provider.gce.script.upload.attempts", gometrics.DefaultRegistry, gometrics.NewExpDecaySample(1028, 0.015))
+
+	retries := count("worker.vm.provider.gce.script.upload.retry")
+	failures := count("worker.vm.provider.gce.script.upload.failure")
+	samples := attempts.Count()
+
+	assert.NotNil(t, i.UploadScript(gocontext.TODO(), []byte("echo hai")))
+	assert.Equal(t, retries+2, count("worker.vm.provider.gce.script.upload.retry"))
+	assert.Equal(t, failures+1, count("worker.vm.provider.gce.script.upload.failure"))
+	if assert.Equal(t, samples+1, attempts.Count()) {
+		assert.Equal(t, int64(3), attempts.Max())
+	}
+}
+
+func TestGCEInstance_UploadFilesRejectsInvalidPaths(t *testing.T) {
+	i := &gceInstance{scriptPath: "build.sh"}
+
+	for _, filePath := range []string{"/etc/passwd", "../build.sh", "..", "auth/../../x", "./build.json"} {
+		err := i.UploadFiles(gocontext.TODO(), map[string][]byte{filePath: []byte("{}")})
+		if assert.IsType(t, &UploadFileError{}, err, filePath) {
+			assert.Equal(t, filePath, err.(*UploadFileError).Path)
+		}
+	}
+}
+
+func TestGCEProvider_instanceForJob(t *testing.T) {
+	rt := &gceTestRoundTripper{responses: map[string]string{
+		"/compute/v1/projects/project_id/zones/us-central1-a/instances": `{"items":[
+			{"name":"testing-gce-a","status":"RUNNING","metadata":{"items":[{"key":"travis-job-id","value":"41"}]}},
+			{"name":"testing-gce-b","status":"STOPPING","metadata":{"items":[{"key":"travis-job-id","value":"42"}]}},
+			{"name":"testing-gce-c","status":"RUNNING"},
+			{"name":"testing-gce-d","status":"RUNNING","metadata":{"items":[{"key":"travis-job-id","value":"42"}]}}
+		]}`,
+	}}
+	client, err := compute.New(&http.Client{Transport: rt})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &gceProvider{
+		api:                &gceComputeService{client: client},
+		projectID:          "project_id",
+		instanceNamePrefix: "testing-gce-",
+		ic:                 &gceInstanceConfig{Zone: &compute.Zone{Name: "us-central1-a"}},
+		zoneNames:          []string{"us-central1-a"},
+	}
+
+	inst, err := p.instanceForJob(gocontext.TODO(), 42)
+	if assert.Nil(t, err) && assert.NotNil(t, inst) {
+		assert.Equal(t, "testing-gce-d", inst.Name)
+	}
+
+	inst, err = p.instanceForJob(gocontext.TODO(), 43)
+	assert.Nil(t, err)
+	assert.Nil(t, inst)
+}
+
+func TestNewGCEProvider_PTY(t *testing.T) {
+	p, _, _ := gceTestSetup(t, nil, nil)
+	gceTestTeardown(p)
+
+	assert.True(t, p.pty)
+	assert.Equal(t, "xterm", p.ptyTerm)
+	assert.Equal(t, 80, p.ptyCols)
+	assert.Equal(t, 40, p.ptyRows)
+
+	cfg := config.ProviderConfigFromMap(map[string]string{
+		"ACCOUNT_JSON": "{}",
+		"PROJECT_ID":   "project_id",
+		"PTY":          "false",
+		"PTY_TERM":     "xterm-256color",
+		"PTY_COLS":     "200",
+		"PTY_ROWS":     "50",
+	})
+	p, _, _ = gceTestSetup(t, cfg, nil)
+	defer gceTestTeardown(p)
+
+	assert.False(t, p.pty)
+	assert.Equal(t, "xterm-256color", p.ptyTerm)
+	assert.Equal(t, 200, p.ptyCols)
+	assert.Equal(t, 50, p.ptyRows)
+
+	cfg.Set("PTY_COLS", "0")
+	_, err := newGCEProvider(cfg)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, "PTY_COLS must be greater than 0", err.Error())
+	}
+}
+
+func TestGCEClassifyWaitError(t *testing.T) {
+	signer := sshTestSigner(t)
+
+	for _, tc := range []struct {
+		handle func(ssh.Channel)
+		result *RunResult
+	}{
+		{
+			handle: func(ch ssh.Channel) {
+				_, _ = ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+			},
+			result: &RunResult{Completed: true},
+		},
+		{
+			handle: func(ch ssh.Channel) {
+				_, _ = ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{3}))
+			},
+			result: &RunResult{Completed: true, ExitCode: 3},
+		},
+		{
+			handle: func(ch ssh.Channel) {
+				_, _ = ch.SendRequest("exit-signal", false, ssh.Marshal(struct {
+					Signal     string
+					CoreDumped bool
+					Error      string
+					Lang       string
+				}{"KILL", false, "", ""}))
+			},
+			result: &RunResult{Completed: true, ExitCode: 137, Reason: RunReasonSignal, Signal: "KILL"},
+		},
+		{
+			handle: func(ch ssh.Channel) {},
+			result: &RunResult{Reason: RunReasonExitMissing},
+		},
+	} {
+		listener := sshTestExecServer(t, signer.PublicKey(), tc.handle)
+
+		client, err := (&sshDialer{DialTimeout: time.Second}).Dial(gocontext.TODO(), listener.Addr().String(), &ssh.ClientConfig{
+			User: "travis",
+			Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		session, err := client.NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		result, err := gceClassifyWaitError(&RunResult{}, session.Run("./build.sh"))
+		assert.Nil(t, err)
+		assert.Equal(t, tc.result, result)
+
+		client.Close()
+		listener.Close()
+	}
+}
+
+func TestNewGCEProvider_SSHBastion(t *testing.T) {
+	cfg := config.ProviderConfigFromMap(map[string]string{
+		"ACCOUNT_JSON":     "{}",
+		"PROJECT_ID":       "project_id",
+		"SSH_BASTION_HOST": "bastion.example.com",
+	})
+	p, _, _ := gceTestSetup(t, cfg, nil)
+	defer gceTestTeardown(p)
+
+	if assert.NotNil(t, p.sshDialer.Bastion) {
+		assert.Equal(t, "bastion.example.com:22", p.sshDialer.Bastion.Addr)
+		assert.Equal(t, "travis", p.sshDialer.Bastion.Config.User)
+	}
+
+	cfg.Set("SSH_BASTION_HOST", "10.0.0.2:2222")
+	cfg.Set("SSH_BASTION_USER", "jump")
+	cfg.Set("SSH_BASTION_KEY_PATH", filepath.Join(cfg.Get("TEMP_DIR"), "missing"))
+	_, err := newGCEProvider(cfg)
+	assert.NotNil(t, err)
+
+	cfg.Unset("SSH_BASTION_KEY_PATH")
+	p2, err := newGCEProvider(cfg)
+	if assert.Nil(t, err) {
+		bastion := p2.(*gceProvider).sshDialer.Bastion
+		assert.Equal(t, "10.0.0.2:2222", bastion.Addr)
+		assert.Equal(t, "jump", bastion.Config.User)
+	}
+
+	cfg.Set("SSH_BASTION_KEY", "not a key")
+	_, err = newGCEProvider(cfg)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "couldn't parse SSH_BASTION_KEY")
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyBytes := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	})
+	cfg.Set("SSH_BASTION_KEY", string(keyBytes))
+	_, err = newGCEProvider(cfg)
+	assert.Nil(t, err)
+
+	cfg.Set("SSH_BASTION_KEY_PATH", "/etc/bastion.key")
+	_, err = newGCEProvider(cfg)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, "SSH_BASTION_KEY can't be combined with SSH_BASTION_KEY_PATH", err.Error())
+	}
+}
+
+func TestNewGCEProvider_BuildScriptPath(t *testing.T) {
+	cfg := config.ProviderConfigFromMap(map[string]string{
+		"ACCOUNT_JSON":             "{}",
+		"PROJECT_ID":               "project_id",
+		"BUILD_SCRIPT_PATH":        "/home/ci/bin/build",
+		"BUILD_SCRIPT_INTERPRETER": "",
+	})
+	p, _, _ := gceTestSetup(t, cfg, nil)
+	defer gceTestTeardown(p)
+
+	assert.Equal(t, "/home/ci/bin/build", p.scriptPathFor("linux"))
+	assert.Equal(t, "", p.scriptInterpreter)
+
+	i := p.newInstance(&compute.Instance{Name: "testing-gce-abc"}, "image", &StartAttributes{OS: "linux"})
+	assert.Equal(t, "/home/ci/bin/build", i.scriptPath)
+	assert.Equal(t, `'/home/ci/bin/build'`, i.scriptCommand())
+
+	cfg.Set("SCRIPT_PATH", "build.sh")
+	_, err := newGCEProvider(cfg)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, "SCRIPT_PATH and BUILD_SCRIPT_PATH can't be set to different paths", err.Error())
+	}
+}
+
+func TestGCEUploadErrorClass(t *testing.T) {
+	for _, tc := range []struct {
+		err   error
+		class string
+	}{
+		{&gceSSHError{err: &sshAuthError{err: assert.AnError}}, "auth"},
+		{&gceSSHError{err: &sshHostKeyError{err: assert.AnError}}, "host_key"},
+		{&gceSSHError{err: &sshNetworkError{err: assert.AnError}}, "network"},
+		{&UploadFileError{Path: "build.sh", Err: assert.AnError}, "other"},
+		{&UploadFileError{Path: "build.sh", Err: &sftpPartialWriteError{written: 512, expected: 1024}}, "partial_write"},
+	} {
+		assert.Equal(t, tc.class, gceUploadErrorClass(tc.err))
+	}
+
+	partialErr := &UploadFileError{Path: "build.sh", Err: &sftpPartialWriteError{written: 512, expected: 1024}}
+	assert.Equal(t, "couldn't upload build.sh: uploaded file is 512 bytes, expected 1024", partialErr.Error())
+
+	err := &gceSSHError{connectVia: "public-ip", host: "10.0.0.1", err: &sshAuthError{err: assert.AnError}}
+	assert.Equal(t, "couldn't connect via public-ip to 10.0.0.1: ssh authentication failed: "+assert.AnError.Error(), err.Error())
+}
+
+func TestGCEUploadRetryBackoff(t *testing.T) {
+	assert.Equal(t, 5*time.Second, gceUploadRetryBackoff(5*time.Second, 1))
+	assert.Equal(t, 10*time.Second, gceUploadRetryBackoff(5*time.Second, 2))
+	assert.Equal(t, 15*time.Second, gceUploadRetryBackoff(5*time.Second, 3))
+	assert.Equal(t, 15*time.Second, gceUploadRetryBackoff(5*time.Second, 100))
+}
+
+func TestGCEInstance_recycle(t *testing.T) {
+	rt := &gceTestRoundTripper{responses: map[string]string{}}
+	client, err := compute.New(&http.Client{Transport: rt})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i := &gceInstance{
+		provider:  &gceProvider{api: &gceComputeService{client: client}, projectID: "project_id", staleVMAction: "recycle"},
+		instance:  &compute.Instance{Name: "testing-gce-abc"},
+		ic:        &gceInstanceConfig{Zone: &compute.Zone{Name: "us-central1-a"}},
+		projectID: "project_id",
+	}
+
+	assert.Equal(t, ErrStaleVM, i.recycle(gocontext.TODO()))
+
+	rt.responses["/compute/v1/projects/project_id/zones/us-central1-a/instances/testing-gce-abc"] = `{"name":"delete-op"}`
+	rt.responses["/compute/v1/projects/project_id/zones/us-central1-a/operations/delete-op"] = `{"name":"delete-op","status":"DONE"}`
+
+	assert.Equal(t, ErrStaleVMRecycled, i.recycle(gocontext.TODO()))
+	assert.Equal(t, "DELETE", rt.reqs[1].Method)
+}
+
+func TestGCEInstance_StopNotFound(t *testing.T) {
+	for _, responses := range []map[string]string{
+		// the delete request itself 404s
+		{},
+		// the instance is gone by the time the delete operation runs
+		{
+			"/compute/v1/projects/project_id/zones/us-central1-a/instances/testing-gce-abc": `{"name":"op-1","status":"PENDING"}`,
+			"/compute/v1/projects/project_id/zones/us-central1-a/operations/op-1":           `{"name":"op-1","status":"DONE","error":{"errors":[{"code":"RESOURCE_NOT_FOUND","message":"not found"}]}}`,
+		},
+	} {
+		rt := &gceTestRoundTripper{responses: responses}
+		client, err := compute.New(&http.Client{Transport: rt})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		i := &gceInstance{
+			provider:  &gceProvider{api: &gceComputeService{client: client}, projectID: "project_id"},
+			instance:  &compute.Instance{Name: "testing-gce-abc"},
+			ic:        &gceInstanceConfig{Zone: &compute.Zone{Name: "us-central1-a"}},
+			projectID: "project_id",
+		}
+
+		assert.Nil(t, i.Stop(gocontext.TODO()))
+		assert.Equal(t, "DELETE", rt.reqs[0].Method)
+	}
+}
+
+func TestGCEInstance_sshHost(t *testing.T) {
+	instance := &compute.Instance{
+		Name: "testing-gce-abc",
+		NetworkInterfaces: []*compute.NetworkInterface{
+			&compute.NetworkInterface{
+				NetworkIP: "10.0.0.2",
+				AccessConfigs: []*compute.AccessConfig{
+					&compute.AccessConfig{NatIP: "203.0.113.2"},
+				},
+			},
+			// an extra interface, which ssh doesn't use
+			&compute.NetworkInterface{
+				NetworkIP: "10.1.0.2",
+				AccessConfigs: []*compute.AccessConfig{
+					&compute.AccessConfig{NatIP: "203.0.113.3"},
+				},
+			},
+		},
+	}
+
+	body, err := json.Marshal(instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rt := &gceTestRoundTripper{responses: map[string]string{
+		"/compute/v1/projects/project_id/zones/us-central1-a/instances/testing-gce-abc": string(body),
+	}}
+
+	client, err := compute.New(&http.Client{Transport: rt})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for connectVia, expected := range map[string]string{
+		"public-ip":    "203.0.113.2",
+		"private-ip":   "10.0.0.2",
+		"internal-dns": "testing-gce-abc.c.project_id.internal",
+	} {
+		i := &gceInstance{
+			provider:  &gceProvider{api: &gceComputeService{client: client}, connectVia: connectVia},
+			instance:  &compute.Instance{Name: "testing-gce-abc"},
+			ic:        &gceInstanceConfig{Zone: &compute.Zone{Name: "us-central1-a"}},
+			projectID: "project_id",
+		}
+
+		host, err := i.sshHost(gocontext.TODO())
+		assert.Nil(t, err, "connect via %s", connectVia)
+		assert.Equal(t, expected, host, "connect via %s", connectVia)
+	}
+
+	assert.Len(t, rt.reqs, 2)
+}
+
+func TestGCEInstanceNamePrefix(t *testing.T) {
+	for prefix, expected := range map[string]string{
+		"testing-gce-":          "testing-gce-",
+		"Testing_GCE.":          "testing-gce-",
+		"größe-":                "gr--e-",
+		"42-builds-":            "builds-",
+		"":                      defaultGCEInstanceNamePrefix,
+		"123":                   defaultGCEInstanceNamePrefix,
+		strings.Repeat("a", 80): strings.Repeat("a", 27),
+	} {
+		assert.Equal(t, expected, gceInstanceNamePrefix(prefix), "prefix %q", prefix)
+	}
+
+	p := &gceProvider{instanceNamePrefix: gceInstanceNamePrefix(strings.Repeat("Äb", 40))}
+	name := p.instanceName()
+	assert.Len(t, name, 63)
+	assert.Regexp(t, `^[a-z]([-a-z0-9]*[a-z0-9])?$`, name)
+	assert.NotEqual(t, name, p.instanceName())
+}
+
+type gceTestCollisionRoundTripper struct {
+	names []string
+}
+
+func (rt *gceTestCollisionRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	inst := &compute.Instance{}
+	err := json.NewDecoder(req.Body).Decode(inst)
+	if err != nil {
+		return nil, err
+	}
+	rt.names = append(rt.names, inst.Name)
+
+	rec := httptest.NewRecorder()
+	if len(rt.names) == 1 {
+		rec.WriteHeader(http.StatusConflict)
+		io.WriteString(rec, `{"error":{"errors":[{"domain":"global","reason":"alreadyExists","message":"The resource already exists"}],"code":409,"message":"The resource already exists"}}`)
+	} else {
+		io.WriteString(rec, `{"name":"operation-1"}`)
+	}
+
+	return rec.Result(), nil
+}
+
+func TestGCEProvider_insertInstanceRetriesNameCollision(t *testing.T) {
+	rt := &gceTestCollisionRoundTripper{}
+	client, err := compute.New(&http.Client{Transport: rt})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &gceProvider{
+		api:                &gceComputeService{client: client},
+		projectID:          "project_id",
+		instanceNamePrefix: "testing-gce-",
+		ic:                 &gceInstanceConfig{Zone: &compute.Zone{Name: "us-central1-a"}},
+	}
+
+	inst := &compute.Instance{Name: p.instanceName()}
+	origName := inst.Name
+
+	op, err := p.insertInstance(gocontext.TODO(), "us-central1-a", inst)
+	assert.Nil(t, err)
+	assert.Equal(t, "operation-1", op.Name)
+	assert.Len(t, rt.names, 2)
+	assert.Equal(t, origName, rt.names[0])
+	assert.NotEqual(t, origName, inst.Name)
+	assert.Equal(t, inst.Name, rt.names[1])
+}
+
+func TestNewGCEProvider_RejectsSnapshotWithImageConfig(t *testing.T) {
+	for _, key := range []string{"IMAGE_SELECTOR_TYPE", "IMAGE_DEFAULT"} {
+		cfg := config.ProviderConfigFromMap(map[string]string{
+			"ACCOUNT_JSON":  "{}",
+			"PROJECT_ID":    "project_id",
+			"SNAPSHOT_NAME": "travis-ci-snap",
+			key:             "legacy",
+		})
+		gceTestSetupSSH(t, cfg)
+
+		_, err := newGCEProvider(cfg)
+		assert.NotNil(t, err, "key %s", key)
+
+		os.RemoveAll(cfg.Get("TEMP_DIR"))
+	}
+}
+
+func TestGCEProvider_bootFromSnapshot(t *testing.T) {
+	rt := &gceTestRoundTripper{responses: map[string]string{
+		"/compute/v1/projects/project_id/global/snapshots":                           `{"items":[{"name":"travis-ci-snap-2","selfLink":"snap-2-link"},{"name":"travis-ci-snap-10","selfLink":"snap-10-link"}]}`,
+		"/compute/v1/projects/project_id/zones/us-central1-a/disks":                  `{"name":"operation-1","targetLink":"disk-link"}`,
+		"/compute/v1/projects/project_id/zones/us-central1-a/operations/operation-1": `{"name":"operation-1","status":"DONE"}`,
+	}}
+
+	client, err := compute.New(&http.Client{Transport: rt})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &gceProvider{
+		api:       &gceComputeService{client: client},
+		projectID: "project_id",
+		ic: &gceInstanceConfig{
+			Zone:     &compute.Zone{Name: "us-central1-a"},
+			DiskType: "zones/us-central1-a/diskTypes/pd-ssd",
+			DiskSize: 20,
+		},
+	}
+
+	snapshot, err := p.snapshotByPrefix("travis-ci-snap")
+	assert.Nil(t, err)
+	assert.Equal(t, "travis-ci-snap-2", snapshot.Name)
+	assert.Equal(t, "name eq ^travis-ci-snap.*", rt.reqs[0].URL.Query().Get("filter"))
+
+	inst := &compute.Instance{
+		Name: "testing-gce-abc",
+		Disks: []*compute.AttachedDisk{
+			&compute.AttachedDisk{
+				Boot:             true,
+				AutoDelete:       true,
+				InitializeParams: &compute.AttachedDiskInitializeParams{DiskSizeGb: 30},
+			},
+		},
+	}
+
+	err = p.attachBootDiskFromSnapshot(gocontext.TODO(), "us-central1-a", inst, snapshot)
+	assert.Nil(t, err)
+	assert.Nil(t, inst.Disks[0].InitializeParams)
+	assert.Equal(t, "disk-link", inst.Disks[0].Source)
+	assert.Equal(t, "testing-gce-abc", inst.Disks[0].DeviceName)
+	assert.True(t, inst.Disks[0].AutoDelete)
+
+	disk := &compute.Disk{}
+	err = json.NewDecoder(rt.reqs[1].Body).Decode(disk)
+	assert.Nil(t, err)
+	assert.Equal(t, "snap-2-link", disk.SourceSnapshot)
+	assert.Equal(t, int64(30), disk.SizeGb)
+	assert.Equal(t, "projects/project_id/zones/us-central1-a/diskTypes/pd-ssd", disk.Type)
+}
+
+func TestGCEProvider_getImageBySelfLink(t *testing.T) {
+	rt := &gceTestRoundTripper{responses: map[string]string{
+		"/compute/v1/projects/image-bakery/global/images/travis-ci-candidate-1": `{"name":"travis-ci-candidate-1","selfLink":"candidate-link"}`,
+	}}
+
+	client, err := compute.New(&http.Client{Transport: rt})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &gceProvider{
+		api:                  &gceComputeService{client: client},
+		projectID:            "project_id",
+		allowedImageProjects: map[string]bool{"image-bakery": true},
+	}
+
+	ctx := gocontext.TODO()
+
+	image, err := p.getImage(ctx, &StartAttributes{
+		ImageSelfLink: "https://www.googleapis.com/compute/v1/projects/image-bakery/global/images/travis-ci-candidate-1",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "candidate-link", image.SelfLink)
+
+	_, err = p.getImage(ctx, &StartAttributes{
+		ImageSelfLink: "projects/image-bakery/global/images/travis-ci-candidate-2",
+	})
+	if assert.IsType(t, &StartError{}, err) {
+		assert.Equal(t, ErrImageNotFound, err.(*StartError).Cause)
+	}
+
+	nReqs := len(rt.reqs)
+	for _, selfLink := range []string{
+		"https://www.googleapis.com/compute/v1/projects/someone-else/global/images/travis-ci-candidate-1",
+		"travis-ci-candidate-1",
+	} {
+		_, err = p.getImage(ctx, &StartAttributes{ImageSelfLink: selfLink})
+		if assert.IsType(t, &StartError{}, err, "self link %q", selfLink) {
+			assert.Equal(t, ErrImageNotAllowed, err.(*StartError).Cause)
+			assert.False(t, IsRecoverable(err))
+		}
+	}
+	assert.Len(t, rt.reqs, nReqs)
+}
+
+func TestGCEProvider_waitForGroupMembership(t *testing.T) {
+	rt := &gceTestRoundTripper{responses: map[string]string{
+		"/compute/v1/projects/project_id/zones/us-central1-a/instanceGroups/workers/listInstances": `{"items":[{"instance":"other-link"},{"instance":"instance-link"}]}`,
+	}}
+
+	client, err := compute.New(&http.Client{Transport: rt})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &gceProvider{
+		api:           &gceComputeService{client: client},
+		projectID:     "project_id",
+		instanceGroup: "workers",
+		bootPollSleep: time.Millisecond,
+		ic:            &gceInstanceConfig{Zone: &compute.Zone{Name: "us-central1-a"}},
+	}
+
+	err = p.waitForGroupMembership(gocontext.TODO(), "us-central1-a", "workers", "instance-link")
+	assert.Nil(t, err)
+	assert.Len(t, rt.reqs, 1)
+
+	ctx, cancel := gocontext.WithTimeout(gocontext.TODO(), 20*time.Millisecond)
+	defer cancel()
+
+	err = p.waitForGroupMembership(ctx, "us-central1-a", "workers", "missing-link")
+	assert.Equal(t, gocontext.DeadlineExceeded, err)
+	assert.True(t, len(rt.reqs) > 2)
+}
+
+func TestGCEProvider_bootTimeoutError(t *testing.T) {
+	serialOutputPath := "/compute/v1/projects/project_id/zones/us-central1-a/instances/testing-gce-abc/serialPort"
+	rt := &gceTestRoundTripper{responses: map[string]string{
+		serialOutputPath: `{"contents":"Booting from Hard Disk 0...\nKernel panic - not syncing: VFS: Unable to mount root fs\n"}`,
+	}}
+	client, err := compute.New(&http.Client{Transport: rt})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &gceProvider{
+		api:       &gceComputeService{client: client},
+		projectID: "project_id",
+		ic:        &gceInstanceConfig{Zone: &compute.Zone{Name: "us-central1-a"}},
+	}
+	inst := &compute.Instance{Name: "testing-gce-abc"}
+
+	err = p.bootTimeoutError(gocontext.TODO(), inst, gocontext.DeadlineExceeded)
+	if assert.IsType(t, &StartError{}, err) {
+		assert.Equal(t, ErrBootTimeout, err.(*StartError).Cause)
+		assert.Contains(t, err.Error(), "Kernel panic - not syncing")
+	}
+	if assert.Len(t, rt.reqs, 1) {
+		assert.Equal(t, "1", rt.reqs[0].URL.Query().Get("port"))
+	}
+
+	delete(rt.responses, serialOutputPath)
+
+	err = p.bootTimeoutError(gocontext.TODO(), inst, gocontext.DeadlineExceeded)
+	if assert.IsType(t, &StartError{}, err) {
+		assert.Equal(t, ErrBootTimeout, err.(*StartError).Cause)
+		assert.Equal(t, gocontext.DeadlineExceeded, err.(*StartError).Err)
+	}
+}
+
+func TestGCEProvider_instanceGroupForZone(t *testing.T) {
+	cfg := config.ProviderConfigFromMap(map[string]string{
+		"ACCOUNT_JSON":                 "{}",
+		"PROJECT_ID":                   "project_id",
+		"INSTANCE_GROUP":               "workers",
+		"INSTANCE_GROUP_US_CENTRAL1_B": "workers-b",
+	})
+
+	p, _, _ := gceTestSetup(t, cfg, nil)
+	defer gceTestTeardown(p)
+
+	assert.Equal(t, "workers", p.instanceGroupForZone("us-central1-a"))
+	assert.Equal(t, "workers-b", p.instanceGroupForZone("us-central1-b"))
+}
+
+func TestGCEProvider_bootDiskSize(t *testing.T) {
+	p := &gceProvider{ic: &gceInstanceConfig{DiskSize: 20, AutoExpandDisk: true}}
+	ctx := gocontext.TODO()
+
+	size, err := p.bootDiskSize(ctx, "travis-ci-ruby-1", 10)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(20), size)
+
+	size, err = p.bootDiskSize(ctx, "travis-ci-ruby-1", 30)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(30), size)
+
+	p.ic.AutoExpandDisk = false
+
+	_, err = p.bootDiskSize(ctx, "travis-ci-ruby-1", 30)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, "disk size 20GB is smaller than the 30GB required by travis-ci-ruby-1", err.Error())
+	}
+}
+
+func TestGCEReportProgress(t *testing.T) {
+	gceReportProgress(nil, ProgressStageInstanceInsert)
+
+	progress := make(chan ProgressEntry, 1)
+	gceReportProgress(progress, ProgressStageInstanceInsert)
+	gceReportProgress(progress, ProgressStageOperationDone)
+
+	entry := <-progress
+	assert.Equal(t, ProgressStageInstanceInsert, entry.Stage)
+	assert.Len(t, progress, 0)
+}
+
+func TestGCEErrorCauses(t *testing.T) {
+	for code, expected := range map[string]error{
+		"QUOTA_EXCEEDED":                            ErrQuotaExceeded,
+		"RESOURCE_EXHAUSTED":                        ErrResourceExhausted,
+		"ZONE_RESOURCE_POOL_EXHAUSTED":              ErrResourceExhausted,
+		"ZONE_RESOURCE_POOL_EXHAUSTED_WITH_DETAILS": ErrResourceExhausted,
+		"RESOURCE_NOT_FOUND":                        nil,
+		"INTERNAL_ERROR":                            nil,
+		"":                                          nil,
+	} {
+		assert.Equal(t, expected, gceOpErrorCodeCause(code), "code %q", code)
+	}
+
+	for reason, expected := range map[string]error{
+		"quotaExceeded":         ErrQuotaExceeded,
+		"rateLimitExceeded":     ErrQuotaExceeded,
+		"userRateLimitExceeded": ErrQuotaExceeded,
+		"resourceExhausted":     ErrResourceExhausted,
+		"notFound":              nil,
+		"alreadyExists":         nil,
+	} {
+		assert.Equal(t, expected, gceAPIErrorReasonCause(reason), "reason %q", reason)
+	}
+
+	err := gceClassifyStartError(&googleapi.Error{Code: http.StatusTooManyRequests})
+	if assert.IsType(t, &StartError{}, err) {
+		assert.Equal(t, ErrQuotaExceeded, err.(*StartError).Cause)
+	}
+}
+
+func TestLoadGoogleAccountJSON(t *testing.T) {
+	td, err := ioutil.TempDir("", "travis-worker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	err = ioutil.WriteFile(filepath.Join(td, "account.json"), []byte(`{"client_email":"worker@example.com"}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, filenameOrJSON := range []string{
+		`{"client_email":"worker@example.com"}`,
+		filepath.Join(td, "account.json"),
+		td,
+	} {
+		a, err := loadGoogleAccountJSON(filenameOrJSON)
+		assert.Nil(t, err, "%q", filenameOrJSON)
+		assert.Equal(t, "worker@example.com", a.ClientEmail, "%q", filenameOrJSON)
+	}
+}
+
+func TestBuildGoogleHTTPClient_GoogleApplicationCredentials(t *testing.T) {
+	origCreds := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	defer os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", origCreds)
+
+	cfg := config.ProviderConfigFromMap(map[string]string{})
+
+	os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", "")
+	_, err := buildGoogleHTTPClient(cfg)
+	assert.NotNil(t, err)
+
+	os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", "{}")
+	_, err = buildGoogleHTTPClient(cfg)
+	assert.Nil(t, err)
+}
+
+func TestNewGoogleComputeService_ComputeEndpoint(t *testing.T) {
+	cfg := config.ProviderConfigFromMap(map[string]string{})
+
+	service, err := newGoogleComputeService(http.DefaultClient, cfg)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "https://compute.googleapis.com/compute/v1/", service.BasePath)
+	}
+
+	for _, endpoint := range []string{"http://127.0.0.1:8080/compute/v1", "http://127.0.0.1:8080/compute/v1/projects/"} {
+		cfg.Set("COMPUTE_ENDPOINT", endpoint)
+		service, err = newGoogleComputeService(http.DefaultClient, cfg)
+		if assert.Nil(t, err, endpoint) {
+			assert.Equal(t, "http://127.0.0.1:8080/compute/v1/", service.BasePath)
+		}
+	}
+
+	for _, endpoint := range []string{"127.0.0.1:8080", "/compute/v1/projects/", "ftp://example.com/"} {
+		cfg.Set("COMPUTE_ENDPOINT", endpoint)
+		_, err = newGoogleComputeService(http.DefaultClient, cfg)
+		if assert.NotNil(t, err, endpoint) {
+			assert.Equal(t, fmt.Sprintf("invalid COMPUTE_ENDPOINT %q", endpoint), err.Error())
+		}
+	}
+}
+
+func TestBuildGoogleHTTPClient_MetadataCredentials(t *testing.T) {
+	origCreds := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	defer os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", origCreds)
+	os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", "")
+
+	for _, cfgMap := range []map[string]string{
+		{"ACCOUNT_JSON": "metadata"},
+		{"USE_METADATA_CREDENTIALS": "true"},
+		{"ACCOUNT_JSON": "/nonexistent/account.json", "USE_METADATA_CREDENTIALS": "true"},
+	} {
+		_, err := buildGoogleHTTPClient(config.ProviderConfigFromMap(cfgMap))
+		assert.Nil(t, err, "%v", cfgMap)
+	}
+
+	_, err := buildGoogleHTTPClient(config.ProviderConfigFromMap(map[string]string{
+		"USE_METADATA_CREDENTIALS": "false",
+	}))
+	assert.NotNil(t, err)
+}
+
+// gceTestAccountJSON returns account JSON with a fresh private key whose
+// tokens are requested from tokenURI.
+func gceTestAccountJSON(t *testing.T, tokenURI string) string {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accountJSON, err := json.Marshal(map[string]string{
+		"client_email": "worker@example.com",
+		"private_key": string(pem.EncodeToMemory(&pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(key),
+		})),
+		"token_uri": tokenURI,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(accountJSON)
+}
+
+func TestBuildGoogleTokenSource_Refreshes(t *testing.T) {
+	var (
+		refreshes int
+		expiresIn = 3600
+		fail      = false
+	)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		refreshes++
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token":"token-%d","token_type":"Bearer","expires_in":%d}`, refreshes, expiresIn)
+	}))
+	defer ts.Close()
+
+	accountJSON := gceTestAccountJSON(t, ts.URL)
+
+	tokenSource, err := buildGoogleTokenSource(config.ProviderConfigFromMap(map[string]string{
+		"ACCOUNT_JSON": accountJSON,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		tok, err := tokenSource.Token()
+		assert.Nil(t, err)
+		assert.Equal(t, "token-1", tok.AccessToken)
+	}
+	assert.Equal(t, 1, refreshes)
+
+	tokenSource, err = buildGoogleTokenSource(config.ProviderConfigFromMap(map[string]string{
+		"ACCOUNT_JSON": accountJSON,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// tokens expiring within oauth2's expiry delta are refreshed on every use
+	expiresIn = 1
+	for i := 0; i < 3; i++ {
+		_, err := tokenSource.Token()
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, 4, refreshes)
+
+	fail = true
+	_, err = tokenSource.Token()
+	assert.NotNil(t, err)
+	assert.Equal(t, 5, refreshes)
+}
+
+func TestBuildGoogleTokenSource_Scopes(t *testing.T) {
+	var scope string
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assertion := strings.Split(req.FormValue("assertion"), ".")
+		claims := struct {
+			Scope string `json:"scope"`
+		}{}
+		if len(assertion) == 3 {
+			payload, _ := base64.RawURLEncoding.DecodeString(strings.TrimRight(assertion[1], "="))
+			_ = json.Unmarshal(payload, &claims)
+		}
+		scope = claims.Scope
+
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"access_token":"token","token_type":"Bearer","expires_in":3600}`)
+	}))
+	defer ts.Close()
+
+	accountJSON := gceTestAccountJSON(t, ts.URL)
+
+	for _, tc := range []struct {
+		scopes   string
+		expected string
+	}{
+		{"", compute.ComputeScope},
+		{"compute.readonly, " + compute.DevstorageReadOnlyScope, compute.ComputeReadonlyScope + " " + compute.DevstorageReadOnlyScope},
+	} {
+		cfgMap := map[string]string{"ACCOUNT_JSON": accountJSON}
+		if tc.scopes != "" {
+			cfgMap["COMPUTE_SCOPES"] = tc.scopes
+		}
+
+		tokenSource, err := buildGoogleTokenSource(config.ProviderConfigFromMap(cfgMap))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = tokenSource.Token()
+		assert.Nil(t, err)
+		assert.Equal(t, tc.expected, scope)
+	}
+
+	_, err := buildGoogleTokenSource(config.ProviderConfigFromMap(map[string]string{
+		"ACCOUNT_JSON":   accountJSON,
+		"COMPUTE_SCOPES": " , ",
+	}))
+	assert.NotNil(t, err)
+}
+
+func TestGCEInstance_scriptCommand(t *testing.T) {
+	for _, tc := range []struct {
+		scriptPath  string
+		interpreter string
+		os          string
+		path        string
+		command     string
+	}{
+		{"", "", "linux", "build.sh", `'./build.sh'`},
+		{"", "bash", "linux", "build.sh", `bash './build.sh'`},
+		{"", "bash", "windows", "build.ps1", `powershell -NoProfile -NonInteractive -ExecutionPolicy Bypass -File 'build.ps1'`},
+		{"/opt/travis/build", "/usr/bin/env zsh", "linux", "/opt/travis/build", `/usr/bin/env zsh '/opt/travis/build'`},
+		{"it's/build.sh", "", "osx", "it's/build.sh", `'./it'\''s/build.sh'`},
+		{"C:/it's/build.ps1", "", "windows", "C:/it's/build.ps1", `powershell -NoProfile -NonInteractive -ExecutionPolicy Bypass -File 'C:/it''s/build.ps1'`},
+	} {
+		p := &gceProvider{scriptPath: tc.scriptPath, scriptInterpreter: tc.interpreter}
+		i := &gceInstance{provider: p, os: tc.os, scriptPath: p.scriptPathFor(tc.os)}
+
+		assert.Equal(t, tc.path, i.scriptPath)
+		assert.Equal(t, tc.command, i.scriptCommand())
+	}
+}
+
+func TestGCEProvider_Shutdown(t *testing.T) {
+	rt := &gceTestRoundTripper{responses: map[string]string{
+		"/compute/v1/projects/project_id/zones/us-central1-a/instances/testing-gce-pooled": `{"name":"delete-op"}`,
+		"/compute/v1/projects/project_id/zones/us-central1-a/operations/delete-op":         `{"name":"delete-op","status":"DONE"}`,
+	}}
+	client, err := compute.New(&http.Client{Transport: rt})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &gceProvider{
+		api:          &gceComputeService{client: client},
+		projectID:    "project_id",
+		ic:           &gceInstanceConfig{Zone: &compute.Zone{Name: "us-central1-a"}},
+		pool:         &gcePool{size: 1, maxAge: time.Minute},
+		shutdownChan: make(chan struct{}),
+	}
+	p.pool.instances = []*gceInstance{{
+		provider:  p,
+		instance:  &compute.Instance{Name: "testing-gce-pooled"},
+		ic:        p.ic,
+		projectID: "project_id",
+		bootedAt:  time.Now(),
+	}}
+
+	startCtx, done, err := p.trackStart(gocontext.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := gocontext.WithTimeout(gocontext.TODO(), 50*time.Millisecond)
+	defer cancel()
+
+	assert.Equal(t, gocontext.DeadlineExceeded, p.Shutdown(ctx))
+	assert.Equal(t, gocontext.Canceled, startCtx.Err())
+	assert.Len(t, p.pool.instances, 1)
+
+	_, err = p.Start(gocontext.TODO(), &StartAttributes{})
+	assert.Equal(t, errGCEShuttingDown, err)
+
+	done()
+
+	assert.Nil(t, p.Shutdown(gocontext.TODO()))
+	assert.Len(t, p.pool.instances, 0)
+	if assert.Len(t, rt.reqs, 2) {
+		assert.Equal(t, "DELETE", rt.reqs[0].Method)
+	}
+}
+
+func TestGCEProvider_StartDryRun(t *testing.T) {
+	cfg := config.ProviderConfigFromMap(map[string]string{
+		"ACCOUNT_JSON": "{}",
+		"PROJECT_ID":   "project_id",
+		"DRY_RUN":      "true",
+	})
+
+	p, _, _ := gceTestSetup(t, cfg, nil)
+	defer gceTestTeardown(p)
+
+	rt := &gceTestRoundTripper{responses: map[string]string{
+		"/compute/v1/projects/project_id/zones/us-central1-a":                            `{"name":"us-central1-a"}`,
+		"/compute/v1/projects/project_id/zones/us-central1-a/diskTypes/pd-ssd":           `{"name":"pd-ssd"}`,
+		"/compute/v1/projects/project_id/zones/us-central1-a/machineTypes/n1-standard-2": `{"name":"n1-standard-2"}`,
+		"/compute/v1/projects/project_id/global/networks/default":                        `{"name":"default"}`,
+		"/compute/v1/projects/project_id/global/images":                                  `{"items":[{"name":"travis-ci-minimal-1","selfLink":"travis-ci-minimal-1-link"}]}`,
+	}}
+
+	client, err := compute.New(&http.Client{Transport: rt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.api = &gceComputeService{client: client}
+
+	err = p.Setup()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inst, err := p.Start(gocontext.TODO(), &StartAttributes{Language: "minimal"})
+	if assert.Nil(t, err) && assert.IsType(t, &gceDryRunInstance{}, inst) {
+		assert.Regexp(t, "^testing-gce-.+:travis-ci-minimal-1:dry-run$", inst.ID())
+
+		buf := &bytes.Buffer{}
+		result, err := inst.RunScript(gocontext.TODO(), buf)
+		assert.Equal(t, errGCEDryRun, err)
+		assert.False(t, result.Completed, "dry run jobs must not be reported as finished")
+		assert.Equal(t, uint8(0), result.ExitCode)
+		assert.Contains(t, buf.String(), "Dry run")
+	}
+
+	for _, req := range rt.reqs {
+		assert.Equal(t, "GET", req.Method, "%s", req.URL)
+	}
+}
+
+func TestNewGCEProvider_RejectsDryRunWithPool(t *testing.T) {
+	cfg := config.ProviderConfigFromMap(map[string]string{
+		"ACCOUNT_JSON": "{}",
+		"PROJECT_ID":   "project_id",
+		"DRY_RUN":      "true",
+		"POOL_SIZE":    "2",
+	})
+	gceTestSetupSSH(t, cfg)
+	defer os.RemoveAll(cfg.Get("TEMP_DIR"))
+
+	_, err := newGCEProvider(cfg)
+	assert.NotNil(t, err)
+}
+
+func TestParseGCEImageRollout(t *testing.T) {
+	weights, err := parseGCEImageRollout("90, 10")
+	assert.Nil(t, err)
+	assert.Equal(t, []int{90, 10}, weights)
+
+	for value, message := range map[string]string{
+		"90,ten":  `invalid IMAGE_ROLLOUT "90,ten", must be comma-delimited percentages`,
+		"110,-10": `invalid IMAGE_ROLLOUT "110,-10", must be comma-delimited percentages`,
+		"90,20":   `invalid IMAGE_ROLLOUT "90,20", percentages add up to 110 instead of 100`,
+	} {
+		_, err := parseGCEImageRollout(value)
+		if assert.NotNil(t, err) {
+			assert.Equal(t, message, err.Error())
+		}
+	}
+}
+
+func TestGCEImageRolloutIndex(t *testing.T) {
+	assert.Equal(t, 0, gceImageRolloutIndex(nil, 3, 42))
+	assert.Equal(t, 0, gceImageRolloutIndex([]int{0, 100}, 3, 0))
+	assert.Equal(t, 0, gceImageRolloutIndex([]int{0, 100}, 1, 42))
+	assert.Equal(t, 1, gceImageRolloutIndex([]int{0, 100}, 2, 42))
+
+	counts := make([]int, 2)
+	for jobID := uint64(1); jobID <= 1000; jobID++ {
+		idx := gceImageRolloutIndex([]int{90, 10}, 2, jobID)
+		assert.Equal(t, idx, gceImageRolloutIndex([]int{90, 10}, 2, jobID))
+		counts[idx]++
+	}
+	assert.InDelta(t, 900, counts[0], 50)
+	assert.InDelta(t, 100, counts[1], 50)
+}
+
+func TestGCECall(t *testing.T) {
+	calls := 0
+	err := gceCall(gocontext.TODO(), func() error {
+		calls++
+		return fmt.Errorf("broken")
+	})
+	assert.EqualError(t, err, "broken")
+	assert.Equal(t, 1, calls)
+
+	ctx, cancel := gocontext.WithCancel(gocontext.TODO())
+	cancel()
+	err = gceCall(ctx, func() error {
+		calls++
+		return nil
+	})
+	assert.Equal(t, gocontext.Canceled, err)
+	assert.Equal(t, 1, calls)
+
+	ctx, cancel = gocontext.WithTimeout(gocontext.TODO(), 10*time.Millisecond)
+	defer cancel()
+	release := make(chan struct{})
+	defer close(release)
+	err = gceCall(ctx, func() error {
+		<-release
+		return nil
+	})
+	assert.Equal(t, gocontext.DeadlineExceeded, err)
 }
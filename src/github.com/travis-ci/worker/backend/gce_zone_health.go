@@ -0,0 +1,138 @@
+package backend
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+
+	"github.com/travis-ci/worker/metrics"
+)
+
+const (
+	// gceZoneHealthWindow is the number of most recent boots per zone that
+	// zone stats are computed over.
+	gceZoneHealthWindow = 20
+
+	// gceZoneMinWeight is the smallest weight a zone is selected with, so
+	// that zones that failed every recent boot still get the occasional
+	// instance, which tells when they recovered.
+	gceZoneMinWeight = 0.05
+)
+
+// gceZoneHealth keeps the outcomes of the most recent boots in each zone.
+// Only failures that are the zone's fault, such as exhausted resources and
+// boot timeouts, count against it.
+type gceZoneHealth struct {
+	mutex    sync.Mutex
+	outcomes map[string][]bool
+}
+
+// gceZoneStats counts the instances started in a zone, and the starts that
+// failed because of the zone, over the window of recent boots.
+type gceZoneStats struct {
+	successes int
+	failures  int
+}
+
+// successRate returns the fraction of starts that succeeded, which is 1 if
+// there were none.
+func (s gceZoneStats) successRate() float64 {
+	if s.successes+s.failures == 0 {
+		return 1
+	}
+	return float64(s.successes) / float64(s.successes+s.failures)
+}
+
+func newGCEZoneHealth() *gceZoneHealth {
+	return &gceZoneHealth{outcomes: map[string][]bool{}}
+}
+
+// record adds the outcome of a boot in the zone, dropping the oldest once
+// the window is full, and reports the zone's success rate as a gauge.
+func (h *gceZoneHealth) record(zoneName string, success bool) {
+	h.mutex.Lock()
+	outcomes := append(h.outcomes[zoneName], success)
+	if len(outcomes) > gceZoneHealthWindow {
+		outcomes = outcomes[len(outcomes)-gceZoneHealthWindow:]
+	}
+	h.outcomes[zoneName] = outcomes
+	stats := gceZoneStatsOf(outcomes)
+	h.mutex.Unlock()
+
+	metrics.Gauge(fmt.Sprintf("worker.vm.provider.gce.zone.%s.success_rate", zoneName), int64(stats.successRate()*100))
+}
+
+// stats returns the stats of every zone that boots were recorded in.
+func (h *gceZoneHealth) stats() map[string]gceZoneStats {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	stats := map[string]gceZoneStats{}
+	for zoneName, outcomes := range h.outcomes {
+		stats[zoneName] = gceZoneStatsOf(outcomes)
+	}
+	return stats
+}
+
+func gceZoneStatsOf(outcomes []bool) gceZoneStats {
+	stats := gceZoneStats{}
+	for _, success := range outcomes {
+		if success {
+			stats.successes++
+		} else {
+			stats.failures++
+		}
+	}
+	return stats
+}
+
+// gceSelectZone picks one of the zones at random, weighted by the success
+// rate of its recent boots, using r in [0, 1) as the random number.
+func gceSelectZone(zoneNames []string, stats map[string]gceZoneStats, r float64) string {
+	weights := make([]float64, len(zoneNames))
+	total := 0.0
+	for i, zoneName := range zoneNames {
+		weights[i] = stats[zoneName].successRate()
+		if weights[i] < gceZoneMinWeight {
+			weights[i] = gceZoneMinWeight
+		}
+		total += weights[i]
+	}
+
+	r *= total
+	for i, weight := range weights {
+		if r < weight {
+			return zoneNames[i]
+		}
+		r -= weight
+	}
+
+	return zoneNames[len(zoneNames)-1]
+}
+
+// selectZone returns the zone to start an instance in, biased away from
+// zones whose recent boots failed.
+func (p *gceProvider) selectZone() string {
+	if len(p.zoneNames) < 2 {
+		return p.ic.Zone.Name
+	}
+
+	return gceSelectZone(p.zoneNames, p.zoneHealth.stats(), rand.Float64())
+}
+
+// recordZoneHealth records the outcome of starting an instance in the zone,
+// or in the zone of an adopted instance. Errors that aren't the zone's fault,
+// e.g. a missing image, and dry runs aren't recorded.
+func (p *gceProvider) recordZoneHealth(zoneName string, inst Instance, err error) {
+	if err == nil {
+		if gceInst, ok := inst.(*gceInstance); ok {
+			p.zoneHealth.record(gceInst.zoneName(), true)
+		}
+		return
+	}
+
+	startErr, ok := err.(*StartError)
+	if ok && (startErr.Cause == ErrResourceExhausted || startErr.Cause == ErrBootTimeout || startErr.Cause == ErrBootHardTimeout) {
+		p.zoneHealth.record(zoneName, false)
+	}
+}
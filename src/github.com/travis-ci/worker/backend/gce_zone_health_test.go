@@ -0,0 +1,108 @@
+package backend
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	gocontext "golang.org/x/net/context"
+	"google.golang.org/api/compute/v1"
+)
+
+func TestGCEZoneHealth(t *testing.T) {
+	h := newGCEZoneHealth()
+	assert.Equal(t, map[string]gceZoneStats{}, h.stats())
+
+	h.record("us-central1-a", false)
+	for i := 0; i < gceZoneHealthWindow-1; i++ {
+		h.record("us-central1-a", true)
+	}
+	h.record("us-central1-b", false)
+
+	stats := h.stats()
+	assert.Equal(t, gceZoneStats{successes: gceZoneHealthWindow - 1, failures: 1}, stats["us-central1-a"])
+	assert.Equal(t, gceZoneStats{failures: 1}, stats["us-central1-b"])
+	assert.Equal(t, 0.0, stats["us-central1-b"].successRate())
+
+	h.record("us-central1-a", true)
+	assert.Equal(t, gceZoneStats{successes: gceZoneHealthWindow}, h.stats()["us-central1-a"])
+	assert.Equal(t, 1.0, gceZoneStats{}.successRate())
+}
+
+func TestGCESelectZone(t *testing.T) {
+	zoneNames := []string{"us-central1-a", "us-central1-b", "us-central1-c"}
+
+	// zones without recent boots are equally likely
+	assert.Equal(t, "us-central1-a", gceSelectZone(zoneNames, nil, 0.0))
+	assert.Equal(t, "us-central1-b", gceSelectZone(zoneNames, nil, 0.5))
+	assert.Equal(t, "us-central1-c", gceSelectZone(zoneNames, nil, 0.99))
+
+	// a failing zone keeps only the minimum weight, out of 2.05 in total
+	stats := map[string]gceZoneStats{"us-central1-a": {failures: 4}}
+	assert.Equal(t, "us-central1-a", gceSelectZone(zoneNames, stats, 0.01))
+	assert.Equal(t, "us-central1-b", gceSelectZone(zoneNames, stats, 0.03))
+	assert.Equal(t, "us-central1-c", gceSelectZone(zoneNames, stats, 0.6))
+
+	stats["us-central1-b"] = gceZoneStats{successes: 1, failures: 1}
+	assert.Equal(t, "us-central1-b", gceSelectZone(zoneNames, stats, 0.3))
+	assert.Equal(t, "us-central1-c", gceSelectZone(zoneNames, stats, 0.4))
+}
+
+func TestGCEProvider_StartRecordsZoneHealth(t *testing.T) {
+	p, fc := gceTestFakeComputeSetup(t, nil)
+	defer gceTestTeardown(p)
+	defer fc.close()
+
+	inst, err := p.Start(gocontext.TODO(), &StartAttributes{Language: "minimal"})
+	if assert.Nil(t, err) {
+		assert.Nil(t, inst.Stop(gocontext.TODO()))
+	}
+
+	images := fc.images
+	fc.images = nil
+	_, err = p.Start(gocontext.TODO(), &StartAttributes{Language: "minimal"})
+	assert.NotNil(t, err)
+	fc.images = images
+
+	fc.opErrors["insert"] = &compute.OperationError{
+		Errors: []*compute.OperationErrorErrors{{Code: "ZONE_RESOURCE_POOL_EXHAUSTED"}},
+	}
+	_, err = p.Start(gocontext.TODO(), &StartAttributes{Language: "minimal"})
+	assert.NotNil(t, err)
+
+	assert.Equal(t, map[string]gceZoneStats{
+		"us-central1-a": {successes: 1, failures: 1},
+	}, p.zoneHealth.stats())
+}
+
+func TestGCEProvider_StartInZones(t *testing.T) {
+	p, fc := gceTestFakeComputeSetup(t, map[string]string{
+		"ZONES": "us-central1-b, us-central1-a,us-central1-c",
+	})
+	defer gceTestTeardown(p)
+	defer fc.close()
+
+	assert.Equal(t, []string{"us-central1-a", "us-central1-b", "us-central1-c"}, p.zoneNames)
+	assert.Nil(t, p.Setup())
+
+	inst, err := p.start(gocontext.TODO(), "us-central1-b", &StartAttributes{Language: "minimal", JobID: 4}, nil)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	gceInst := inst.(*gceInstance)
+	assert.Equal(t, "us-central1-b", gceInst.zoneName())
+	fakeInst := fc.instances[gceInst.instance.Name]
+	if assert.NotNil(t, fakeInst) {
+		assert.Equal(t, "us-central1-b", fakeInst.Zone)
+		assert.Equal(t, "zones/us-central1-b/machineTypes/n1-standard-2", fakeInst.MachineType)
+		assert.Equal(t, "zones/us-central1-b/diskTypes/pd-ssd", fakeInst.Disks[0].InitializeParams.DiskType)
+	}
+
+	found, err := p.instanceForJob(gocontext.TODO(), 4)
+	if assert.Nil(t, err) && assert.NotNil(t, found) {
+		assert.Equal(t, gceInst.instance.Name, found.Name)
+	}
+
+	assert.Nil(t, inst.Stop(gocontext.TODO()))
+	assert.Empty(t, fc.instances)
+}
@@ -12,7 +12,9 @@ import (
 	"net/http"
 	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -20,6 +22,7 @@ import (
 	"github.com/pkg/sftp"
 	"github.com/travis-ci/worker/config"
 	workerctx "github.com/travis-ci/worker/context"
+	"github.com/travis-ci/worker/image"
 	"github.com/travis-ci/worker/metrics"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/net/context"
@@ -29,14 +32,45 @@ var (
 	nonAlphaNumRegexp     = regexp.MustCompile(`[^a-zA-Z0-9_]+`)
 	metricNameCleanRegexp = regexp.MustCompile(`[^A-Za-z0-9.:-_]+`)
 	jupiterBrainHelp      = map[string]string{
-		"ENDPOINT":            "[REQUIRED] url to Jupiter Brain server, including auth",
-		"SSH_KEY_PATH":        "[REQUIRED] path to SSH key used to access job VMs",
-		"SSH_KEY_PASSPHRASE":  "[REQUIRED] passphrase for SSH key given as SSH_KEY_PATH",
-		"KEYCHAIN_PASSWORD":   "[REQUIRED] password used ... somehow",
-		"IMAGE_ALIASES":       "comma-delimited strings used as stable names for images (default: \"\")",
-		"IMAGE_ALIAS_{ALIAS}": "full name for a given alias given via IMAGE_ALIASES, where the alias form in the key is uppercased and normalized by replacing non-alphanumerics with _",
-		"BOOT_POLL_SLEEP":     "sleep interval between polling server for instance status (default 3s)",
-	}
+		"ENDPOINT":               "[REQUIRED] url to Jupiter Brain server, including auth",
+		"SSH_KEY_PATH":           "[REQUIRED] path to SSH key used to access job VMs",
+		"SSH_KEY_PASSPHRASE":     "[REQUIRED] passphrase for SSH key given as SSH_KEY_PATH",
+		"KEYCHAIN_PASSWORD":      "[REQUIRED] password used ... somehow",
+		"IMAGE_SELECTOR_TYPE":    "image selector type (\"legacy\" or \"env\", default \"legacy\"), where legacy picks the image of the first of the osx_image, dist, group, language and os aliases given via IMAGE_ALIASES",
+		"IMAGE_ALIASES":          "comma-delimited strings used as stable names for images, required when image selector type is \"legacy\" (default: \"\")",
+		"IMAGE_ALIAS_{ALIAS}":    "full name for a given alias given via IMAGE_ALIASES, where the alias form in the key is uppercased and normalized by replacing non-alphanumerics with _",
+		"IMAGE_[ALIAS_]{ALIAS}":  "full name for a given alias when image selector type is \"env\", like for gce",
+		"IMAGE_DEFAULT":          "full name of the image used when the \"env\" image selector finds none (default none, failing the job)",
+		"BOOT_POLL_SLEEP":        "initial sleep interval between polling server for instance status, backing off with jitter up to 15s or this if longer (default 3s)",
+		"BOOT_TIMEOUT":           "how long to wait for an instance to boot, bounded by the worker's start timeout (default the start timeout)",
+		"SSH_DIAL_TIMEOUT":       fmt.Sprintf("timeout for connecting to instances over ssh, including the handshake (default %v)", defaultJupiterBrainSSHDialTimeout),
+		"SSH_KEEPALIVE_INTERVAL": fmt.Sprintf("interval between ssh keepalive requests, which keep idle connections of long builds from being dropped, 0 to disable (default %v)", defaultJupiterBrainSSHKeepalive),
+	}
+
+	errJupiterBrainBuildLost = fmt.Errorf("the build stopped running while the connection to the instance was lost")
+)
+
+const (
+	jupiterBrainBootPollMaxSleep = 15 * time.Second
+	jupiterBrainSSHDialTimeout   = 5 * time.Second
+	jupiterBrainSSHDialRetries   = 2
+
+	defaultJupiterBrainSSHDialTimeout = 10 * time.Second
+	defaultJupiterBrainSSHKeepalive   = 30 * time.Second
+
+	// jupiterBrainRunReconnects is how many times RunScript reconnects after
+	// losing the connection to wait for the build to finish.
+	jupiterBrainRunReconnects = 3
+
+	jupiterBrainRunCmd = "bash ~/wrapper.sh"
+
+	// jupiterBrainResumeCheckCmd succeeds if the build, which on macOS keeps
+	// running without the wrapper, has finished or is still running. The
+	// brackets keep pgrep from matching the command itself.
+	jupiterBrainResumeCheckCmd = `[ "$(uname)" = Darwin ] && { [ -f ~/build.sh.exit ] || pgrep -f '[b]uild\.sh$' >/dev/null; }`
+
+	// jupiterBrainResumeCmd waits for the build like the wrapper does.
+	jupiterBrainResumeCmd = `while [ ! -f ~/build.sh.exit ]; do sleep 1; done; exit $(cat ~/build.sh.exit)`
 )
 
 const (
@@ -65,11 +99,23 @@ type jupiterBrainProvider struct {
 	sshKeyPassphrase string
 	keychainPassword string
 	bootPollSleep    time.Duration
+	bootTimeout      time.Duration
+
+	sshDialer *sshDialer
+	sshPort   int
+
+	imageSelectorType string
+	imageSelector     *image.EnvSelector
 }
 
 type jupiterBrainInstance struct {
 	payload  *jupiterBrainInstancePayload
 	provider *jupiterBrainProvider
+
+	// client is the ssh connection shared by uploading and running the
+	// script, which is dialed again once it's lost.
+	clientMutex sync.Mutex
+	client      *ssh.Client
 }
 
 type jupiterBrainInstancePayload struct {
@@ -89,30 +135,31 @@ func newJupiterBrainProvider(cfg *config.ProviderConfig) (Provider, error) {
 		return nil, ErrMissingEndpointConfig
 	}
 
-	if !cfg.IsSet("IMAGE_ALIASES") {
-		return nil, fmt.Errorf("expected IMAGE_ALIASES config key")
-	}
-
-	aliasNames := cfg.Get("IMAGE_ALIASES")
-
 	baseURL, err := url.Parse(cfg.Get("ENDPOINT"))
 	if err != nil {
 		return nil, err
 	}
 
-	aliasNamesSlice := strings.Split(aliasNames, ",")
-
-	imageAliases := make(map[string]string, len(aliasNamesSlice))
-
-	for _, aliasName := range aliasNamesSlice {
-		normalizedAliasName := strings.ToUpper(string(nonAlphaNumRegexp.ReplaceAll([]byte(aliasName), []byte("_"))))
+	imageSelectorType := "legacy"
+	if cfg.IsSet("IMAGE_SELECTOR_TYPE") {
+		imageSelectorType = cfg.Get("IMAGE_SELECTOR_TYPE")
+	}
 
-		key := fmt.Sprintf("IMAGE_ALIAS_%s", normalizedAliasName)
-		if !cfg.IsSet(key) {
-			return nil, fmt.Errorf("expected image alias %q", aliasName)
-		}
+	var (
+		imageAliases  map[string]string
+		imageSelector *image.EnvSelector
+	)
 
-		imageAliases[aliasName] = cfg.Get(key)
+	switch imageSelectorType {
+	case "legacy":
+		imageAliases, err = jupiterBrainImageAliases(cfg)
+	case "env":
+		imageSelector, err = image.NewEnvSelector(cfg)
+	default:
+		err = fmt.Errorf("invalid image selector type %q", imageSelectorType)
+	}
+	if err != nil {
+		return nil, err
 	}
 
 	if !cfg.IsSet("SSH_KEY_PATH") {
@@ -142,6 +189,30 @@ func newJupiterBrainProvider(cfg *config.ProviderConfig) (Provider, error) {
 		bootPollSleep = si
 	}
 
+	bootTimeout := time.Duration(0)
+	if cfg.IsSet("BOOT_TIMEOUT") {
+		bootTimeout, err = time.ParseDuration(cfg.Get("BOOT_TIMEOUT"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid BOOT_TIMEOUT %q: %v", cfg.Get("BOOT_TIMEOUT"), err)
+		}
+	}
+
+	sshDialTimeout := defaultJupiterBrainSSHDialTimeout
+	if cfg.IsSet("SSH_DIAL_TIMEOUT") {
+		sshDialTimeout, err = time.ParseDuration(cfg.Get("SSH_DIAL_TIMEOUT"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid SSH_DIAL_TIMEOUT %q: %v", cfg.Get("SSH_DIAL_TIMEOUT"), err)
+		}
+	}
+
+	sshKeepalive := defaultJupiterBrainSSHKeepalive
+	if cfg.IsSet("SSH_KEEPALIVE_INTERVAL") {
+		sshKeepalive, err = time.ParseDuration(cfg.Get("SSH_KEEPALIVE_INTERVAL"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid SSH_KEEPALIVE_INTERVAL %q: %v", cfg.Get("SSH_KEEPALIVE_INTERVAL"), err)
+		}
+	}
+
 	return &jupiterBrainProvider{
 		client:           http.DefaultClient,
 		baseURL:          baseURL,
@@ -150,28 +221,70 @@ func newJupiterBrainProvider(cfg *config.ProviderConfig) (Provider, error) {
 		sshKeyPassphrase: sshKeyPassphrase,
 		keychainPassword: keychainPassword,
 		bootPollSleep:    bootPollSleep,
+		bootTimeout:      bootTimeout,
+
+		sshDialer: &sshDialer{
+			DialTimeout:       sshDialTimeout,
+			KeepaliveInterval: sshKeepalive,
+			Retries:           jupiterBrainSSHDialRetries,
+			RetrySleep:        time.Second,
+		},
+		sshPort: 22,
+
+		imageSelectorType: imageSelectorType,
+		imageSelector:     imageSelector,
 	}, nil
 }
 
+// jupiterBrainImageAliases maps the aliases given via IMAGE_ALIASES to the
+// images of their IMAGE_ALIAS_{ALIAS} keys for the legacy image selector.
+func jupiterBrainImageAliases(cfg *config.ProviderConfig) (map[string]string, error) {
+	if !cfg.IsSet("IMAGE_ALIASES") {
+		return nil, fmt.Errorf("expected IMAGE_ALIASES config key")
+	}
+
+	aliasNamesSlice := strings.Split(cfg.Get("IMAGE_ALIASES"), ",")
+
+	imageAliases := make(map[string]string, len(aliasNamesSlice))
+
+	for _, aliasName := range aliasNamesSlice {
+		normalizedAliasName := strings.ToUpper(string(nonAlphaNumRegexp.ReplaceAll([]byte(aliasName), []byte("_"))))
+
+		key := fmt.Sprintf("IMAGE_ALIAS_%s", normalizedAliasName)
+		if !cfg.IsSet(key) {
+			return nil, fmt.Errorf("expected image alias %q", aliasName)
+		}
+
+		imageAliases[aliasName] = cfg.Get(key)
+	}
+
+	return imageAliases, nil
+}
+
 func (p *jupiterBrainProvider) Start(ctx context.Context, startAttributes *StartAttributes) (Instance, error) {
 	u, err := p.baseURL.Parse("instances")
 	if err != nil {
 		return nil, err
 	}
 
-	imageName := p.getImageName(startAttributes)
+	alias, imageName, err := p.getImageName(startAttributes)
+	if err != nil {
+		return nil, err
+	}
 
 	if imageName == "" {
 		return nil, fmt.Errorf("no image alias for %#v", startAttributes)
 	}
 
 	workerctx.LoggerFromContext(ctx).WithFields(logrus.Fields{
-		"image_name": imageName,
-		"osx_image":  startAttributes.OsxImage,
-		"language":   startAttributes.Language,
-		"dist":       startAttributes.Dist,
-		"group":      startAttributes.Group,
-		"os":         startAttributes.OS,
+		"image_name":    imageName,
+		"alias":         alias,
+		"selector_type": p.imageSelectorType,
+		"osx_image":     startAttributes.OsxImage,
+		"language":      startAttributes.Language,
+		"dist":          startAttributes.Dist,
+		"group":         startAttributes.Group,
+		"os":            startAttributes.OS,
 	}).Info("selected image name")
 
 	startBooting := time.Now()
@@ -218,106 +331,112 @@ func (p *jupiterBrainProvider) Start(ctx context.Context, startAttributes *Start
 	}
 
 	payload := dataPayload.Data[0]
+	metrics.TimeSince("worker.vm.provider.jupiterbrain.boot.create", startBooting)
 
-	instanceReady := make(chan *jupiterBrainInstancePayload, 1)
-	errChan := make(chan error, 1)
-	go func(id string) {
-		u, err := p.baseURL.Parse(fmt.Sprintf("instances/%s", url.QueryEscape(id)))
-		if err != nil {
-			errChan <- err
-			return
+	err = p.waitForInstance(ctx, payload)
+	if err != nil {
+		if err == context.DeadlineExceeded {
+			metrics.Mark("worker.vm.provider.jupiterbrain.boot.timeout")
+		}
+
+		instance := &jupiterBrainInstance{
+			payload:  payload,
+			provider: p,
 		}
+		instance.Stop(ctx)
+
+		return nil, err
+	}
 
+	metrics.TimeSince("worker.vm.provider.jupiterbrain.boot", startBooting)
+	normalizedImageName := string(metricNameCleanRegexp.ReplaceAll([]byte(imageName), []byte("-")))
+	metrics.TimeSince(fmt.Sprintf("worker.vm.provider.jupiterbrain.boot.image.%s", normalizedImageName), startBooting)
+	workerctx.LoggerFromContext(ctx).WithField("instance_uuid", payload.ID).Info("booted instance")
+	return &jupiterBrainInstance{
+		payload:  payload,
+		provider: p,
+	}, nil
+}
+
+// waitForInstance polls the instance until it has an IPv4 address, and then
+// its ssh port until it accepts connections, updating the payload with the
+// instance's latest state. It gives up after BOOT_TIMEOUT, if set, or when
+// the context is done.
+func (p *jupiterBrainProvider) waitForInstance(ctx context.Context, payload *jupiterBrainInstancePayload) error {
+	if p.bootTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.bootTimeout)
+		defer cancel()
+	}
+
+	u, err := p.baseURL.Parse(fmt.Sprintf("instances/%s", url.QueryEscape(payload.ID)))
+	if err != nil {
+		return err
+	}
+
+	startWaiting := time.Now()
+	var ip net.IP
+
+	err = pollUntil(ctx, p.bootPollSleep, pollMaxSleep(p.bootPollSleep, jupiterBrainBootPollMaxSleep), func() (bool, error) {
 		req, err := http.NewRequest("GET", u.String(), nil)
 		if err != nil {
-			errChan <- err
-			return
+			return false, err
 		}
 
-		for {
-			resp, err := p.httpDo(req)
-			if err != nil {
-				errChan <- err
-				return
-			}
-
-			if resp.StatusCode != 200 {
-				body, _ := ioutil.ReadAll(resp.Body)
-				errChan <- fmt.Errorf("unknown status code: %d, expected 200 (body: %q)", resp.StatusCode, string(body))
-				return
-			}
-
-			dataPayload := &jupiterBrainDataResponse{}
-			err = json.NewDecoder(resp.Body).Decode(dataPayload)
-			if err != nil {
-				errChan <- fmt.Errorf("couldn't decode refresh payload: %s", err)
-				return
-			}
-			payload := dataPayload.Data[0]
-
-			_, _ = io.Copy(ioutil.Discard, resp.Body)
-			_ = resp.Body.Close()
-
-			var ip net.IP
-			for _, ipString := range payload.IPAddresses {
-				curIP := net.ParseIP(ipString)
-				if curIP.To4() != nil {
-					ip = curIP
-					break
-				}
-
-			}
-
-			if ip == nil {
-				time.Sleep(p.bootPollSleep)
-				continue
-			}
-
-			conn, err := net.Dial("tcp", fmt.Sprintf("%s:22", ip.String()))
-			if conn != nil {
-				conn.Close()
-			}
-
-			if err == nil {
-				instanceReady <- payload
-				return
-			}
-
-			time.Sleep(p.bootPollSleep)
+		resp, err := p.httpDo(req)
+		if err != nil {
+			return false, err
 		}
-	}(payload.ID)
+		defer resp.Body.Close()
+		defer io.Copy(ioutil.Discard, resp.Body)
 
-	select {
-	case payload := <-instanceReady:
-		metrics.TimeSince("worker.vm.provider.jupiterbrain.boot", startBooting)
-		normalizedImageName := string(metricNameCleanRegexp.ReplaceAll([]byte(imageName), []byte("-")))
-		metrics.TimeSince(fmt.Sprintf("worker.vm.provider.jupiterbrain.boot.image.%s", normalizedImageName), startBooting)
-		workerctx.LoggerFromContext(ctx).WithField("instance_uuid", payload.ID).Info("booted instance")
-		return &jupiterBrainInstance{
-			payload:  payload,
-			provider: p,
-		}, nil
-	case err := <-errChan:
-		instance := &jupiterBrainInstance{
-			payload:  payload,
-			provider: p,
+		if resp.StatusCode != 200 {
+			body, _ := ioutil.ReadAll(resp.Body)
+			return false, fmt.Errorf("unknown status code: %d, expected 200 (body: %q)", resp.StatusCode, string(body))
 		}
-		instance.Stop(ctx)
 
-		return nil, err
-	case <-ctx.Done():
-		if ctx.Err() == context.DeadlineExceeded {
-			metrics.Mark("worker.vm.provider.jupiterbrain.boot.timeout")
+		dataPayload := &jupiterBrainDataResponse{}
+		err = json.NewDecoder(resp.Body).Decode(dataPayload)
+		if err != nil {
+			return false, fmt.Errorf("couldn't decode refresh payload: %s", err)
 		}
+		*payload = *dataPayload.Data[0]
 
-		instance := &jupiterBrainInstance{
-			payload:  payload,
-			provider: p,
+		ip = payload.ipv4()
+		return ip != nil, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	metrics.TimeSince("worker.vm.provider.jupiterbrain.boot.ip.wait", startWaiting)
+	startSSHWait := time.Now()
+
+	err = pollUntil(ctx, p.bootPollSleep, pollMaxSleep(p.bootPollSleep, jupiterBrainBootPollMaxSleep), func() (bool, error) {
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(ip.String(), strconv.Itoa(p.sshPort)), jupiterBrainSSHDialTimeout)
+		if conn != nil {
+			conn.Close()
 		}
-		instance.Stop(ctx)
+		return err == nil, nil
+	})
+	if err != nil {
+		return err
+	}
 
-		return nil, ctx.Err()
+	metrics.TimeSince("worker.vm.provider.jupiterbrain.boot.ssh.wait", startSSHWait)
+	return nil
+}
+
+// ipv4 returns the instance's first IPv4 address, or nil if it has none.
+func (payload *jupiterBrainInstancePayload) ipv4() net.IP {
+	for _, ipString := range payload.IPAddresses {
+		ip := net.ParseIP(ipString)
+		if ip.To4() != nil {
+			return ip
+		}
 	}
+
+	return nil
 }
 
 func (p *jupiterBrainProvider) Setup() error {
@@ -346,11 +465,10 @@ func (p *jupiterBrainProvider) httpDo(req *http.Request) (*http.Response, error)
 }
 
 func (i *jupiterBrainInstance) UploadScript(ctx context.Context, script []byte) error {
-	client, err := i.sshClient()
+	client, err := i.sshClient(ctx)
 	if err != nil {
 		return err
 	}
-	defer client.Close()
 
 	sftp, err := sftp.NewClient(client)
 	if err != nil {
@@ -368,7 +486,7 @@ func (i *jupiterBrainInstance) UploadScript(ctx context.Context, script []byte)
 		return err
 	}
 
-	_, err = f.Write(script)
+	err = sftpWriteFile(f, script, 0755)
 	if err != nil {
 		return err
 	}
@@ -378,57 +496,133 @@ func (i *jupiterBrainInstance) UploadScript(ctx context.Context, script []byte)
 		return err
 	}
 
-	_, err = fmt.Fprintf(f, wrapperSh)
+	return sftpWriteFile(f, []byte(wrapperSh), 0755)
+}
+
+// RunScript runs the wrapper script, which waits for the build to finish. If
+// the connection is lost once the wrapper started, it reconnects and keeps
+// waiting for the build if it's still running.
+func (i *jupiterBrainInstance) RunScript(ctx context.Context, output io.Writer) (*RunResult, error) {
+	started, err := i.runCommand(ctx, jupiterBrainRunCmd, output)
+
+	for reconnects := 0; started && jupiterBrainConnectionLost(err) && ctx.Err() == nil; reconnects++ {
+		if reconnects == jupiterBrainRunReconnects {
+			metrics.Mark("worker.vm.provider.jupiterbrain.run.reconnect.exhausted")
+			break
+		}
+
+		metrics.Mark("worker.vm.provider.jupiterbrain.run.reconnect")
+		workerctx.LoggerFromContext(ctx).WithFields(logrus.Fields{
+			"err":        err,
+			"reconnects": reconnects,
+		}).Warn("lost connection while running script, reconnecting")
+		fmt.Fprint(output, "\n\nLost the connection to the VM, reconnecting to wait for the build to finish. Output written in the meantime is missing from this log.\n\n")
 
+		err = i.resume(ctx, output)
+	}
+
+	if ctx.Err() != nil {
+		return &RunResult{Completed: false}, ctx.Err()
+	}
+
+	if err == nil {
+		return &RunResult{Completed: true, ExitCode: 0}, nil
+	}
+
+	switch err := err.(type) {
+	case *ssh.ExitError:
+		return &RunResult{Completed: true, ExitCode: uint8(err.ExitStatus())}, nil
+	default:
+		return &RunResult{Completed: false}, err
+	}
+}
+
+// resume waits for the build to finish after the connection running the
+// wrapper script was lost, failing if it stopped running.
+func (i *jupiterBrainInstance) resume(ctx context.Context, output io.Writer) error {
+	_, err := i.runCommand(ctx, jupiterBrainResumeCheckCmd, ioutil.Discard)
+	if _, ok := err.(*ssh.ExitError); ok {
+		metrics.Mark("worker.vm.provider.jupiterbrain.run.lost")
+		return errJupiterBrainBuildLost
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = i.runCommand(ctx, jupiterBrainResumeCmd, output)
 	return err
 }
 
-func (i *jupiterBrainInstance) RunScript(ctx context.Context, output io.Writer) (*RunResult, error) {
-	client, err := i.sshClient()
+// runCommand runs the command in a PTY, writing its output to output, and
+// returns whether the command was started and the error waiting for it. The
+// connection is dropped if the command didn't exit normally, as that's
+// usually because it was lost.
+func (i *jupiterBrainInstance) runCommand(ctx context.Context, cmd string, output io.Writer) (bool, error) {
+	client, err := i.sshClient(ctx)
 	if err != nil {
-		return &RunResult{Completed: false}, err
+		return false, err
 	}
-	defer client.Close()
 
 	session, err := client.NewSession()
 	if err != nil {
-		return &RunResult{Completed: false}, err
+		i.dropSSHClient(client)
+		return false, err
 	}
 	defer session.Close()
 
 	err = session.RequestPty("xterm", 80, 40, ssh.TerminalModes{})
 	if err != nil {
-		return &RunResult{Completed: false}, err
+		return false, err
 	}
 
-	session.Stdout = output
-	session.Stderr = output
+	// stdout and stderr are copied by separate goroutines
+	syncedOutput := &syncWriter{w: output}
+	session.Stdout = syncedOutput
+	session.Stderr = syncedOutput
 
-	errChan := make(chan error)
+	err = session.Start(cmd)
+	if err != nil {
+		return false, err
+	}
 
+	errChan := make(chan error, 1)
 	go func() {
-		errChan <- session.Run("bash ~/wrapper.sh")
+		errChan <- session.Wait()
 	}()
 
 	select {
 	case <-ctx.Done():
-		return &RunResult{Completed: false}, ctx.Err()
+		return true, ctx.Err()
 	case err = <-errChan:
 	}
 
-	if err == nil {
-		return &RunResult{Completed: true, ExitCode: 0}, nil
+	if _, ok := err.(*ssh.ExitError); err != nil && !ok {
+		i.dropSSHClient(client)
 	}
 
-	switch err := err.(type) {
-	case *ssh.ExitError:
-		return &RunResult{Completed: true, ExitCode: uint8(err.ExitStatus())}, nil
+	return true, err
+}
+
+// jupiterBrainConnectionLost says whether running a command failed because
+// the connection was lost, or couldn't be made again, rather than because the
+// command exited with an error or the server refused the key.
+func jupiterBrainConnectionLost(err error) bool {
+	switch err.(type) {
+	case nil, *ssh.ExitError, *sshAuthError, *sshHostKeyError:
+		return false
 	default:
-		return &RunResult{Completed: false}, err
+		return err != errJupiterBrainBuildLost
 	}
 }
 
 func (i *jupiterBrainInstance) Stop(ctx context.Context) error {
+	i.clientMutex.Lock()
+	if i.client != nil {
+		_ = i.client.Close()
+		i.client = nil
+	}
+	i.clientMutex.Unlock()
+
 	u, err := i.provider.baseURL.Parse(fmt.Sprintf("instances/%s", url.QueryEscape(i.payload.ID)))
 	if err != nil {
 		return err
@@ -452,55 +646,101 @@ func (i *jupiterBrainInstance) ID() string {
 	return fmt.Sprintf("%s:%s", i.payload.ID, i.payload.BaseImage)
 }
 
-func (i *jupiterBrainInstance) sshClient() (*ssh.Client, error) {
-	file, err := ioutil.ReadFile(i.provider.sshKeyPath)
+// sshClient returns the instance's ssh connection, dialing it if there is
+// none yet or the last one was lost.
+func (i *jupiterBrainInstance) sshClient(ctx context.Context) (*ssh.Client, error) {
+	i.clientMutex.Lock()
+	defer i.clientMutex.Unlock()
+
+	if i.client != nil {
+		return i.client, nil
+	}
+
+	signer, err := i.provider.sshSigner()
 	if err != nil {
 		return nil, err
 	}
 
-	block, _ := pem.Decode(file)
-	if block == nil {
-		return nil, fmt.Errorf("ssh key does not contain a valid PEM block")
+	ip := i.payload.ipv4()
+	if ip == nil {
+		return nil, fmt.Errorf("no valid IPv4 address")
 	}
 
-	der, err := x509.DecryptPEMBlock(block, []byte(i.provider.sshKeyPassphrase))
+	client, err := i.provider.sshDialer.Dial(ctx, net.JoinHostPort(ip.String(), strconv.Itoa(i.provider.sshPort)), &ssh.ClientConfig{
+		User: "travis",
+		Auth: []ssh.AuthMethod{
+			ssh.PublicKeys(signer),
+		},
+	})
 	if err != nil {
+		metrics.Mark("worker.vm.provider.jupiterbrain.ssh.dial_error")
 		return nil, err
 	}
 
-	key, err := x509.ParsePKCS1PrivateKey(der)
-	if err != nil {
-		return nil, err
+	i.client = client
+	go func() {
+		_ = client.Wait()
+		i.dropSSHClient(client)
+	}()
+
+	return client, nil
+}
+
+// dropSSHClient closes the connection, and forgets it if it's still the
+// instance's so that the next one is dialed again.
+func (i *jupiterBrainInstance) dropSSHClient(client *ssh.Client) {
+	i.clientMutex.Lock()
+	defer i.clientMutex.Unlock()
+
+	if i.client == client {
+		i.client = nil
 	}
+	_ = client.Close()
+}
 
-	signer, err := ssh.NewSignerFromKey(key)
+// sshSigner reads the ssh key, decrypting it with SSH_KEY_PASSPHRASE.
+func (p *jupiterBrainProvider) sshSigner() (ssh.Signer, error) {
+	file, err := ioutil.ReadFile(p.sshKeyPath)
 	if err != nil {
 		return nil, err
 	}
 
-	var ip net.IP
-	for _, ipString := range i.payload.IPAddresses {
-		curIP := net.ParseIP(ipString)
-		if curIP.To4() != nil {
-			ip = curIP
-			break
-		}
+	block, _ := pem.Decode(file)
+	if block == nil {
+		return nil, fmt.Errorf("ssh key does not contain a valid PEM block")
+	}
 
+	der, err := x509.DecryptPEMBlock(block, []byte(p.sshKeyPassphrase))
+	if err != nil {
+		return nil, err
 	}
 
-	if ip == nil {
-		return nil, fmt.Errorf("no valid IPv4 address")
+	key, err := x509.ParsePKCS1PrivateKey(der)
+	if err != nil {
+		return nil, err
 	}
 
-	return ssh.Dial("tcp", fmt.Sprintf("%s:22", ip.String()), &ssh.ClientConfig{
-		User: "travis",
-		Auth: []ssh.AuthMethod{
-			ssh.PublicKeys(signer),
-		},
-	})
+	return ssh.NewSignerFromKey(key)
 }
 
-func (p *jupiterBrainProvider) getImageName(startAttributes *StartAttributes) string {
+// getImageName returns the alias that matched the job and its image, which
+// is empty if no alias matched.
+func (p *jupiterBrainProvider) getImageName(startAttributes *StartAttributes) (string, string, error) {
+	if p.imageSelector != nil {
+		alias, imageName, err := p.imageSelector.SelectAlias(&image.Params{
+			Infra:    "jupiterbrain",
+			Language: startAttributes.Language,
+			OsxImage: startAttributes.OsxImage,
+			Dist:     startAttributes.Dist,
+			Group:    startAttributes.Group,
+			OS:       startAttributes.OS,
+		})
+		if err != nil || imageName == "default" {
+			return alias, "", err
+		}
+		return alias, imageName, nil
+	}
+
 	for _, key := range []string{
 		startAttributes.OsxImage,
 		fmt.Sprintf("osx_image_%s", startAttributes.OsxImage),
@@ -514,9 +754,9 @@ func (p *jupiterBrainProvider) getImageName(startAttributes *StartAttributes) st
 	} {
 		imageName, ok := p.imageAliases[key]
 		if ok {
-			return imageName
+			return key, imageName, nil
 		}
 	}
 
-	return ""
+	return "", "", nil
 }
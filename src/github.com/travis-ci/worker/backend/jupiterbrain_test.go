@@ -0,0 +1,198 @@
+package backend
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/travis-ci/worker/config"
+	"golang.org/x/crypto/ssh"
+	gocontext "golang.org/x/net/context"
+)
+
+func jupiterBrainTestProvider(t *testing.T, cfg map[string]string) (*jupiterBrainProvider, error) {
+	providerCfg := config.ProviderConfigFromMap(map[string]string{
+		"ENDPOINT":           "http://jupiter-brain.example.com",
+		"SSH_KEY_PATH":       "/dev/null",
+		"SSH_KEY_PASSPHRASE": "secret",
+		"KEYCHAIN_PASSWORD":  "secret",
+	})
+	for key, value := range cfg {
+		providerCfg.Set(key, value)
+	}
+
+	p, err := newJupiterBrainProvider(providerCfg)
+	if err != nil {
+		return nil, err
+	}
+	return p.(*jupiterBrainProvider), nil
+}
+
+func TestJupiterBrainProvider_getImageNameLegacy(t *testing.T) {
+	_, err := jupiterBrainTestProvider(t, nil)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, "expected IMAGE_ALIASES config key", err.Error())
+	}
+
+	p, err := jupiterBrainTestProvider(t, map[string]string{
+		"IMAGE_ALIASES":                "osx_image_xcode9,default_osx",
+		"IMAGE_ALIAS_OSX_IMAGE_XCODE9": "travis-ci-macos10.12-xcode9",
+		"IMAGE_ALIAS_DEFAULT_OSX":      "travis-ci-macos10.12-xcode8.3",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alias, imageName, err := p.getImageName(&StartAttributes{OS: "osx", OsxImage: "xcode9"})
+	assert.Nil(t, err)
+	assert.Equal(t, "osx_image_xcode9", alias)
+	assert.Equal(t, "travis-ci-macos10.12-xcode9", imageName)
+
+	alias, imageName, err = p.getImageName(&StartAttributes{OS: "osx", OsxImage: "xcode7"})
+	assert.Nil(t, err)
+	assert.Equal(t, "default_osx", alias)
+	assert.Equal(t, "travis-ci-macos10.12-xcode8.3", imageName)
+}
+
+func TestJupiterBrainProvider_getImageNameEnv(t *testing.T) {
+	p, err := jupiterBrainTestProvider(t, map[string]string{
+		"IMAGE_SELECTOR_TYPE":          "env",
+		"IMAGE_ALIASES":                "osx_image_xcode9",
+		"IMAGE_ALIAS_OSX_IMAGE_XCODE9": "travis-ci-macos10.12-xcode9",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alias, imageName, err := p.getImageName(&StartAttributes{OS: "osx", OsxImage: "xcode9", Language: "objective-c"})
+	assert.Nil(t, err)
+	assert.Equal(t, "osx_image_xcode9", alias)
+	assert.Equal(t, "travis-ci-macos10.12-xcode9", imageName)
+
+	_, imageName, err = p.getImageName(&StartAttributes{OS: "osx", OsxImage: "xcode7", Language: "objective-c"})
+	assert.Nil(t, err)
+	assert.Equal(t, "", imageName)
+
+	p, err = jupiterBrainTestProvider(t, map[string]string{
+		"IMAGE_SELECTOR_TYPE": "env",
+		"IMAGE_DEFAULT":       "travis-ci-macos10.12-xcode8.3",
+	})
+	if assert.Nil(t, err) {
+		alias, imageName, err = p.getImageName(&StartAttributes{OS: "osx", OsxImage: "xcode7", Language: "objective-c"})
+		assert.Nil(t, err)
+		assert.Equal(t, "default", alias)
+		assert.Equal(t, "travis-ci-macos10.12-xcode8.3", imageName)
+	}
+
+	_, err = jupiterBrainTestProvider(t, map[string]string{"IMAGE_SELECTOR_TYPE": "api"})
+	if assert.NotNil(t, err) {
+		assert.Equal(t, `invalid image selector type "api"`, err.Error())
+	}
+}
+
+// jupiterBrainTestInstance returns an instance on a test ssh server, which
+// calls the handlers in turn for the commands run on it.
+func jupiterBrainTestInstance(t *testing.T, handlers ...func(ssh.Channel)) *jupiterBrainInstance {
+	keyFile, err := ioutil.TempFile("", "travis-worker-jupiterbrain-test")
+	require.Nil(t, err)
+	defer keyFile.Close()
+
+	_, err = keyFile.WriteString(gceTestSSHKey)
+	require.Nil(t, err)
+
+	p, err := jupiterBrainTestProvider(t, map[string]string{
+		"IMAGE_SELECTOR_TYPE": "env",
+		"IMAGE_DEFAULT":       "travis-ci-macos10.12-xcode8.3",
+		"SSH_KEY_PATH":        keyFile.Name(),
+		"SSH_KEY_PASSPHRASE":  gceTestSSHKeyPassphrase,
+	})
+	require.Nil(t, err)
+
+	signer, err := p.sshSigner()
+	require.Nil(t, err)
+
+	var mutex sync.Mutex
+	execs := 0
+	listener := sshTestExecServer(t, signer.PublicKey(), func(ch ssh.Channel) {
+		mutex.Lock()
+		handler := handlers[execs]
+		execs++
+		mutex.Unlock()
+
+		handler(ch)
+	})
+
+	_, port, err := net.SplitHostPort(listener.Addr().String())
+	require.Nil(t, err)
+	p.sshPort, err = strconv.Atoi(port)
+	require.Nil(t, err)
+
+	return &jupiterBrainInstance{
+		payload:  &jupiterBrainInstancePayload{IPAddresses: []string{"127.0.0.1"}},
+		provider: p,
+	}
+}
+
+func jupiterBrainTestExit(status uint32) func(ssh.Channel) {
+	return func(ch ssh.Channel) {
+		_, _ = ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+	}
+}
+
+func TestJupiterBrainInstance_sshClientReused(t *testing.T) {
+	i := jupiterBrainTestInstance(t)
+	defer os.Remove(i.provider.sshKeyPath)
+
+	client, err := i.sshClient(gocontext.TODO())
+	require.Nil(t, err)
+
+	again, err := i.sshClient(gocontext.TODO())
+	require.Nil(t, err)
+	assert.True(t, client == again)
+
+	// a lost connection is dialed again
+	i.dropSSHClient(client)
+
+	again, err = i.sshClient(gocontext.TODO())
+	require.Nil(t, err)
+	assert.False(t, client == again)
+
+	assert.Nil(t, again.Close())
+}
+
+func TestJupiterBrainInstance_RunScriptResumes(t *testing.T) {
+	i := jupiterBrainTestInstance(t,
+		// the connection is lost without an exit status
+		func(ch ssh.Channel) {},
+		// the build is still running
+		jupiterBrainTestExit(0),
+		jupiterBrainTestExit(3),
+	)
+	defer os.Remove(i.provider.sshKeyPath)
+
+	output := &bytes.Buffer{}
+	result, err := i.RunScript(gocontext.TODO(), output)
+	require.Nil(t, err)
+	assert.True(t, result.Completed)
+	assert.Equal(t, uint8(3), result.ExitCode)
+	assert.Contains(t, output.String(), "Lost the connection to the VM")
+}
+
+func TestJupiterBrainInstance_RunScriptBuildLost(t *testing.T) {
+	i := jupiterBrainTestInstance(t,
+		func(ch ssh.Channel) {},
+		// the build isn't running anymore
+		jupiterBrainTestExit(1),
+	)
+	defer os.Remove(i.provider.sshKeyPath)
+
+	result, err := i.RunScript(gocontext.TODO(), ioutil.Discard)
+	assert.Equal(t, errJupiterBrainBuildLost, err)
+	assert.False(t, result.Completed)
+}
@@ -0,0 +1,1086 @@
+package backend
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pborman/uuid"
+	"github.com/travis-ci/worker/config"
+	"github.com/travis-ci/worker/context"
+	"github.com/travis-ci/worker/image"
+	"github.com/travis-ci/worker/metrics"
+	gocontext "golang.org/x/net/context"
+)
+
+const (
+	defaultKubernetesNamespace     = "default"
+	defaultKubernetesBootPollSleep = 3 * time.Second
+	defaultKubernetesGracePeriod   = 30 * time.Second
+	kubernetesBootPollMaxSleep     = 15 * time.Second
+	kubernetesCleanupTimeout       = time.Minute
+	kubernetesDialTimeout          = 30 * time.Second
+	kubernetesPodNamePrefix        = "travis-job-"
+	kubernetesContainerName        = "build"
+	kubernetesScriptPath           = "$HOME/build.sh"
+	kubernetesStaleScriptExitCode  = 3
+	kubernetesUploadChunkSize      = 32 << 10
+
+	// kubernetesExecProtocol is the websocket subprotocol of the exec
+	// subresource, whose messages start with the number of the stream they
+	// belong to, and where the error stream ends with the command's status.
+	kubernetesExecProtocol = "v4.channel.k8s.io"
+	kubernetesStreamStdin  = 0
+	kubernetesStreamStdout = 1
+	kubernetesStreamStderr = 2
+	kubernetesStreamError  = 3
+)
+
+var (
+	kubernetesHelp = map[string]string{
+		"KUBECONFIG":            "path to a kubeconfig in JSON form, e.g. written by kubectl config view --raw --minify -o json, whose current context is used; required unless IN_CLUSTER is true",
+		"IN_CLUSTER":            "authenticate with the service account of the pod the worker runs in instead of KUBECONFIG (default false)",
+		"NAMESPACE":             "namespace in which pods are created (default the namespace of the kubeconfig's context or the worker's pod, or \"default\")",
+		"IMAGE_[ALIAS_]{ALIAS}": "image for a given alias, like for gce",
+		"IMAGE_DEFAULT":         "image used when no alias matches the job (default none, erroring the job)",
+		"IMAGE_PULL_SECRET":     "name of the secret used to pull images (default none)",
+		"CPU_REQUEST":           "CPU requested for every pod, e.g. 2 or 1500m (default none)",
+		"CPU_LIMIT":             "CPU limit of every pod (default none)",
+		"MEMORY_REQUEST":        "memory requested for every pod, e.g. 4Gi (default none)",
+		"MEMORY_LIMIT":          "memory limit of every pod (default none)",
+		"NODE_SELECTOR":         "comma-delimited key=value labels of the nodes pods may be scheduled on (default any node)",
+		"TOLERATIONS":           "comma-delimited key[=value]:effect taints that pods tolerate, e.g. dedicated=builds:NoSchedule (default none)",
+		"BOOT_POLL_SLEEP":       fmt.Sprintf("initial sleep interval between polling pods for their status while starting, backing off with jitter up to %v or this if longer (default %v)", kubernetesBootPollMaxSleep, defaultKubernetesBootPollSleep),
+		"BOOT_TIMEOUT":          "how long to wait for a pod to be running, bounded by the worker's start timeout (default the start timeout)",
+		"DELETE_GRACE_PERIOD":   fmt.Sprintf("how long pods are given to stop when they're deleted (default %v)", defaultKubernetesGracePeriod),
+	}
+
+	kubernetesNameRegexp     = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+	kubernetesQuantityRegexp = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?(m|k|M|G|T|P|E|Ki|Mi|Gi|Ti|Pi|Ei)?$`)
+	kubernetesTaintEffects   = map[string]bool{
+		"NoSchedule":       true,
+		"PreferNoSchedule": true,
+		"NoExecute":        true,
+	}
+
+	// the container only keeps the pod running, the script is uploaded and
+	// run through the exec subresource, and it exits right away when the
+	// pod is deleted
+	kubernetesIdleCommand = []string{
+		"/bin/sh", "-c",
+		"trap 'exit 0' TERM; while true; do sleep 1; done",
+	}
+
+	kubernetesScriptCommand = []string{
+		"/bin/bash", "-c",
+		fmt.Sprintf(`exec bash "%s"`, kubernetesScriptPath),
+	}
+
+	// errKubernetesExitMissing is returned by exec when the stream ended
+	// without the command's status, e.g. because the pod was deleted.
+	errKubernetesExitMissing = fmt.Errorf("exec stream ended without an exit status")
+
+	// kubernetesServiceAccountDir is where the credentials of the pod's
+	// service account are mounted when running in a cluster.
+	kubernetesServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+)
+
+func init() {
+	Register("kubernetes", "Kubernetes", kubernetesHelp, newKubernetesProvider)
+}
+
+type kubernetesProvider struct {
+	client    *kubernetesClient
+	namespace string
+
+	imageSelector   *image.EnvSelector
+	imagePullSecret string
+	resources       kubernetesResources
+	nodeSelector    map[string]string
+	tolerations     []kubernetesToleration
+
+	bootPollSleep time.Duration
+	bootTimeout   time.Duration
+	gracePeriod   time.Duration
+}
+
+type kubernetesInstance struct {
+	provider *kubernetesProvider
+	pod      *kubernetesPod
+}
+
+func newKubernetesProvider(cfg *config.ProviderConfig) (Provider, error) {
+	inCluster := false
+	if cfg.IsSet("IN_CLUSTER") {
+		var err error
+		inCluster, err = strconv.ParseBool(cfg.Get("IN_CLUSTER"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid IN_CLUSTER %q: %v", cfg.Get("IN_CLUSTER"), err)
+		}
+	}
+
+	var (
+		client    *kubernetesClient
+		namespace string
+		err       error
+	)
+
+	switch {
+	case inCluster:
+		client, namespace, err = kubernetesInClusterClient()
+	case cfg.IsSet("KUBECONFIG"):
+		client, namespace, err = kubernetesKubeconfigClient(cfg.Get("KUBECONFIG"))
+	default:
+		err = fmt.Errorf("expected KUBECONFIG config key or IN_CLUSTER=true")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.IsSet("NAMESPACE") {
+		namespace = cfg.Get("NAMESPACE")
+	}
+	if namespace == "" {
+		namespace = defaultKubernetesNamespace
+	}
+	if !kubernetesNameRegexp.MatchString(namespace) {
+		return nil, fmt.Errorf("invalid NAMESPACE %q", namespace)
+	}
+
+	imageSelector, err := image.NewEnvSelector(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	resources := kubernetesResources{}
+	for _, resource := range []struct {
+		key        string
+		name       string
+		quantities *map[string]string
+	}{
+		{"CPU_REQUEST", "cpu", &resources.Requests},
+		{"CPU_LIMIT", "cpu", &resources.Limits},
+		{"MEMORY_REQUEST", "memory", &resources.Requests},
+		{"MEMORY_LIMIT", "memory", &resources.Limits},
+	} {
+		if !cfg.IsSet(resource.key) {
+			continue
+		}
+
+		quantity := cfg.Get(resource.key)
+		if !kubernetesQuantityRegexp.MatchString(quantity) {
+			return nil, fmt.Errorf("invalid %s %q, expected a quantity like 2, 500m or 4Gi", resource.key, quantity)
+		}
+
+		if *resource.quantities == nil {
+			*resource.quantities = map[string]string{}
+		}
+		(*resource.quantities)[resource.name] = quantity
+	}
+
+	nodeSelector := map[string]string{}
+	if cfg.IsSet("NODE_SELECTOR") {
+		nodeSelector, err = parseKubernetesNodeSelector(cfg.Get("NODE_SELECTOR"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	tolerations := []kubernetesToleration{}
+	if cfg.IsSet("TOLERATIONS") {
+		tolerations, err = parseKubernetesTolerations(cfg.Get("TOLERATIONS"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	bootPollSleep := defaultKubernetesBootPollSleep
+	if cfg.IsSet("BOOT_POLL_SLEEP") {
+		bootPollSleep, err = time.ParseDuration(cfg.Get("BOOT_POLL_SLEEP"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid BOOT_POLL_SLEEP %q: %v", cfg.Get("BOOT_POLL_SLEEP"), err)
+		}
+	}
+
+	bootTimeout := time.Duration(0)
+	if cfg.IsSet("BOOT_TIMEOUT") {
+		bootTimeout, err = time.ParseDuration(cfg.Get("BOOT_TIMEOUT"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid BOOT_TIMEOUT %q: %v", cfg.Get("BOOT_TIMEOUT"), err)
+		}
+	}
+
+	gracePeriod := defaultKubernetesGracePeriod
+	if cfg.IsSet("DELETE_GRACE_PERIOD") {
+		gracePeriod, err = time.ParseDuration(cfg.Get("DELETE_GRACE_PERIOD"))
+		if err != nil || gracePeriod < 0 {
+			return nil, fmt.Errorf("invalid DELETE_GRACE_PERIOD %q", cfg.Get("DELETE_GRACE_PERIOD"))
+		}
+	}
+
+	return &kubernetesProvider{
+		client:    client,
+		namespace: namespace,
+
+		imageSelector:   imageSelector,
+		imagePullSecret: cfg.Get("IMAGE_PULL_SECRET"),
+		resources:       resources,
+		nodeSelector:    nodeSelector,
+		tolerations:     tolerations,
+
+		bootPollSleep: bootPollSleep,
+		bootTimeout:   bootTimeout,
+		gracePeriod:   gracePeriod,
+	}, nil
+}
+
+// parseKubernetesNodeSelector parses comma-delimited key=value labels.
+func parseKubernetesNodeSelector(s string) (map[string]string, error) {
+	nodeSelector := map[string]string{}
+	for _, label := range strings.Split(s, ",") {
+		label = strings.TrimSpace(label)
+		if label == "" {
+			continue
+		}
+
+		parts := strings.SplitN(label, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid NODE_SELECTOR label %q, expected key=value", label)
+		}
+
+		nodeSelector[parts[0]] = parts[1]
+	}
+
+	return nodeSelector, nil
+}
+
+// parseKubernetesTolerations parses comma-delimited key[=value]:effect
+// tolerations, where a toleration without a value tolerates the key's taint
+// with any value.
+func parseKubernetesTolerations(s string) ([]kubernetesToleration, error) {
+	tolerations := []kubernetesToleration{}
+	for _, toleration := range strings.Split(s, ",") {
+		toleration = strings.TrimSpace(toleration)
+		if toleration == "" {
+			continue
+		}
+
+		colon := strings.LastIndex(toleration, ":")
+		if colon == -1 || !kubernetesTaintEffects[toleration[colon+1:]] {
+			return nil, fmt.Errorf("invalid TOLERATIONS entry %q, expected key[=value]:effect with an effect of NoSchedule, PreferNoSchedule or NoExecute", toleration)
+		}
+
+		t := kubernetesToleration{Operator: "Exists", Effect: toleration[colon+1:]}
+		t.Key = toleration[:colon]
+		if equals := strings.Index(t.Key, "="); equals != -1 {
+			t.Key, t.Value = t.Key[:equals], t.Key[equals+1:]
+			t.Operator = "Equal"
+		}
+
+		if t.Key == "" {
+			return nil, fmt.Errorf("invalid TOLERATIONS entry %q, expected key[=value]:effect", toleration)
+		}
+
+		tolerations = append(tolerations, t)
+	}
+
+	return tolerations, nil
+}
+
+func (p *kubernetesProvider) Setup() error { return nil }
+
+func (p *kubernetesProvider) Start(ctx gocontext.Context, startAttributes *StartAttributes) (Instance, error) {
+	logger := context.LoggerFromContext(ctx)
+
+	imageName, err := p.imageSelector.Select(&image.Params{
+		Infra:    "kubernetes",
+		Language: startAttributes.Language,
+		OsxImage: startAttributes.OsxImage,
+		Dist:     startAttributes.Dist,
+		Group:    startAttributes.Group,
+		OS:       startAttributes.OS,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if imageName == "default" {
+		return nil, &StartError{Cause: ErrImageNotFound, Err: fmt.Errorf("no image configured for language %q", startAttributes.Language)}
+	}
+
+	startBooting := time.Now()
+
+	pod := &kubernetesPod{}
+	err = p.client.do(ctx, "POST", p.path("pods", ""), p.podFor(startAttributes, imageName), pod)
+	if err != nil {
+		return nil, kubernetesClassifyStartError(err)
+	}
+
+	instance := &kubernetesInstance{provider: p, pod: pod}
+	logger = logger.WithFields(logrus.Fields{
+		"pod":   pod.Metadata.Name,
+		"image": imageName,
+	})
+
+	err = instance.waitForRunning(ctx)
+	if err != nil {
+		logger.WithField("err", err).Error("couldn't start pod, deleting it")
+		instance.cleanup(ctx)
+		return nil, err
+	}
+
+	metrics.TimeSince("worker.vm.provider.kubernetes.boot", startBooting)
+	logger.WithField("node", instance.pod.Spec.NodeName).Info("pod is running")
+
+	return instance, nil
+}
+
+// kubernetesClassifyStartError wraps errors creating a pod that exceeds a
+// resource quota of the namespace in a *StartError, so that the job is
+// requeued, and returns any other error unchanged.
+func kubernetesClassifyStartError(err error) error {
+	if apiErr, ok := err.(*kubernetesAPIError); ok {
+		if apiErr.StatusCode == http.StatusForbidden && strings.Contains(apiErr.Message, "exceeded quota") {
+			metrics.Mark("worker.vm.provider.kubernetes.boot.quota_exceeded")
+			return &StartError{Cause: ErrQuotaExceeded, Err: err}
+		}
+	}
+
+	return err
+}
+
+// podFor returns the pod that runs the job.
+func (p *kubernetesProvider) podFor(startAttributes *StartAttributes, imageName string) *kubernetesPod {
+	pod := &kubernetesPod{
+		APIVersion: "v1",
+		Kind:       "Pod",
+		Metadata: kubernetesObjectMeta{
+			Name: fmt.Sprintf("%s%s", kubernetesPodNamePrefix, uuid.NewRandom()),
+			Labels: map[string]string{
+				"app":                  "travis-worker",
+				"travis-ci.org/job-id": strconv.FormatUint(startAttributes.JobID, 10),
+			},
+		},
+		Spec: &kubernetesPodSpec{
+			RestartPolicy: "Never",
+			// jobs run untrusted code, which mustn't get the credentials
+			// of the namespace's service account
+			AutomountServiceAccountToken: false,
+			NodeSelector:                 p.nodeSelector,
+			Tolerations:                  p.tolerations,
+			Containers: []kubernetesContainer{
+				{
+					Name:      kubernetesContainerName,
+					Image:     imageName,
+					Command:   kubernetesIdleCommand,
+					Resources: p.resources,
+				},
+			},
+		},
+	}
+
+	if p.imagePullSecret != "" {
+		pod.Spec.ImagePullSecrets = []kubernetesLocalObjectReference{{Name: p.imagePullSecret}}
+	}
+
+	return pod
+}
+
+// waitForRunning polls the pod until it's running. It gives up after
+// BOOT_TIMEOUT, if set, or when the context is done, and as soon as the pod
+// can't be scheduled, so that the job is requeued instead of waiting for
+// capacity.
+func (i *kubernetesInstance) waitForRunning(ctx gocontext.Context) error {
+	bootCtx := ctx
+	if i.provider.bootTimeout > 0 {
+		var cancel gocontext.CancelFunc
+		bootCtx, cancel = gocontext.WithTimeout(ctx, i.provider.bootTimeout)
+		defer cancel()
+	}
+
+	waitingReason := "scheduling"
+	err := pollUntil(bootCtx, i.provider.bootPollSleep, pollMaxSleep(i.provider.bootPollSleep, kubernetesBootPollMaxSleep), func() (bool, error) {
+		err := i.refresh(bootCtx)
+		if err != nil {
+			return false, err
+		}
+
+		status := i.pod.Status
+		switch status.Phase {
+		case "Running":
+			return true, nil
+		case "Succeeded", "Failed":
+			return false, fmt.Errorf("pod %s stopped while starting: %s %s", i.pod.Metadata.Name, status.Reason, status.Message)
+		}
+
+		for _, condition := range status.Conditions {
+			if condition.Type == "PodScheduled" && condition.Status == "False" && condition.Reason == "Unschedulable" {
+				metrics.Mark("worker.vm.provider.kubernetes.boot.unschedulable")
+				return false, &StartError{
+					Cause: ErrResourceExhausted,
+					Err:   fmt.Errorf("pod %s is unschedulable: %s", i.pod.Metadata.Name, condition.Message),
+				}
+			}
+		}
+
+		if containerStatus := i.pod.containerStatus(); containerStatus != nil && containerStatus.State.Waiting != nil {
+			waitingReason = containerStatus.State.Waiting.Reason
+		}
+
+		return false, nil
+	})
+
+	if err != nil && ctx.Err() == nil && bootCtx.Err() != nil {
+		metrics.Mark("worker.vm.provider.kubernetes.boot.timeout")
+		return &StartError{
+			Cause: ErrBootTimeout,
+			Err:   fmt.Errorf("pod %s wasn't running after %v, last waiting for %s", i.pod.Metadata.Name, i.provider.bootTimeout, waitingReason),
+		}
+	}
+
+	return err
+}
+
+// path returns the API path of the resources of the given kind in the
+// provider's namespace, or of the named one.
+func (p *kubernetesProvider) path(resource, name string) string {
+	resourcePath := fmt.Sprintf("/api/v1/namespaces/%s/%s", p.namespace, resource)
+	if name == "" {
+		return resourcePath
+	}
+	return fmt.Sprintf("%s/%s", resourcePath, name)
+}
+
+func (i *kubernetesInstance) refresh(ctx gocontext.Context) error {
+	pod := &kubernetesPod{}
+	err := i.provider.client.do(ctx, "GET", i.provider.path("pods", i.pod.Metadata.Name), nil, pod)
+	if err != nil {
+		return err
+	}
+
+	if pod.Spec == nil {
+		pod.Spec = &kubernetesPodSpec{}
+	}
+	if pod.Status == nil {
+		pod.Status = &kubernetesPodStatus{}
+	}
+
+	i.pod = pod
+	return nil
+}
+
+func (i *kubernetesInstance) UploadScript(ctx gocontext.Context, script []byte) error {
+	// the exec subresource can't close stdin without closing the other
+	// streams, so head reads exactly as many bytes as the script has
+	command := fmt.Sprintf(`[ ! -e "%[1]s" ] || exit %[2]d; head -c %[3]d >"%[1]s.uploading" && chmod 0755 "%[1]s.uploading" && mv "%[1]s.uploading" "%[1]s"`, kubernetesScriptPath, kubernetesStaleScriptExitCode, len(script))
+
+	output := &bytes.Buffer{}
+	exitCode, err := i.exec(ctx, []string{"/bin/sh", "-c", command}, script, output)
+	if err != nil {
+		return err
+	}
+
+	switch exitCode {
+	case 0:
+		return nil
+	case kubernetesStaleScriptExitCode:
+		return ErrStaleVM
+	default:
+		return fmt.Errorf("uploading the script to pod %s exited with %d: %s", i.pod.Metadata.Name, exitCode, strings.TrimSpace(output.String()))
+	}
+}
+
+func (i *kubernetesInstance) RunScript(ctx gocontext.Context, output io.Writer) (*RunResult, error) {
+	startRun := time.Now()
+
+	exitCode, err := i.exec(ctx, kubernetesScriptCommand, nil, output)
+	if ctx.Err() != nil {
+		return i.cancel(ctx, startRun)
+	}
+	if err == errKubernetesExitMissing {
+		metrics.Mark("worker.vm.provider.kubernetes.run.exit_missing")
+		return &RunResult{Reason: RunReasonExitMissing, Duration: time.Since(startRun)}, nil
+	}
+	if err != nil {
+		return &RunResult{Completed: false}, err
+	}
+
+	result := &RunResult{
+		Completed: true,
+		ExitCode:  uint8(exitCode),
+		Duration:  time.Since(startRun),
+	}
+
+	if exitCode > 128 {
+		metrics.Mark("worker.vm.provider.kubernetes.run.signal")
+		result.Reason = RunReasonSignal
+		result.Signal = dockerSignalName(exitCode - 128)
+	}
+
+	return result, nil
+}
+
+// exec runs the command in the pod's build container through the exec
+// subresource, writing stdin, if not nil, to the command's stdin and its
+// stdout and stderr to output, and returns its exit code.
+func (i *kubernetesInstance) exec(ctx gocontext.Context, command []string, stdin []byte, output io.Writer) (int, error) {
+	query := url.Values{}
+	query.Set("container", kubernetesContainerName)
+	query.Set("stdout", "true")
+	query.Set("stderr", "true")
+	if stdin != nil {
+		query.Set("stdin", "true")
+	}
+	for _, arg := range command {
+		query.Add("command", arg)
+	}
+
+	ws, err := i.provider.client.dialWebsocket(fmt.Sprintf("%s/exec?%s", i.provider.path("pods", i.pod.Metadata.Name), query.Encode()))
+	if err != nil {
+		return 0, err
+	}
+	defer ws.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			ws.Close()
+		case <-done:
+		}
+	}()
+
+	if stdin != nil {
+		go func() {
+			for len(stdin) > 0 {
+				n := len(stdin)
+				if n > kubernetesUploadChunkSize {
+					n = kubernetesUploadChunkSize
+				}
+
+				err := ws.WriteMessage(append([]byte{kubernetesStreamStdin}, stdin[:n]...))
+				if err != nil {
+					return
+				}
+				stdin = stdin[n:]
+			}
+		}()
+	}
+
+	for {
+		message, err := ws.ReadMessage()
+		if err == io.EOF {
+			return 0, errKubernetesExitMissing
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		// every stream starts with an empty message
+		if len(message) < 2 {
+			continue
+		}
+
+		switch message[0] {
+		case kubernetesStreamStdout, kubernetesStreamStderr:
+			_, err = output.Write(message[1:])
+			if err != nil {
+				return 0, err
+			}
+		case kubernetesStreamError:
+			return kubernetesExitCode(message[1:])
+		}
+	}
+}
+
+// kubernetesExitCode returns the exit code of a command from the status
+// written to the exec subresource's error stream, or an error if the command
+// couldn't be run at all.
+func kubernetesExitCode(b []byte) (int, error) {
+	status := &kubernetesStatus{}
+	err := json.Unmarshal(b, status)
+	if err != nil {
+		return 0, err
+	}
+
+	if status.Status == "Success" {
+		return 0, nil
+	}
+
+	if status.Reason == "NonZeroExitCode" && status.Details != nil {
+		for _, cause := range status.Details.Causes {
+			if cause.Reason == "ExitCode" {
+				return strconv.Atoi(cause.Message)
+			}
+		}
+	}
+
+	return 0, fmt.Errorf("couldn't exec in pod: %s", status.Message)
+}
+
+// cancel deletes the pod without a grace period when the script was stopped
+// because the context is done.
+func (i *kubernetesInstance) cancel(ctx gocontext.Context, startRun time.Time) (*RunResult, error) {
+	metrics.Mark("worker.vm.provider.kubernetes.run.cancelled")
+	i.cleanup(ctx)
+	return &RunResult{Cancelled: true, Duration: time.Since(startRun)}, ctx.Err()
+}
+
+// cleanup deletes the pod without a grace period, even if the context is
+// already done, logging any error.
+func (i *kubernetesInstance) cleanup(ctx gocontext.Context) {
+	cleanupCtx, cancel := gocontext.WithTimeout(gocontext.Background(), kubernetesCleanupTimeout)
+	defer cancel()
+
+	err := i.delete(cleanupCtx, 0)
+	if err != nil {
+		context.LoggerFromContext(ctx).WithFields(logrus.Fields{
+			"err": err,
+			"pod": i.pod.Metadata.Name,
+		}).Error("couldn't delete pod")
+	}
+}
+
+func (i *kubernetesInstance) delete(ctx gocontext.Context, gracePeriod time.Duration) error {
+	err := i.provider.client.do(ctx, "DELETE", i.provider.path("pods", i.pod.Metadata.Name), &kubernetesDeleteOptions{
+		APIVersion:         "v1",
+		Kind:               "DeleteOptions",
+		GracePeriodSeconds: int64(gracePeriod / time.Second),
+	}, nil)
+	if kubernetesIsNotFound(err) {
+		return nil
+	}
+
+	return err
+}
+
+func (i *kubernetesInstance) Stop(ctx gocontext.Context) error {
+	return i.delete(ctx, i.provider.gracePeriod)
+}
+
+func (i *kubernetesInstance) ID() string {
+	return i.pod.Metadata.Name
+}
+
+// kubernetesClient is a minimal client of the Kubernetes API.
+type kubernetesClient struct {
+	restClient
+
+	token string
+	// tokenPath is read for every request if set, as the service account
+	// tokens mounted into pods are rotated
+	tokenPath string
+}
+
+// kubernetesAPIError is returned for requests that the API didn't respond to
+// with a 2xx status.
+type kubernetesAPIError struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Message    string
+}
+
+func (e *kubernetesAPIError) Error() string {
+	return fmt.Sprintf("kubernetes API returned %d for %s %s: %s", e.StatusCode, e.Method, e.Path, e.Message)
+}
+
+func kubernetesIsNotFound(err error) bool {
+	apiErr, ok := err.(*kubernetesAPIError)
+	return ok && apiErr.StatusCode == http.StatusNotFound
+}
+
+// kubernetesResponseError returns the error for a response without a 2xx
+// status, with the message of the Status the API responded with, if any.
+func kubernetesResponseError(method, path string, statusCode int, body []byte) error {
+	status := &kubernetesStatus{}
+	if json.Unmarshal(body, status) != nil || status.Message == "" {
+		status.Message = strings.TrimSpace(string(body))
+	}
+
+	return &kubernetesAPIError{
+		Method:     method,
+		Path:       path,
+		StatusCode: statusCode,
+		Message:    status.Message,
+	}
+}
+
+// authorize sets the Authorization header for the client's token, if any.
+func (c *kubernetesClient) authorize(header http.Header) error {
+	token := c.token
+	if c.tokenPath != "" {
+		b, err := ioutil.ReadFile(c.tokenPath)
+		if err != nil {
+			return err
+		}
+		token = strings.TrimSpace(string(b))
+	}
+	if token != "" {
+		header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	}
+
+	return nil
+}
+
+// dialWebsocket connects to the websocket of the exec subresource at the
+// given path.
+func (c *kubernetesClient) dialWebsocket(path string) (*websocketConn, error) {
+	u, err := url.Parse(c.baseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	host := u.Host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		port := "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+		host = net.JoinHostPort(host, port)
+	}
+
+	header := http.Header{}
+	header.Set("Sec-WebSocket-Protocol", kubernetesExecProtocol)
+	err = c.authorize(header)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{Timeout: kubernetesDialTimeout}
+	var conn net.Conn
+	if u.Scheme == "https" {
+		// the websocket bypasses the HTTP client, but not its TLS config
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, c.client.Transport.(*http.Transport).TLSClientConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", host)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return newWebsocketConn(conn, u.Host, u.Path+path, header)
+}
+
+// newKubernetesClient returns a client that authorizes its requests with its
+// token and returns API errors as *kubernetesAPIError.
+func newKubernetesClient() *kubernetesClient {
+	c := &kubernetesClient{}
+	c.header = c.authorize
+	c.responseError = kubernetesResponseError
+	return c
+}
+
+// kubernetesInClusterClient returns a client authenticated as the service
+// account of the pod the worker runs in, along with the pod's namespace.
+func kubernetesInClusterClient() (*kubernetesClient, string, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, "", fmt.Errorf("IN_CLUSTER requires KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT, which are set in pods")
+	}
+
+	caPEM, err := ioutil.ReadFile(filepath.Join(kubernetesServiceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, "", err
+	}
+
+	httpClient, err := kubernetesHTTPClient(caPEM, nil, nil, false)
+	if err != nil {
+		return nil, "", err
+	}
+
+	namespace, _ := ioutil.ReadFile(filepath.Join(kubernetesServiceAccountDir, "namespace"))
+
+	client := newKubernetesClient()
+	client.baseURL = fmt.Sprintf("https://%s", net.JoinHostPort(host, port))
+	client.client = httpClient
+	client.tokenPath = filepath.Join(kubernetesServiceAccountDir, "token")
+
+	return client, strings.TrimSpace(string(namespace)), nil
+}
+
+// kubernetesKubeconfig is the part of a kubeconfig that's used to connect to
+// the cluster of its current context. Fields ending in -data are decoded from
+// base64 by encoding/json.
+type kubernetesKubeconfig struct {
+	CurrentContext string `json:"current-context"`
+	Contexts       []struct {
+		Name    string `json:"name"`
+		Context struct {
+			Cluster   string `json:"cluster"`
+			User      string `json:"user"`
+			Namespace string `json:"namespace"`
+		} `json:"context"`
+	} `json:"contexts"`
+	Clusters []struct {
+		Name    string `json:"name"`
+		Cluster struct {
+			Server                   string `json:"server"`
+			CertificateAuthority     string `json:"certificate-authority"`
+			CertificateAuthorityData []byte `json:"certificate-authority-data"`
+			InsecureSkipTLSVerify    bool   `json:"insecure-skip-tls-verify"`
+		} `json:"cluster"`
+	} `json:"clusters"`
+	Users []struct {
+		Name string `json:"name"`
+		User struct {
+			Token                 string `json:"token"`
+			TokenFile             string `json:"tokenFile"`
+			ClientCertificate     string `json:"client-certificate"`
+			ClientCertificateData []byte `json:"client-certificate-data"`
+			ClientKey             string `json:"client-key"`
+			ClientKeyData         []byte `json:"client-key-data"`
+		} `json:"user"`
+	} `json:"users"`
+}
+
+// kubernetesKubeconfigClient returns a client for the current context of the
+// kubeconfig at the given path, along with the context's namespace. Only
+// kubeconfigs in JSON form are supported, as there's no YAML parser vendored.
+func kubernetesKubeconfigClient(kubeconfigPath string) (*kubernetesClient, string, error) {
+	b, err := ioutil.ReadFile(kubeconfigPath)
+	if err != nil {
+		return nil, "", err
+	}
+
+	kubeconfig := &kubernetesKubeconfig{}
+	err = json.Unmarshal(b, kubeconfig)
+	if err != nil {
+		return nil, "", fmt.Errorf("couldn't parse KUBECONFIG %s, which must be in JSON form, e.g. written by kubectl config view --raw --minify -o json: %v", kubeconfigPath, err)
+	}
+
+	// relative paths are relative to the kubeconfig, like for kubectl
+	readFile := func(filePath string) ([]byte, error) {
+		if !filepath.IsAbs(filePath) {
+			filePath = filepath.Join(filepath.Dir(kubeconfigPath), filePath)
+		}
+		return ioutil.ReadFile(filePath)
+	}
+
+	for _, kubeContext := range kubeconfig.Contexts {
+		if kubeContext.Name != kubeconfig.CurrentContext {
+			continue
+		}
+
+		client := newKubernetesClient()
+		var caPEM, certPEM, keyPEM []byte
+		insecure := false
+
+		for _, cluster := range kubeconfig.Clusters {
+			if cluster.Name != kubeContext.Context.Cluster {
+				continue
+			}
+
+			client.baseURL = strings.TrimSuffix(cluster.Cluster.Server, "/")
+			insecure = cluster.Cluster.InsecureSkipTLSVerify
+			caPEM = cluster.Cluster.CertificateAuthorityData
+			if len(caPEM) == 0 && cluster.Cluster.CertificateAuthority != "" {
+				caPEM, err = readFile(cluster.Cluster.CertificateAuthority)
+				if err != nil {
+					return nil, "", err
+				}
+			}
+		}
+
+		if client.baseURL == "" {
+			return nil, "", fmt.Errorf("no server found for cluster %q of context %q in KUBECONFIG %s", kubeContext.Context.Cluster, kubeContext.Name, kubeconfigPath)
+		}
+
+		for _, user := range kubeconfig.Users {
+			if user.Name != kubeContext.Context.User {
+				continue
+			}
+
+			client.token = user.User.Token
+			if client.token == "" && user.User.TokenFile != "" {
+				client.tokenPath = user.User.TokenFile
+				if !filepath.IsAbs(client.tokenPath) {
+					client.tokenPath = filepath.Join(filepath.Dir(kubeconfigPath), client.tokenPath)
+				}
+			}
+
+			certPEM = user.User.ClientCertificateData
+			if len(certPEM) == 0 && user.User.ClientCertificate != "" {
+				certPEM, err = readFile(user.User.ClientCertificate)
+				if err != nil {
+					return nil, "", err
+				}
+			}
+
+			keyPEM = user.User.ClientKeyData
+			if len(keyPEM) == 0 && user.User.ClientKey != "" {
+				keyPEM, err = readFile(user.User.ClientKey)
+				if err != nil {
+					return nil, "", err
+				}
+			}
+		}
+
+		client.client, err = kubernetesHTTPClient(caPEM, certPEM, keyPEM, insecure)
+		if err != nil {
+			return nil, "", err
+		}
+
+		return client, kubeContext.Context.Namespace, nil
+	}
+
+	return nil, "", fmt.Errorf("current context %q not found in KUBECONFIG %s", kubeconfig.CurrentContext, kubeconfigPath)
+}
+
+// kubernetesHTTPClient returns an HTTP client that trusts the given
+// certificate authority, if any, and authenticates with the given client
+// certificate, if any. It has no timeout, as logs are streamed for as long as
+// jobs run.
+func kubernetesHTTPClient(caPEM, certPEM, keyPEM []byte, insecure bool) (*http.Client, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: insecure}
+
+	if len(caPEM) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in the kubernetes certificate authority")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if len(certPEM) > 0 || len(keyPEM) > 0 {
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, fmt.Errorf("invalid kubernetes client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		},
+	}, nil
+}
+
+// The types below are the parts of the Kubernetes API's v1 objects that the
+// provider uses.
+
+type kubernetesObjectMeta struct {
+	Name   string            `json:"name,omitempty"`
+	UID    string            `json:"uid,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+type kubernetesPod struct {
+	APIVersion string               `json:"apiVersion,omitempty"`
+	Kind       string               `json:"kind,omitempty"`
+	Metadata   kubernetesObjectMeta `json:"metadata"`
+	Spec       *kubernetesPodSpec   `json:"spec,omitempty"`
+	Status     *kubernetesPodStatus `json:"status,omitempty"`
+}
+
+// containerStatus returns the status of the container that runs the script,
+// or nil if it's not known yet.
+func (pod *kubernetesPod) containerStatus() *kubernetesContainerStatus {
+	if pod.Status == nil {
+		return nil
+	}
+
+	for i := range pod.Status.ContainerStatuses {
+		if pod.Status.ContainerStatuses[i].Name == kubernetesContainerName {
+			return &pod.Status.ContainerStatuses[i]
+		}
+	}
+
+	return nil
+}
+
+type kubernetesPodSpec struct {
+	NodeName                     string                           `json:"nodeName,omitempty"`
+	RestartPolicy                string                           `json:"restartPolicy,omitempty"`
+	AutomountServiceAccountToken bool                             `json:"automountServiceAccountToken"`
+	NodeSelector                 map[string]string                `json:"nodeSelector,omitempty"`
+	Tolerations                  []kubernetesToleration           `json:"tolerations,omitempty"`
+	ImagePullSecrets             []kubernetesLocalObjectReference `json:"imagePullSecrets,omitempty"`
+	Containers                   []kubernetesContainer            `json:"containers,omitempty"`
+}
+
+type kubernetesToleration struct {
+	Key      string `json:"key"`
+	Operator string `json:"operator"`
+	Value    string `json:"value,omitempty"`
+	Effect   string `json:"effect"`
+}
+
+type kubernetesLocalObjectReference struct {
+	Name string `json:"name"`
+}
+
+type kubernetesContainer struct {
+	Name      string              `json:"name"`
+	Image     string              `json:"image"`
+	Command   []string            `json:"command,omitempty"`
+	Resources kubernetesResources `json:"resources"`
+}
+
+type kubernetesResources struct {
+	Requests map[string]string `json:"requests,omitempty"`
+	Limits   map[string]string `json:"limits,omitempty"`
+}
+
+type kubernetesPodStatus struct {
+	Phase             string                      `json:"phase"`
+	Reason            string                      `json:"reason,omitempty"`
+	Message           string                      `json:"message,omitempty"`
+	Conditions        []kubernetesPodCondition    `json:"conditions,omitempty"`
+	ContainerStatuses []kubernetesContainerStatus `json:"containerStatuses,omitempty"`
+}
+
+type kubernetesPodCondition struct {
+	Type    string `json:"type"`
+	Status  string `json:"status"`
+	Reason  string `json:"reason,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type kubernetesContainerStatus struct {
+	Name  string                   `json:"name"`
+	State kubernetesContainerState `json:"state"`
+}
+
+type kubernetesContainerState struct {
+	Waiting *struct {
+		Reason string `json:"reason"`
+	} `json:"waiting,omitempty"`
+	Running *struct{} `json:"running,omitempty"`
+}
+
+type kubernetesDeleteOptions struct {
+	APIVersion         string `json:"apiVersion"`
+	Kind               string `json:"kind"`
+	GracePeriodSeconds int64  `json:"gracePeriodSeconds"`
+}
+
+type kubernetesStatus struct {
+	Status  string                   `json:"status,omitempty"`
+	Message string                   `json:"message"`
+	Reason  string                   `json:"reason,omitempty"`
+	Details *kubernetesStatusDetails `json:"details,omitempty"`
+}
+
+type kubernetesStatusDetails struct {
+	Causes []struct {
+		Reason  string `json:"reason"`
+		Message string `json:"message"`
+	} `json:"causes"`
+}
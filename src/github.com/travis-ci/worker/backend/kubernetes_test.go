@@ -0,0 +1,370 @@
+package backend
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/travis-ci/worker/config"
+	gocontext "golang.org/x/net/context"
+)
+
+// kubernetesTestAPI is a fake Kubernetes API that creates pods with the given
+// status and records the requests made to it. Commands exec'd with stdin
+// upload the script, and others write the log and exit with exitCode.
+type kubernetesTestAPI struct {
+	mutex sync.Mutex
+
+	podStatus *kubernetesPodStatus
+	log       string
+	exitCode  int
+	pods      map[string]*kubernetesPod
+	script    []byte
+	commands  [][]string
+	deletes   []kubernetesDeleteOptions
+}
+
+func (a *kubernetesTestAPI) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if req.Header.Get("Authorization") != "Bearer test-token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/api/v1/namespaces/builds/"), "/")
+	name := ""
+	if len(parts) > 1 {
+		name = parts[1]
+	}
+
+	writeJSON := func(status int, v interface{}) {
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(v)
+	}
+
+	switch {
+	case req.Method == "POST" && parts[0] == "pods":
+		pod := &kubernetesPod{}
+		_ = json.NewDecoder(req.Body).Decode(pod)
+		pod.Metadata.UID = "uid-" + pod.Metadata.Name
+		pod.Status = a.podStatus
+		a.pods[pod.Metadata.Name] = pod
+		writeJSON(http.StatusCreated, pod)
+	case req.Method == "GET" && parts[0] == "pods" && len(parts) == 3 && parts[2] == "exec":
+		a.serveExec(w, req)
+	case req.Method == "GET" && parts[0] == "pods":
+		pod, ok := a.pods[name]
+		if !ok {
+			writeJSON(http.StatusNotFound, &kubernetesStatus{Message: "pods not found"})
+			return
+		}
+		writeJSON(http.StatusOK, pod)
+	case req.Method == "DELETE" && parts[0] == "pods":
+		options := kubernetesDeleteOptions{}
+		_ = json.NewDecoder(req.Body).Decode(&options)
+		a.deletes = append(a.deletes, options)
+		delete(a.pods, name)
+		writeJSON(http.StatusOK, &kubernetesStatus{})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (a *kubernetesTestAPI) serveExec(w http.ResponseWriter, req *http.Request) {
+	accept := sha1.Sum([]byte(req.Header.Get("Sec-WebSocket-Key") + websocketGUID))
+
+	conn, rw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Protocol: %s\r\nSec-WebSocket-Accept: %s\r\n\r\n", req.Header.Get("Sec-WebSocket-Protocol"), base64.StdEncoding.EncodeToString(accept[:]))
+	_ = rw.Flush()
+
+	a.commands = append(a.commands, req.URL.Query()["command"])
+
+	// the client's frames are masked, which the server side's reads don't
+	// mind
+	ws := &websocketConn{conn: conn, reader: rw.Reader}
+
+	exitCode := a.exitCode
+	if req.URL.Query().Get("stdin") == "true" {
+		exitCode = 0
+		if a.script != nil {
+			exitCode = kubernetesStaleScriptExitCode
+		} else {
+			message, err := ws.ReadMessage()
+			if err != nil || message[0] != kubernetesStreamStdin {
+				return
+			}
+			a.script = message[1:]
+		}
+	} else {
+		_ = ws.WriteMessage([]byte{kubernetesStreamStdout})
+		_ = ws.WriteMessage(append([]byte{kubernetesStreamStdout}, a.log...))
+	}
+
+	status := &kubernetesStatus{Status: "Success"}
+	if exitCode != 0 {
+		status = &kubernetesStatus{
+			Status:  "Failure",
+			Reason:  "NonZeroExitCode",
+			Details: &kubernetesStatusDetails{},
+		}
+		status.Details.Causes = append(status.Details.Causes, struct {
+			Reason  string `json:"reason"`
+			Message string `json:"message"`
+		}{Reason: "ExitCode", Message: fmt.Sprintf("%d", exitCode)})
+	}
+
+	b, _ := json.Marshal(status)
+	_ = ws.WriteMessage(append([]byte{kubernetesStreamError}, b...))
+	_ = ws.writeFrame(websocketOpClose, nil)
+}
+
+func (a *kubernetesTestAPI) onlyPod(t *testing.T) *kubernetesPod {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	require.Len(t, a.pods, 1)
+	for _, pod := range a.pods {
+		return pod
+	}
+	return nil
+}
+
+func kubernetesTestKubeconfig(t *testing.T, server string) string {
+	dir, err := ioutil.TempDir("", "travis-kubernetes-test")
+	require.Nil(t, err)
+
+	kubeconfig := fmt.Sprintf(`{
+		"current-context": "test",
+		"contexts": [
+			{"name": "other", "context": {"cluster": "other", "user": "other"}},
+			{"name": "test", "context": {"cluster": "test", "user": "test", "namespace": "builds"}}
+		],
+		"clusters": [{"name": "test", "cluster": {"server": %q}}],
+		"users": [{"name": "test", "user": {"token": "test-token"}}]
+	}`, server+"/")
+
+	kubeconfigPath := filepath.Join(dir, "kubeconfig.json")
+	require.Nil(t, ioutil.WriteFile(kubeconfigPath, []byte(kubeconfig), 0600))
+	return kubeconfigPath
+}
+
+func kubernetesTestProvider(t *testing.T, podStatus *kubernetesPodStatus, cfg map[string]string) (*kubernetesProvider, *kubernetesTestAPI, func()) {
+	api := &kubernetesTestAPI{
+		podStatus: podStatus,
+		pods:      map[string]*kubernetesPod{},
+	}
+	server := httptest.NewServer(api)
+	kubeconfigPath := kubernetesTestKubeconfig(t, server.URL)
+
+	cfg["KUBECONFIG"] = kubeconfigPath
+	cfg["BOOT_POLL_SLEEP"] = "1ms"
+	if cfg["IMAGE_DEFAULT"] == "" {
+		cfg["IMAGE_DEFAULT"] = "travisci/ci-garnet:packer-1490989530"
+	}
+
+	provider, err := newKubernetesProvider(config.ProviderConfigFromMap(cfg))
+	require.Nil(t, err)
+
+	return provider.(*kubernetesProvider), api, func() {
+		server.Close()
+		_ = os.RemoveAll(filepath.Dir(kubeconfigPath))
+	}
+}
+
+func TestNewKubernetesProvider(t *testing.T) {
+	provider, _, cleanup := kubernetesTestProvider(t, nil, map[string]string{
+		"CPU_REQUEST":         "2",
+		"MEMORY_LIMIT":        "4Gi",
+		"NODE_SELECTOR":       "pool=builds, disk=ssd",
+		"TOLERATIONS":         "dedicated=builds:NoSchedule,preemptible:NoExecute",
+		"DELETE_GRACE_PERIOD": "10s",
+	})
+	defer cleanup()
+
+	assert.Equal(t, "builds", provider.namespace)
+	assert.Equal(t, kubernetesResources{
+		Requests: map[string]string{"cpu": "2"},
+		Limits:   map[string]string{"memory": "4Gi"},
+	}, provider.resources)
+	assert.Equal(t, map[string]string{"pool": "builds", "disk": "ssd"}, provider.nodeSelector)
+	assert.Equal(t, []kubernetesToleration{
+		{Key: "dedicated", Operator: "Equal", Value: "builds", Effect: "NoSchedule"},
+		{Key: "preemptible", Operator: "Exists", Effect: "NoExecute"},
+	}, provider.tolerations)
+	assert.Equal(t, "10s", provider.gracePeriod.String())
+	assert.False(t, strings.HasSuffix(provider.client.baseURL, "/"))
+}
+
+func TestNewKubernetesProvider_InvalidConfig(t *testing.T) {
+	kubeconfigPath := kubernetesTestKubeconfig(t, "https://kubernetes.example.com")
+	defer os.RemoveAll(filepath.Dir(kubeconfigPath))
+
+	for _, tc := range []struct {
+		cfg map[string]string
+		err string
+	}{
+		{map[string]string{}, "expected KUBECONFIG config key or IN_CLUSTER=true"},
+		{map[string]string{"KUBECONFIG": kubeconfigPath, "NAMESPACE": "Builds"}, `invalid NAMESPACE "Builds"`},
+		{map[string]string{"KUBECONFIG": kubeconfigPath, "CPU_LIMIT": "two"}, `invalid CPU_LIMIT "two", expected a quantity like 2, 500m or 4Gi`},
+		{map[string]string{"KUBECONFIG": kubeconfigPath, "NODE_SELECTOR": "pool"}, `invalid NODE_SELECTOR label "pool", expected key=value`},
+		{map[string]string{"KUBECONFIG": kubeconfigPath, "TOLERATIONS": "dedicated=builds"}, `invalid TOLERATIONS entry "dedicated=builds", expected key[=value]:effect with an effect of NoSchedule, PreferNoSchedule or NoExecute`},
+		{map[string]string{"KUBECONFIG": kubeconfigPath, "TOLERATIONS": "=builds:NoSchedule"}, `invalid TOLERATIONS entry "=builds:NoSchedule", expected key[=value]:effect`},
+		{map[string]string{"KUBECONFIG": kubeconfigPath, "DELETE_GRACE_PERIOD": "-1s"}, `invalid DELETE_GRACE_PERIOD "-1s"`},
+	} {
+		_, err := newKubernetesProvider(config.ProviderConfigFromMap(tc.cfg))
+		assert.EqualError(t, err, tc.err)
+	}
+}
+
+func TestKubernetesKubeconfigClient_NotJSON(t *testing.T) {
+	dir, err := ioutil.TempDir("", "travis-kubernetes-test")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	kubeconfigPath := filepath.Join(dir, "kubeconfig")
+	require.Nil(t, ioutil.WriteFile(kubeconfigPath, []byte("apiVersion: v1\n"), 0600))
+
+	_, _, err = kubernetesKubeconfigClient(kubeconfigPath)
+	assert.Contains(t, err.Error(), "must be in JSON form")
+}
+
+func TestKubernetesProvider_Start(t *testing.T) {
+	provider, api, cleanup := kubernetesTestProvider(t, &kubernetesPodStatus{Phase: "Running"}, map[string]string{
+		"IMAGE_PULL_SECRET": "registry",
+		"NODE_SELECTOR":     "pool=builds",
+	})
+	defer cleanup()
+	api.log = "Hello from the pod\n"
+	api.exitCode = 137
+
+	instance, err := provider.Start(gocontext.TODO(), &StartAttributes{Language: "ruby", JobID: 42})
+	require.Nil(t, err)
+
+	pod := api.onlyPod(t)
+	assert.Equal(t, pod.Metadata.Name, instance.ID())
+	assert.True(t, strings.HasPrefix(pod.Metadata.Name, kubernetesPodNamePrefix))
+	assert.Equal(t, "42", pod.Metadata.Labels["travis-ci.org/job-id"])
+	assert.False(t, pod.Spec.AutomountServiceAccountToken)
+	assert.Equal(t, []kubernetesLocalObjectReference{{Name: "registry"}}, pod.Spec.ImagePullSecrets)
+	assert.Equal(t, map[string]string{"pool": "builds"}, pod.Spec.NodeSelector)
+	assert.Equal(t, "travisci/ci-garnet:packer-1490989530", pod.Spec.Containers[0].Image)
+	assert.Equal(t, kubernetesIdleCommand, pod.Spec.Containers[0].Command)
+
+	err = instance.UploadScript(gocontext.TODO(), []byte("echo hi\n"))
+	require.Nil(t, err)
+	assert.Equal(t, "echo hi\n", string(api.script))
+	assert.Contains(t, api.commands[0][2], "head -c 8 ")
+
+	err = instance.UploadScript(gocontext.TODO(), []byte("echo hi\n"))
+	assert.Equal(t, ErrStaleVM, err)
+
+	output := &bytes.Buffer{}
+	result, err := instance.RunScript(gocontext.TODO(), output)
+	require.Nil(t, err)
+	assert.Equal(t, "Hello from the pod\n", output.String())
+	assert.Equal(t, kubernetesScriptCommand, api.commands[2])
+	assert.True(t, result.Completed)
+	assert.Equal(t, uint8(137), result.ExitCode)
+	assert.Equal(t, RunReasonSignal, result.Reason)
+	assert.Equal(t, "KILL", result.Signal)
+
+	err = instance.Stop(gocontext.TODO())
+	require.Nil(t, err)
+	assert.Equal(t, []kubernetesDeleteOptions{{APIVersion: "v1", Kind: "DeleteOptions", GracePeriodSeconds: 30}}, api.deletes)
+	assert.Len(t, api.pods, 0)
+
+	// stopping a pod that's already gone succeeds
+	err = instance.Stop(gocontext.TODO())
+	assert.Nil(t, err)
+}
+
+func TestKubernetesProvider_StartUnschedulable(t *testing.T) {
+	provider, api, cleanup := kubernetesTestProvider(t, &kubernetesPodStatus{
+		Phase: "Pending",
+		Conditions: []kubernetesPodCondition{
+			{Type: "PodScheduled", Status: "False", Reason: "Unschedulable", Message: "0/3 nodes are available: 3 Insufficient cpu."},
+		},
+	}, map[string]string{})
+	defer cleanup()
+
+	_, err := provider.Start(gocontext.TODO(), &StartAttributes{Language: "ruby"})
+	require.IsType(t, &StartError{}, err)
+	assert.Equal(t, ErrResourceExhausted, err.(*StartError).Cause)
+	assert.True(t, IsRecoverable(err))
+	assert.Contains(t, err.Error(), "3 Insufficient cpu")
+
+	assert.Len(t, api.pods, 0)
+	assert.Equal(t, int64(0), api.deletes[0].GracePeriodSeconds)
+}
+
+func TestKubernetesProvider_StartBootTimeout(t *testing.T) {
+	provider, api, cleanup := kubernetesTestProvider(t, &kubernetesPodStatus{
+		Phase: "Pending",
+		ContainerStatuses: []kubernetesContainerStatus{
+			{Name: kubernetesContainerName, State: kubernetesContainerState{Waiting: &struct {
+				Reason string `json:"reason"`
+			}{Reason: "ImagePullBackOff"}}},
+		},
+	}, map[string]string{"BOOT_TIMEOUT": "50ms"})
+	defer cleanup()
+
+	_, err := provider.Start(gocontext.TODO(), &StartAttributes{Language: "ruby"})
+	require.IsType(t, &StartError{}, err)
+	assert.Equal(t, ErrBootTimeout, err.(*StartError).Cause)
+	assert.Contains(t, err.Error(), "last waiting for ImagePullBackOff")
+	assert.Len(t, api.pods, 0)
+}
+
+func TestKubernetesProvider_StartQuotaExceeded(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		_ = json.NewEncoder(w).Encode(&kubernetesStatus{Message: `pods "travis-job-abc" is forbidden: exceeded quota: builds`})
+	}))
+	defer server.Close()
+
+	kubeconfigPath := kubernetesTestKubeconfig(t, server.URL)
+	defer os.RemoveAll(filepath.Dir(kubeconfigPath))
+
+	provider, err := newKubernetesProvider(config.ProviderConfigFromMap(map[string]string{
+		"KUBECONFIG":    kubeconfigPath,
+		"IMAGE_DEFAULT": "travisci/ci-garnet:packer-1490989530",
+	}))
+	require.Nil(t, err)
+
+	_, err = provider.Start(gocontext.TODO(), &StartAttributes{Language: "ruby"})
+	require.IsType(t, &StartError{}, err)
+	assert.Equal(t, ErrQuotaExceeded, err.(*StartError).Cause)
+}
+
+func TestKubernetesProvider_StartWithoutImage(t *testing.T) {
+	kubeconfigPath := kubernetesTestKubeconfig(t, "https://kubernetes.example.com")
+	defer os.RemoveAll(filepath.Dir(kubeconfigPath))
+
+	provider, err := newKubernetesProvider(config.ProviderConfigFromMap(map[string]string{
+		"KUBECONFIG": kubeconfigPath,
+	}))
+	require.Nil(t, err)
+
+	_, err = provider.Start(gocontext.TODO(), &StartAttributes{Language: "ruby"})
+	require.IsType(t, &StartError{}, err)
+	assert.Equal(t, ErrImageNotFound, err.(*StartError).Cause)
+}
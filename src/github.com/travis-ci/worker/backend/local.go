@@ -1,22 +1,34 @@
 package backend
 
 import (
-	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/travis-ci/worker/config"
+	"github.com/travis-ci/worker/context"
+	"github.com/travis-ci/worker/metrics"
 	gocontext "golang.org/x/net/context"
 )
 
+const (
+	localScriptName = "build.sh"
+	localWorkDir    = "build"
+)
+
 var (
 	errNoScriptUploaded = fmt.Errorf("no script uploaded")
+	errLocalNotEnabled  = fmt.Errorf("the local provider runs the scripts of jobs on this host without any isolation, set ENABLED=true to use it anyway")
 	localHelp           = map[string]string{
-		"SCRIPTS_DIR": "directory where generated scripts will be written",
+		"ENABLED":     "must be true to use this provider, as it runs the scripts of jobs on the worker's host without any isolation, only use it for development and smoke tests (default false)",
+		"SCRIPTS_DIR": "directory in which a temporary directory is created for the script and working directory of every job (default the system's temporary directory)",
 	}
 )
 
@@ -30,14 +42,22 @@ type localProvider struct {
 }
 
 func newLocalProvider(cfg *config.ProviderConfig) (Provider, error) {
-	scriptsDir, _ := os.Getwd()
+	enabled := false
+	if cfg.IsSet("ENABLED") {
+		var err error
+		enabled, err = strconv.ParseBool(cfg.Get("ENABLED"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid ENABLED %q: %v", cfg.Get("ENABLED"), err)
+		}
+	}
 
-	if cfg.IsSet("SCRIPTS_DIR") {
-		scriptsDir = cfg.Get("SCRIPTS_DIR")
+	if !enabled {
+		return nil, errLocalNotEnabled
 	}
 
-	if scriptsDir == "" {
-		scriptsDir = os.TempDir()
+	scriptsDir := os.TempDir()
+	if cfg.IsSet("SCRIPTS_DIR") {
+		scriptsDir = cfg.Get("SCRIPTS_DIR")
 	}
 
 	return &localProvider{cfg: cfg, scriptsDir: scriptsDir}, nil
@@ -52,27 +72,44 @@ func (p *localProvider) Setup() error { return nil }
 type localInstance struct {
 	p *localProvider
 
+	// dir holds the script and, in its build directory, the working
+	// directory of the script.
+	dir        string
 	scriptPath string
+
+	// cmd is the running script, if any, whose process group is killed when
+	// the instance is stopped.
+	cmdMutex sync.Mutex
+	cmd      *exec.Cmd
 }
 
 func newLocalInstance(p *localProvider) (*localInstance, error) {
+	dir, err := ioutil.TempDir(p.scriptsDir, "travis-local-")
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.Mkdir(filepath.Join(dir, localWorkDir), 0700)
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		return nil, err
+	}
+
 	return &localInstance{
-		p: p,
+		p:   p,
+		dir: dir,
 	}, nil
 }
 
 func (i *localInstance) UploadScript(ctx gocontext.Context, script []byte) error {
-	scriptPath := filepath.Join(i.p.scriptsDir, fmt.Sprintf("build-%v.sh", time.Now().UTC().UnixNano()))
-	f, err := os.Create(scriptPath)
+	scriptPath := filepath.Join(i.dir, localScriptName)
+	err := ioutil.WriteFile(scriptPath, script, 0600)
 	if err != nil {
 		return err
 	}
 
 	i.scriptPath = scriptPath
-
-	scriptBuf := bytes.NewBuffer(script)
-	_, err = io.Copy(f, scriptBuf)
-	return err
+	return nil
 }
 
 func (i *localInstance) RunScript(ctx gocontext.Context, writer io.Writer) (*RunResult, error) {
@@ -80,39 +117,98 @@ func (i *localInstance) RunScript(ctx gocontext.Context, writer io.Writer) (*Run
 		return &RunResult{Completed: false}, errNoScriptUploaded
 	}
 
+	startRun := time.Now()
+
 	cmd := exec.Command("bash", i.scriptPath)
+	cmd.Dir = filepath.Join(i.dir, localWorkDir)
 	cmd.Stdout = writer
 	cmd.Stderr = writer
+	// the script gets its own process group, so that whatever it started can
+	// be killed along with it
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 
+	i.cmdMutex.Lock()
 	err := cmd.Start()
+	if err == nil {
+		i.cmd = cmd
+	}
+	i.cmdMutex.Unlock()
 	if err != nil {
 		return &RunResult{Completed: false}, err
 	}
 
-	errChan := make(chan error)
+	errChan := make(chan error, 1)
 	go func() {
 		errChan <- cmd.Wait()
 	}()
 
 	select {
 	case err := <-errChan:
-		if err != nil {
-			return &RunResult{Completed: false}, err
-		}
-		return &RunResult{Completed: true}, nil
+		result, err := localClassifyWaitError(&RunResult{}, err)
+		result.Duration = time.Since(startRun)
+		return result, err
 	case <-ctx.Done():
-		err = ctx.Err()
-		if err != nil {
-			return &RunResult{Completed: false}, err
-		}
-		return &RunResult{Completed: true}, nil
+		metrics.Mark("worker.vm.provider.local.run.cancelled")
+		i.killProcessGroup(ctx)
+		<-errChan
+		return &RunResult{Cancelled: true, Duration: time.Since(startRun)}, ctx.Err()
+	}
+}
+
+// localClassifyWaitError fills in the result of a script from the error
+// returned by waiting for it the same way as gceClassifyWaitError does for
+// scripts run over ssh, returning the error if it isn't one the result can
+// express.
+func localClassifyWaitError(result *RunResult, err error) (*RunResult, error) {
+	if err == nil {
+		result.Completed = true
+		return result, nil
+	}
+
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return result, err
+	}
+
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	if !ok {
+		return result, err
+	}
+
+	result.Completed = true
+	if status.Signaled() {
+		metrics.Mark("worker.vm.provider.local.run.signal")
+		result.ExitCode = uint8(128 + int(status.Signal()))
+		result.Reason = RunReasonSignal
+		result.Signal = dockerSignalName(int(status.Signal()))
+		return result, nil
+	}
+
+	result.ExitCode = uint8(status.ExitStatus())
+	return result, nil
+}
+
+// killProcessGroup kills the process group of the running script, if any,
+// including any processes the script left behind.
+func (i *localInstance) killProcessGroup(ctx gocontext.Context) {
+	i.cmdMutex.Lock()
+	defer i.cmdMutex.Unlock()
+
+	if i.cmd == nil || i.cmd.Process == nil {
+		return
+	}
+
+	err := syscall.Kill(-i.cmd.Process.Pid, syscall.SIGKILL)
+	if err != nil && err != syscall.ESRCH {
+		context.LoggerFromContext(ctx).WithField("err", err).Error("couldn't kill process group")
 	}
 }
 
 func (i *localInstance) Stop(ctx gocontext.Context) error {
-	return nil
+	i.killProcessGroup(ctx)
+	return os.RemoveAll(i.dir)
 }
 
 func (i *localInstance) ID() string {
-	return fmt.Sprintf("local:%s", i.scriptPath)
+	return filepath.Base(i.dir)
 }
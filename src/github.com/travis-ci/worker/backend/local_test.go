@@ -0,0 +1,113 @@
+package backend
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/travis-ci/worker/config"
+	gocontext "golang.org/x/net/context"
+)
+
+func localTestInstance(t *testing.T) (*localInstance, func()) {
+	scriptsDir, err := ioutil.TempDir("", "travis-local-test")
+	require.Nil(t, err)
+
+	provider, err := newLocalProvider(config.ProviderConfigFromMap(map[string]string{
+		"ENABLED":     "true",
+		"SCRIPTS_DIR": scriptsDir,
+	}))
+	require.Nil(t, err)
+
+	instance, err := provider.Start(gocontext.TODO(), &StartAttributes{})
+	require.Nil(t, err)
+
+	return instance.(*localInstance), func() { _ = os.RemoveAll(scriptsDir) }
+}
+
+func TestNewLocalProvider_OptIn(t *testing.T) {
+	_, err := newLocalProvider(config.ProviderConfigFromMap(map[string]string{}))
+	assert.Equal(t, errLocalNotEnabled, err)
+
+	_, err = newLocalProvider(config.ProviderConfigFromMap(map[string]string{"ENABLED": "false"}))
+	assert.Equal(t, errLocalNotEnabled, err)
+
+	_, err = newLocalProvider(config.ProviderConfigFromMap(map[string]string{"ENABLED": "maybe"}))
+	assert.EqualError(t, err, `invalid ENABLED "maybe": strconv.ParseBool: parsing "maybe": invalid syntax`)
+}
+
+func TestLocalInstance_RunScript(t *testing.T) {
+	instance, cleanup := localTestInstance(t)
+	defer cleanup()
+
+	assert.True(t, strings.HasPrefix(instance.ID(), "travis-local-"))
+
+	err := instance.UploadScript(gocontext.TODO(), []byte("echo out\necho err >&2\npwd\nexit 3\n"))
+	require.Nil(t, err)
+
+	output := &bytes.Buffer{}
+	result, err := instance.RunScript(gocontext.TODO(), output)
+	require.Nil(t, err)
+	assert.True(t, result.Completed)
+	assert.Equal(t, uint8(3), result.ExitCode)
+	assert.Equal(t, "", result.Reason)
+
+	workDir, err := filepath.EvalSymlinks(filepath.Join(instance.dir, localWorkDir))
+	require.Nil(t, err)
+	assert.Equal(t, "out\nerr\n"+workDir+"\n", output.String())
+
+	err = instance.Stop(gocontext.TODO())
+	require.Nil(t, err)
+	_, err = os.Stat(instance.dir)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestLocalInstance_RunScriptSignal(t *testing.T) {
+	instance, cleanup := localTestInstance(t)
+	defer cleanup()
+	defer instance.Stop(gocontext.TODO())
+
+	err := instance.UploadScript(gocontext.TODO(), []byte("kill -KILL $$\n"))
+	require.Nil(t, err)
+
+	result, err := instance.RunScript(gocontext.TODO(), ioutil.Discard)
+	require.Nil(t, err)
+	assert.True(t, result.Completed)
+	assert.Equal(t, uint8(137), result.ExitCode)
+	assert.Equal(t, RunReasonSignal, result.Reason)
+	assert.Equal(t, "KILL", result.Signal)
+}
+
+func TestLocalInstance_RunScriptCancelled(t *testing.T) {
+	instance, cleanup := localTestInstance(t)
+	defer cleanup()
+	defer instance.Stop(gocontext.TODO())
+
+	err := instance.UploadScript(gocontext.TODO(), []byte("sleep 60 &\nsleep 60\n"))
+	require.Nil(t, err)
+
+	ctx, cancel := gocontext.WithTimeout(gocontext.TODO(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	result, err := instance.RunScript(ctx, ioutil.Discard)
+	assert.Equal(t, gocontext.DeadlineExceeded, err)
+	assert.True(t, result.Cancelled)
+	assert.False(t, result.Completed)
+	assert.True(t, time.Since(start) < 10*time.Second)
+}
+
+func TestLocalInstance_RunScriptWithoutUpload(t *testing.T) {
+	instance, cleanup := localTestInstance(t)
+	defer cleanup()
+	defer instance.Stop(gocontext.TODO())
+
+	_, err := instance.RunScript(gocontext.TODO(), ioutil.Discard)
+	assert.Equal(t, errNoScriptUploaded, err)
+}
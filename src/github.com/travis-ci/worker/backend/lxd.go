@@ -0,0 +1,752 @@
+package backend
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pborman/uuid"
+	"github.com/travis-ci/worker/config"
+	"github.com/travis-ci/worker/context"
+	"github.com/travis-ci/worker/image"
+	"github.com/travis-ci/worker/metrics"
+	gocontext "golang.org/x/net/context"
+)
+
+const (
+	defaultLXDEndpoint      = "unix:///var/lib/lxd/unix.socket"
+	defaultLXDProfiles      = "default"
+	defaultLXDUserID        = 1000
+	defaultLXDHome          = "/home/travis"
+	defaultLXDBootPollSleep = time.Second
+	lxdBootPollMaxSleep     = 5 * time.Second
+	lxdDialTimeout          = 10 * time.Second
+	lxdStateChangeTimeout   = 30
+	lxdCleanupTimeout       = time.Minute
+	lxdContainerNamePrefix  = "travis-job-"
+	lxdScriptName           = "build.sh"
+)
+
+var (
+	lxdHelp = map[string]string{
+		"ENDPOINT":              fmt.Sprintf("LXD daemon to talk to, a unix:// socket path or an https:// URL (default %q)", defaultLXDEndpoint),
+		"TLS_CLIENT_CERT_PATH":  "path to the PEM client certificate trusted by a remote LXD daemon, required for https:// endpoints",
+		"TLS_CLIENT_KEY_PATH":   "path to the PEM key of TLS_CLIENT_CERT_PATH, required for https:// endpoints",
+		"TLS_SERVER_CERT_PATH":  "path to the PEM certificate of a remote LXD daemon, which is trusted instead of the system's certificate authorities (default none)",
+		"IMAGE_[ALIAS_]{ALIAS}": "alias of the LXD image for a given alias, like for gce",
+		"IMAGE_DEFAULT":         "alias of the LXD image used when no alias matches the job (default none, erroring the job)",
+		"PROFILES":              fmt.Sprintf("comma-delimited profiles applied to containers (default %q)", defaultLXDProfiles),
+		"LIMITS_CPU":            "limits.cpu of containers, e.g. 2 (default none)",
+		"LIMITS_MEMORY":         "limits.memory of containers, e.g. 4GB (default none)",
+		"EPHEMERAL":             "launch ephemeral containers, which LXD deletes once they're stopped (default false)",
+		"USER_ID":               fmt.Sprintf("uid that owns and runs the build script, which needs LXD 3.0 or later unless 0 (default %d)", defaultLXDUserID),
+		"GROUP_ID":              "gid that owns and runs the build script (default USER_ID)",
+		"HOME":                  fmt.Sprintf("home directory of USER_ID, where the build script is uploaded and run (default %q)", defaultLXDHome),
+		"BOOT_POLL_SLEEP":       fmt.Sprintf("initial sleep interval between polling containers for a network address while starting, backing off with jitter up to %v or this if longer (default %v)", lxdBootPollMaxSleep, defaultLXDBootPollSleep),
+		"BOOT_TIMEOUT":          "how long to wait for a container to get a network address, bounded by the worker's start timeout (default the start timeout)",
+	}
+)
+
+func init() {
+	Register("lxd", "LXD", lxdHelp, newLXDProvider)
+}
+
+type lxdProvider struct {
+	client *lxdClient
+
+	imageSelector *image.EnvSelector
+	profiles      []string
+	limits        map[string]string
+	ephemeral     bool
+
+	userID  int
+	groupID int
+	home    string
+
+	bootPollSleep time.Duration
+	bootTimeout   time.Duration
+}
+
+type lxdInstance struct {
+	provider *lxdProvider
+	name     string
+}
+
+func newLXDProvider(cfg *config.ProviderConfig) (Provider, error) {
+	endpoint := defaultLXDEndpoint
+	if cfg.IsSet("ENDPOINT") {
+		endpoint = cfg.Get("ENDPOINT")
+	}
+
+	client, err := newLXDClient(endpoint, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	imageSelector, err := image.NewEnvSelector(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	profilesString := defaultLXDProfiles
+	if cfg.IsSet("PROFILES") {
+		profilesString = cfg.Get("PROFILES")
+	}
+
+	profiles := []string{}
+	for _, profile := range strings.Split(profilesString, ",") {
+		profile = strings.TrimSpace(profile)
+		if profile != "" {
+			profiles = append(profiles, profile)
+		}
+	}
+
+	limits := map[string]string{}
+	if cfg.IsSet("LIMITS_CPU") {
+		limits["limits.cpu"] = cfg.Get("LIMITS_CPU")
+	}
+	if cfg.IsSet("LIMITS_MEMORY") {
+		limits["limits.memory"] = cfg.Get("LIMITS_MEMORY")
+	}
+
+	ephemeral := false
+	if cfg.IsSet("EPHEMERAL") {
+		ephemeral, err = strconv.ParseBool(cfg.Get("EPHEMERAL"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid EPHEMERAL %q: %v", cfg.Get("EPHEMERAL"), err)
+		}
+	}
+
+	userID := defaultLXDUserID
+	if cfg.IsSet("USER_ID") {
+		userID, err = strconv.Atoi(cfg.Get("USER_ID"))
+		if err != nil || userID < 0 {
+			return nil, fmt.Errorf("invalid USER_ID %q", cfg.Get("USER_ID"))
+		}
+	}
+
+	groupID := userID
+	if cfg.IsSet("GROUP_ID") {
+		groupID, err = strconv.Atoi(cfg.Get("GROUP_ID"))
+		if err != nil || groupID < 0 {
+			return nil, fmt.Errorf("invalid GROUP_ID %q", cfg.Get("GROUP_ID"))
+		}
+	}
+
+	home := defaultLXDHome
+	if cfg.IsSet("HOME") {
+		home = cfg.Get("HOME")
+		if !path.IsAbs(home) {
+			return nil, fmt.Errorf("invalid HOME %q, expected an absolute path", home)
+		}
+	}
+
+	bootPollSleep := defaultLXDBootPollSleep
+	if cfg.IsSet("BOOT_POLL_SLEEP") {
+		bootPollSleep, err = time.ParseDuration(cfg.Get("BOOT_POLL_SLEEP"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid BOOT_POLL_SLEEP %q: %v", cfg.Get("BOOT_POLL_SLEEP"), err)
+		}
+	}
+
+	bootTimeout := time.Duration(0)
+	if cfg.IsSet("BOOT_TIMEOUT") {
+		bootTimeout, err = time.ParseDuration(cfg.Get("BOOT_TIMEOUT"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid BOOT_TIMEOUT %q: %v", cfg.Get("BOOT_TIMEOUT"), err)
+		}
+	}
+
+	return &lxdProvider{
+		client: client,
+
+		imageSelector: imageSelector,
+		profiles:      profiles,
+		limits:        limits,
+		ephemeral:     ephemeral,
+
+		userID:  userID,
+		groupID: groupID,
+		home:    home,
+
+		bootPollSleep: bootPollSleep,
+		bootTimeout:   bootTimeout,
+	}, nil
+}
+
+func (p *lxdProvider) Setup() error { return nil }
+
+func (p *lxdProvider) Start(ctx gocontext.Context, startAttributes *StartAttributes) (Instance, error) {
+	logger := context.LoggerFromContext(ctx)
+
+	imageAlias, err := p.imageSelector.Select(&image.Params{
+		Infra:    "lxd",
+		Language: startAttributes.Language,
+		OsxImage: startAttributes.OsxImage,
+		Dist:     startAttributes.Dist,
+		Group:    startAttributes.Group,
+		OS:       startAttributes.OS,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if imageAlias == "default" {
+		return nil, &StartError{Cause: ErrImageNotFound, Err: fmt.Errorf("no image configured for language %q", startAttributes.Language)}
+	}
+
+	startBooting := time.Now()
+
+	instance := &lxdInstance{
+		provider: p,
+		name:     fmt.Sprintf("%s%s", lxdContainerNamePrefix, uuid.NewRandom()),
+	}
+	logger = logger.WithFields(logrus.Fields{
+		"container": instance.name,
+		"image":     imageAlias,
+	})
+
+	resp, err := p.client.do(ctx, "POST", "/1.0/containers", &lxdContainerCreate{
+		Name:      instance.name,
+		Ephemeral: p.ephemeral,
+		Profiles:  p.profiles,
+		Config:    p.limits,
+		Source:    lxdContainerSource{Type: "image", Alias: imageAlias},
+	}, nil)
+	if err == nil {
+		_, err = p.client.waitForOperation(ctx, resp.Operation)
+	}
+	if err != nil {
+		// the container may have been created even if waiting failed
+		instance.cleanup(ctx)
+		return nil, err
+	}
+
+	err = instance.changeState(ctx, "start", false)
+	if err == nil {
+		err = instance.waitForNetwork(ctx)
+	}
+	if err != nil {
+		logger.WithField("err", err).Error("couldn't start container, deleting it")
+		instance.cleanup(ctx)
+		return nil, err
+	}
+
+	metrics.TimeSince("worker.vm.provider.lxd.boot", startBooting)
+	logger.Info("container is running")
+
+	return instance, nil
+}
+
+// waitForNetwork polls the container until it has a global IPv4 address, as
+// build scripts need the network. It gives up after BOOT_TIMEOUT, if set, or
+// when the context is done.
+func (i *lxdInstance) waitForNetwork(ctx gocontext.Context) error {
+	bootCtx := ctx
+	if i.provider.bootTimeout > 0 {
+		var cancel gocontext.CancelFunc
+		bootCtx, cancel = gocontext.WithTimeout(ctx, i.provider.bootTimeout)
+		defer cancel()
+	}
+
+	err := pollUntil(bootCtx, i.provider.bootPollSleep, pollMaxSleep(i.provider.bootPollSleep, lxdBootPollMaxSleep), func() (bool, error) {
+		state := &lxdContainerState{}
+		_, err := i.provider.client.do(bootCtx, "GET", i.path("/state"), nil, state)
+		if err != nil {
+			return false, err
+		}
+
+		for name, network := range state.Network {
+			if name == "lo" {
+				continue
+			}
+
+			for _, address := range network.Addresses {
+				if address.Family == "inet" && address.Scope == "global" {
+					return true, nil
+				}
+			}
+		}
+
+		return false, nil
+	})
+
+	if err != nil && ctx.Err() == nil && bootCtx.Err() != nil {
+		metrics.Mark("worker.vm.provider.lxd.boot.timeout")
+		return &StartError{
+			Cause: ErrBootTimeout,
+			Err:   fmt.Errorf("container %s had no network address after %v", i.name, i.provider.bootTimeout),
+		}
+	}
+
+	return err
+}
+
+// path returns the API path of the container with the given suffix.
+func (i *lxdInstance) path(suffix string) string {
+	return fmt.Sprintf("/1.0/containers/%s%s", i.name, suffix)
+}
+
+func (i *lxdInstance) scriptPath() string {
+	return path.Join(i.provider.home, lxdScriptName)
+}
+
+func (i *lxdInstance) changeState(ctx gocontext.Context, action string, force bool) error {
+	resp, err := i.provider.client.do(ctx, "PUT", i.path("/state"), &lxdStateChange{
+		Action:  action,
+		Timeout: lxdStateChangeTimeout,
+		Force:   force,
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	_, err = i.provider.client.waitForOperation(ctx, resp.Operation)
+	return err
+}
+
+func (i *lxdInstance) UploadScript(ctx gocontext.Context, script []byte) error {
+	filePath := i.path(fmt.Sprintf("/files?path=%s", url.QueryEscape(i.scriptPath())))
+
+	_, err := i.provider.client.send(ctx, "GET", filePath, nil, nil)
+	if err == nil {
+		return ErrStaleVM
+	}
+	if !lxdIsNotFound(err) {
+		return err
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/octet-stream")
+	header.Set("X-LXD-type", "file")
+	header.Set("X-LXD-uid", strconv.Itoa(i.provider.userID))
+	header.Set("X-LXD-gid", strconv.Itoa(i.provider.groupID))
+	header.Set("X-LXD-mode", "0755")
+
+	_, err = i.provider.client.send(ctx, "POST", filePath, bytes.NewReader(script), header)
+	return err
+}
+
+func (i *lxdInstance) RunScript(ctx gocontext.Context, output io.Writer) (*RunResult, error) {
+	startRun := time.Now()
+
+	exec := &lxdExec{
+		Command:          []string{"bash", "--login", i.scriptPath()},
+		Environment:      map[string]string{"HOME": i.provider.home},
+		WaitForWebsocket: true,
+		Interactive:      true,
+		Width:            80,
+		Height:           40,
+	}
+	// the fields are only understood by LXD 3.0 and later, so they're left
+	// out for root
+	if i.provider.userID != 0 || i.provider.groupID != 0 {
+		exec.User = i.provider.userID
+		exec.Group = i.provider.groupID
+		exec.Cwd = i.provider.home
+	}
+
+	execOp := &lxdOperation{}
+	resp, err := i.provider.client.do(ctx, "POST", i.path("/exec"), exec, execOp)
+	if err != nil {
+		return &RunResult{Completed: false}, err
+	}
+
+	execMetadata := &lxdExecMetadata{}
+	err = json.Unmarshal(execOp.Metadata, execMetadata)
+	if err != nil {
+		return &RunResult{Completed: false}, err
+	}
+
+	// LXD only runs the command once every websocket of the operation is
+	// connected; the control websocket is unused but must stay open
+	websockets := []*websocketConn{}
+	defer func() {
+		for _, ws := range websockets {
+			ws.Close()
+		}
+	}()
+
+	for _, fd := range []string{"0", "control"} {
+		ws, err := i.provider.client.dialWebsocket(fmt.Sprintf("%s/websocket?secret=%s", resp.Operation, url.QueryEscape(execMetadata.FDs[fd])))
+		if err != nil {
+			return &RunResult{Completed: false}, err
+		}
+		websockets = append(websockets, ws)
+	}
+
+	copied := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			for _, ws := range websockets {
+				ws.Close()
+			}
+		case <-copied:
+		}
+	}()
+
+	err = websockets[0].CopyTo(output)
+	close(copied)
+
+	if ctx.Err() != nil {
+		return i.cancel(ctx, startRun)
+	}
+	if err != nil {
+		return &RunResult{Completed: false}, err
+	}
+
+	op, err := i.provider.client.waitForOperation(ctx, resp.Operation)
+	if err != nil {
+		if ctx.Err() != nil {
+			return i.cancel(ctx, startRun)
+		}
+		return &RunResult{Completed: false}, err
+	}
+
+	err = json.Unmarshal(op.Metadata, execMetadata)
+	if err != nil {
+		return &RunResult{Completed: false}, err
+	}
+	if execMetadata.Return == nil {
+		metrics.Mark("worker.vm.provider.lxd.run.exit_missing")
+		return &RunResult{Reason: RunReasonExitMissing, Duration: time.Since(startRun)}, nil
+	}
+
+	exitCode := *execMetadata.Return
+	result := &RunResult{
+		Completed: true,
+		ExitCode:  uint8(exitCode),
+		Duration:  time.Since(startRun),
+	}
+
+	if exitCode > 128 {
+		metrics.Mark("worker.vm.provider.lxd.run.signal")
+		result.Reason = RunReasonSignal
+		result.Signal = dockerSignalName(exitCode - 128)
+	}
+
+	return result, nil
+}
+
+// cancel force-deletes the container when the script was stopped because
+// the context is done.
+func (i *lxdInstance) cancel(ctx gocontext.Context, startRun time.Time) (*RunResult, error) {
+	metrics.Mark("worker.vm.provider.lxd.run.cancelled")
+	i.cleanup(ctx)
+	return &RunResult{Cancelled: true, Duration: time.Since(startRun)}, ctx.Err()
+}
+
+// cleanup force-deletes the container, even if the context is already done,
+// logging any error.
+func (i *lxdInstance) cleanup(ctx gocontext.Context) {
+	cleanupCtx, cancel := gocontext.WithTimeout(gocontext.Background(), lxdCleanupTimeout)
+	defer cancel()
+
+	err := i.delete(cleanupCtx)
+	if err != nil {
+		context.LoggerFromContext(ctx).WithFields(logrus.Fields{
+			"err":       err,
+			"container": i.name,
+		}).Error("couldn't delete container")
+	}
+}
+
+// delete force-stops the container, which deletes ephemeral ones, and deletes
+// it. A container that's already gone is taken as deleted.
+func (i *lxdInstance) delete(ctx gocontext.Context) error {
+	err := i.changeState(ctx, "stop", true)
+	if lxdIsNotFound(err) {
+		return nil
+	}
+	if err != nil && !lxdIsNotRunning(err) {
+		return err
+	}
+
+	resp, err := i.provider.client.do(ctx, "DELETE", i.path(""), nil, nil)
+	if err == nil {
+		_, err = i.provider.client.waitForOperation(ctx, resp.Operation)
+	}
+	if lxdIsNotFound(err) {
+		return nil
+	}
+
+	return err
+}
+
+func (i *lxdInstance) Stop(ctx gocontext.Context) error {
+	return i.delete(ctx)
+}
+
+func (i *lxdInstance) ID() string {
+	return i.name
+}
+
+// lxdClient is a minimal client of the LXD REST API.
+type lxdClient struct {
+	restClient
+
+	// host is the Host header of websocket requests
+	host string
+	dial func() (net.Conn, error)
+}
+
+// newLXDClient returns a client for the LXD daemon listening on the given
+// unix:// socket path or https:// URL.
+func newLXDClient(endpoint string, cfg *config.ProviderConfig) (*lxdClient, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ENDPOINT %q: %v", endpoint, err)
+	}
+
+	var dial func() (net.Conn, error)
+	client := &lxdClient{}
+
+	switch u.Scheme {
+	case "unix":
+		socketPath := u.Path
+		dial = func() (net.Conn, error) {
+			return net.DialTimeout("unix", socketPath, lxdDialTimeout)
+		}
+		client.baseURL = "http://lxd"
+		client.host = "lxd"
+	case "https":
+		if !cfg.IsSet("TLS_CLIENT_CERT_PATH") || !cfg.IsSet("TLS_CLIENT_KEY_PATH") {
+			return nil, fmt.Errorf("https:// ENDPOINT requires TLS_CLIENT_CERT_PATH and TLS_CLIENT_KEY_PATH")
+		}
+
+		cert, err := tls.LoadX509KeyPair(cfg.Get("TLS_CLIENT_CERT_PATH"), cfg.Get("TLS_CLIENT_KEY_PATH"))
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+		if cfg.IsSet("TLS_SERVER_CERT_PATH") {
+			serverCert, err := ioutil.ReadFile(cfg.Get("TLS_SERVER_CERT_PATH"))
+			if err != nil {
+				return nil, err
+			}
+
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(serverCert) {
+				return nil, fmt.Errorf("no certificate found in TLS_SERVER_CERT_PATH %s", cfg.Get("TLS_SERVER_CERT_PATH"))
+			}
+			tlsConfig.RootCAs = pool
+		}
+
+		host := u.Host
+		serverName, _, err := net.SplitHostPort(host)
+		if err != nil {
+			serverName = host
+			host = net.JoinHostPort(host, "8443")
+		}
+		tlsConfig.ServerName = serverName
+
+		dial = func() (net.Conn, error) {
+			return tls.DialWithDialer(&net.Dialer{Timeout: lxdDialTimeout}, "tcp", host, tlsConfig)
+		}
+		client.baseURL = fmt.Sprintf("https://%s", host)
+		client.host = host
+	default:
+		return nil, fmt.Errorf("invalid ENDPOINT %q, expected a unix:// socket path or an https:// URL", endpoint)
+	}
+
+	client.dial = dial
+	client.responseError = lxdResponseError
+	client.client = &http.Client{
+		Transport: &http.Transport{
+			// the dial function connects to the daemon whatever the URL's
+			// host is, and does the TLS handshake for https
+			Dial: func(network, addr string) (net.Conn, error) {
+				return dial()
+			},
+			DialTLS: func(network, addr string) (net.Conn, error) {
+				return dial()
+			},
+		},
+	}
+
+	return client, nil
+}
+
+// lxdAPIError is returned for requests that LXD responded to with an error.
+type lxdAPIError struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Message    string
+}
+
+func (e *lxdAPIError) Error() string {
+	return fmt.Sprintf("lxd returned %d for %s %s: %s", e.StatusCode, e.Method, e.Path, e.Message)
+}
+
+func lxdIsNotFound(err error) bool {
+	apiErr, ok := err.(*lxdAPIError)
+	return ok && apiErr.StatusCode == http.StatusNotFound
+}
+
+// lxdIsNotRunning returns whether the error is LXD refusing to stop a
+// container that isn't running.
+func lxdIsNotRunning(err error) bool {
+	if opErr, ok := err.(*lxdOperationError); ok {
+		return strings.Contains(opErr.Message, "not running")
+	}
+	if apiErr, ok := err.(*lxdAPIError); ok {
+		return strings.Contains(apiErr.Message, "not running")
+	}
+	return false
+}
+
+// lxdOperationError is returned for operations that failed.
+type lxdOperationError struct {
+	ID      string
+	Message string
+}
+
+func (e *lxdOperationError) Error() string {
+	return fmt.Sprintf("lxd operation %s failed: %s", e.ID, e.Message)
+}
+
+// do sends the request with in, if not nil, as its JSON body and decodes the
+// response's metadata into out, if not nil.
+func (c *lxdClient) do(ctx gocontext.Context, method, path string, in, out interface{}) (*lxdResponse, error) {
+	b, err := c.request(ctx, method, path, in, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &lxdResponse{}
+	err = json.Unmarshal(b, resp)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't decode lxd response to %s %s: %v", method, path, err)
+	}
+
+	if out != nil && len(resp.Metadata) > 0 {
+		err = json.Unmarshal(resp.Metadata, out)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't decode lxd response to %s %s: %v", method, path, err)
+		}
+	}
+
+	return resp, nil
+}
+
+// lxdResponseError returns the error for a response without a 2xx status,
+// with the error LXD responded with, if any.
+func lxdResponseError(method, path string, statusCode int, body []byte) error {
+	errResp := &lxdResponse{}
+	if json.Unmarshal(body, errResp) != nil || errResp.Error == "" {
+		errResp.Error = strings.TrimSpace(string(body))
+	}
+
+	return &lxdAPIError{
+		Method:     method,
+		Path:       path,
+		StatusCode: statusCode,
+		Message:    errResp.Error,
+	}
+}
+
+// waitForOperation waits for the background operation at the given path to
+// finish, returning an error if it failed.
+func (c *lxdClient) waitForOperation(ctx gocontext.Context, operationPath string) (*lxdOperation, error) {
+	if operationPath == "" {
+		return nil, fmt.Errorf("lxd didn't return an operation")
+	}
+
+	op := &lxdOperation{}
+	_, err := c.do(ctx, "GET", fmt.Sprintf("%s/wait", operationPath), nil, op)
+	if err != nil {
+		return nil, err
+	}
+
+	if op.StatusCode >= 400 {
+		return nil, &lxdOperationError{ID: op.ID, Message: op.Err}
+	}
+
+	return op, nil
+}
+
+// dialWebsocket connects to the websocket at the given path.
+func (c *lxdClient) dialWebsocket(path string) (*websocketConn, error) {
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+
+	return newWebsocketConn(conn, c.host, path, nil)
+}
+
+// The types below are the parts of LXD's 1.0 API that the provider uses.
+
+type lxdResponse struct {
+	Type      string          `json:"type"`
+	Error     string          `json:"error"`
+	Operation string          `json:"operation"`
+	Metadata  json.RawMessage `json:"metadata"`
+}
+
+type lxdOperation struct {
+	ID         string          `json:"id"`
+	StatusCode int             `json:"status_code"`
+	Err        string          `json:"err"`
+	Metadata   json.RawMessage `json:"metadata"`
+}
+
+type lxdContainerCreate struct {
+	Name      string             `json:"name"`
+	Ephemeral bool               `json:"ephemeral"`
+	Profiles  []string           `json:"profiles"`
+	Config    map[string]string  `json:"config"`
+	Source    lxdContainerSource `json:"source"`
+}
+
+type lxdContainerSource struct {
+	Type  string `json:"type"`
+	Alias string `json:"alias"`
+}
+
+type lxdStateChange struct {
+	Action  string `json:"action"`
+	Timeout int    `json:"timeout"`
+	Force   bool   `json:"force"`
+}
+
+type lxdContainerState struct {
+	Network map[string]struct {
+		Addresses []struct {
+			Family  string `json:"family"`
+			Address string `json:"address"`
+			Scope   string `json:"scope"`
+		} `json:"addresses"`
+	} `json:"network"`
+}
+
+type lxdExec struct {
+	Command          []string          `json:"command"`
+	Environment      map[string]string `json:"environment"`
+	WaitForWebsocket bool              `json:"wait-for-websocket"`
+	Interactive      bool              `json:"interactive"`
+	Width            int               `json:"width"`
+	Height           int               `json:"height"`
+	User             int               `json:"user,omitempty"`
+	Group            int               `json:"group,omitempty"`
+	Cwd              string            `json:"cwd,omitempty"`
+}
+
+type lxdExecMetadata struct {
+	FDs    map[string]string `json:"fds"`
+	Return *int              `json:"return"`
+}
@@ -0,0 +1,256 @@
+package backend
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/travis-ci/worker/config"
+	gocontext "golang.org/x/net/context"
+)
+
+// lxdTestDaemon is a fake LXD daemon serving a single container, whose exec
+// writes output and exits with the given code, or hangs if output is empty.
+type lxdTestDaemon struct {
+	mutex sync.Mutex
+
+	output   string
+	exitCode int
+
+	create  *lxdContainerCreate
+	exec    *lxdExec
+	states  []lxdStateChange
+	files   map[string][]byte
+	deleted bool
+}
+
+func (d *lxdTestDaemon) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	async := func(operation string, metadata interface{}) {
+		w.WriteHeader(http.StatusAccepted)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"type":      "async",
+			"operation": fmt.Sprintf("/1.0/operations/%s", operation),
+			"metadata":  map[string]interface{}{"id": operation, "metadata": metadata},
+		})
+	}
+	syncResponse := func(metadata interface{}) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"type": "sync", "metadata": metadata})
+	}
+
+	if strings.HasSuffix(req.URL.Path, "/websocket") {
+		d.serveWebsocket(w, req)
+		return
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	switch {
+	case req.Method == "POST" && req.URL.Path == "/1.0/containers":
+		d.create = &lxdContainerCreate{}
+		_ = json.NewDecoder(req.Body).Decode(d.create)
+		async("create", nil)
+	case req.Method == "PUT" && strings.HasSuffix(req.URL.Path, "/state"):
+		state := lxdStateChange{}
+		_ = json.NewDecoder(req.Body).Decode(&state)
+		d.states = append(d.states, state)
+		async("state", nil)
+	case req.Method == "GET" && strings.HasSuffix(req.URL.Path, "/state"):
+		syncResponse(map[string]interface{}{
+			"network": map[string]interface{}{
+				"lo":   map[string]interface{}{"addresses": []map[string]string{{"family": "inet", "address": "127.0.0.1", "scope": "local"}}},
+				"eth0": map[string]interface{}{"addresses": []map[string]string{{"family": "inet", "address": "10.0.3.2", "scope": "global"}}},
+			},
+		})
+	case strings.HasSuffix(req.URL.Path, "/files"):
+		filePath := req.URL.Query().Get("path")
+		if req.Method == "POST" {
+			d.files[filePath], _ = ioutil.ReadAll(req.Body)
+			syncResponse(nil)
+			return
+		}
+		if _, ok := d.files[filePath]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"type": "error", "error": "not found", "error_code": 404})
+			return
+		}
+		_, _ = w.Write(d.files[filePath])
+	case req.Method == "POST" && strings.HasSuffix(req.URL.Path, "/exec"):
+		d.exec = &lxdExec{}
+		_ = json.NewDecoder(req.Body).Decode(d.exec)
+		async("exec", map[string]interface{}{"fds": map[string]string{"0": "stdout-secret", "control": "control-secret"}})
+	case req.Method == "DELETE":
+		d.deleted = true
+		async("delete", nil)
+	case req.Method == "GET" && req.URL.Path == "/1.0/operations/exec/wait":
+		syncResponse(map[string]interface{}{"id": "exec", "status_code": 200, "metadata": map[string]int{"return": d.exitCode}})
+	case req.Method == "GET" && strings.HasSuffix(req.URL.Path, "/wait"):
+		syncResponse(map[string]interface{}{"id": "op", "status_code": 200})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (d *lxdTestDaemon) serveWebsocket(w http.ResponseWriter, req *http.Request) {
+	accept := sha1.Sum([]byte(req.Header.Get("Sec-WebSocket-Key") + websocketGUID))
+
+	conn, rw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", base64.StdEncoding.EncodeToString(accept[:]))
+	_ = rw.Flush()
+
+	d.mutex.Lock()
+	output := d.output
+	d.mutex.Unlock()
+
+	if req.URL.Query().Get("secret") == "stdout-secret" && output != "" {
+		// a ping, the output and the closing frame
+		frames := []byte{0x89, 0x00, 0x82, byte(len(output))}
+		frames = append(frames, output...)
+		frames = append(frames, 0x88, 0x00)
+		_, _ = conn.Write(frames)
+	}
+
+	// hold the websocket open until the client closes it
+	_, _ = io.Copy(ioutil.Discard, rw)
+}
+
+func lxdTestProvider(t *testing.T, daemon *lxdTestDaemon, cfg map[string]string) (*lxdProvider, func()) {
+	dir, err := ioutil.TempDir("", "travis-lxd-test")
+	require.Nil(t, err)
+
+	socketPath := filepath.Join(dir, "unix.socket")
+	listener, err := net.Listen("unix", socketPath)
+	require.Nil(t, err)
+
+	daemon.files = map[string][]byte{}
+	server := httptest.NewUnstartedServer(daemon)
+	server.Listener = listener
+	server.Start()
+
+	cfg["ENDPOINT"] = fmt.Sprintf("unix://%s", socketPath)
+	cfg["BOOT_POLL_SLEEP"] = "1ms"
+	cfg["IMAGE_DEFAULT"] = "travis-trusty"
+
+	provider, err := newLXDProvider(config.ProviderConfigFromMap(cfg))
+	require.Nil(t, err)
+
+	return provider.(*lxdProvider), func() {
+		server.Close()
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func TestNewLXDProvider_InvalidConfig(t *testing.T) {
+	for _, tc := range []struct {
+		cfg map[string]string
+		err string
+	}{
+		{map[string]string{"ENDPOINT": "tcp://lxd:8443"}, `invalid ENDPOINT "tcp://lxd:8443", expected a unix:// socket path or an https:// URL`},
+		{map[string]string{"ENDPOINT": "https://lxd:8443"}, "https:// ENDPOINT requires TLS_CLIENT_CERT_PATH and TLS_CLIENT_KEY_PATH"},
+		{map[string]string{"EPHEMERAL": "sometimes"}, `invalid EPHEMERAL "sometimes": strconv.ParseBool: parsing "sometimes": invalid syntax`},
+		{map[string]string{"USER_ID": "travis"}, `invalid USER_ID "travis"`},
+		{map[string]string{"HOME": "travis"}, `invalid HOME "travis", expected an absolute path`},
+	} {
+		_, err := newLXDProvider(config.ProviderConfigFromMap(tc.cfg))
+		assert.EqualError(t, err, tc.err)
+	}
+}
+
+func TestLXDProvider_Start(t *testing.T) {
+	daemon := &lxdTestDaemon{output: "Hello from the container\r\n", exitCode: 137}
+	provider, cleanup := lxdTestProvider(t, daemon, map[string]string{
+		"PROFILES":      "default, builds",
+		"LIMITS_CPU":    "2",
+		"LIMITS_MEMORY": "4GB",
+		"EPHEMERAL":     "true",
+	})
+	defer cleanup()
+
+	instance, err := provider.Start(gocontext.TODO(), &StartAttributes{Language: "ruby"})
+	require.Nil(t, err)
+
+	assert.Equal(t, daemon.create.Name, instance.ID())
+	assert.True(t, strings.HasPrefix(instance.ID(), lxdContainerNamePrefix))
+	assert.Equal(t, &lxdContainerCreate{
+		Name:      instance.ID(),
+		Ephemeral: true,
+		Profiles:  []string{"default", "builds"},
+		Config:    map[string]string{"limits.cpu": "2", "limits.memory": "4GB"},
+		Source:    lxdContainerSource{Type: "image", Alias: "travis-trusty"},
+	}, daemon.create)
+	assert.Equal(t, []lxdStateChange{{Action: "start", Timeout: lxdStateChangeTimeout}}, daemon.states)
+
+	err = instance.UploadScript(gocontext.TODO(), []byte("echo hi\n"))
+	require.Nil(t, err)
+	assert.Equal(t, "echo hi\n", string(daemon.files["/home/travis/build.sh"]))
+
+	err = instance.UploadScript(gocontext.TODO(), []byte("echo hi\n"))
+	assert.Equal(t, ErrStaleVM, err)
+
+	output := &bytes.Buffer{}
+	result, err := instance.RunScript(gocontext.TODO(), output)
+	require.Nil(t, err)
+	assert.Equal(t, "Hello from the container\r\n", output.String())
+	assert.True(t, result.Completed)
+	assert.Equal(t, uint8(137), result.ExitCode)
+	assert.Equal(t, RunReasonSignal, result.Reason)
+	assert.Equal(t, "KILL", result.Signal)
+	assert.Equal(t, []string{"bash", "--login", "/home/travis/build.sh"}, daemon.exec.Command)
+	assert.Equal(t, 1000, daemon.exec.User)
+	assert.True(t, daemon.exec.Interactive)
+
+	err = instance.Stop(gocontext.TODO())
+	require.Nil(t, err)
+	assert.Equal(t, lxdStateChange{Action: "stop", Timeout: lxdStateChangeTimeout, Force: true}, daemon.states[1])
+	assert.True(t, daemon.deleted)
+}
+
+func TestLXDInstance_RunScriptCancelled(t *testing.T) {
+	daemon := &lxdTestDaemon{}
+	provider, cleanup := lxdTestProvider(t, daemon, map[string]string{})
+	defer cleanup()
+
+	instance, err := provider.Start(gocontext.TODO(), &StartAttributes{Language: "ruby"})
+	require.Nil(t, err)
+
+	ctx, cancel := gocontext.WithTimeout(gocontext.TODO(), 100*time.Millisecond)
+	defer cancel()
+
+	result, err := instance.RunScript(ctx, ioutil.Discard)
+	assert.Equal(t, gocontext.DeadlineExceeded, err)
+	assert.True(t, result.Cancelled)
+
+	daemon.mutex.Lock()
+	defer daemon.mutex.Unlock()
+	assert.True(t, daemon.states[len(daemon.states)-1].Force)
+	assert.True(t, daemon.deleted)
+}
+
+func TestLXDProvider_StartWithoutImage(t *testing.T) {
+	provider, err := newLXDProvider(config.ProviderConfigFromMap(map[string]string{}))
+	require.Nil(t, err)
+
+	_, err = provider.Start(gocontext.TODO(), &StartAttributes{Language: "ruby"})
+	require.IsType(t, &StartError{}, err)
+	assert.Equal(t, ErrImageNotFound, err.(*StartError).Cause)
+}
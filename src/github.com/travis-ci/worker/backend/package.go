@@ -6,8 +6,16 @@ import (
 	"encoding/base64"
 	"fmt"
 	"io"
+	"net/url"
 	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
 
+	"github.com/travis-ci/worker/config"
+	"github.com/travis-ci/worker/image"
 	"golang.org/x/net/context"
 )
 
@@ -17,6 +25,47 @@ var (
 	// afterwards.
 	ErrStaleVM = fmt.Errorf("previous build artifacts found on stale vm")
 
+	// ErrStaleVMRecycled is returned from one of the Instance methods if it
+	// detected a stale VM and already deleted it, so the instance must be
+	// replaced but doesn't need to be stopped.
+	ErrStaleVMRecycled = fmt.Errorf("stale vm was deleted")
+
+	// ErrQuotaExceeded is the cause of a StartError when starting an
+	// instance would exceed a quota or rate limit of the provider's account.
+	// Retrying after backing off may succeed.
+	ErrQuotaExceeded = fmt.Errorf("quota exceeded")
+
+	// ErrResourceExhausted is the cause of a StartError when the provider's
+	// zone or region is out of resources for the requested instance. Retrying
+	// later or in another zone may succeed.
+	ErrResourceExhausted = fmt.Errorf("resources exhausted")
+
+	// ErrImageNotFound is the cause of a StartError when no image could be
+	// found to start an instance from.
+	ErrImageNotFound = fmt.Errorf("image not found")
+
+	// ErrImageNotAllowed is the cause of a StartError when the job asked for
+	// an image that the provider isn't configured to allow.
+	ErrImageNotAllowed = fmt.Errorf("image not allowed")
+
+	// ErrImageMismatch is the cause of a StartError when the image that was
+	// selected doesn't match the OS or dist the job asked for.
+	ErrImageMismatch = fmt.Errorf("image doesn't match job")
+
+	// ErrBootTimeout is the cause of a StartError when the instance didn't
+	// finish booting before the context was done.
+	ErrBootTimeout = fmt.Errorf("timed out waiting for instance to boot")
+
+	// ErrBootHardTimeout is the cause of a StartError when the instance
+	// didn't become ready within the provider's hard boot deadline, however
+	// long the context allowed, and was deleted.
+	ErrBootHardTimeout = fmt.Errorf("instance didn't become ready within the boot hard timeout")
+
+	// ErrDiskEncryptionKey is the cause of a StartError when the provider
+	// couldn't use the key the instance's boot disk is configured to be
+	// encrypted with, e.g. for lack of permission.
+	ErrDiskEncryptionKey = fmt.Errorf("disk encryption key can't be used")
+
 	// ErrMissingEndpointConfig is returned if the provider config was missing
 	// an 'ENDPOINT' configuration, but one is required.
 	ErrMissingEndpointConfig = fmt.Errorf("expected config key endpoint")
@@ -53,6 +102,169 @@ type Instance interface {
 	ID() string
 }
 
+// An ExpiringInstance is an Instance that carries a timestamp after which it
+// is considered leaked and may be cleaned up by external tooling.
+type ExpiringInstance interface {
+	Instance
+
+	// Expires returns the time after which the instance may be deleted. The
+	// zero time is returned if no expiry is known.
+	Expires() time.Time
+}
+
+// A WarningInstance is an Instance that was started differently than the
+// job asked for, e.g. without a feature the provider doesn't allow.
+type WarningInstance interface {
+	Instance
+
+	// Warnings returns lines explaining how the instance differs from what
+	// the job asked for, which are shown in the job log.
+	Warnings() []string
+}
+
+// A Sweeper is a Provider that can clean up instances that were leaked, e.g.
+// because the worker was killed while booting them.
+type Sweeper interface {
+	// Sweep deletes leaked instances older than the given duration and
+	// returns how many were deleted.
+	Sweep(context.Context, time.Duration) (int, error)
+}
+
+// A Shutdowner is a Provider that holds resources, such as instances being
+// started, which should be cleaned up when the worker exits.
+type Shutdowner interface {
+	// Shutdown cleans up the provider's resources, returning once done or
+	// when the context is done. The provider can't be used afterwards.
+	Shutdown(context.Context) error
+}
+
+// Stages reported by a StartProgresser. Providers only report the stages
+// that apply to them.
+const (
+	ProgressStageInstanceInsert   = "instance-insert"
+	ProgressStageOperationRunning = "operation-running"
+	ProgressStageOperationDone    = "operation-done"
+	ProgressStageGroupAdd         = "group-add"
+	ProgressStageGroupAdded       = "group-added"
+)
+
+// A ProgressEntry reports that starting an instance reached a stage.
+type ProgressEntry struct {
+	Stage string
+	Time  time.Time
+
+	// Percent is how far the stage got, e.g. as reported by the provider's
+	// API for operation-running, which may be reported several times. It's
+	// only set for stages that are reported as percentages.
+	Percent int
+}
+
+// String returns the stage, followed by the percentage for stages reported
+// as percentages.
+func (e ProgressEntry) String() string {
+	if e.Stage == ProgressStageOperationRunning {
+		return fmt.Sprintf("%s %d%%", e.Stage, e.Percent)
+	}
+
+	return e.Stage
+}
+
+// A StartProgresser is a Provider that can report progress while starting an
+// instance.
+type StartProgresser interface {
+	// StartWithProgress starts an instance like Provider.Start, sending a
+	// ProgressEntry to the given channel as each stage is reached. Sends
+	// don't block, so entries are dropped if the channel isn't ready to
+	// receive them, and may happen after StartWithProgress returned. The
+	// channel is never closed by the provider.
+	StartWithProgress(context.Context, *StartAttributes, chan<- ProgressEntry) (Instance, error)
+}
+
+// An Executor is an Instance that can run arbitrary commands, e.g. to
+// collect diagnostics before it's stopped.
+type Executor interface {
+	// Exec runs the command and returns its combined stdout and stderr,
+	// which the provider may truncate. An error is returned if the command
+	// couldn't run or exited with a non-zero status, along with any output.
+	Exec(context.Context, string) ([]byte, error)
+}
+
+// A FileUploader is an Instance that can upload auxiliary files alongside the
+// build script, such as wrapper scripts or credentials the build needs.
+type FileUploader interface {
+	// UploadFiles uploads the contents of the files keyed by their paths,
+	// which are relative to the directory the build script runs in,
+	// creating parent directories as needed. Like UploadScript, it returns
+	// ErrStaleVM if the instance already has a build script, so the files
+	// must be uploaded before it. If a file fails, an *UploadFileError is
+	// returned.
+	UploadFiles(context.Context, map[string][]byte) error
+}
+
+// An UploadFileError is returned when uploading one of several files failed.
+type UploadFileError struct {
+	Path string
+	Err  error
+}
+
+func (e *UploadFileError) Error() string {
+	return fmt.Sprintf("couldn't upload %s: %v", e.Path, e.Err)
+}
+
+// A RecoverableError is an error that knows whether the operation that
+// failed may succeed if it's retried later, e.g. by requeueing the job.
+type RecoverableError interface {
+	error
+	Recoverable() bool
+}
+
+// IsRecoverable returns whether the operation that returned the given error
+// may succeed if retried. Errors that don't implement RecoverableError are
+// assumed to be recoverable.
+func IsRecoverable(err error) bool {
+	if re, ok := err.(RecoverableError); ok {
+		return re.Recoverable()
+	}
+
+	return true
+}
+
+// A StartError is returned by Provider.Start when the provider could
+// classify why an instance couldn't be started.
+type StartError struct {
+	// Cause is one of ErrQuotaExceeded, ErrResourceExhausted,
+	// ErrImageNotFound, ErrImageNotAllowed, ErrImageMismatch,
+	// ErrDiskEncryptionKey or ErrBootTimeout.
+	Cause error
+
+	// Err is the underlying error as returned by the provider's API.
+	Err error
+}
+
+func (e *StartError) Error() string {
+	return fmt.Sprintf("%v: %v", e.Cause, e.Err)
+}
+
+// Recoverable returns false if starting an instance can't succeed without
+// changing the job or the worker's configuration.
+func (e *StartError) Recoverable() bool {
+	return e.Cause != ErrImageNotFound && e.Cause != ErrImageNotAllowed && e.Cause != ErrImageMismatch && e.Cause != ErrDiskEncryptionKey
+}
+
+// ImageNotFoundError is the Err of a StartError with the ErrImageNotFound
+// cause when images were looked up by filters, listing every filter tried.
+type ImageNotFoundError struct {
+	Filters []string
+}
+
+func (e *ImageNotFoundError) Error() string {
+	if len(e.Filters) == 1 {
+		return fmt.Sprintf("no image found with filter %s", e.Filters[0])
+	}
+
+	return fmt.Sprintf("no image found with filters %s", strings.Join(e.Filters, "; "))
+}
+
 // StartAttributes contains some parts of the config which can be used to
 // determine the type of instance to boot up (for example, what image to use)
 type StartAttributes struct {
@@ -61,6 +273,61 @@ type StartAttributes struct {
 	Dist     string `json:"dist"`
 	Group    string `json:"group"`
 	OS       string `json:"os"`
+
+	// Privileged requests that the job's instance runs privileged, which
+	// providers only grant where configured to.
+	Privileged bool `json:"privileged"`
+
+	// ImageSelfLink is the self link of an image to boot instead of the one
+	// the provider would select, for providers that support it.
+	ImageSelfLink string `json:"image_self_link"`
+
+	// VMConfig is given alongside the job config in the job payload.
+	VMConfig VMConfig `json:"-"`
+
+	// JobID is the ID of the job the instance is started for. It isn't part
+	// of the job config, but is filled in by the caller of Provider.Start when
+	// known.
+	JobID uint64 `json:"-"`
+
+	// Repository is the slug of the job's repository. It isn't part of the
+	// job config, but is filled in by the caller of Provider.Start when
+	// known.
+	Repository string `json:"-"`
+
+	// HardTimeout is how long the job may run once the instance is started.
+	// It isn't part of the job config, but is filled in by the caller of
+	// Provider.Start when known.
+	HardTimeout time.Duration `json:"-"`
+
+	// LogSilenceTimeout is how long the job's script may go without writing
+	// any output, the worker's log timeout or the job's override of it. It
+	// isn't part of the job config, but is filled in by the caller of
+	// Provider.Start, and zero means there's no limit.
+	LogSilenceTimeout time.Duration `json:"-"`
+
+	// MaxLogLength is the number of bytes of output after which the job's
+	// script should be stopped, the length limit of the job's log. It isn't
+	// part of the job config, but is filled in by the caller of
+	// Provider.Start, and zero means there's no limit.
+	MaxLogLength int `json:"-"`
+}
+
+// VMConfig contains per-job settings for the VM a job runs on
+type VMConfig struct {
+	// Size is the provider-specific size of the VM, e.g. a machine type for
+	// GCE. Providers fall back to their configured default if it's empty or
+	// not allowed.
+	Size string `json:"size"`
+
+	// SkipInstanceGroup keeps the VM out of any instance group the provider
+	// would otherwise add it to, e.g. for canary pools.
+	SkipInstanceGroup bool `json:"skip_instance_group"`
+
+	// SkipVolumes keeps the volumes the provider would otherwise mount into
+	// the VM, e.g. shared caches, out of it, for jobs that must not share
+	// them.
+	SkipVolumes bool `json:"skip_volumes"`
 }
 
 // RunResult represents the result of running a script with Instance.RunScript.
@@ -71,6 +338,161 @@ type RunResult struct {
 	// Whether the script finished running or not. Can be false if there was a
 	// connection error in the middle of the script run.
 	Completed bool
+
+	// How long the script ran for. Only set by providers that measure it.
+	Duration time.Duration
+
+	// The number of bytes of output the script wrote. Only set by providers
+	// that measure it.
+	OutputBytes int64
+
+	// Whether the script was stopped because the context was done, in which
+	// case the job shouldn't be requeued. Only set by providers that stop
+	// scripts on cancellation.
+	Cancelled bool
+
+	// Whether the script was stopped because it didn't write any output for
+	// too long, in which case the job should be errored. Only set by
+	// providers that enforce a log silence timeout themselves.
+	TimedOut bool
+
+	// Whether the script was stopped because its output exceeded the maximum
+	// log length, in which case the job should be errored. Only set by
+	// providers that enforce a maximum log length themselves.
+	LogLimitExceeded bool
+
+	// Why the script stopped without exiting normally, RunReasonSignal or
+	// RunReasonExitMissing, in which case the job should be errored. Empty if
+	// it exited normally or the provider doesn't tell.
+	Reason string
+
+	// The name of the signal that killed the script, e.g. "KILL", if Reason
+	// is RunReasonSignal.
+	Signal string
+}
+
+// Reasons a script stopped without exiting normally, reported in
+// RunResult.Reason.
+const (
+	// RunReasonSignal means the script was killed by a signal, e.g. by the
+	// OOM killer.
+	RunReasonSignal = "signal"
+
+	// RunReasonExitMissing means the script stopped without an exit status,
+	// e.g. because the VM was shut down while it was running.
+	RunReasonExitMissing = "exit-missing"
+)
+
+// silenceWriter is an io.Writer that records when it was last written to.
+// It's safe to use from multiple goroutines as long as the underlying writer
+// is.
+type silenceWriter struct {
+	w         io.Writer
+	lastWrite int64
+}
+
+func newSilenceWriter(w io.Writer) *silenceWriter {
+	return &silenceWriter{w: w, lastWrite: time.Now().UnixNano()}
+}
+
+func (sw *silenceWriter) Write(p []byte) (int, error) {
+	atomic.StoreInt64(&sw.lastWrite, time.Now().UnixNano())
+	return sw.w.Write(p)
+}
+
+// SilentFor returns how long ago the writer was last written to, or created
+// if it wasn't written to yet.
+func (sw *silenceWriter) SilentFor() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&sw.lastWrite)))
+}
+
+// limitWriter is an io.Writer that forwards at most limit bytes to another
+// io.Writer, cutting off before any UTF-8 sequence that would cross the
+// limit, and discards everything after that. It's safe to use from multiple
+// goroutines.
+type limitWriter struct {
+	w     io.Writer
+	limit int64
+
+	mutex        sync.Mutex
+	written      int64
+	exceeded     bool
+	exceededChan chan struct{}
+}
+
+func newLimitWriter(w io.Writer, limit int64) *limitWriter {
+	return &limitWriter{w: w, limit: limit, exceededChan: make(chan struct{})}
+}
+
+func (lw *limitWriter) Write(p []byte) (int, error) {
+	lw.mutex.Lock()
+	defer lw.mutex.Unlock()
+
+	if lw.exceeded {
+		return len(p), nil
+	}
+
+	if int64(len(p)) <= lw.limit-lw.written {
+		n, err := lw.w.Write(p)
+		lw.written += int64(n)
+		return n, err
+	}
+
+	cut := int(lw.limit - lw.written)
+	for cut > 0 && !utf8.RuneStart(p[cut]) {
+		cut--
+	}
+
+	lw.exceeded = true
+	close(lw.exceededChan)
+
+	n, err := lw.w.Write(p[:cut])
+	lw.written += int64(n)
+	if err != nil {
+		return n, err
+	}
+
+	return len(p), nil
+}
+
+// Exceeded returns a channel that's closed once more than limit bytes were
+// written.
+func (lw *limitWriter) Exceeded() <-chan struct{} {
+	return lw.exceededChan
+}
+
+// countingWriter is an io.Writer that counts the bytes written through it to
+// another io.Writer. It's safe to use from multiple goroutines as long as the
+// underlying writer is.
+type countingWriter struct {
+	w     io.Writer
+	count int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	atomic.AddInt64(&cw.count, int64(n))
+	return n, err
+}
+
+// Count returns the number of bytes written so far.
+func (cw *countingWriter) Count() int64 {
+	return atomic.LoadInt64(&cw.count)
+}
+
+// syncWriter is an io.Writer that serializes writes to another io.Writer, so
+// that writers used from multiple goroutines, such as the stdout and stderr
+// of a session, write whole chunks in the order they arrive.
+type syncWriter struct {
+	w     io.Writer
+	mutex sync.Mutex
+}
+
+func (sw *syncWriter) Write(p []byte) (int, error) {
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
+
+	return sw.w.Write(p)
 }
 
 func generatePassword() string {
@@ -80,3 +502,19 @@ func generatePassword() string {
 	str := base64.StdEncoding.EncodeToString(hash)
 	return punctRegex.ReplaceAllLiteralString(str, "")[0:19]
 }
+
+// buildImageSelector returns the "env" or "api" image selector.
+func buildImageSelector(selectorType string, cfg *config.ProviderConfig) (image.Selector, error) {
+	switch selectorType {
+	case "env":
+		return image.NewEnvSelector(cfg)
+	case "api":
+		baseURL, err := url.Parse(cfg.Get("IMAGE_SELECTOR_URL"))
+		if err != nil {
+			return nil, err
+		}
+		return image.NewAPISelector(baseURL), nil
+	default:
+		return nil, fmt.Errorf("invalid image selector type %q", selectorType)
+	}
+}
@@ -1,8 +1,15 @@
 package backend
 
 import (
+	"bytes"
 	"fmt"
 	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
 )
 
 type recordingHTTPTransport struct {
@@ -13,3 +20,90 @@ func (t *recordingHTTPTransport) RoundTrip(req *http.Request) (*http.Response, e
 	t.req = req
 	return nil, fmt.Errorf("recording HTTP transport impl")
 }
+
+func TestIsRecoverable(t *testing.T) {
+	assert.True(t, IsRecoverable(fmt.Errorf("some error")))
+	assert.True(t, IsRecoverable(&StartError{Cause: ErrQuotaExceeded, Err: fmt.Errorf("quota exceeded")}))
+	assert.True(t, IsRecoverable(&StartError{Cause: ErrResourceExhausted, Err: fmt.Errorf("out of resources")}))
+	assert.True(t, IsRecoverable(&StartError{Cause: ErrBootTimeout, Err: fmt.Errorf("timed out")}))
+	assert.False(t, IsRecoverable(&StartError{Cause: ErrImageNotFound, Err: fmt.Errorf("no image")}))
+	assert.False(t, IsRecoverable(&StartError{Cause: ErrDiskEncryptionKey, Err: fmt.Errorf("permission denied")}))
+}
+
+func TestCountingWriter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	cw := &countingWriter{w: buf}
+
+	fmt.Fprint(cw, "hello ")
+	fmt.Fprint(cw, "world")
+
+	assert.Equal(t, int64(11), cw.Count())
+	assert.Equal(t, "hello world", buf.String())
+}
+
+func TestSilenceWriter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	sw := newSilenceWriter(buf)
+
+	time.Sleep(20 * time.Millisecond)
+	assert.True(t, sw.SilentFor() >= 20*time.Millisecond)
+
+	fmt.Fprint(sw, "hello")
+	assert.True(t, sw.SilentFor() < 20*time.Millisecond)
+	assert.Equal(t, "hello", buf.String())
+}
+
+func TestLimitWriter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	lw := newLimitWriter(buf, 7)
+
+	n, err := fmt.Fprint(lw, "hello")
+	assert.Nil(t, err)
+	assert.Equal(t, 5, n)
+
+	select {
+	case <-lw.Exceeded():
+		t.Fatal("limit exceeded too early")
+	default:
+	}
+
+	// "wörld" would cross the limit in the middle of "ö"
+	n, err = fmt.Fprint(lw, "wörld")
+	assert.Nil(t, err)
+	assert.Equal(t, 6, n)
+	assert.Equal(t, "hellow", buf.String())
+
+	select {
+	case <-lw.Exceeded():
+	default:
+		t.Fatal("limit not exceeded")
+	}
+
+	n, err = fmt.Fprint(lw, "more")
+	assert.Nil(t, err)
+	assert.Equal(t, 4, n)
+	assert.Equal(t, "hellow", buf.String())
+}
+
+func TestSyncWriter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	sw := &syncWriter{w: buf}
+
+	var wg sync.WaitGroup
+	for _, chunk := range []string{"stdout\n", "stderr\n"} {
+		wg.Add(1)
+		go func(chunk string) {
+			defer wg.Done()
+			for n := 0; n < 100; n++ {
+				_, _ = fmt.Fprint(sw, chunk)
+			}
+		}(chunk)
+	}
+	wg.Wait()
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	assert.Len(t, lines, 200)
+	for _, line := range lines {
+		assert.Contains(t, []string{"stdout", "stderr"}, line)
+	}
+}
@@ -0,0 +1,45 @@
+package backend
+
+import (
+	"time"
+
+	"github.com/cenkalti/backoff"
+	gocontext "golang.org/x/net/context"
+)
+
+// pollUntil calls check until it returns true or an error, sleeping between
+// calls with an exponential backoff that starts at interval, is capped at
+// maxInterval and is jittered so that many instances booting at once don't
+// poll in lockstep. The context's error is returned once it's done.
+func pollUntil(ctx gocontext.Context, interval, maxInterval time.Duration, check func() (bool, error)) error {
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = interval
+	b.MaxInterval = maxInterval
+	b.MaxElapsedTime = 0
+	b.Reset()
+
+	for {
+		done, err := check()
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(b.NextBackOff()):
+		}
+	}
+}
+
+// pollMaxSleep returns the longest the backoff of polls starting at sleep
+// grows to, which is max unless sleep is longer.
+func pollMaxSleep(sleep, max time.Duration) time.Duration {
+	if sleep > max {
+		return sleep
+	}
+	return max
+}
@@ -0,0 +1,38 @@
+package backend
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	gocontext "golang.org/x/net/context"
+)
+
+func TestPollUntil(t *testing.T) {
+	checks := 0
+	err := pollUntil(gocontext.TODO(), time.Millisecond, 2*time.Millisecond, func() (bool, error) {
+		checks++
+		return checks == 3, nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, checks)
+
+	checkErr := errors.New("broken")
+	err = pollUntil(gocontext.TODO(), time.Millisecond, time.Millisecond, func() (bool, error) {
+		return false, checkErr
+	})
+	assert.Equal(t, checkErr, err)
+
+	ctx, cancel := gocontext.WithTimeout(gocontext.TODO(), 20*time.Millisecond)
+	defer cancel()
+	err = pollUntil(ctx, time.Millisecond, 5*time.Millisecond, func() (bool, error) {
+		return false, nil
+	})
+	assert.Equal(t, gocontext.DeadlineExceeded, err)
+}
+
+func TestPollMaxSleep(t *testing.T) {
+	assert.Equal(t, 10*time.Second, pollMaxSleep(3*time.Second, 10*time.Second))
+	assert.Equal(t, 30*time.Second, pollMaxSleep(30*time.Second, 10*time.Second))
+}
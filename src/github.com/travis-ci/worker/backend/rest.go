@@ -0,0 +1,109 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	gocontext "golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
+)
+
+// restClient is a minimal client of a JSON REST API, shared by the providers
+// that talk to their API without a vendored client.
+type restClient struct {
+	// baseURL is what API paths are appended to
+	baseURL string
+	client  *http.Client
+
+	// header, if set, adds headers such as credentials to every request
+	header func(http.Header) error
+	// responseError returns the error for a response without a 2xx status
+	responseError func(method, path string, statusCode int, body []byte) error
+}
+
+// do sends the request with in, if not nil, as its JSON body and decodes the
+// response into out, if not nil and the response has a body.
+func (c *restClient) do(ctx gocontext.Context, method, path string, in, out interface{}) error {
+	b, err := c.request(ctx, method, path, in, nil)
+	if err != nil {
+		return err
+	}
+
+	return restDecode(method, path, b, out)
+}
+
+// request sends the request with in, if not nil, as its JSON body and the
+// given additional headers, and returns the response body.
+func (c *restClient) request(ctx gocontext.Context, method, path string, in interface{}, header http.Header) ([]byte, error) {
+	var body io.Reader
+	jsonHeader := http.Header{}
+	for key, values := range header {
+		jsonHeader[key] = values
+	}
+	jsonHeader.Set("Accept", "application/json")
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(b)
+		jsonHeader.Set("Content-Type", "application/json")
+	}
+
+	return c.send(ctx, method, path, body, jsonHeader)
+}
+
+// send sends the request and returns the response body if the API responded
+// with a 2xx status.
+func (c *restClient) send(ctx gocontext.Context, method, path string, body io.Reader, header http.Header) ([]byte, error) {
+	req, err := http.NewRequest(method, c.baseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	if c.header != nil {
+		err = c.header(req.Header)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	resp, err := ctxhttp.Do(ctx, c.client, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode/100 != 2 {
+		return nil, c.responseError(method, path, resp.StatusCode, b)
+	}
+
+	return b, nil
+}
+
+// restDecode decodes the response body b into out, unless out is nil or the
+// body is empty.
+func restDecode(method, path string, b []byte, out interface{}) error {
+	if out == nil || len(bytes.TrimSpace(b)) == 0 {
+		return nil
+	}
+
+	err := json.Unmarshal(b, out)
+	if err != nil {
+		return fmt.Errorf("couldn't decode response to %s %s: %v", method, path, err)
+	}
+
+	return nil
+}
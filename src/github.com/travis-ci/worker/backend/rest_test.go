@@ -0,0 +1,72 @@
+package backend
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	gocontext "golang.org/x/net/context"
+)
+
+func TestRESTClient_Do(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "application/json", req.Header.Get("Accept"))
+		assert.Equal(t, "Bearer token", req.Header.Get("Authorization"))
+
+		switch req.URL.Path {
+		case "/echo":
+			assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
+			b, _ := ioutil.ReadAll(req.Body)
+			_, _ = w.Write(b)
+		case "/empty":
+			assert.Equal(t, "", req.Header.Get("Content-Type"))
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "no such path")
+		}
+	}))
+	defer server.Close()
+
+	c := &restClient{
+		baseURL: server.URL,
+		client:  server.Client(),
+		header: func(header http.Header) error {
+			header.Set("Authorization", "Bearer token")
+			return nil
+		},
+		responseError: func(method, path string, statusCode int, body []byte) error {
+			return fmt.Errorf("%s %s returned %d: %s", method, path, statusCode, body)
+		},
+	}
+
+	out := map[string]string{}
+	err := c.do(gocontext.TODO(), "POST", "/echo", map[string]string{"name": "travis"}, &out)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"name": "travis"}, out)
+
+	out = map[string]string{}
+	err = c.do(gocontext.TODO(), "DELETE", "/empty", nil, &out)
+	assert.Nil(t, err)
+	assert.Empty(t, out)
+
+	err = c.do(gocontext.TODO(), "GET", "/missing", nil, nil)
+	assert.EqualError(t, err, "GET /missing returned 404: no such path")
+}
+
+func TestRESTDecode(t *testing.T) {
+	out := []string{}
+	assert.Nil(t, restDecode("GET", "/list", []byte(`["a", "b"]`), &out))
+	assert.Equal(t, []string{"a", "b"}, out)
+
+	assert.Nil(t, restDecode("GET", "/list", []byte(" \n"), &out))
+	assert.Nil(t, restDecode("GET", "/list", []byte("not json"), nil))
+
+	err := restDecode("GET", "/list", []byte("not json"), &out)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "couldn't decode response to GET /list")
+	}
+}
@@ -0,0 +1,45 @@
+package backend
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// sftpPartialWriteError is returned when an uploaded file doesn't have the
+// size of its contents, e.g. because the connection was reset mid-write.
+type sftpPartialWriteError struct {
+	written  int64
+	expected int64
+}
+
+func (e *sftpPartialWriteError) Error() string {
+	return fmt.Sprintf("uploaded file is %d bytes, expected %d", e.written, e.expected)
+}
+
+// sftpFile is the part of *sftp.File that sftpWriteFile uses.
+type sftpFile interface {
+	io.WriteCloser
+	Chmod(os.FileMode) error
+}
+
+// sftpWriteFile writes the contents to f, setting its mode and closing it.
+// The error from closing f is returned too, as data buffered by the server
+// may only fail to be written then.
+func sftpWriteFile(f sftpFile, contents []byte, mode os.FileMode) error {
+	n, err := f.Write(contents)
+	if err == nil && n != len(contents) {
+		err = &sftpPartialWriteError{written: int64(n), expected: int64(len(contents))}
+	}
+
+	if err == nil {
+		err = f.Chmod(mode)
+	}
+
+	closeErr := f.Close()
+	if err != nil {
+		return err
+	}
+
+	return closeErr
+}
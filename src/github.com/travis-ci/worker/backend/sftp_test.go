@@ -0,0 +1,57 @@
+package backend
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// sftpTestFile is an sftpFile that can fail to be closed and write only part
+// of what it's given.
+type sftpTestFile struct {
+	bytes.Buffer
+	maxWrite int
+	closeErr error
+	closed   bool
+	mode     os.FileMode
+}
+
+func (f *sftpTestFile) Write(p []byte) (int, error) {
+	if f.maxWrite > 0 && len(p) > f.maxWrite {
+		p = p[:f.maxWrite]
+	}
+	return f.Buffer.Write(p)
+}
+
+func (f *sftpTestFile) Chmod(mode os.FileMode) error {
+	f.mode = mode
+	return nil
+}
+
+func (f *sftpTestFile) Close() error {
+	f.closed = true
+	return f.closeErr
+}
+
+func TestSFTPWriteFile(t *testing.T) {
+	f := &sftpTestFile{}
+	err := sftpWriteFile(f, []byte("echo hi\n"), 0755)
+	assert.Nil(t, err)
+	assert.True(t, f.closed)
+	assert.Equal(t, os.FileMode(0755), f.mode)
+	assert.Equal(t, "echo hi\n", f.String())
+
+	f = &sftpTestFile{closeErr: fmt.Errorf("connection reset")}
+	err = sftpWriteFile(f, []byte("echo hi\n"), 0755)
+	assert.EqualError(t, err, "connection reset")
+	assert.True(t, f.closed)
+
+	f = &sftpTestFile{maxWrite: 4, closeErr: fmt.Errorf("connection reset")}
+	err = sftpWriteFile(f, []byte("echo hi\n"), 0755)
+	assert.Equal(t, &sftpPartialWriteError{written: 4, expected: 8}, err)
+	assert.True(t, f.closed)
+	assert.Equal(t, os.FileMode(0), f.mode)
+}
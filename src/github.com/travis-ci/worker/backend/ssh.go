@@ -0,0 +1,383 @@
+package backend
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/context"
+)
+
+// sshDialer dials SSH connections with a timeout, retrying network failures,
+// and keeps the connections it made alive by periodically sending keepalive
+// requests.
+type sshDialer struct {
+	// DialTimeout bounds both the TCP connection and the SSH handshake.
+	DialTimeout time.Duration
+
+	// KeepaliveInterval is how often a keepalive request is sent over
+	// established connections. Keepalives are disabled if it's zero.
+	KeepaliveInterval time.Duration
+
+	// Retries is how many times dialing is retried after a network failure.
+	// Authentication failures are never retried.
+	Retries int
+
+	// RetrySleep is how long to wait between retries.
+	RetrySleep time.Duration
+
+	// Bastion is a host to connect through, or nil to connect directly.
+	Bastion *sshBastion
+}
+
+// sshBastion is a jump host that sshDialer connects to first, connecting to
+// the destination over a direct-tcpip channel opened through it.
+type sshBastion struct {
+	Addr   string
+	Config *ssh.ClientConfig
+}
+
+// sshAuthError is returned by sshDialer.Dial when the server rejected all
+// authentication methods.
+type sshAuthError struct {
+	hop string
+	err error
+}
+
+func (e *sshAuthError) Error() string {
+	return fmt.Sprintf("ssh authentication failed%s: %v", sshHopSuffix(e.hop), e.err)
+}
+
+// sshNetworkError is returned by sshDialer.Dial when the server couldn't be
+// reached or the handshake didn't complete.
+type sshNetworkError struct {
+	hop string
+	err error
+}
+
+func (e *sshNetworkError) Error() string {
+	return fmt.Sprintf("ssh connection failed%s: %v", sshHopSuffix(e.hop), e.err)
+}
+
+// sshHostKeyError is returned by sshDialer.Dial when the config's
+// HostKeyCallback rejected the server's host key. Unless the callback's error
+// has a Temporary method returning true, in which case an *sshNetworkError is
+// returned instead, it's never retried.
+type sshHostKeyError struct {
+	hop string
+	err error
+}
+
+func (e *sshHostKeyError) Error() string {
+	return fmt.Sprintf("ssh host key verification failed%s: %v", sshHopSuffix(e.hop), e.err)
+}
+
+// sshHopSuffix says which hop an error happened at when connecting through a
+// bastion.
+func sshHopSuffix(hop string) string {
+	if hop == "" {
+		return ""
+	}
+
+	return " at " + hop
+}
+
+// Dial connects to the given address, giving up when the context is done.
+func (d *sshDialer) Dial(ctx context.Context, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	var err error
+
+	for attempt := 0; attempt <= d.Retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(d.RetrySleep):
+			}
+		}
+
+		var client *ssh.Client
+		client, err = d.dialAttempt(ctx, addr, config)
+		if err == nil {
+			if d.KeepaliveInterval > 0 {
+				go sshKeepalive(client, d.KeepaliveInterval)
+			}
+			return client, nil
+		}
+
+		if _, ok := err.(*sshNetworkError); !ok {
+			return nil, err
+		}
+	}
+
+	return nil, err
+}
+
+func (d *sshDialer) dialAttempt(ctx context.Context, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	type dialResult struct {
+		client *ssh.Client
+		err    error
+	}
+
+	resultChan := make(chan dialResult, 1)
+
+	go func() {
+		client, err := d.dialSync(ctx, addr, config)
+		resultChan <- dialResult{client: client, err: err}
+	}()
+
+	select {
+	case result := <-resultChan:
+		return result.client, result.err
+	case <-ctx.Done():
+		go func() {
+			result := <-resultChan
+			if result.client != nil {
+				_ = result.client.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// dialSync dials and completes the handshake, through the bastion if there
+// is one. The vendored ssh package has no ClientConfig.Timeout, so the TCP
+// connection is made with a net.Dialer that gives up when the context is
+// done, and the handshake is bounded by closing the connection once the dial
+// timeout passed.
+func (d *sshDialer) dialSync(ctx context.Context, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	dialer := &net.Dialer{Timeout: d.DialTimeout}
+
+	if d.Bastion == nil {
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return nil, &sshNetworkError{err: err}
+		}
+
+		return d.handshake(conn, addr, config, "")
+	}
+
+	bastionHop := fmt.Sprintf("bastion %s", d.Bastion.Addr)
+	bastionConn, err := dialer.DialContext(ctx, "tcp", d.Bastion.Addr)
+	if err != nil {
+		return nil, &sshNetworkError{hop: bastionHop, err: err}
+	}
+
+	bastion, err := d.handshake(bastionConn, d.Bastion.Addr, d.Bastion.Config, bastionHop)
+	if err != nil {
+		return nil, err
+	}
+
+	instanceHop := fmt.Sprintf("%s via %s", addr, bastionHop)
+	conn, err := bastion.Dial("tcp", addr)
+	if err != nil {
+		_ = bastion.Close()
+		return nil, &sshNetworkError{hop: instanceHop, err: err}
+	}
+
+	client, err := d.handshake(conn, addr, config, instanceHop)
+	if err != nil {
+		_ = bastion.Close()
+		return nil, err
+	}
+
+	if d.KeepaliveInterval > 0 {
+		go sshKeepalive(bastion, d.KeepaliveInterval)
+	}
+
+	go func() {
+		_ = client.Wait()
+		_ = bastion.Close()
+	}()
+
+	return client, nil
+}
+
+// handshake sets up an ssh client over the connection, classifying errors as
+// happening at the given hop.
+func (d *sshDialer) handshake(conn net.Conn, addr string, config *ssh.ClientConfig, hop string) (*ssh.Client, error) {
+	var timer *time.Timer
+	if d.DialTimeout > 0 {
+		timer = time.AfterFunc(d.DialTimeout, func() {
+			_ = conn.Close()
+		})
+	}
+
+	var hostKeyErr error
+	if config.HostKeyCallback != nil {
+		origConfig := config
+		configCopy := *config
+		configCopy.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			hostKeyErr = origConfig.HostKeyCallback(hostname, remote, key)
+			return hostKeyErr
+		}
+		config = &configCopy
+	}
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if timer != nil && !timer.Stop() && err == nil {
+		// the connection was closed right after the handshake completed
+		_ = c.Close()
+		err = fmt.Errorf("handshake timed out")
+	}
+
+	if err != nil {
+		_ = conn.Close()
+		if hostKeyErr != nil {
+			if temp, ok := hostKeyErr.(interface {
+				Temporary() bool
+			}); ok && temp.Temporary() {
+				return nil, &sshNetworkError{hop: hop, err: hostKeyErr}
+			}
+			return nil, &sshHostKeyError{hop: hop, err: hostKeyErr}
+		}
+		if strings.Contains(err.Error(), "unable to authenticate") {
+			return nil, &sshAuthError{hop: hop, err: err}
+		}
+		return nil, &sshNetworkError{hop: hop, err: err}
+	}
+
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// sshKeepalive sends keepalive requests over the client's connection until
+// sending one fails, which happens once the connection is closed.
+func sshKeepalive(client *ssh.Client, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// sshKnownHosts holds the entries of an OpenSSH known_hosts file.
+// Markers such as @cert-authority and @revoked aren't supported, and lines
+// using them are skipped.
+type sshKnownHosts struct {
+	entries []sshKnownHostsEntry
+}
+
+type sshKnownHostsEntry struct {
+	patterns []string
+	key      ssh.PublicKey
+}
+
+// parseSSHKnownHosts parses the contents of a known_hosts file.
+func parseSSHKnownHosts(contents []byte) (*sshKnownHosts, error) {
+	kh := &sshKnownHosts{}
+
+	for n, line := range strings.Split(string(contents), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "@") {
+			continue
+		}
+
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("known hosts line %d: missing key", n+1)
+		}
+
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(fields[1]))
+		if err != nil {
+			return nil, fmt.Errorf("known hosts line %d: %v", n+1, err)
+		}
+
+		kh.entries = append(kh.entries, sshKnownHostsEntry{
+			patterns: strings.Split(fields[0], ","),
+			key:      key,
+		})
+	}
+
+	return kh, nil
+}
+
+// HostKeyCallback accepts a host key if an entry for the host has the same
+// key. The host may be given with or without a port.
+func (kh *sshKnownHosts) HostKeyCallback(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	host, port, err := net.SplitHostPort(hostname)
+	if err != nil {
+		host, port = hostname, "22"
+	}
+
+	names := []string{host}
+	if port != "22" {
+		names = []string{fmt.Sprintf("[%s]:%s", host, port)}
+	}
+
+	known := false
+	for _, entry := range kh.entries {
+		if !entry.matches(names) {
+			continue
+		}
+
+		known = true
+		if bytes.Equal(entry.key.Marshal(), key.Marshal()) {
+			return nil
+		}
+	}
+
+	if known {
+		return fmt.Errorf("host key for %s doesn't match any known host key", hostname)
+	}
+
+	return fmt.Errorf("no known host key for %s", hostname)
+}
+
+func (e sshKnownHostsEntry) matches(names []string) bool {
+	matched := false
+	for _, pattern := range e.patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+
+		for _, name := range names {
+			if !sshKnownHostsPatternMatches(pattern, name) {
+				continue
+			}
+
+			if negated {
+				return false
+			}
+			matched = true
+		}
+	}
+
+	return matched
+}
+
+// sshKnownHostsPatternMatches matches a host name against a known_hosts
+// pattern, which is either hashed ("|1|salt|hash") or may contain the
+// wildcards "*" and "?".
+func sshKnownHostsPatternMatches(pattern, name string) bool {
+	if strings.HasPrefix(pattern, "|1|") {
+		parts := strings.Split(pattern[3:], "|")
+		if len(parts) != 2 {
+			return false
+		}
+
+		salt, err := base64.StdEncoding.DecodeString(parts[0])
+		if err != nil {
+			return false
+		}
+
+		mac := hmac.New(sha1.New, salt)
+		_, _ = mac.Write([]byte(name))
+		return base64.StdEncoding.EncodeToString(mac.Sum(nil)) == parts[1]
+	}
+
+	expr := regexp.QuoteMeta(pattern)
+	expr = strings.Replace(expr, `\*`, ".*", -1)
+	expr = strings.Replace(expr, `\?`, ".", -1)
+
+	matched, err := regexp.MatchString("^"+expr+"$", name)
+	return err == nil && matched
+}
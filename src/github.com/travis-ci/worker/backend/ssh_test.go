@@ -0,0 +1,429 @@
+package backend
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/context"
+)
+
+func sshTestSigner(t *testing.T) ssh.Signer {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signer
+}
+
+// sshTestServer accepts connections and serves the ssh handshake, accepting
+// only the given client key.
+func sshTestServer(t *testing.T, clientKey ssh.PublicKey) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverConfig := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) == string(clientKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, assert.AnError
+		},
+	}
+	serverConfig.AddHostKey(sshTestSigner(t))
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				_, chans, reqs, err := ssh.NewServerConn(conn, serverConfig)
+				if err != nil {
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+				for newChan := range chans {
+					_ = newChan.Reject(ssh.Prohibited, "no channels")
+				}
+			}()
+		}
+	}()
+
+	return listener
+}
+
+// sshTestExecServer is like sshTestServer, but accepts session channels and
+// PTY requests, and calls handle with the channel once a command is executed
+// on it, closing the channel afterwards. A signal sent to the command ends it
+// as if it was killed by the signal.
+func sshTestExecServer(t *testing.T, clientKey ssh.PublicKey, handle func(ssh.Channel)) net.Listener {
+	return sshTestSignalServer(t, clientKey, handle, nil)
+}
+
+// sshTestSignalServer is like sshTestExecServer, but also sends the names of
+// the signals sent to commands to signals.
+func sshTestSignalServer(t *testing.T, clientKey ssh.PublicKey, handle func(ssh.Channel), signals chan<- string) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverConfig := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) == string(clientKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, assert.AnError
+		},
+	}
+	serverConfig.AddHostKey(sshTestSigner(t))
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				_, chans, reqs, err := ssh.NewServerConn(conn, serverConfig)
+				if err != nil {
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+				for newChan := range chans {
+					if newChan.ChannelType() != "session" {
+						_ = newChan.Reject(ssh.UnknownChannelType, "only sessions")
+						continue
+					}
+
+					ch, chReqs, err := newChan.Accept()
+					if err != nil {
+						continue
+					}
+
+					go func() {
+						for req := range chReqs {
+							_ = req.Reply(req.Type == "exec" || req.Type == "pty-req", nil)
+							switch req.Type {
+							case "exec":
+								go func() {
+									handle(ch)
+									_ = ch.Close()
+								}()
+							case "signal":
+								signal := struct{ Signal string }{}
+								_ = ssh.Unmarshal(req.Payload, &signal)
+								if signals != nil {
+									signals <- signal.Signal
+								}
+
+								_, _ = ch.SendRequest("exit-signal", false, ssh.Marshal(struct {
+									Signal     string
+									CoreDumped bool
+									Error      string
+									Lang       string
+								}{signal.Signal, false, "", ""}))
+								_ = ch.Close()
+							}
+						}
+					}()
+				}
+			}()
+		}
+	}()
+
+	return listener
+}
+
+// sshTestBastionServer is like sshTestServer, but forwards direct-tcpip
+// channels to the address they ask for.
+func sshTestBastionServer(t *testing.T, clientKey ssh.PublicKey) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverConfig := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) == string(clientKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, assert.AnError
+		},
+	}
+	serverConfig.AddHostKey(sshTestSigner(t))
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				_, chans, reqs, err := ssh.NewServerConn(conn, serverConfig)
+				if err != nil {
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+				for newChan := range chans {
+					var msg struct {
+						RAddr string
+						RPort uint32
+						LAddr string
+						LPort uint32
+					}
+					if newChan.ChannelType() != "direct-tcpip" || ssh.Unmarshal(newChan.ExtraData(), &msg) != nil {
+						_ = newChan.Reject(ssh.Prohibited, "only direct-tcpip")
+						continue
+					}
+
+					target, err := net.Dial("tcp", net.JoinHostPort(msg.RAddr, fmt.Sprintf("%d", msg.RPort)))
+					if err != nil {
+						_ = newChan.Reject(ssh.ConnectionFailed, err.Error())
+						continue
+					}
+
+					ch, chReqs, err := newChan.Accept()
+					if err != nil {
+						_ = target.Close()
+						continue
+					}
+					go ssh.DiscardRequests(chReqs)
+
+					go func() {
+						_, _ = io.Copy(ch, target)
+						_ = ch.Close()
+					}()
+					go func() {
+						_, _ = io.Copy(target, ch)
+						_ = target.Close()
+					}()
+				}
+			}()
+		}
+	}()
+
+	return listener
+}
+
+func TestSSHDialer_Dial(t *testing.T) {
+	signer := sshTestSigner(t)
+	listener := sshTestServer(t, signer.PublicKey())
+	defer listener.Close()
+
+	d := &sshDialer{DialTimeout: time.Second, KeepaliveInterval: 10 * time.Millisecond}
+
+	client, err := d.Dial(context.TODO(), listener.Addr().String(), &ssh.ClientConfig{
+		User: "travis",
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
+	})
+	if assert.Nil(t, err) {
+		time.Sleep(30 * time.Millisecond)
+		_, _, err = client.SendRequest("keepalive@openssh.com", true, nil)
+		assert.Nil(t, err)
+		client.Close()
+	}
+}
+
+func TestSSHDialer_DialAuthFailure(t *testing.T) {
+	listener := sshTestServer(t, sshTestSigner(t).PublicKey())
+	defer listener.Close()
+
+	d := &sshDialer{DialTimeout: time.Second, Retries: 2}
+
+	_, err := d.Dial(context.TODO(), listener.Addr().String(), &ssh.ClientConfig{
+		User: "travis",
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(sshTestSigner(t))},
+	})
+	assert.IsType(t, &sshAuthError{}, err)
+}
+
+func TestSSHDialer_DialHostKeyMismatch(t *testing.T) {
+	signer := sshTestSigner(t)
+	listener := sshTestServer(t, signer.PublicKey())
+	defer listener.Close()
+
+	d := &sshDialer{DialTimeout: time.Second, Retries: 2}
+
+	calls := 0
+	_, err := d.Dial(context.TODO(), listener.Addr().String(), &ssh.ClientConfig{
+		User: "travis",
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			calls++
+			return assert.AnError
+		},
+	})
+	assert.IsType(t, &sshHostKeyError{}, err)
+	assert.Equal(t, 1, calls)
+}
+
+func TestSSHKnownHosts_HostKeyCallback(t *testing.T) {
+	key := sshTestSigner(t).PublicKey()
+	otherKey := sshTestSigner(t).PublicKey()
+	authorizedKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+
+	mac := hmac.New(sha1.New, []byte("salt"))
+	_, _ = mac.Write([]byte("10.0.0.9"))
+	hashedHost := fmt.Sprintf("|1|%s|%s",
+		base64.StdEncoding.EncodeToString([]byte("salt")),
+		base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+
+	kh, err := parseSSHKnownHosts([]byte(strings.Join([]string{
+		"# comment",
+		"",
+		"10.0.0.1,build-host " + authorizedKey,
+		"[10.0.0.2]:2222 " + authorizedKey,
+		"10.0.1.*,!10.0.1.13 " + authorizedKey,
+		hashedHost + " " + authorizedKey,
+		"@revoked 10.0.0.1 " + authorizedKey,
+	}, "\n")))
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	for _, host := range []string{"10.0.0.1:22", "build-host:22", "10.0.0.2:2222", "10.0.1.7:22", "10.0.0.9:22", "10.0.0.1"} {
+		assert.Nil(t, kh.HostKeyCallback(host, nil, key), host)
+	}
+
+	assert.NotNil(t, kh.HostKeyCallback("10.0.0.1:22", nil, otherKey))
+	for _, host := range []string{"10.0.0.2:22", "10.0.1.13:22", "10.0.0.3:22"} {
+		assert.NotNil(t, kh.HostKeyCallback(host, nil, key), host)
+	}
+
+	_, err = parseSSHKnownHosts([]byte("10.0.0.1 ssh-rsa notbase64"))
+	assert.NotNil(t, err)
+}
+
+func TestSSHDialer_DialHandshakeTimeout(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	d := &sshDialer{DialTimeout: 50 * time.Millisecond, Retries: 1, RetrySleep: time.Millisecond}
+
+	start := time.Now()
+	_, err = d.Dial(context.TODO(), listener.Addr().String(), &ssh.ClientConfig{User: "travis"})
+	assert.IsType(t, &sshNetworkError{}, err)
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestSSHDialer_DialContextCancelled(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	d := &sshDialer{DialTimeout: time.Minute}
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err = d.Dial(ctx, listener.Addr().String(), &ssh.ClientConfig{User: "travis"})
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestSSHDialer_dialSyncContextCancelled(t *testing.T) {
+	signer := sshTestSigner(t)
+	listener := sshTestServer(t, signer.PublicKey())
+	defer listener.Close()
+
+	d := &sshDialer{DialTimeout: time.Minute}
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	cancel()
+
+	_, err := d.dialSync(ctx, listener.Addr().String(), &ssh.ClientConfig{
+		User: "travis",
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
+	})
+	assert.IsType(t, &sshNetworkError{}, err)
+}
+
+func TestSSHDialer_DialBastion(t *testing.T) {
+	signer := sshTestSigner(t)
+	bastionSigner := sshTestSigner(t)
+
+	listener := sshTestServer(t, signer.PublicKey())
+	defer listener.Close()
+	bastionListener := sshTestBastionServer(t, bastionSigner.PublicKey())
+	defer bastionListener.Close()
+
+	d := &sshDialer{
+		DialTimeout:       time.Second,
+		KeepaliveInterval: 10 * time.Millisecond,
+		Bastion: &sshBastion{
+			Addr: bastionListener.Addr().String(),
+			Config: &ssh.ClientConfig{
+				User: "bastion",
+				Auth: []ssh.AuthMethod{ssh.PublicKeys(bastionSigner)},
+			},
+		},
+	}
+
+	client, err := d.Dial(context.TODO(), listener.Addr().String(), &ssh.ClientConfig{
+		User: "travis",
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
+	})
+	if assert.Nil(t, err) {
+		time.Sleep(30 * time.Millisecond)
+		_, _, err = client.SendRequest("keepalive@openssh.com", true, nil)
+		assert.Nil(t, err)
+		client.Close()
+	}
+
+	// the instance rejects the key at the second hop
+	_, err = d.Dial(context.TODO(), listener.Addr().String(), &ssh.ClientConfig{
+		User: "travis",
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(bastionSigner)},
+	})
+	if assert.IsType(t, &sshAuthError{}, err) {
+		assert.Contains(t, err.Error(), "via bastion "+bastionListener.Addr().String())
+	}
+
+	// the bastion rejects the key at the first hop
+	d.Bastion.Config.Auth = []ssh.AuthMethod{ssh.PublicKeys(signer)}
+	_, err = d.Dial(context.TODO(), listener.Addr().String(), &ssh.ClientConfig{
+		User: "travis",
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
+	})
+	if assert.IsType(t, &sshAuthError{}, err) {
+		assert.Contains(t, err.Error(), "at bastion "+bastionListener.Addr().String()+":")
+	}
+}
@@ -0,0 +1,858 @@
+package backend
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pborman/uuid"
+	"github.com/pkg/sftp"
+	"github.com/travis-ci/worker/config"
+	"github.com/travis-ci/worker/context"
+	"github.com/travis-ci/worker/image"
+	"github.com/travis-ci/worker/metrics"
+	"golang.org/x/crypto/ssh"
+	gocontext "golang.org/x/net/context"
+)
+
+const (
+	defaultVSphereCloneConcurrency = 2
+	defaultVSphereSSHUser          = "travis"
+	defaultVSphereBootPollSleep    = 3 * time.Second
+	vsphereBootPollMaxSleep        = 10 * time.Second
+	vsphereSSHDialTimeout          = 10 * time.Second
+	vsphereSSHDialRetries          = 2
+	vsphereCleanupTimeout          = 5 * time.Minute
+	vsphereVMNamePrefix            = "travis-job-"
+	vsphereScriptName              = "build.sh"
+	vsphereExitMissingMessage      = "exited without exit status or exit signal"
+)
+
+var (
+	vsphereHelp = map[string]string{
+		"ENDPOINT":              "https:// URL of the vCenter server, which needs the /api REST API of vSphere 7.0 Update 2 or later (required)",
+		"USERNAME":              "vCenter user to log in as (required)",
+		"PASSWORD":              "password of USERNAME (required)",
+		"INSECURE_SKIP_VERIFY":  "don't verify the certificate of ENDPOINT, for vCenter servers with self-signed certificates (default false)",
+		"IMAGE_[ALIAS_]{ALIAS}": "name of the template VM to clone for a given alias, like for gce",
+		"IMAGE_DEFAULT":         "name of the template VM cloned when no alias matches the job (default none, erroring the job)",
+		"DATASTORE":             "name of the datastore clones are placed on (default the template's)",
+		"RESOURCE_POOL":         "name of the resource pool clones run in (default the template's)",
+		"FOLDER":                "name of the VM folder clones are placed in (default the template's)",
+		"NETWORK":               "name of the network the first network adapter of clones is connected to (default the template's)",
+		"CLONE_CONCURRENCY":     fmt.Sprintf("how many clones this worker asks vCenter for at once, the rest waiting their turn (default %d)", defaultVSphereCloneConcurrency),
+		"SSH_KEY_PATH":          "path to the PEM private key used to connect to clones (required)",
+		"SSH_KEY_PASSPHRASE":    "passphrase of SSH_KEY_PATH, if it's encrypted (default none)",
+		"SSH_USER":              fmt.Sprintf("user to connect to clones as, which needs passwordless sudo to set the hostname (default %q)", defaultVSphereSSHUser),
+		"BOOT_POLL_SLEEP":       fmt.Sprintf("initial sleep interval between polling clones for an IP address and ssh while starting, backing off with jitter up to %v or this if longer (default %v)", vsphereBootPollMaxSleep, defaultVSphereBootPollSleep),
+		"BOOT_TIMEOUT":          "how long to wait for a clone to report an IP address and accept ssh connections, bounded by the worker's start timeout (default the start timeout)",
+	}
+
+	// vsphereUnsupportedConfigKeys are config keys for features the REST API
+	// lacks, e.g. linked clones, which its clone action can't make. They are
+	// rejected outright so that an operator relying on them doesn't end up
+	// with full clones instead.
+	vsphereUnsupportedConfigKeys = []string{
+		"LINKED_CLONE_SNAPSHOT",
+	}
+)
+
+func init() {
+	Register("vsphere", "vSphere", vsphereHelp, newVSphereProvider)
+}
+
+type vsphereProvider struct {
+	client *vsphereClient
+
+	imageSelector *image.EnvSelector
+
+	datastoreName    string
+	resourcePoolName string
+	folderName       string
+	networkName      string
+
+	// placement and network are resolved from the names above by Setup
+	placement *vspherePlacement
+	network   *vsphereNICBacking
+
+	// cloneSemaphore holds a value for every clone in progress
+	cloneSemaphore chan struct{}
+
+	sshDialer *sshDialer
+	sshUser   string
+	sshSigner ssh.Signer
+	sshPort   int
+
+	bootPollSleep time.Duration
+	bootTimeout   time.Duration
+}
+
+type vsphereInstance struct {
+	provider *vsphereProvider
+	name     string
+	vm       string
+	ip       string
+}
+
+func newVSphereProvider(cfg *config.ProviderConfig) (Provider, error) {
+	for _, key := range vsphereUnsupportedConfigKeys {
+		if cfg.IsSet(key) {
+			return nil, fmt.Errorf("%s is not supported", key)
+		}
+	}
+
+	for _, key := range []string{"ENDPOINT", "USERNAME", "PASSWORD", "SSH_KEY_PATH"} {
+		if !cfg.IsSet(key) {
+			return nil, fmt.Errorf("expected %s config key", key)
+		}
+	}
+
+	endpoint, err := url.Parse(cfg.Get("ENDPOINT"))
+	if err != nil || endpoint.Scheme != "https" || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid ENDPOINT %q, expected an https:// URL", cfg.Get("ENDPOINT"))
+	}
+
+	insecureSkipVerify := false
+	if cfg.IsSet("INSECURE_SKIP_VERIFY") {
+		insecureSkipVerify, err = strconv.ParseBool(cfg.Get("INSECURE_SKIP_VERIFY"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid INSECURE_SKIP_VERIFY %q: %v", cfg.Get("INSECURE_SKIP_VERIFY"), err)
+		}
+	}
+
+	imageSelector, err := image.NewEnvSelector(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	cloneConcurrency := defaultVSphereCloneConcurrency
+	if cfg.IsSet("CLONE_CONCURRENCY") {
+		cloneConcurrency, err = strconv.Atoi(cfg.Get("CLONE_CONCURRENCY"))
+		if err != nil || cloneConcurrency < 1 {
+			return nil, fmt.Errorf("invalid CLONE_CONCURRENCY %q, expected a positive integer", cfg.Get("CLONE_CONCURRENCY"))
+		}
+	}
+
+	sshSigner, err := vsphereSSHSigner(cfg.Get("SSH_KEY_PATH"), cfg.Get("SSH_KEY_PASSPHRASE"))
+	if err != nil {
+		return nil, err
+	}
+
+	sshUser := defaultVSphereSSHUser
+	if cfg.IsSet("SSH_USER") {
+		sshUser = cfg.Get("SSH_USER")
+	}
+
+	bootPollSleep := defaultVSphereBootPollSleep
+	if cfg.IsSet("BOOT_POLL_SLEEP") {
+		bootPollSleep, err = time.ParseDuration(cfg.Get("BOOT_POLL_SLEEP"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid BOOT_POLL_SLEEP %q: %v", cfg.Get("BOOT_POLL_SLEEP"), err)
+		}
+	}
+
+	bootTimeout := time.Duration(0)
+	if cfg.IsSet("BOOT_TIMEOUT") {
+		bootTimeout, err = time.ParseDuration(cfg.Get("BOOT_TIMEOUT"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid BOOT_TIMEOUT %q: %v", cfg.Get("BOOT_TIMEOUT"), err)
+		}
+	}
+
+	return &vsphereProvider{
+		client: &vsphereClient{
+			restClient: restClient{
+				baseURL: strings.TrimSuffix(endpoint.String(), "/"),
+				client: &http.Client{
+					Transport: &http.Transport{
+						TLSClientConfig: &tls.Config{InsecureSkipVerify: insecureSkipVerify},
+					},
+				},
+				responseError: vsphereResponseError,
+			},
+			username: cfg.Get("USERNAME"),
+			password: cfg.Get("PASSWORD"),
+		},
+
+		imageSelector: imageSelector,
+
+		datastoreName:    cfg.Get("DATASTORE"),
+		resourcePoolName: cfg.Get("RESOURCE_POOL"),
+		folderName:       cfg.Get("FOLDER"),
+		networkName:      cfg.Get("NETWORK"),
+
+		cloneSemaphore: make(chan struct{}, cloneConcurrency),
+
+		sshDialer: &sshDialer{
+			DialTimeout: vsphereSSHDialTimeout,
+			Retries:     vsphereSSHDialRetries,
+			RetrySleep:  time.Second,
+		},
+		sshUser:   sshUser,
+		sshSigner: sshSigner,
+		sshPort:   22,
+
+		bootPollSleep: bootPollSleep,
+		bootTimeout:   bootTimeout,
+	}, nil
+}
+
+// vsphereSSHSigner reads the private key at the given path, decrypting it
+// with the passphrase if one is given.
+func vsphereSSHSigner(keyPath, passphrase string) (ssh.Signer, error) {
+	keyBytes, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if passphrase == "" {
+		return ssh.ParsePrivateKey(keyBytes)
+	}
+
+	block, _ := pem.Decode(keyBytes)
+	if block == nil {
+		return nil, fmt.Errorf("ssh key does not contain a valid PEM block")
+	}
+
+	der, err := x509.DecryptPEMBlock(block, []byte(passphrase))
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := x509.ParsePKCS1PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return ssh.NewSignerFromKey(key)
+}
+
+// Setup logs in and resolves the names of the configured placement and
+// network, so that typos fail the worker's start rather than every job.
+func (p *vsphereProvider) Setup() error {
+	ctx := gocontext.Background()
+
+	placement := &vspherePlacement{}
+	for _, lookup := range []struct {
+		collection string
+		idField    string
+		name       string
+		id         *string
+	}{
+		{"datastore", "datastore", p.datastoreName, &placement.Datastore},
+		{"resource-pool", "resource_pool", p.resourcePoolName, &placement.ResourcePool},
+		{"folder", "folder", p.folderName, &placement.Folder},
+	} {
+		if lookup.name == "" {
+			continue
+		}
+
+		summary, err := p.client.lookup(ctx, lookup.collection, lookup.name)
+		if err != nil {
+			return err
+		}
+		*lookup.id = summary.string(lookup.idField)
+	}
+
+	if p.networkName != "" {
+		summary, err := p.client.lookup(ctx, "network", p.networkName)
+		if err != nil {
+			return err
+		}
+		p.network = &vsphereNICBacking{
+			Type:    summary.string("type"),
+			Network: summary.string("network"),
+		}
+	}
+
+	// clones are placed like their template unless told otherwise
+	if *placement != (vspherePlacement{}) {
+		p.placement = placement
+	}
+	return nil
+}
+
+func (p *vsphereProvider) Start(ctx gocontext.Context, startAttributes *StartAttributes) (Instance, error) {
+	logger := context.LoggerFromContext(ctx)
+
+	templateName, err := p.imageSelector.Select(&image.Params{
+		Infra:    "vsphere",
+		Language: startAttributes.Language,
+		OsxImage: startAttributes.OsxImage,
+		Dist:     startAttributes.Dist,
+		Group:    startAttributes.Group,
+		OS:       startAttributes.OS,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if templateName == "default" {
+		return nil, &StartError{Cause: ErrImageNotFound, Err: fmt.Errorf("no template configured for language %q", startAttributes.Language)}
+	}
+
+	template, err := p.client.lookup(ctx, "vm", templateName)
+	if err != nil {
+		return nil, &StartError{Cause: ErrImageNotFound, Err: err}
+	}
+
+	startBooting := time.Now()
+
+	instance := &vsphereInstance{
+		provider: p,
+		name:     fmt.Sprintf("%s%s", vsphereVMNamePrefix, uuid.NewRandom()),
+	}
+	logger = logger.WithFields(logrus.Fields{
+		"vm_name":  instance.name,
+		"template": templateName,
+	})
+
+	err = instance.clone(ctx, template.string("vm"))
+	if err == nil {
+		err = instance.connectNetwork(ctx)
+	}
+	if err == nil {
+		err = instance.powerOn(ctx)
+	}
+	if err == nil {
+		err = instance.waitForSSH(ctx)
+	}
+	if err != nil {
+		logger.WithField("err", err).Error("couldn't start clone, destroying it")
+		instance.cleanup(ctx)
+		return nil, err
+	}
+
+	metrics.TimeSince("worker.vm.provider.vsphere.boot", startBooting)
+	logger.WithFields(logrus.Fields{"vm": instance.vm, "ip": instance.ip}).Info("clone is running")
+
+	return instance, nil
+}
+
+// clone clones the template, waiting for its turn if CLONE_CONCURRENCY clones
+// are already in progress.
+func (i *vsphereInstance) clone(ctx gocontext.Context, template string) error {
+	startWaiting := time.Now()
+	select {
+	case i.provider.cloneSemaphore <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-i.provider.cloneSemaphore }()
+	metrics.TimeSince("worker.vm.provider.vsphere.boot.clone.wait", startWaiting)
+
+	startCloning := time.Now()
+	err := i.provider.client.do(ctx, "POST", "/api/vcenter/vm?action=clone", &vsphereCloneSpec{
+		Name:      i.name,
+		Source:    template,
+		Placement: i.provider.placement,
+		PowerOn:   false,
+	}, &i.vm)
+	if err != nil {
+		return err
+	}
+
+	metrics.TimeSince("worker.vm.provider.vsphere.boot.clone", startCloning)
+	return nil
+}
+
+// connectNetwork connects the clone's first network adapter to NETWORK, if
+// set.
+func (i *vsphereInstance) connectNetwork(ctx gocontext.Context) error {
+	if i.provider.network == nil {
+		return nil
+	}
+
+	nics := []struct {
+		NIC string `json:"nic"`
+	}{}
+	err := i.provider.client.do(ctx, "GET", i.path("/hardware/ethernet"), nil, &nics)
+	if err != nil {
+		return err
+	}
+	if len(nics) == 0 {
+		return fmt.Errorf("clone %s has no network adapter to connect to %s", i.vm, i.provider.networkName)
+	}
+
+	return i.provider.client.do(ctx, "PATCH", i.path(fmt.Sprintf("/hardware/ethernet/%s", nics[0].NIC)), map[string]interface{}{
+		"backing": i.provider.network,
+	}, nil)
+}
+
+func (i *vsphereInstance) powerOn(ctx gocontext.Context) error {
+	startPoweringOn := time.Now()
+
+	err := i.provider.client.do(ctx, "POST", i.path("/power?action=start"), nil, nil)
+	if err != nil {
+		return err
+	}
+
+	metrics.TimeSince("worker.vm.provider.vsphere.boot.power_on", startPoweringOn)
+	return nil
+}
+
+// waitForSSH polls the clone until VMware Tools reports its IP address and it
+// accepts ssh connections, setting its hostname once it does. It gives up
+// after BOOT_TIMEOUT, if set, or when the context is done.
+func (i *vsphereInstance) waitForSSH(ctx gocontext.Context) error {
+	bootCtx := ctx
+	if i.provider.bootTimeout > 0 {
+		var cancel gocontext.CancelFunc
+		bootCtx, cancel = gocontext.WithTimeout(ctx, i.provider.bootTimeout)
+		defer cancel()
+	}
+
+	startWaiting := time.Now()
+	reported := false
+
+	err := pollUntil(bootCtx, i.provider.bootPollSleep, pollMaxSleep(i.provider.bootPollSleep, vsphereBootPollMaxSleep), func() (bool, error) {
+		identity := &vsphereGuestIdentity{}
+		err := i.provider.client.do(bootCtx, "GET", i.path("/guest/identity"), nil, identity)
+		if vsphereIsServiceUnavailable(err) {
+			// VMware Tools isn't running yet
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if identity.IPAddress == "" {
+			return false, nil
+		}
+
+		if !reported {
+			metrics.TimeSince("worker.vm.provider.vsphere.boot.ip", startWaiting)
+			reported = true
+		}
+		i.ip = identity.IPAddress
+
+		err = i.setHostname(bootCtx)
+		if _, ok := err.(*sshNetworkError); ok {
+			return false, nil
+		}
+		return err == nil, err
+	})
+
+	if err != nil && ctx.Err() == nil && bootCtx.Err() != nil {
+		metrics.Mark("worker.vm.provider.vsphere.boot.timeout")
+		return &StartError{
+			Cause: ErrBootTimeout,
+			Err:   fmt.Errorf("clone %s wasn't reachable over ssh after %v", i.vm, i.provider.bootTimeout),
+		}
+	}
+
+	return err
+}
+
+// setHostname names the clone after itself. Guest customization doesn't
+// support macOS, so it's done over ssh instead.
+func (i *vsphereInstance) setHostname(ctx gocontext.Context) error {
+	client, err := i.sshClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	output, err := session.CombinedOutput(fmt.Sprintf(
+		"sudo scutil --set HostName %[1]s && sudo scutil --set LocalHostName %[1]s && sudo scutil --set ComputerName %[1]s",
+		i.name))
+	if err != nil {
+		return fmt.Errorf("couldn't set hostname: %v: %s", err, bytes.TrimSpace(output))
+	}
+
+	return nil
+}
+
+// path returns the API path of the clone with the given suffix.
+func (i *vsphereInstance) path(suffix string) string {
+	return fmt.Sprintf("/api/vcenter/vm/%s%s", url.QueryEscape(i.vm), suffix)
+}
+
+func (i *vsphereInstance) sshClient(ctx gocontext.Context) (*ssh.Client, error) {
+	if i.ip == "" {
+		return nil, fmt.Errorf("clone %s has no IP address", i.vm)
+	}
+
+	client, err := i.provider.sshDialer.Dial(ctx, fmt.Sprintf("%s:%d", i.ip, i.provider.sshPort), &ssh.ClientConfig{
+		User: i.provider.sshUser,
+		Auth: []ssh.AuthMethod{
+			ssh.PublicKeys(i.provider.sshSigner),
+		},
+	})
+	if err != nil {
+		metrics.Mark("worker.vm.provider.vsphere.ssh.dial_error")
+		return nil, err
+	}
+
+	return client, nil
+}
+
+func (i *vsphereInstance) UploadScript(ctx gocontext.Context, script []byte) error {
+	client, err := i.sshClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	sftp, err := sftp.NewClient(client)
+	if err != nil {
+		return err
+	}
+	defer sftp.Close()
+
+	_, err = sftp.Lstat(vsphereScriptName)
+	if err == nil {
+		return ErrStaleVM
+	}
+
+	f, err := sftp.Create(vsphereScriptName)
+	if err != nil {
+		return err
+	}
+
+	return sftpWriteFile(f, script, 0755)
+}
+
+func (i *vsphereInstance) RunScript(ctx gocontext.Context, output io.Writer) (*RunResult, error) {
+	startRun := time.Now()
+
+	client, err := i.sshClient(ctx)
+	if err != nil {
+		return &RunResult{Completed: false}, err
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return &RunResult{Completed: false}, err
+	}
+	defer session.Close()
+
+	err = session.RequestPty("xterm", 80, 40, ssh.TerminalModes{})
+	if err != nil {
+		return &RunResult{Completed: false}, err
+	}
+
+	session.Stdout = output
+	session.Stderr = output
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- session.Run(fmt.Sprintf("bash --login ~/%s", vsphereScriptName))
+	}()
+
+	select {
+	case err = <-errChan:
+	case <-ctx.Done():
+		metrics.Mark("worker.vm.provider.vsphere.run.cancelled")
+		_ = session.Close()
+		return &RunResult{Cancelled: true, Duration: time.Since(startRun)}, ctx.Err()
+	}
+
+	return vsphereClassifyWaitError(&RunResult{Duration: time.Since(startRun)}, err)
+}
+
+// vsphereClassifyWaitError fills in the result of a script from the error
+// returned by running it, returning the error if it isn't one the result can
+// express.
+func vsphereClassifyWaitError(result *RunResult, err error) (*RunResult, error) {
+	if err == nil {
+		result.Completed = true
+		return result, nil
+	}
+
+	switch e := err.(type) {
+	case *ssh.ExitError:
+		result.Completed = true
+		result.ExitCode = uint8(e.ExitStatus())
+		if e.Signal() != "" {
+			metrics.Mark("worker.vm.provider.vsphere.run.signal")
+			result.Reason = RunReasonSignal
+			result.Signal = e.Signal()
+		}
+		return result, nil
+	default:
+		// the vendored ssh package doesn't have a type for this error
+		if strings.Contains(err.Error(), vsphereExitMissingMessage) {
+			metrics.Mark("worker.vm.provider.vsphere.run.exit_missing")
+			result.Reason = RunReasonExitMissing
+			return result, nil
+		}
+		return result, err
+	}
+}
+
+// cleanup destroys the clone, even if the context is already done, logging
+// any error.
+func (i *vsphereInstance) cleanup(ctx gocontext.Context) {
+	cleanupCtx, cancel := gocontext.WithTimeout(gocontext.Background(), vsphereCleanupTimeout)
+	defer cancel()
+
+	err := i.delete(cleanupCtx)
+	if err != nil {
+		context.LoggerFromContext(ctx).WithFields(logrus.Fields{
+			"err":     err,
+			"vm_name": i.name,
+		}).Error("couldn't destroy clone")
+	}
+}
+
+// delete powers off and destroys the clone. A clone that's already gone is
+// taken as destroyed.
+func (i *vsphereInstance) delete(ctx gocontext.Context) error {
+	startDeleting := time.Now()
+
+	if i.vm == "" {
+		// cloning may have succeeded even if its request failed
+		summary, err := i.provider.client.lookup(ctx, "vm", i.name)
+		if vsphereIsNoneNamed(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		i.vm = summary.string("vm")
+	}
+
+	err := i.provider.client.do(ctx, "POST", i.path("/power?action=stop"), nil, nil)
+	if err != nil && !vsphereIsErrorType(err, "ALREADY_IN_DESIRED_STATE") {
+		if vsphereIsErrorType(err, "NOT_FOUND") {
+			metrics.Mark("worker.vm.provider.vsphere.delete.not_found")
+			return nil
+		}
+		return err
+	}
+
+	err = i.provider.client.do(ctx, "DELETE", i.path(""), nil, nil)
+	if vsphereIsErrorType(err, "NOT_FOUND") {
+		metrics.Mark("worker.vm.provider.vsphere.delete.not_found")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	metrics.TimeSince("worker.vm.provider.vsphere.delete", startDeleting)
+	return nil
+}
+
+func (i *vsphereInstance) Stop(ctx gocontext.Context) error {
+	return i.delete(ctx)
+}
+
+func (i *vsphereInstance) ID() string {
+	return i.name
+}
+
+// vsphereClient is a minimal client of the vCenter REST API, logging in
+// whenever it has no session or its session expired.
+type vsphereClient struct {
+	restClient
+
+	username string
+	password string
+
+	sessionMutex sync.Mutex
+	sessionID    string
+}
+
+// vsphereAPIError is returned for requests that vCenter responded to with an
+// error.
+type vsphereAPIError struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Type       string
+	Message    string
+}
+
+func (e *vsphereAPIError) Error() string {
+	return fmt.Sprintf("vcenter returned %d %s for %s %s: %s", e.StatusCode, e.Type, e.Method, e.Path, e.Message)
+}
+
+func vsphereIsErrorType(err error, errorType string) bool {
+	apiErr, ok := err.(*vsphereAPIError)
+	return ok && apiErr.Type == errorType
+}
+
+func vsphereIsServiceUnavailable(err error) bool {
+	apiErr, ok := err.(*vsphereAPIError)
+	return ok && apiErr.StatusCode == http.StatusServiceUnavailable
+}
+
+// vsphereNoneNamedError is returned by lookup when nothing has the name.
+type vsphereNoneNamedError struct {
+	collection string
+	name       string
+}
+
+func (e *vsphereNoneNamedError) Error() string {
+	return fmt.Sprintf("no %s named %q", e.collection, e.name)
+}
+
+func vsphereIsNoneNamed(err error) bool {
+	_, ok := err.(*vsphereNoneNamedError)
+	return ok
+}
+
+// lookup returns the summary of the only object of the collection with the
+// given name.
+func (c *vsphereClient) lookup(ctx gocontext.Context, collection, name string) (vsphereSummary, error) {
+	summaries := []vsphereSummary{}
+	err := c.do(ctx, "GET", fmt.Sprintf("/api/vcenter/%s?names=%s", collection, url.QueryEscape(name)), nil, &summaries)
+	if err != nil {
+		return nil, err
+	}
+
+	switch len(summaries) {
+	case 0:
+		return nil, &vsphereNoneNamedError{collection: collection, name: name}
+	case 1:
+		return summaries[0], nil
+	default:
+		return nil, fmt.Errorf("%d %ss are named %q", len(summaries), collection, name)
+	}
+}
+
+// do sends the request with in, if not nil, as its JSON body and decodes the
+// response into out, if not nil. A request rejected for lack of a valid
+// session is sent again after logging in.
+func (c *vsphereClient) do(ctx gocontext.Context, method, path string, in, out interface{}) error {
+	sessionID, err := c.session(ctx, "")
+	if err != nil {
+		return err
+	}
+
+	b, err := c.request(ctx, method, path, in, vsphereSessionHeader(sessionID))
+	if apiErr, ok := err.(*vsphereAPIError); ok && apiErr.StatusCode == http.StatusUnauthorized {
+		sessionID, err = c.session(ctx, sessionID)
+		if err != nil {
+			return err
+		}
+		b, err = c.request(ctx, method, path, in, vsphereSessionHeader(sessionID))
+	}
+	if err != nil {
+		return err
+	}
+
+	return restDecode(method, path, b, out)
+}
+
+// vsphereSessionHeader returns the header that authenticates a request with
+// the given session.
+func vsphereSessionHeader(sessionID string) http.Header {
+	header := http.Header{}
+	header.Set("vmware-api-session-id", sessionID)
+	return header
+}
+
+// session returns the current session, logging in if there is none or it's
+// the given expired one.
+func (c *vsphereClient) session(ctx gocontext.Context, expired string) (string, error) {
+	c.sessionMutex.Lock()
+	defer c.sessionMutex.Unlock()
+
+	if c.sessionID != "" && c.sessionID != expired {
+		return c.sessionID, nil
+	}
+
+	header := http.Header{}
+	header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(c.username+":"+c.password)))
+
+	b, err := c.send(ctx, "POST", "/api/session", nil, header)
+	if err != nil {
+		return "", err
+	}
+
+	sessionID := ""
+	err = json.Unmarshal(b, &sessionID)
+	if err != nil {
+		return "", fmt.Errorf("couldn't decode vcenter session: %v", err)
+	}
+
+	metrics.Mark("worker.vm.provider.vsphere.login")
+	c.sessionID = sessionID
+	return sessionID, nil
+}
+
+func vsphereResponseError(method, path string, statusCode int, body []byte) error {
+	apiErr := &vsphereAPIError{
+		Method:     method,
+		Path:       path,
+		StatusCode: statusCode,
+	}
+
+	errResp := &vsphereError{}
+	if json.Unmarshal(body, errResp) != nil || errResp.ErrorType == "" {
+		apiErr.Message = strings.TrimSpace(string(body))
+		return apiErr
+	}
+
+	apiErr.Type = errResp.ErrorType
+	messages := []string{}
+	for _, message := range errResp.Messages {
+		messages = append(messages, message.DefaultMessage)
+	}
+	apiErr.Message = strings.Join(messages, "; ")
+
+	return apiErr
+}
+
+// The types below are the parts of the vCenter REST API that the provider
+// uses.
+
+type vsphereError struct {
+	ErrorType string `json:"error_type"`
+	Messages  []struct {
+		DefaultMessage string `json:"default_message"`
+	} `json:"messages"`
+}
+
+// vsphereSummary is an entry of a list of vCenter objects, whose fields
+// differ by collection.
+type vsphereSummary map[string]interface{}
+
+func (s vsphereSummary) string(field string) string {
+	value, _ := s[field].(string)
+	return value
+}
+
+type vsphereCloneSpec struct {
+	Name      string            `json:"name"`
+	Source    string            `json:"source"`
+	Placement *vspherePlacement `json:"placement,omitempty"`
+	PowerOn   bool              `json:"power_on"`
+}
+
+type vspherePlacement struct {
+	Datastore    string `json:"datastore,omitempty"`
+	ResourcePool string `json:"resource_pool,omitempty"`
+	Folder       string `json:"folder,omitempty"`
+}
+
+type vsphereNICBacking struct {
+	Type    string `json:"type"`
+	Network string `json:"network"`
+}
+
+type vsphereGuestIdentity struct {
+	IPAddress string `json:"ip_address"`
+	HostName  string `json:"host_name"`
+}
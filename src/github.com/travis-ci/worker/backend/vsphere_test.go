@@ -0,0 +1,318 @@
+package backend
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/travis-ci/worker/config"
+	"github.com/travis-ci/worker/image"
+	"golang.org/x/crypto/ssh"
+	gocontext "golang.org/x/net/context"
+)
+
+// vsphereTestServer is a fake vCenter with a single template, macos-sierra,
+// and a single clone, vm-2, once it's cloned.
+type vsphereTestServer struct {
+	mutex sync.Mutex
+
+	logins    int
+	sessionID string
+
+	clone      *vsphereCloneSpec
+	nicBacking map[string]*vsphereNICBacking
+	power      []string
+	identities int
+	deleted    bool
+}
+
+func (s *vsphereTestServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	respond := func(status int, body interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(body)
+	}
+	respondError := func(status int, errorType string) {
+		respond(status, map[string]interface{}{
+			"error_type": errorType,
+			"messages":   []map[string]string{{"default_message": strings.ToLower(errorType)}},
+		})
+	}
+
+	if req.URL.Path == "/api/session" {
+		username, password, ok := req.BasicAuth()
+		if !ok || username != "travis" || password != "secret" {
+			respondError(http.StatusUnauthorized, "UNAUTHENTICATED")
+			return
+		}
+		s.logins++
+		s.sessionID = "session-" + strconv.Itoa(s.logins)
+		respond(http.StatusCreated, s.sessionID)
+		return
+	}
+
+	if s.sessionID == "" || req.Header.Get("vmware-api-session-id") != s.sessionID {
+		respondError(http.StatusUnauthorized, "UNAUTHENTICATED")
+		return
+	}
+
+	names := req.URL.Query().Get("names")
+
+	switch {
+	case req.Method == "GET" && req.URL.Path == "/api/vcenter/vm":
+		switch {
+		case names == "macos-sierra":
+			respond(http.StatusOK, []map[string]interface{}{{"vm": "vm-1", "name": names, "cpu_count": 4}})
+		case s.clone != nil && names == s.clone.Name && !s.deleted:
+			respond(http.StatusOK, []map[string]interface{}{{"vm": "vm-2", "name": names, "cpu_count": 4}})
+		default:
+			respond(http.StatusOK, []interface{}{})
+		}
+	case req.Method == "GET" && req.URL.Path == "/api/vcenter/datastore":
+		respond(http.StatusOK, []map[string]string{{"datastore": "datastore-1", "name": names}})
+	case req.Method == "GET" && req.URL.Path == "/api/vcenter/resource-pool":
+		respond(http.StatusOK, []map[string]string{{"resource_pool": "resgroup-1", "name": names}})
+	case req.Method == "GET" && req.URL.Path == "/api/vcenter/folder":
+		respond(http.StatusOK, []map[string]string{{"folder": "group-v1", "name": names}, {"folder": "group-v2", "name": names}})
+	case req.Method == "GET" && req.URL.Path == "/api/vcenter/network":
+		respond(http.StatusOK, []map[string]string{{"network": "dvportgroup-1", "name": names, "type": "DISTRIBUTED_PORTGROUP"}})
+	case req.Method == "POST" && req.URL.Path == "/api/vcenter/vm" && req.URL.Query().Get("action") == "clone":
+		s.clone = &vsphereCloneSpec{}
+		_ = json.NewDecoder(req.Body).Decode(s.clone)
+		respond(http.StatusOK, "vm-2")
+	case s.deleted || !strings.HasPrefix(req.URL.Path, "/api/vcenter/vm/vm-2"):
+		respondError(http.StatusNotFound, "NOT_FOUND")
+	case req.Method == "GET" && strings.HasSuffix(req.URL.Path, "/hardware/ethernet"):
+		respond(http.StatusOK, []map[string]string{{"nic": "4000"}})
+	case req.Method == "PATCH" && strings.Contains(req.URL.Path, "/hardware/ethernet/"):
+		body := struct {
+			Backing *vsphereNICBacking `json:"backing"`
+		}{}
+		_ = json.NewDecoder(req.Body).Decode(&body)
+		s.nicBacking[req.URL.Path[strings.LastIndex(req.URL.Path, "/")+1:]] = body.Backing
+		w.WriteHeader(http.StatusNoContent)
+	case req.Method == "POST" && strings.HasSuffix(req.URL.Path, "/power"):
+		action := req.URL.Query().Get("action")
+		if action == "stop" && s.power[len(s.power)-1] == "stop" {
+			respondError(http.StatusBadRequest, "ALREADY_IN_DESIRED_STATE")
+			return
+		}
+		s.power = append(s.power, action)
+		w.WriteHeader(http.StatusNoContent)
+	case req.Method == "GET" && strings.HasSuffix(req.URL.Path, "/guest/identity"):
+		// VMware Tools takes a moment to start
+		s.identities++
+		if s.identities == 1 {
+			respondError(http.StatusServiceUnavailable, "SERVICE_UNAVAILABLE")
+			return
+		}
+		respond(http.StatusOK, map[string]string{"ip_address": "127.0.0.1", "host_name": "localhost"})
+	case req.Method == "DELETE":
+		s.deleted = true
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// vsphereTestSSHKey writes an unencrypted ssh key to a temporary file,
+// returning its path and signer.
+func vsphereTestSSHKey(t *testing.T) (string, ssh.Signer) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.Nil(t, err)
+
+	f, err := ioutil.TempFile("", "travis-vsphere-test")
+	require.Nil(t, err)
+	defer f.Close()
+
+	err = pem.Encode(f, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	require.Nil(t, err)
+
+	signer, err := ssh.NewSignerFromKey(key)
+	require.Nil(t, err)
+
+	return f.Name(), signer
+}
+
+func vsphereTestProvider(t *testing.T, server *vsphereTestServer, cfg map[string]string) (*vsphereProvider, func()) {
+	keyPath, signer := vsphereTestSSHKey(t)
+
+	server.nicBacking = map[string]*vsphereNICBacking{}
+	httpServer := httptest.NewTLSServer(server)
+
+	listener := sshTestExecServer(t, signer.PublicKey(), func(ch ssh.Channel) {
+		_, _ = ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+	})
+
+	cfg["ENDPOINT"] = httpServer.URL
+	cfg["USERNAME"] = "travis"
+	cfg["PASSWORD"] = "secret"
+	cfg["INSECURE_SKIP_VERIFY"] = "true"
+	cfg["SSH_KEY_PATH"] = keyPath
+	cfg["BOOT_POLL_SLEEP"] = "1ms"
+	cfg["IMAGE_DEFAULT"] = "macos-sierra"
+
+	provider, err := newVSphereProvider(config.ProviderConfigFromMap(cfg))
+	require.Nil(t, err)
+
+	_, port, err := net.SplitHostPort(listener.Addr().String())
+	require.Nil(t, err)
+	provider.(*vsphereProvider).sshPort, _ = strconv.Atoi(port)
+
+	return provider.(*vsphereProvider), func() {
+		_ = listener.Close()
+		httpServer.Close()
+		_ = os.Remove(keyPath)
+	}
+}
+
+func TestNewVSphereProvider_InvalidConfig(t *testing.T) {
+	valid := map[string]string{
+		"ENDPOINT":     "https://vcenter.example.com",
+		"USERNAME":     "travis",
+		"PASSWORD":     "secret",
+		"SSH_KEY_PATH": "/nonexistent",
+	}
+
+	for _, tc := range []struct {
+		cfg map[string]string
+		err string
+	}{
+		{map[string]string{"PASSWORD": ""}, "expected PASSWORD config key"},
+		{map[string]string{"ENDPOINT": "http://vcenter.example.com"}, `invalid ENDPOINT "http://vcenter.example.com", expected an https:// URL`},
+		{map[string]string{"CLONE_CONCURRENCY": "0"}, `invalid CLONE_CONCURRENCY "0", expected a positive integer`},
+		{map[string]string{"LINKED_CLONE_SNAPSHOT": "base"}, "LINKED_CLONE_SNAPSHOT is not supported"},
+	} {
+		cfg := map[string]string{}
+		for key, value := range valid {
+			cfg[key] = value
+		}
+		for key, value := range tc.cfg {
+			if value == "" {
+				delete(cfg, key)
+				continue
+			}
+			cfg[key] = value
+		}
+
+		_, err := newVSphereProvider(config.ProviderConfigFromMap(cfg))
+		assert.EqualError(t, err, tc.err)
+	}
+}
+
+func TestVSphereProvider_Setup(t *testing.T) {
+	server := &vsphereTestServer{}
+	provider, cleanup := vsphereTestProvider(t, server, map[string]string{
+		"DATASTORE":     "ssd",
+		"RESOURCE_POOL": "builds",
+		"NETWORK":       "vlan-42",
+	})
+	defer cleanup()
+
+	require.Nil(t, provider.Setup())
+	assert.Equal(t, &vspherePlacement{Datastore: "datastore-1", ResourcePool: "resgroup-1"}, provider.placement)
+	assert.Equal(t, &vsphereNICBacking{Type: "DISTRIBUTED_PORTGROUP", Network: "dvportgroup-1"}, provider.network)
+
+	provider.folderName = "builds"
+	assert.EqualError(t, provider.Setup(), `2 folders are named "builds"`)
+}
+
+func TestVSphereProvider_Start(t *testing.T) {
+	server := &vsphereTestServer{}
+	provider, cleanup := vsphereTestProvider(t, server, map[string]string{
+		"DATASTORE": "ssd",
+		"NETWORK":   "vlan-42",
+	})
+	defer cleanup()
+
+	require.Nil(t, provider.Setup())
+
+	instance, err := provider.Start(gocontext.TODO(), &StartAttributes{Language: "objective-c"})
+	require.Nil(t, err)
+
+	assert.True(t, strings.HasPrefix(instance.ID(), vsphereVMNamePrefix))
+	assert.Equal(t, &vsphereCloneSpec{
+		Name:      instance.ID(),
+		Source:    "vm-1",
+		Placement: &vspherePlacement{Datastore: "datastore-1"},
+	}, server.clone)
+	assert.Equal(t, map[string]*vsphereNICBacking{"4000": provider.network}, server.nicBacking)
+	assert.Equal(t, []string{"start"}, server.power)
+	assert.Equal(t, "127.0.0.1", instance.(*vsphereInstance).ip)
+	assert.Len(t, provider.cloneSemaphore, 0)
+
+	require.Nil(t, instance.Stop(gocontext.TODO()))
+	assert.Equal(t, []string{"start", "stop"}, server.power)
+	assert.True(t, server.deleted)
+
+	// a clone that's already gone is stopped
+	require.Nil(t, instance.Stop(gocontext.TODO()))
+}
+
+func TestVSphereProvider_StartWaitsForClone(t *testing.T) {
+	server := &vsphereTestServer{}
+	provider, cleanup := vsphereTestProvider(t, server, map[string]string{
+		"CLONE_CONCURRENCY": "1",
+	})
+	defer cleanup()
+
+	// another clone is in progress
+	provider.cloneSemaphore <- struct{}{}
+
+	ctx, cancel := gocontext.WithTimeout(gocontext.TODO(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := provider.Start(ctx, &StartAttributes{Language: "objective-c"})
+	assert.Equal(t, gocontext.DeadlineExceeded, err)
+	assert.Nil(t, server.clone)
+}
+
+func TestVSphereProvider_StartWithoutTemplate(t *testing.T) {
+	server := &vsphereTestServer{}
+	provider, cleanup := vsphereTestProvider(t, server, map[string]string{})
+	defer cleanup()
+
+	imageSelector, err := image.NewEnvSelector(config.ProviderConfigFromMap(map[string]string{"IMAGE_DEFAULT": "macos-high-sierra"}))
+	require.Nil(t, err)
+	provider.imageSelector = imageSelector
+
+	_, err = provider.Start(gocontext.TODO(), &StartAttributes{Language: "objective-c"})
+	require.IsType(t, &StartError{}, err)
+	assert.Equal(t, ErrImageNotFound, err.(*StartError).Cause)
+	assert.Nil(t, server.clone)
+}
+
+func TestVSphereClient_SessionExpired(t *testing.T) {
+	server := &vsphereTestServer{}
+	provider, cleanup := vsphereTestProvider(t, server, map[string]string{})
+	defer cleanup()
+
+	_, err := provider.client.lookup(gocontext.TODO(), "vm", "macos-sierra")
+	require.Nil(t, err)
+
+	server.mutex.Lock()
+	server.sessionID = "expired"
+	server.mutex.Unlock()
+
+	summary, err := provider.client.lookup(gocontext.TODO(), "vm", "macos-sierra")
+	require.Nil(t, err)
+	assert.Equal(t, "vm-1", summary.string("vm"))
+	assert.Equal(t, 2, server.logins)
+}
@@ -0,0 +1,243 @@
+package backend
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// There's no websocket package vendored, so websocketConn implements the
+// small part of RFC 6455 that LXD's operation websockets and Kubernetes' exec
+// subresource need.
+
+const (
+	websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	websocketOpContinuation = 0x0
+	websocketOpText         = 0x1
+	websocketOpBinary       = 0x2
+	websocketOpClose        = 0x8
+	websocketOpPing         = 0x9
+	websocketOpPong         = 0xa
+
+	// LXD and Kubernetes only send small frames, this guards against
+	// allocating whatever a corrupted length says
+	websocketMaxFrame = 16 << 20
+)
+
+// websocketConn is a client websocket connection.
+type websocketConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+
+	writeMutex sync.Mutex
+	closeOnce  sync.Once
+}
+
+// newWebsocketConn upgrades a connection to a websocket by requesting the
+// given path on it with the given additional headers, closing the connection
+// if that fails.
+func newWebsocketConn(conn net.Conn, host, path string, header http.Header) (*websocketConn, error) {
+	ws, err := upgradeWebsocketConn(conn, host, path, header)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return ws, nil
+}
+
+func upgradeWebsocketConn(conn net.Conn, host, path string, header http.Header) (*websocketConn, error) {
+	nonce := make([]byte, 16)
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s%s", host, path), nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+
+	err = req.Write(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("websocket upgrade of %s returned %d", path, resp.StatusCode)
+	}
+
+	accept := sha1.Sum([]byte(key + websocketGUID))
+	if resp.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(accept[:]) {
+		return nil, fmt.Errorf("websocket upgrade of %s returned an invalid Sec-WebSocket-Accept", path)
+	}
+
+	return &websocketConn{conn: conn, reader: reader}, nil
+}
+
+// CopyTo writes the payloads of the messages received to w until the server
+// closes the websocket, answering pings along the way.
+func (ws *websocketConn) CopyTo(w io.Writer) error {
+	for {
+		payload, err := ws.ReadMessage()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		_, err = w.Write(payload)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// ReadMessage returns the payload of the next message received, answering
+// pings along the way, or io.EOF once the server closes the websocket.
+func (ws *websocketConn) ReadMessage() ([]byte, error) {
+	for {
+		opcode, payload, err := ws.readFrame()
+		if err != nil {
+			return nil, err
+		}
+
+		switch opcode {
+		case websocketOpText, websocketOpBinary, websocketOpContinuation:
+			return payload, nil
+		case websocketOpPing:
+			err = ws.writeFrame(websocketOpPong, payload)
+			if err != nil {
+				return nil, err
+			}
+		case websocketOpClose:
+			_ = ws.writeFrame(websocketOpClose, nil)
+			return nil, io.EOF
+		}
+	}
+}
+
+// WriteMessage sends the payload as a binary message.
+func (ws *websocketConn) WriteMessage(payload []byte) error {
+	return ws.writeFrame(websocketOpBinary, payload)
+}
+
+// Close closes the connection without a closing handshake, which is safe to
+// call more than once and from another goroutine than CopyTo's, making it
+// return.
+func (ws *websocketConn) Close() error {
+	var err error
+	ws.closeOnce.Do(func() {
+		err = ws.conn.Close()
+	})
+	return err
+}
+
+func (ws *websocketConn) readFrame() (byte, []byte, error) {
+	header := make([]byte, 2)
+	_, err := io.ReadFull(ws.reader, header)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	opcode := header[0] & 0x0f
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7f)
+
+	switch length {
+	case 126:
+		extended := make([]byte, 2)
+		_, err = io.ReadFull(ws.reader, extended)
+		length = uint64(binary.BigEndian.Uint16(extended))
+	case 127:
+		extended := make([]byte, 8)
+		_, err = io.ReadFull(ws.reader, extended)
+		length = binary.BigEndian.Uint64(extended)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if length > websocketMaxFrame {
+		return 0, nil, fmt.Errorf("websocket frame of %d bytes is too large", length)
+	}
+
+	var mask []byte
+	if masked {
+		mask = make([]byte, 4)
+		_, err = io.ReadFull(ws.reader, mask)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+
+	payload := make([]byte, length)
+	_, err = io.ReadFull(ws.reader, payload)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	for i := range mask {
+		for j := i; j < len(payload); j += 4 {
+			payload[j] ^= mask[i]
+		}
+	}
+
+	return opcode, payload, nil
+}
+
+// writeFrame writes a final frame, which clients must mask.
+func (ws *websocketConn) writeFrame(opcode byte, payload []byte) error {
+	ws.writeMutex.Lock()
+	defer ws.writeMutex.Unlock()
+
+	frame := []byte{0x80 | opcode}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, 0x80|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, 0x80|126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(len(payload)))
+	default:
+		frame = append(frame, 0x80|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(len(payload)))
+	}
+
+	mask := make([]byte, 4)
+	_, err := io.ReadFull(rand.Reader, mask)
+	if err != nil {
+		return err
+	}
+	frame = append(frame, mask...)
+
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+
+	_, err = ws.conn.Write(frame)
+	return err
+}
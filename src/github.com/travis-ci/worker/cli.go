@@ -25,6 +25,10 @@ import (
 	gocontext "golang.org/x/net/context"
 )
 
+// providerShutdownTimeout bounds how long the backend provider may take to
+// clean up when the worker exits.
+const providerShutdownTimeout = 2 * time.Minute
+
 // CLI is the top level of execution for the whole shebang
 type CLI struct {
 	c        *cli.Context
@@ -131,6 +135,8 @@ func (i *CLI) Setup() (bool, error) {
 		i.BackendProvider, i.BuildScriptGenerator, i.Canceller)
 
 	pool.SkipShutdownOnLogTimeout = cfg.SkipShutdownOnLogTimeout
+	pool.PostFailureCommands = cfg.PostFailureCommands
+	pool.PostFailureCommandsOnSuccess = cfg.PostFailureCommandsOnSuccess
 	logger.WithFields(logrus.Fields{
 		"pool": pool,
 	}).Debug("built")
@@ -167,6 +173,16 @@ func (i *CLI) Run() {
 	if err != nil {
 		i.logger.WithField("err", err).Error("couldn't clean up job queue")
 	}
+
+	if shutdowner, ok := i.BackendProvider.(backend.Shutdowner); ok {
+		ctx, cancel := gocontext.WithTimeout(gocontext.Background(), providerShutdownTimeout)
+		defer cancel()
+
+		err = shutdowner.Shutdown(ctx)
+		if err != nil {
+			i.logger.WithField("err", err).Error("couldn't shut down backend provider")
+		}
+	}
 }
 
 func (i *CLI) setupSentry() {
@@ -29,6 +29,9 @@ type Config struct {
 	HardTimeout         time.Duration
 	LogTimeout          time.Duration
 
+	PostFailureCommands          []string
+	PostFailureCommandsOnSuccess bool
+
 	BuildAPIInsecureSkipVerify bool
 	SkipShutdownOnLogTimeout   bool
 
@@ -68,6 +71,9 @@ func FromCLIContext(c *cli.Context) *Config {
 		HardTimeout:         c.Duration("hard-timeout"),
 		LogTimeout:          c.Duration("log-timeout"),
 
+		PostFailureCommands:          c.StringSlice("post-failure-commands"),
+		PostFailureCommandsOnSuccess: c.Bool("post-failure-commands-on-success"),
+
 		BuildAPIInsecureSkipVerify: c.Bool("build-api-insecure-skip-verify"),
 		SkipShutdownOnLogTimeout:   c.Bool("skip-shutdown-on-log-timeout"),
 
@@ -111,6 +117,9 @@ func WriteEnvConfig(cfg *Config, out io.Writer) {
 		"hostname":              cfg.Hostname,
 		"hard-timout":           cfg.HardTimeout,
 
+		"post-failure-commands":            strings.Join(cfg.PostFailureCommands, ","),
+		"post-failure-commands-on-success": cfg.PostFailureCommandsOnSuccess,
+
 		"build-api-insecure-skip-verify": cfg.BuildAPIInsecureSkipVerify,
 		"skip-shutdown-on-log-timeout":   cfg.SkipShutdownOnLogTimeout,
 
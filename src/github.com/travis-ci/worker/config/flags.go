@@ -95,6 +95,16 @@ var (
 			Usage:  "The timeout for a job that's not outputting anything",
 			EnvVar: twEnvVars("LOG_TIMEOUT"),
 		},
+		cli.StringSliceFlag{
+			Name:   "post-failure-commands",
+			Usage:  "Comma-delimited commands to run on the instance of a job that didn't pass, before it's stopped, whose output is logged for debugging",
+			EnvVar: twEnvVars("POST_FAILURE_COMMANDS"),
+		},
+		cli.BoolFlag{
+			Name:   "post-failure-commands-on-success",
+			Usage:  "Also run the post-failure commands for jobs that passed",
+			EnvVar: twEnvVars("POST_FAILURE_COMMANDS_ON_SUCCESS"),
+		},
 
 		// build script generator flags
 		cli.DurationFlag{
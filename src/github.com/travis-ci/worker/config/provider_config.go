@@ -2,6 +2,7 @@ package config
 
 import (
 	"fmt"
+	"net/http"
 	"net/url"
 	"os"
 	"sort"
@@ -13,7 +14,8 @@ import (
 type ProviderConfig struct {
 	sync.Mutex
 
-	cfgMap map[string]string
+	cfgMap        map[string]string
+	httpTransport http.RoundTripper
 }
 
 // GoString formats the ProviderConfig as valid Go syntax. This makes
@@ -67,6 +69,25 @@ func (pc *ProviderConfig) Unset(key string) {
 	delete(pc.cfgMap, key)
 }
 
+// SetHTTPTransport sets an http.RoundTripper to be used by providers that make
+// HTTP requests, in place of their default transport. This is mostly useful
+// for testing.
+func (pc *ProviderConfig) SetHTTPTransport(rt http.RoundTripper) {
+	pc.Lock()
+	defer pc.Unlock()
+
+	pc.httpTransport = rt
+}
+
+// HTTPTransport returns the http.RoundTripper set with SetHTTPTransport, or
+// nil if none was set.
+func (pc *ProviderConfig) HTTPTransport() http.RoundTripper {
+	pc.Lock()
+	defer pc.Unlock()
+
+	return pc.httpTransport
+}
+
 // IsSet returns true if a setting with the given key exists, or false if it
 // does not.
 func (pc *ProviderConfig) IsSet(key string) bool {
@@ -136,7 +136,7 @@ func (f *FileJobQueue) pollInDirTick(ctx gocontext.Context) {
 			continue
 		}
 
-		buildJob.startAttributes = startAttrs.Config
+		buildJob.startAttributes = startAttrs.StartAttributes()
 		buildJob.receivedFile = filepath.Join(f.receivedDir, entry.Name())
 		buildJob.startedFile = filepath.Join(f.startedDir, entry.Name())
 		buildJob.finishedFile = filepath.Join(f.finishedDir, entry.Name())
@@ -29,11 +29,11 @@ func NewEnvSelector(c *config.ProviderConfig) (*EnvSelector, error) {
 	return es, nil
 }
 
+// buildImageAliasMap maps the lowercased names of IMAGE_{NAME} keys and the
+// aliases listed in IMAGE_ALIASES to their images. Each alias must have an
+// IMAGE_ALIAS_{ALIAS} or IMAGE_{ALIAS} key, and all aliases missing one are
+// reported at once.
 func (es *EnvSelector) buildImageAliasMap() error {
-	aliasNames := es.c.Get("IMAGE_ALIASES")
-
-	aliasNamesSlice := strings.Split(aliasNames, ",")
-
 	imageAliases := map[string]string{}
 
 	es.c.Each(func(key, value string) {
@@ -42,22 +42,46 @@ func (es *EnvSelector) buildImageAliasMap() error {
 		}
 	})
 
-	for _, aliasName := range aliasNamesSlice {
+	missingKeys := []string{}
+
+	for _, aliasName := range strings.Split(es.c.Get("IMAGE_ALIASES"), ",") {
+		aliasName = strings.TrimSpace(aliasName)
+		if aliasName == "" {
+			continue
+		}
+
 		normalizedAliasName := strings.ToUpper(string(nonAlphaNumRegexp.ReplaceAll([]byte(aliasName), []byte("_"))))
 
 		key := fmt.Sprintf("IMAGE_ALIAS_%s", normalizedAliasName)
-		if !es.c.IsSet(key) {
-			return fmt.Errorf("missing config key %q", key)
+		if es.c.Get(key) == "" {
+			key = fmt.Sprintf("IMAGE_%s", normalizedAliasName)
+		}
+
+		if es.c.Get(key) == "" {
+			missingKeys = append(missingKeys, fmt.Sprintf("IMAGE_ALIAS_%s", normalizedAliasName))
+			continue
 		}
 
 		imageAliases[aliasName] = es.c.Get(key)
 	}
 
+	if len(missingKeys) > 0 {
+		return fmt.Errorf("missing config keys for IMAGE_ALIASES: %s", strings.Join(missingKeys, ", "))
+	}
+
 	es.imageAliases = imageAliases
 	return nil
 }
 
 func (es *EnvSelector) Select(params *Params) (string, error) {
+	_, imageName, err := es.SelectAlias(params)
+	return imageName, err
+}
+
+// SelectAlias selects an image like Select, also returning the first
+// candidate key that has an alias, or "default" if none has one.
+func (es *EnvSelector) SelectAlias(params *Params) (string, string, error) {
+	alias := "default"
 	imageName := "default"
 
 	for _, key := range es.buildCandidateKeys(params) {
@@ -66,16 +90,17 @@ func (es *EnvSelector) Select(params *Params) (string, error) {
 		}
 
 		if s, ok := es.imageAliases[key]; ok {
+			alias = key
 			imageName = s
 			break
 		}
 	}
 
 	if selected, ok := es.imageAliases[imageName]; ok {
-		return selected, nil
+		return alias, selected, nil
 	}
 
-	return imageName, nil
+	return alias, imageName, nil
 }
 
 func (es *EnvSelector) buildCandidateKeys(params *Params) []string {
@@ -105,6 +105,32 @@ func TestNewEnvSelector(t *testing.T) {
 	})
 }
 
+func TestNewEnvSelector_ValidatesAliases(t *testing.T) {
+	_, err := NewEnvSelector(config.ProviderConfigFromMap(map[string]string{
+		"IMAGE_ALIASES":           "dist_trusty, language_go,osx_image_xcode6.4,,language_java",
+		"IMAGE_ALIAS_DIST_TRUSTY": "travis-ci-mega",
+		"IMAGE_LANGUAGE_JAVA":     "travis-ci-java",
+	}))
+	if assert.NotNil(t, err) {
+		assert.Equal(t, "missing config keys for IMAGE_ALIASES: IMAGE_ALIAS_LANGUAGE_GO, IMAGE_ALIAS_OSX_IMAGE_XCODE6_4", err.Error())
+	}
+
+	es, err := NewEnvSelector(config.ProviderConfigFromMap(map[string]string{
+		"IMAGE_ALIASES":           " dist_trusty ,language_java,",
+		"IMAGE_ALIAS_DIST_TRUSTY": "travis-ci-mega",
+		"IMAGE_LANGUAGE_JAVA":     "travis-ci-java",
+	}))
+	if assert.Nil(t, err) {
+		actual, _ := es.Select(&Params{Dist: "trusty"})
+		assert.Equal(t, "travis-ci-mega", actual)
+		actual, _ = es.Select(&Params{Language: "java"})
+		assert.Equal(t, "travis-ci-java", actual)
+	}
+
+	_, err = NewEnvSelector(config.ProviderConfigFromMap(map[string]string{}))
+	assert.Nil(t, err)
+}
+
 func TestEnvSelector_Select(t *testing.T) {
 	for _, tesm := range testEnvSelectorMaps {
 		es, err := NewEnvSelector(config.ProviderConfigFromMap(tesm.E))
@@ -118,3 +144,24 @@ func TestEnvSelector_Select(t *testing.T) {
 		}
 	}
 }
+
+func TestEnvSelector_SelectAlias(t *testing.T) {
+	es, err := NewEnvSelector(config.ProviderConfigFromMap(map[string]string{
+		"IMAGE_ALIASES":                "osx_image_xcode9",
+		"IMAGE_ALIAS_OSX_IMAGE_XCODE9": "travis-ci-macos10.12-xcode9",
+		"IMAGE_DEFAULT":                "travis-ci-macos10.12-xcode8.3",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alias, imageName, err := es.SelectAlias(&Params{OS: "osx", OsxImage: "xcode9", Language: "objective-c"})
+	assert.Nil(t, err)
+	assert.Equal(t, "osx_image_xcode9", alias)
+	assert.Equal(t, "travis-ci-macos10.12-xcode9", imageName)
+
+	alias, imageName, err = es.SelectAlias(&Params{OS: "osx", OsxImage: "xcode7", Language: "objective-c"})
+	assert.Nil(t, err)
+	assert.Equal(t, "default", alias)
+	assert.Equal(t, "travis-ci-macos10.12-xcode8.3", imageName)
+}
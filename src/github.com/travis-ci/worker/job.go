@@ -7,7 +7,20 @@ import (
 )
 
 type jobPayloadStartAttrs struct {
-	Config *backend.StartAttributes `json:"config"`
+	Config   *backend.StartAttributes `json:"config"`
+	VMConfig backend.VMConfig         `json:"vm_config"`
+}
+
+// StartAttributes returns the start attributes from the job config, combined
+// with the parts of the payload outside the job config that are relevant for
+// starting an instance.
+func (sa *jobPayloadStartAttrs) StartAttributes() *backend.StartAttributes {
+	if sa.Config == nil {
+		sa.Config = &backend.StartAttributes{}
+	}
+
+	sa.Config.VMConfig = sa.VMConfig
+	return sa.Config
 }
 
 // JobPayload is the payload we receive over RabbitMQ.
@@ -1,6 +1,7 @@
 package worker
 
 import (
+	"fmt"
 	"io"
 	"time"
 )
@@ -42,3 +43,9 @@ type LogWriter interface {
 	Timeout() <-chan time.Time
 	SetMaxLogLength(int)
 }
+
+// logLengthExceededMessage is written to the log of a job whose output
+// exceeded the maximum log length.
+func logLengthExceededMessage(maxLength int) string {
+	return fmt.Sprintf("\n\nThe log length has exceeded the limit of %d MB (this usually means that the test suite is raising the same exception over and over).\n\nThe job has been terminated\n", maxLength/1000/1000)
+}
@@ -21,3 +21,13 @@ func TimeSince(name string, since time.Time) {
 func TimeDuration(name string, duration time.Duration) {
 	metrics.GetOrRegisterTimer(name, metrics.DefaultRegistry).Update(duration)
 }
+
+// Sample adds the given value to the histogram metric with the given name
+func Sample(name string, value int64) {
+	metrics.GetOrRegisterHistogram(name, metrics.DefaultRegistry, metrics.NewExpDecaySample(1028, 0.015)).Update(value)
+}
+
+// Gauge sets the gauge metric with the given name to the given value
+func Gauge(name string, value int64) {
+	metrics.GetOrRegisterGauge(name, metrics.DefaultRegistry).Update(value)
+}
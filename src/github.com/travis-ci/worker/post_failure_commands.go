@@ -0,0 +1,65 @@
+package worker
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/travis-ci/worker/backend"
+	"github.com/travis-ci/worker/context"
+	"github.com/travis-ci/worker/metrics"
+	gocontext "golang.org/x/net/context"
+)
+
+// postFailureCommands runs diagnostic commands on the instance of a job that
+// didn't pass, and writes their output to the job's log before it's closed.
+type postFailureCommands struct {
+	commands       []string
+	onSuccess      bool
+	commandTimeout time.Duration
+}
+
+// run runs the commands if the result of the script (nil if it didn't
+// finish) calls for it and the instance supports running them.
+func (c *postFailureCommands) run(ctx gocontext.Context, instance backend.Instance, result *backend.RunResult, w io.Writer) {
+	if c == nil || len(c.commands) == 0 {
+		return
+	}
+
+	passed := result != nil && result.Completed && result.ExitCode == 0 && result.Reason == ""
+	if passed && !c.onSuccess {
+		return
+	}
+
+	executor, ok := instance.(backend.Executor)
+	if !ok {
+		context.LoggerFromContext(ctx).Debug("instance can't run post-failure commands")
+		return
+	}
+
+	for _, command := range c.commands {
+		// the job's context may already be done, e.g. after a hard timeout
+		execCtx, cancel := gocontext.WithTimeout(gocontext.Background(), c.commandTimeout)
+		output, err := executor.Exec(execCtx, command)
+		cancel()
+
+		logger := context.LoggerFromContext(ctx).WithFields(logrus.Fields{
+			"command": command,
+			"output":  string(output),
+		})
+
+		_, _ = w.Write([]byte(fmt.Sprintf("\n$ %s\n%s", command, output)))
+		if err != nil {
+			metrics.Mark("worker.job.post_failure_command.error")
+			logger = logger.WithField("err", err)
+			_, _ = w.Write([]byte(fmt.Sprintf("\nThe command failed: %v\n", err)))
+		}
+
+		if passed {
+			logger.Info("ran post-failure command")
+		} else {
+			logger.Error("ran post-failure command")
+		}
+	}
+}
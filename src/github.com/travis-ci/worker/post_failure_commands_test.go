@@ -0,0 +1,64 @@
+package worker
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/travis-ci/worker/backend"
+	"golang.org/x/net/context"
+)
+
+type fakeExecInstance struct {
+	fakeRunInstance
+
+	commands []string
+}
+
+func (i *fakeExecInstance) Exec(ctx context.Context, command string) ([]byte, error) {
+	i.commands = append(i.commands, command)
+	return []byte("output\n"), nil
+}
+
+func TestPostFailureCommands_run(t *testing.T) {
+	for _, tc := range []struct {
+		result    *backend.RunResult
+		onSuccess bool
+		ran       bool
+	}{
+		{nil, false, true},
+		{&backend.RunResult{Completed: true, ExitCode: 0}, false, false},
+		{&backend.RunResult{Completed: true, ExitCode: 0}, true, true},
+		{&backend.RunResult{Completed: true, ExitCode: 1}, false, true},
+		{&backend.RunResult{Completed: true, ExitCode: 137, Reason: backend.RunReasonSignal}, false, true},
+	} {
+		instance := &fakeExecInstance{}
+		log := &bytes.Buffer{}
+
+		c := &postFailureCommands{
+			commands:       []string{"dmesg | tail", "df -h"},
+			onSuccess:      tc.onSuccess,
+			commandTimeout: time.Second,
+		}
+		c.run(context.TODO(), instance, tc.result, log)
+
+		if tc.ran {
+			assert.Equal(t, []string{"dmesg | tail", "df -h"}, instance.commands)
+			assert.Equal(t, "\n$ dmesg | tail\noutput\n\n$ df -h\noutput\n", log.String())
+		} else {
+			assert.Len(t, instance.commands, 0)
+			assert.Equal(t, "", log.String())
+		}
+	}
+
+	// instances that can't exec are skipped
+	log := &bytes.Buffer{}
+	(&postFailureCommands{commands: []string{"df -h"}}).run(context.TODO(), &fakeRunInstance{result: &backend.RunResult{}, err: io.EOF}, nil, log)
+	assert.Equal(t, "", log.String())
+
+	// as are steps without any commands
+	(*postFailureCommands)(nil).run(context.TODO(), &fakeExecInstance{}, nil, log)
+	assert.Equal(t, "", log.String())
+}
@@ -31,6 +31,12 @@ type Processor struct {
 	ProcessedCount int
 
 	SkipShutdownOnLogTimeout bool
+
+	// PostFailureCommands are run on the instance of a job that didn't pass
+	// before it's stopped, or of every job if PostFailureCommandsOnSuccess
+	// is set, and their output is logged.
+	PostFailureCommands          []string
+	PostFailureCommandsOnSuccess bool
 }
 
 // NewProcessor creates a new processor that will run the build jobs on the
@@ -139,6 +145,8 @@ func (p *Processor) process(ctx gocontext.Context, buildJob Job) {
 		logTimeout = time.Duration(buildJob.Payload().Timeouts.LogSilence) * time.Second
 	}
 
+	maxLogLength := 4500000
+
 	steps := []multistep.Step{
 		&stepSubscribeCancellation{
 			canceller: p.canceller,
@@ -150,6 +158,8 @@ func (p *Processor) process(ctx gocontext.Context, buildJob Job) {
 		&stepStartInstance{
 			provider:     p.provider,
 			startTimeout: 4 * time.Minute,
+			logTimeout:   logTimeout,
+			maxLogLength: maxLogLength,
 		},
 		&stepUploadScript{
 			uploadTimeout: 1 * time.Minute,
@@ -157,9 +167,15 @@ func (p *Processor) process(ctx gocontext.Context, buildJob Job) {
 		&stepUpdateState{},
 		&stepRunScript{
 			logTimeout:               logTimeout,
-			maxLogLength:             4500000,
+			maxLogLength:             maxLogLength,
 			hardTimeout:              p.hardTimeout,
 			skipShutdownOnLogTimeout: p.SkipShutdownOnLogTimeout,
+			cancelFlushTimeout:       10 * time.Second,
+			postFailureCommands: &postFailureCommands{
+				commands:       p.PostFailureCommands,
+				onSuccess:      p.PostFailureCommandsOnSuccess,
+				commandTimeout: 30 * time.Second,
+			},
 		},
 	}
 
@@ -25,6 +25,9 @@ type ProcessorPool struct {
 
 	SkipShutdownOnLogTimeout bool
 
+	PostFailureCommands          []string
+	PostFailureCommandsOnSuccess bool
+
 	queue          JobQueue
 	poolErrors     []error
 	processorsLock sync.Mutex
@@ -146,6 +149,8 @@ func (p *ProcessorPool) runProcessor(queue JobQueue) error {
 	}
 
 	proc.SkipShutdownOnLogTimeout = p.SkipShutdownOnLogTimeout
+	proc.PostFailureCommands = p.PostFailureCommands
+	proc.PostFailureCommandsOnSuccess = p.PostFailureCommandsOnSuccess
 
 	p.processorsLock.Lock()
 	p.processors = append(p.processors, proc)
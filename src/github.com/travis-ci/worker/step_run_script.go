@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/mitchellh/multistep"
 	"github.com/travis-ci/worker/backend"
 	"github.com/travis-ci/worker/context"
@@ -15,6 +16,8 @@ type stepRunScript struct {
 	hardTimeout              time.Duration
 	skipShutdownOnLogTimeout bool
 	maxLogLength             int
+	cancelFlushTimeout       time.Duration
+	postFailureCommands      *postFailureCommands
 }
 
 func (s *stepRunScript) Run(state multistep.StateBag) multistep.StepAction {
@@ -49,6 +52,20 @@ func (s *stepRunScript) Run(state multistep.StateBag) multistep.StepAction {
 		if hostname, ok := state.Get("hostname").(string); ok && hostname != "" {
 			_, _ = logWriter.Write([]byte(fmt.Sprintf("Using worker: %s (%s)\n\n", hostname, instance.ID())))
 		}
+		if bootProgress, ok := state.Get("bootProgress").([]string); ok && len(bootProgress) > 0 {
+			for _, line := range bootProgress {
+				_, _ = logWriter.Write([]byte(fmt.Sprintf("Boot progress: %s\n", line)))
+			}
+			_, _ = logWriter.Write([]byte("\n"))
+		}
+		if warningInstance, ok := instance.(backend.WarningInstance); ok {
+			if warnings := warningInstance.Warnings(); len(warnings) > 0 {
+				for _, warning := range warnings {
+					_, _ = logWriter.Write([]byte(fmt.Sprintf("Warning: %s\n", warning)))
+				}
+				_, _ = logWriter.Write([]byte("\n"))
+			}
+		}
 		result, err := instance.RunScript(ctx, logWriter)
 		resultChan <- struct {
 			result *backend.RunResult
@@ -70,6 +87,7 @@ func (s *stepRunScript) Run(state multistep.StateBag) multistep.StepAction {
 
 		if ctx.Err() == gocontext.DeadlineExceeded {
 			context.LoggerFromContext(ctx).Info("hard timeout exceeded, terminating")
+			s.postFailureCommands.run(ctx, instance, nil, logWriter)
 			_, err := logWriter.WriteAndClose([]byte("\n\nThe job exceeded the maxmimum time limit for jobs, and has been terminated.\n\n"))
 			if err != nil {
 				context.LoggerFromContext(ctx).WithField("err", err).Error("couldn't write hard timeout log message")
@@ -85,9 +103,70 @@ func (s *stepRunScript) Run(state multistep.StateBag) multistep.StepAction {
 
 		return multistep.ActionHalt
 	case r := <-resultChan:
+		if r.result != nil && (r.result.TimedOut || r.result.LogLimitExceeded) {
+			context.LoggerFromContext(ctx).WithFields(logrus.Fields{
+				"timed_out":          r.result.TimedOut,
+				"log_limit_exceeded": r.result.LogLimitExceeded,
+			}).Info("script was stopped by the provider")
+
+			// the provider stopped forwarding output at the limit, so the
+			// log writer didn't exceed it and write its message itself
+			var err error
+			if r.result.LogLimitExceeded {
+				_, err = logWriter.WriteAndClose([]byte(logLengthExceededMessage(s.maxLogLength)))
+			} else {
+				s.postFailureCommands.run(ctx, instance, r.result, logWriter)
+				err = logWriter.Close()
+			}
+			if err != nil {
+				context.LoggerFromContext(ctx).WithField("err", err).Error("couldn't close log writer")
+			}
+
+			err = buildJob.Finish(FinishStateErrored)
+			if err != nil {
+				context.LoggerFromContext(ctx).WithField("err", err).Error("couldn't update job state to errored")
+			}
+
+			if r.result.TimedOut && s.skipShutdownOnLogTimeout {
+				state.Put("skipShutdown", true)
+			}
+
+			return multistep.ActionHalt
+		}
+
+		if r.result != nil && r.result.Reason != "" {
+			context.LoggerFromContext(ctx).WithFields(logrus.Fields{
+				"reason": r.result.Reason,
+				"signal": r.result.Signal,
+			}).Info("script stopped without exiting normally")
+
+			message := "\n\nThe build VM was shut down unexpectedly.\n\n"
+			if r.result.Reason == backend.RunReasonSignal {
+				message = fmt.Sprintf("\n\nThe build script was killed by signal %s, which usually means the build VM ran out of memory.\n\n", r.result.Signal)
+			}
+
+			s.postFailureCommands.run(ctx, instance, r.result, logWriter)
+			_, err := logWriter.WriteAndClose([]byte(message))
+			if err != nil {
+				context.LoggerFromContext(ctx).WithField("err", err).Error("couldn't write script stopped log message")
+			}
+
+			err = buildJob.Finish(FinishStateErrored)
+			if err != nil {
+				context.LoggerFromContext(ctx).WithField("err", err).Error("couldn't update job state to errored")
+			}
+
+			return multistep.ActionHalt
+		}
+
 		if r.err != nil {
 			context.LoggerFromContext(ctx).WithField("err", r.err).WithField("completed", r.result.Completed).Error("couldn't run script")
 
+			if r.result.Cancelled {
+				context.LoggerFromContext(ctx).Info("script was stopped, not requeueing job")
+				return multistep.ActionHalt
+			}
+
 			if !r.result.Completed {
 				err := buildJob.Requeue()
 				if err != nil {
@@ -98,11 +177,19 @@ func (s *stepRunScript) Run(state multistep.StateBag) multistep.StepAction {
 			return multistep.ActionHalt
 		}
 
+		s.postFailureCommands.run(ctx, instance, r.result, logWriter)
 		state.Put("scriptResult", r.result)
 		return multistep.ActionContinue
 	case <-cancelChan:
 		cancelCtx()
 
+		// give the script a chance to write its last output before the log
+		// is closed
+		select {
+		case <-resultChan:
+		case <-time.After(s.cancelFlushTimeout):
+		}
+
 		_, err := logWriter.WriteAndClose([]byte("\n\nDone: Job Cancelled\n\n"))
 		if err != nil {
 			context.LoggerFromContext(ctx).WithField("err", err).Error("couldn't write cancellation log message")
@@ -116,6 +203,7 @@ func (s *stepRunScript) Run(state multistep.StateBag) multistep.StepAction {
 		return multistep.ActionHalt
 	case <-logWriter.Timeout():
 		cancelCtx()
+		s.postFailureCommands.run(ctx, instance, nil, logWriter)
 
 		_, err := logWriter.WriteAndClose([]byte(fmt.Sprintf("\n\nNo output has been received in the last %v, this potentially indicates a stalled build or something wrong with the build itself.\n\nThe build has been terminated\n\n", s.logTimeout)))
 		if err != nil {
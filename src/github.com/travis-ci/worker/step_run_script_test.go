@@ -0,0 +1,101 @@
+package worker
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/multistep"
+	"github.com/stretchr/testify/assert"
+	"github.com/travis-ci/worker/backend"
+	"golang.org/x/net/context"
+)
+
+type fakeRunInstance struct {
+	result *backend.RunResult
+	err    error
+}
+
+func (i *fakeRunInstance) UploadScript(ctx context.Context, script []byte) error { return nil }
+
+func (i *fakeRunInstance) RunScript(ctx context.Context, output io.Writer) (*backend.RunResult, error) {
+	return i.result, i.err
+}
+
+func (i *fakeRunInstance) Stop(ctx context.Context) error { return nil }
+
+func (i *fakeRunInstance) ID() string { return "fake" }
+
+func TestStepRunScript_Run(t *testing.T) {
+	for _, tc := range []struct {
+		result *backend.RunResult
+		err    error
+		events []string
+	}{
+		{&backend.RunResult{Completed: false}, io.EOF, []string{"requeued"}},
+		{&backend.RunResult{Completed: false, Cancelled: true}, context.Canceled, nil},
+		{&backend.RunResult{Completed: false, TimedOut: true}, nil, []string{"errored"}},
+		{&backend.RunResult{Completed: false, LogLimitExceeded: true}, nil, []string{"errored"}},
+		{&backend.RunResult{Completed: true, ExitCode: 137, Reason: backend.RunReasonSignal, Signal: "KILL"}, nil, []string{"errored"}},
+		{&backend.RunResult{Completed: false, Reason: backend.RunReasonExitMissing}, nil, []string{"errored"}},
+	} {
+		job := &fakeJob{}
+
+		state := new(multistep.BasicStateBag)
+		state.Put("ctx", context.TODO())
+		state.Put("buildJob", job)
+		state.Put("instance", &fakeRunInstance{result: tc.result, err: tc.err})
+		state.Put("cancelChan", (<-chan struct{})(make(chan struct{})))
+
+		s := &stepRunScript{logTimeout: time.Minute, cancelFlushTimeout: time.Second}
+
+		assert.Equal(t, multistep.ActionHalt, s.Run(state))
+		assert.Equal(t, tc.events, job.events)
+	}
+}
+
+func TestStepRunScript_RunProviderTimeoutSkipsShutdown(t *testing.T) {
+	for _, skip := range []bool{false, true} {
+		state := new(multistep.BasicStateBag)
+		state.Put("ctx", context.TODO())
+		state.Put("buildJob", &fakeJob{})
+		state.Put("instance", &fakeRunInstance{result: &backend.RunResult{TimedOut: true}})
+		state.Put("cancelChan", (<-chan struct{})(make(chan struct{})))
+
+		s := &stepRunScript{logTimeout: time.Minute, cancelFlushTimeout: time.Second, skipShutdownOnLogTimeout: skip}
+
+		assert.Equal(t, multistep.ActionHalt, s.Run(state))
+		_, ok := state.GetOk("skipShutdown")
+		assert.Equal(t, skip, ok)
+	}
+}
+
+func TestStepRunScript_RunPostFailureCommands(t *testing.T) {
+	for _, tc := range []struct {
+		result *backend.RunResult
+		action multistep.StepAction
+		ran    bool
+	}{
+		{&backend.RunResult{Completed: true, ExitCode: 1}, multistep.ActionContinue, true},
+		{&backend.RunResult{Completed: true, ExitCode: 0}, multistep.ActionContinue, false},
+		{&backend.RunResult{Completed: false, TimedOut: true}, multistep.ActionHalt, true},
+		{&backend.RunResult{Completed: false, LogLimitExceeded: true}, multistep.ActionHalt, false},
+	} {
+		instance := &fakeExecInstance{fakeRunInstance: fakeRunInstance{result: tc.result}}
+
+		state := new(multistep.BasicStateBag)
+		state.Put("ctx", context.TODO())
+		state.Put("buildJob", &fakeJob{})
+		state.Put("instance", instance)
+		state.Put("cancelChan", (<-chan struct{})(make(chan struct{})))
+
+		s := &stepRunScript{
+			logTimeout:          time.Minute,
+			cancelFlushTimeout:  time.Second,
+			postFailureCommands: &postFailureCommands{commands: []string{"df -h"}, commandTimeout: time.Second},
+		}
+
+		assert.Equal(t, tc.action, s.Run(state))
+		assert.Equal(t, tc.ran, len(instance.commands) > 0)
+	}
+}
@@ -1,6 +1,7 @@
 package worker
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -13,6 +14,8 @@ import (
 type stepStartInstance struct {
 	provider     backend.Provider
 	startTimeout time.Duration
+	logTimeout   time.Duration
+	maxLogLength int
 }
 
 func (s *stepStartInstance) Run(state multistep.StateBag) multistep.StepAction {
@@ -21,14 +24,47 @@ func (s *stepStartInstance) Run(state multistep.StateBag) multistep.StepAction {
 
 	context.LoggerFromContext(ctx).Info("starting instance")
 
+	startAttributes := buildJob.StartAttributes()
+	if startAttributes != nil {
+		startAttributes.JobID = buildJob.Payload().Job.ID
+		startAttributes.Repository = buildJob.Payload().Repository.Slug
+		if deadline, ok := ctx.Deadline(); ok {
+			startAttributes.HardTimeout = deadline.Sub(time.Now())
+		}
+		startAttributes.LogSilenceTimeout = s.logTimeout
+		startAttributes.MaxLogLength = s.maxLogLength
+	}
+
 	ctx, cancel := gocontext.WithTimeout(ctx, s.startTimeout)
 	defer cancel()
 
 	startTime := time.Now()
 
-	instance, err := s.provider.Start(ctx, buildJob.StartAttributes())
+	var (
+		instance backend.Instance
+		err      error
+	)
+
+	if progresser, ok := s.provider.(backend.StartProgresser); ok {
+		var bootProgress []string
+		instance, bootProgress, err = s.startWithProgress(ctx, progresser, startAttributes, startTime)
+		state.Put("bootProgress", bootProgress)
+	} else {
+		instance, err = s.provider.Start(ctx, startAttributes)
+	}
+
 	if err != nil {
 		context.LoggerFromContext(ctx).WithField("err", err).Error("couldn't start instance")
+
+		if !backend.IsRecoverable(err) {
+			err := buildJob.Error(ctx, "An error occurred while starting the instance for this job.")
+			if err != nil {
+				context.LoggerFromContext(ctx).WithField("err", err).Error("couldn't error job")
+			}
+
+			return multistep.ActionHalt
+		}
+
 		err := buildJob.Requeue()
 		if err != nil {
 			context.LoggerFromContext(ctx).WithField("err", err).Error("couldn't requeue job")
@@ -37,13 +73,61 @@ func (s *stepStartInstance) Run(state multistep.StateBag) multistep.StepAction {
 		return multistep.ActionHalt
 	}
 
-	context.LoggerFromContext(ctx).WithField("boot_time", time.Now().Sub(startTime)).Info("started instance")
+	logger := context.LoggerFromContext(ctx).WithField("boot_time", time.Now().Sub(startTime))
+	if expiringInstance, ok := instance.(backend.ExpiringInstance); ok {
+		logger = logger.WithField("expires", expiringInstance.Expires())
+	}
+	logger.Info("started instance")
 
 	state.Put("instance", instance)
 
 	return multistep.ActionContinue
 }
 
+// startWithProgress starts an instance while collecting the progress the
+// provider reports, returning it as lines to show in the job log. The job log
+// can't be written to yet at this point, since the job may still be requeued,
+// so progress is only logged as it happens.
+func (s *stepStartInstance) startWithProgress(ctx gocontext.Context, progresser backend.StartProgresser, startAttributes *backend.StartAttributes, startTime time.Time) (backend.Instance, []string, error) {
+	progress := make(chan backend.ProgressEntry, 10)
+	done := make(chan struct{})
+	linesChan := make(chan []string, 1)
+
+	go func() {
+		lines := []string{}
+		addLine := func(entry backend.ProgressEntry) {
+			elapsed := entry.Time.Sub(startTime)
+			context.LoggerFromContext(ctx).WithFields(logrus.Fields{
+				"stage":   entry.Stage,
+				"elapsed": elapsed,
+			}).Info("instance start progress")
+			lines = append(lines, fmt.Sprintf("%s after %v", entry, elapsed))
+		}
+
+		for {
+			select {
+			case entry := <-progress:
+				addLine(entry)
+			case <-done:
+				for {
+					select {
+					case entry := <-progress:
+						addLine(entry)
+					default:
+						linesChan <- lines
+						return
+					}
+				}
+			}
+		}
+	}()
+
+	instance, err := progresser.StartWithProgress(ctx, startAttributes, progress)
+	close(done)
+
+	return instance, <-linesChan, err
+}
+
 func (s *stepStartInstance) Cleanup(state multistep.StateBag) {
 	ctx := state.Get("ctx").(gocontext.Context)
 	instance, ok := state.Get("instance").(backend.Instance)
@@ -0,0 +1,46 @@
+package worker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/travis-ci/worker/backend"
+	"golang.org/x/net/context"
+)
+
+type fakeProgressProvider struct {
+	entries []backend.ProgressEntry
+}
+
+func (p *fakeProgressProvider) Setup() error { return nil }
+
+func (p *fakeProgressProvider) Start(ctx context.Context, startAttributes *backend.StartAttributes) (backend.Instance, error) {
+	return p.StartWithProgress(ctx, startAttributes, nil)
+}
+
+func (p *fakeProgressProvider) StartWithProgress(ctx context.Context, _ *backend.StartAttributes, progress chan<- backend.ProgressEntry) (backend.Instance, error) {
+	for _, entry := range p.entries {
+		entry.Time = time.Now()
+		progress <- entry
+	}
+
+	return nil, nil
+}
+
+func TestStepStartInstance_startWithProgress(t *testing.T) {
+	provider := &fakeProgressProvider{entries: []backend.ProgressEntry{
+		{Stage: backend.ProgressStageInstanceInsert},
+		{Stage: backend.ProgressStageOperationRunning, Percent: 40},
+		{Stage: backend.ProgressStageOperationDone},
+	}}
+	s := &stepStartInstance{provider: provider, startTimeout: time.Minute}
+
+	_, lines, err := s.startWithProgress(context.TODO(), provider, &backend.StartAttributes{}, time.Now())
+	assert.Nil(t, err)
+	if assert.Len(t, lines, 3) {
+		assert.Regexp(t, "^instance-insert after ", lines[0])
+		assert.Regexp(t, "^operation-running 40% after ", lines[1])
+		assert.Regexp(t, "^operation-done after ", lines[2])
+	}
+}
@@ -30,6 +30,11 @@ func (s *stepUploadScript) Run(state multistep.StateBag) multistep.StepAction {
 		if err == backend.ErrStaleVM {
 			errMetric += ".stalevm"
 		}
+		if err == backend.ErrStaleVMRecycled {
+			errMetric += ".stalevm.recycled"
+			// the instance is gone, so there's nothing to stop during cleanup
+			state.Put("instance", nil)
+		}
 		metrics.Mark(errMetric)
 
 		context.LoggerFromContext(ctx).WithField("err", err).Error("couldn't upload script")